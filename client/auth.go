@@ -0,0 +1,142 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/utils/openstack/clientconfig"
+
+	"github.com/cloudbase/garm-provider-openstack/config"
+)
+
+// enableReauth makes the service client get a new token when keystone rejects the current
+// one, and retry the request. gophercloud only does this if allow_reauth is set in
+// clouds.yaml, and then reuses the credentials it read when the client was created. We
+// read clouds.yaml again instead, so rotated credentials are picked up without restarting.
+//
+// gophercloud makes sure only one reauthentication runs at a time, and that requests that
+// fail at the same time all wait for it and use the new token.
+func enableReauth(sc *gophercloud.ServiceClient, opts *clientconfig.ClientOpts) {
+	if sc == nil || sc.ProviderClient == nil {
+		return
+	}
+	provider := sc.ProviderClient
+	provider.ReauthFunc = func() error {
+		fresh, err := clientconfig.AuthenticatedClient(opts)
+		if err != nil {
+			return fmt.Errorf("failed to reauthenticate: %w", err)
+		}
+		provider.CopyTokenFrom(fresh)
+		return nil
+	}
+}
+
+// domainOverrides loads clouds.yaml and secure.yaml like config.Credentials, and replaces
+// the project and user domains of the cloud with the ones set in the config. clientconfig
+// ignores ClientOpts.AuthInfo when a cloud is set, so the override has to be applied to
+// the clouds we load. secure.yaml takes precedence over clouds.yaml, so both are changed.
+type domainOverrides struct {
+	config.Credentials
+
+	cloud             string
+	projectDomainName string
+	userDomainName    string
+}
+
+// newYAMLOpts returns the options used to load the given cloud, with the domain overrides
+// from the config applied, if any.
+func newYAMLOpts(cfg *config.Config, cloud string) (clientconfig.YAMLOptsBuilder, error) {
+	if cfg.ProjectDomainName == "" && cfg.UserDomainName == "" {
+		return &cfg.Credentials, nil
+	}
+	// Keystone v2 has no domains.
+	isV2, err := usesIdentityV2(&cfg.Credentials, cloud)
+	if err != nil {
+		return nil, err
+	}
+	if isV2 {
+		return nil, fmt.Errorf("project_domain_name and user_domain_name require keystone v3, but cloud %s uses v2", cloud)
+	}
+	return &domainOverrides{
+		Credentials:       cfg.Credentials,
+		cloud:             cloud,
+		projectDomainName: cfg.ProjectDomainName,
+		userDomainName:    cfg.UserDomainName,
+	}, nil
+}
+
+// usesIdentityV2 returns true if the cloud authenticates with keystone v2. This follows
+// the order clientconfig uses to pick the identity API version, without the environment
+// variables, which garm does not pass to the provider.
+func usesIdentityV2(yamlOpts clientconfig.YAMLOptsBuilder, cloudName string) (bool, error) {
+	cloud, err := clientconfig.GetCloudFromYAML(&clientconfig.ClientOpts{
+		Cloud:    cloudName,
+		YAMLOpts: yamlOpts,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to load cloud %s: %w", cloudName, err)
+	}
+	if cloud.IdentityAPIVersion != "" {
+		return strings.HasPrefix(cloud.IdentityAPIVersion, "2"), nil
+	}
+	if cloud.AuthInfo != nil && strings.Contains(cloud.AuthInfo.AuthURL, "v2.0") {
+		return true, nil
+	}
+	return cloud.AuthType == clientconfig.AuthV2Password || cloud.AuthType == clientconfig.AuthV2Token, nil
+}
+
+func (d *domainOverrides) LoadCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	clouds, err := d.Credentials.LoadCloudsYAML()
+	if err != nil {
+		return nil, err
+	}
+	d.apply(clouds)
+	return clouds, nil
+}
+
+func (d *domainOverrides) LoadSecureCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	clouds, err := d.Credentials.LoadSecureCloudsYAML()
+	if err != nil {
+		return nil, err
+	}
+	d.apply(clouds)
+	return clouds, nil
+}
+
+// apply sets the domain overrides on the cloud, if it is defined. The IDs of the domains
+// are cleared, as keystone would otherwise use them instead of the names.
+func (d *domainOverrides) apply(clouds map[string]clientconfig.Cloud) {
+	cloud, ok := clouds[d.cloud]
+	if !ok {
+		return
+	}
+	authInfo := clientconfig.AuthInfo{}
+	if cloud.AuthInfo != nil {
+		authInfo = *cloud.AuthInfo
+	}
+	if d.projectDomainName != "" {
+		authInfo.ProjectDomainName = d.projectDomainName
+		authInfo.ProjectDomainID = ""
+	}
+	if d.userDomainName != "" {
+		authInfo.UserDomainName = d.userDomainName
+		authInfo.UserDomainID = ""
+	}
+	cloud.AuthInfo = &authInfo
+	clouds[d.cloud] = cloud
+}
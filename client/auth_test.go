@@ -0,0 +1,276 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/testhelper"
+	"github.com/gophercloud/gophercloud/testhelper/client"
+	"github.com/gophercloud/utils/openstack/clientconfig"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cloudbase/garm-provider-openstack/config"
+)
+
+func writeTestCloudsYAML(t *testing.T, path, password string) {
+	contents := fmt.Sprintf(`clouds:
+  mycloud:
+    auth:
+      auth_url: %sv3
+      username: garm
+      password: %s
+      project_name: garm
+      user_domain_name: Default
+      project_domain_name: Default
+    region_name: RegionOne
+`, testhelper.Endpoint(), password)
+	assert.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+}
+
+func TestReauthOnExpiredToken(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	var authCalls atomic.Int32
+	testhelper.Mux.HandleFunc("/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		authCalls.Add(1)
+		var body struct {
+			Auth struct {
+				Identity struct {
+					Password struct {
+						User struct {
+							Password string `json:"password"`
+						} `json:"user"`
+					} `json:"password"`
+				} `json:"identity"`
+			} `json:"auth"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		// Only the rotated password is accepted.
+		if body.Auth.Identity.Password.User.Password != "rotated-password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Add("X-Subject-Token", "fresh-token")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"token": {"expires_at": "2030-01-01T00:00:00.000000Z", "catalog": []}}`)
+	})
+
+	var rejected atomic.Int32
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		if r.Header.Get("X-Auth-Token") != "fresh-token" {
+			rejected.Add(1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-server",
+			"status": "ACTIVE",
+			"tags": ["garm-controller-id=my-controller-id"]
+		}}`)
+	})
+
+	// The credentials were rotated after the client was created.
+	cloudsPath := filepath.Join(t.TempDir(), "clouds.yaml")
+	writeTestCloudsYAML(t, cloudsPath, "rotated-password")
+
+	sc := client.ServiceClient()
+	sc.ProviderClient.UseTokenLock()
+	sc.ProviderClient.SetToken("expired-token")
+	enableReauth(sc, &clientconfig.ClientOpts{
+		Cloud:    "mycloud",
+		YAMLOpts: &config.Credentials{Clouds: cloudsPath},
+	})
+	osClient := &OpenstackClient{
+		compute:      sc,
+		controllerID: "my-controller-id",
+	}
+
+	// Requests that fail at the same time share a single reauthentication.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv, err := osClient.GetServer(context.Background(), "d9072956-1560-487c-97f2-18bdf65ec749")
+			assert.NoError(t, err)
+			assert.Equal(t, "ACTIVE", srv.Status)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), authCalls.Load())
+	assert.Equal(t, "fresh-token", sc.ProviderClient.Token())
+
+	// Later calls use the new token right away.
+	rejectedBefore := rejected.Load()
+	_, err := osClient.GetServer(context.Background(), "d9072956-1560-487c-97f2-18bdf65ec749")
+	assert.NoError(t, err)
+	assert.Equal(t, rejectedBefore, rejected.Load())
+	assert.Equal(t, int32(1), authCalls.Load())
+}
+
+func TestReauthFails(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	testhelper.Mux.HandleFunc("/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	cloudsPath := filepath.Join(t.TempDir(), "clouds.yaml")
+	writeTestCloudsYAML(t, cloudsPath, "wrong-password")
+
+	sc := client.ServiceClient()
+	sc.ProviderClient.UseTokenLock()
+	enableReauth(sc, &clientconfig.ClientOpts{
+		Cloud:    "mycloud",
+		YAMLOpts: &config.Credentials{Clouds: cloudsPath},
+	})
+	osClient := &OpenstackClient{
+		compute:      sc,
+		controllerID: "my-controller-id",
+	}
+
+	_, err := osClient.GetServer(context.Background(), "d9072956-1560-487c-97f2-18bdf65ec749")
+	assert.ErrorContains(t, err, "failed to reauthenticate")
+}
+
+func TestDomainOverrides(t *testing.T) {
+	dir := t.TempDir()
+	cloudsPath := filepath.Join(dir, "clouds.yaml")
+	assert.NoError(t, os.WriteFile(cloudsPath, []byte(`clouds:
+  v3cloud:
+    auth:
+      auth_url: https://keystone.example.com/v3
+      username: garm
+      project_name: garm
+      project_domain_id: default
+      user_domain_name: Default
+    region_name: RegionOne
+  v2cloud:
+    auth:
+      auth_url: https://keystone.example.com/v2.0
+      username: garm
+      project_name: garm
+    region_name: RegionOne
+`), 0o600))
+	securePath := filepath.Join(dir, "secure.yaml")
+	assert.NoError(t, os.WriteFile(securePath, []byte(`clouds:
+  v3cloud:
+    auth:
+      password: secret
+      project_domain_name: Default
+`), 0o600))
+	creds := config.Credentials{
+		Clouds:       cloudsPath,
+		SecureClouds: securePath,
+	}
+
+	tests := []struct {
+		name                  string
+		cloud                 string
+		projectDomainName     string
+		userDomainName        string
+		wantProjectDomainID   string
+		wantProjectDomainName string
+		wantUserDomainName    string
+		errString             string
+	}{
+		{
+			name:                "no overrides",
+			cloud:               "v3cloud",
+			wantProjectDomainID: "default",
+			// secure.yaml is merged over clouds.yaml.
+			wantProjectDomainName: "Default",
+			wantUserDomainName:    "Default",
+		},
+		{
+			name:                  "project and user domain",
+			cloud:                 "v3cloud",
+			projectDomainName:     "projects",
+			userDomainName:        "users",
+			wantProjectDomainName: "projects",
+			wantUserDomainName:    "users",
+		},
+		{
+			name:                  "project domain only",
+			cloud:                 "v3cloud",
+			projectDomainName:     "projects",
+			wantProjectDomainName: "projects",
+			wantUserDomainName:    "Default",
+		},
+		{
+			name:              "keystone v2",
+			cloud:             "v2cloud",
+			projectDomainName: "projects",
+			errString:         "require keystone v3, but cloud v2cloud uses v2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Credentials:       creds,
+				ProjectDomainName: tt.projectDomainName,
+				UserDomainName:    tt.userDomainName,
+			}
+			yamlOpts, err := newYAMLOpts(cfg, tt.cloud)
+			if tt.errString != "" {
+				assert.ErrorContains(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+
+			cloud, err := clientconfig.GetCloudFromYAML(&clientconfig.ClientOpts{
+				Cloud:    tt.cloud,
+				YAMLOpts: yamlOpts,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantProjectDomainID, cloud.AuthInfo.ProjectDomainID)
+			assert.Equal(t, tt.wantProjectDomainName, cloud.AuthInfo.ProjectDomainName)
+			assert.Equal(t, tt.wantUserDomainName, cloud.AuthInfo.UserDomainName)
+			// The rest of the auth info is left as is.
+			assert.Equal(t, "https://keystone.example.com/v3", cloud.AuthInfo.AuthURL)
+			assert.Equal(t, "secret", cloud.AuthInfo.Password)
+
+			authOpts, err := clientconfig.AuthOptions(&clientconfig.ClientOpts{
+				Cloud:    tt.cloud,
+				YAMLOpts: yamlOpts,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "garm", authOpts.Scope.ProjectName)
+			assert.Equal(t, tt.wantProjectDomainID, authOpts.Scope.DomainID)
+			assert.Equal(t, tt.wantProjectDomainName, authOpts.Scope.DomainName)
+			assert.Equal(t, tt.wantUserDomainName, authOpts.DomainName)
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+func init() {
+	// Image properties hold arbitrary JSON values.
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+type cacheEntry[T any] struct {
+	Value   T
+	Expires time.Time
+}
+
+// resourceCache holds the results of resource lookups for a limited time, so that
+// creating many servers at once does not look up the same flavor, image and network
+// over and over again. garm runs the provider once for every runner, so entries are
+// also written to a directory, where the next runs find them. It is safe for concurrent
+// use. A nil cache caches nothing.
+type resourceCache[T any] struct {
+	ttl     time.Duration
+	dir     string
+	entries map[string]cacheEntry[T]
+	mux     sync.Mutex
+
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+}
+
+// newResourceCache returns a cache whose entries expire after ttl. Entries are also
+// stored in dir, unless dir is empty. If ttl is not positive, caching is disabled and
+// nil is returned.
+func newResourceCache[T any](ttl time.Duration, dir string) *resourceCache[T] {
+	if ttl <= 0 {
+		return nil
+	}
+	return &resourceCache[T]{
+		ttl:     ttl,
+		dir:     dir,
+		entries: map[string]cacheEntry[T]{},
+		now:     time.Now,
+	}
+}
+
+// get returns the value cached for key, if it has not expired yet.
+func (c *resourceCache[T]) get(key string) (T, bool) {
+	var zero T
+	if c == nil {
+		return zero, false
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry, ok = c.readEntry(key)
+		if !ok {
+			return zero, false
+		}
+		c.entries[key] = entry
+	}
+	if !c.now().Before(entry.Expires) {
+		delete(c.entries, key)
+		if c.dir != "" {
+			_ = os.Remove(c.entryPath(key))
+		}
+		return zero, false
+	}
+	return entry.Value, true
+}
+
+// set caches value for key.
+func (c *resourceCache[T]) set(key string, value T) {
+	if c == nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry := cacheEntry[T]{
+		Value:   value,
+		Expires: c.now().Add(c.ttl),
+	}
+	c.entries[key] = entry
+	if err := c.writeEntry(key, entry); err != nil {
+		log.Printf("failed to write cache entry: %s", err)
+	}
+}
+
+// entryPath returns the file an entry is stored in. Keys are hashed, as they are
+// names or IDs that may not be valid file names.
+func (c *resourceCache[T]) entryPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// readEntry reads an entry from the cache directory. Entries that can not be read are
+// treated as missing.
+func (c *resourceCache[T]) readEntry(key string) (cacheEntry[T], bool) {
+	var entry cacheEntry[T]
+	if c.dir == "" {
+		return entry, false
+	}
+	f, err := os.Open(c.entryPath(key))
+	if err != nil {
+		return entry, false
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&entry); err != nil {
+		return cacheEntry[T]{}, false
+	}
+	return entry, true
+}
+
+// writeEntry stores an entry in the cache directory. The entry is written to a
+// temporary file first, so concurrent runs never read a partial entry.
+func (c *resourceCache[T]) writeEntry(key string, entry cacheEntry[T]) error {
+	if c.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, ".entry-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := gob.NewEncoder(f).Encode(entry); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.entryPath(key))
+}
@@ -0,0 +1,232 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/testhelper"
+	"github.com/gophercloud/gophercloud/testhelper/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceCache(t *testing.T) {
+	now := time.Now()
+	cache := newResourceCache[string](time.Minute, "")
+	cache.now = func() time.Time { return now }
+
+	_, ok := cache.get("key")
+	assert.False(t, ok)
+
+	cache.set("key", "value")
+	value, ok := cache.get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+
+	now = now.Add(59 * time.Second)
+	_, ok = cache.get("key")
+	assert.True(t, ok)
+
+	now = now.Add(time.Second)
+	_, ok = cache.get("key")
+	assert.False(t, ok)
+}
+
+func TestResourceCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	image := images.Image{
+		ID:         "aee1d242-730f-431f-88c1-87630c0f07ba",
+		Name:       "test-image",
+		SizeBytes:  1024,
+		Properties: map[string]interface{}{"hw_disk_bus": "scsi", "hw_numa_nodes": float64(2)},
+	}
+	writer := newResourceCache[images.Image](time.Minute, dir)
+	writer.now = clock
+	writer.set("test-image", image)
+
+	// A cache of another run finds the entry.
+	reader := newResourceCache[images.Image](time.Minute, dir)
+	reader.now = clock
+	cached, ok := reader.get("test-image")
+	assert.True(t, ok)
+	assert.Equal(t, image, cached)
+
+	now = now.Add(time.Minute)
+	expired := newResourceCache[images.Image](time.Minute, dir)
+	expired.now = clock
+	_, ok = expired.get("test-image")
+	assert.False(t, ok)
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestResourceCacheDirCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	cache := newResourceCache[string](time.Minute, dir)
+	assert.NoError(t, os.WriteFile(cache.entryPath("key"), []byte("not an entry"), 0o600))
+
+	_, ok := cache.get("key")
+	assert.False(t, ok)
+
+	cache.set("key", "value")
+	value, ok := newResourceCache[string](time.Minute, dir).get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+}
+
+func TestResourceCacheDisabled(t *testing.T) {
+	cache := newResourceCache[string](0, "")
+	assert.Nil(t, cache)
+
+	cache.set("key", "value")
+	_, ok := cache.get("key")
+	assert.False(t, ok)
+}
+
+func TestResourceCacheConcurrent(t *testing.T) {
+	cache := newResourceCache[int](time.Minute, "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i%5)
+			cache.set(key, i)
+			_, ok := cache.get(key)
+			assert.True(t, ok)
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, cache.entries, 5)
+}
+
+func TestLookupsAreCached(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	var flavorCalls, imageCalls, networkCalls atomic.Int32
+	testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+		flavorCalls.Add(1)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"flavors": [{"id": "flavor-uuid", "name": "test-flavor", "ram": 1024, "vcpus": 1, "disk": 10}]}`)
+	})
+	testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+		imageCalls.Add(1)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"images": [{"id": "aee1d242-730f-431f-88c1-87630c0f07ba", "name": "test-image", "status": "active", "hw_disk_bus": "scsi"}]}`)
+	})
+	testhelper.Mux.HandleFunc("/networks", func(w http.ResponseWriter, r *http.Request) {
+		networkCalls.Add(1)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"networks": [{"id": "aee1d242-730f-431f-88c1-87630c0f20ca", "name": "test-network"}]}`)
+	})
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	osClient := &OpenstackClient{
+		compute:      client.ServiceClient(),
+		image:        client.ServiceClient(),
+		network:      client.ServiceClient(),
+		flavorCache:  newResourceCache[flavors.Flavor](time.Minute, ""),
+		imageCache:   newResourceCache[images.Image](time.Minute, ""),
+		networkCache: newResourceCache[networks.Network](time.Minute, ""),
+	}
+	osClient.flavorCache.now = clock
+	osClient.imageCache.now = clock
+	osClient.networkCache.now = clock
+
+	lookup := func() {
+		flavor, err := osClient.GetFlavor(context.Background(), "test-flavor")
+		assert.NoError(t, err)
+		assert.Equal(t, "flavor-uuid", flavor.ID)
+
+		image, err := osClient.GetImage(context.Background(), "test-image", "", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "aee1d242-730f-431f-88c1-87630c0f07ba", image.ID)
+
+		network, err := osClient.GetNetwork(context.Background(), "test-network")
+		assert.NoError(t, err)
+		assert.Equal(t, "aee1d242-730f-431f-88c1-87630c0f20ca", network.ID)
+	}
+
+	lookup()
+	lookup()
+	assert.Equal(t, int32(1), flavorCalls.Load())
+	assert.Equal(t, int32(1), imageCalls.Load())
+	assert.Equal(t, int32(1), networkCalls.Load())
+
+	// Changing a returned value does not change the cached one.
+	flavor, err := osClient.GetFlavor(context.Background(), "test-flavor")
+	assert.NoError(t, err)
+	flavor.Name = "changed"
+	flavor, err = osClient.GetFlavor(context.Background(), "test-flavor")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-flavor", flavor.Name)
+
+	for i := 0; i < 2; i++ {
+		image, err := osClient.GetImage(context.Background(), "test-image", "", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"hw_disk_bus": "scsi"}, image.Properties)
+		delete(image.Properties, "hw_disk_bus")
+	}
+
+	now = now.Add(time.Minute)
+	lookup()
+	assert.Equal(t, int32(2), flavorCalls.Load())
+	assert.Equal(t, int32(2), imageCalls.Load())
+	assert.Equal(t, int32(2), networkCalls.Load())
+}
+
+func TestFailedLookupsAreNotCached(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	var calls atomic.Int32
+	testhelper.Mux.HandleFunc("/networks", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"networks": []}`)
+	})
+
+	osClient := &OpenstackClient{
+		network:      client.ServiceClient(),
+		networkCache: newResourceCache[networks.Network](time.Minute, ""),
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := osClient.GetNetwork(context.Background(), "missing-network")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
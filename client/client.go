@@ -15,50 +15,228 @@
 package client
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	gErrors "errors"
 
+	runnerErrors "github.com/cloudbase/garm-provider-common/errors"
 	"github.com/cloudbase/garm-provider-openstack/config"
 	"github.com/google/uuid"
 	"github.com/gophercloud/gophercloud"
+	volumequotas "github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/quotasets"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/aggregates"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/diskconfig"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedstatus"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/quotasets"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/rescueunrescue"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/shelveunshelve"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/startstop"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/tags"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
 	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/extradhcpopts"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/quotas"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
 	"github.com/gophercloud/gophercloud/pagination"
 	"github.com/gophercloud/utils/openstack/clientconfig"
 )
 
 const (
-	controllerIDTagName = "garm-controller-id"
-	poolIDTagName       = "garm-pool-id"
+	controllerIDTagName         = "garm-controller-id"
+	controllerInstanceIDTagName = "garm-controller-uuid"
+	poolIDTagName               = "garm-pool-id"
+
+	// errorAtTagName is the tag that records when a server kept in ERROR state was
+	// first seen in that state, as a unix timestamp.
+	errorAtTagName = "garm-error-at"
+
+	// forceStopTimeout is the number of seconds we wait for a server to power off
+	// when a forced stop is requested.
+	forceStopTimeout = 30
+
+	// defaultCreateTimeout is the number of seconds we wait for a new server to become
+	// ACTIVE, if no create timeout is configured.
+	defaultCreateTimeout = 120
+
+	// defaultDeleteTimeout is the number of seconds we wait for a deleted server to go
+	// away, if no delete timeout is configured.
+	defaultDeleteTimeout = 120
+
+	// defaultPollInterval is how often we check the status of a server while waiting
+	// for it, if no poll interval is configured.
+	defaultPollInterval = time.Second
+
+	// defaultComputeMicroversion is the nova microversion we use, if none is configured.
+	defaultComputeMicroversion = "2.67"
+
+	// defaultMinComputeMicroversion is the lowest nova microversion we accept when
+	// verifying the compute microversion, if none is configured. Listing servers by
+	// their tags needs 2.26. Below createTagsMicroversion, tags are set after the
+	// create.
+	defaultMinComputeMicroversion = "2.26"
+
+	// volumeTypeMicroversion is the nova microversion that allows setting the volume
+	// type of block devices.
+	volumeTypeMicroversion = "2.67"
+
+	// createTagsMicroversion is the nova microversion that allows setting tags when a
+	// server is created. On older microversions the tags are set after the create.
+	createTagsMicroversion = "2.52"
+
+	// verifyTagsMaxAttempts is the number of times we list a new server by its tags,
+	// before giving up.
+	verifyTagsMaxAttempts = 5
 )
 
+// ErrInstanceNotFound is returned when a server does not exist, or does not belong to
+// this controller. It wraps the not found error of garm, so garm can tell a runner that
+// is gone from a runner we failed to look up.
+var ErrInstanceNotFound = fmt.Errorf("instance %w", runnerErrors.ErrNotFound)
+
+// ErrNoValidHost is returned when the scheduler could not find a host for the server.
+var ErrNoValidHost = gErrors.New("no valid host found")
+
+// ErrImageDownloadFailed is returned when a server went into ERROR state because the
+// compute host failed to download its image. This is usually transient, and creating
+// the server again succeeds.
+var ErrImageDownloadFailed = gErrors.New("image download failed")
+
+// ErrVolumeCreateFailed is returned when nova could not create the volumes of a server,
+// because their volume type does not exist or the cinder backend is out of capacity.
+var ErrVolumeCreateFailed = gErrors.New("volume create failed")
+
+// ErrVolumeServiceUnavailable is returned when a runner needs volumes, but the cloud has
+// no volume service in its catalog.
+var ErrVolumeServiceUnavailable = gErrors.New("the cloud has no volume service")
+
+// ErrPartialList is returned along with the servers that were listed before an error
+// occurred, when partial lists are allowed.
+var ErrPartialList = gErrors.New("failed to list all servers")
+
+// ErrStillDeleting is returned when a server was not gone after the delete timeout.
+// The delete request was accepted, so the server will most likely go away on its own.
+var ErrStillDeleting = gErrors.New("server is still being deleted")
+
+// ErrMultipleServers is returned when deleting a server by name, and more than one server
+// has that name.
+var ErrMultipleServers = gErrors.New("multiple servers found")
+
+// ErrConsoleOutputNotSupported is returned when nova can not get the console output of
+// a server, like bare metal servers whose driver has no console log.
+var ErrConsoleOutputNotSupported = gErrors.New("console output is not supported by the server")
+
+// ErrPasswordNotAvailable is returned when nova has no password for a server, because it
+// was created without a key pair, or the guest has not posted its encrypted password yet.
+var ErrPasswordNotAvailable = gErrors.New("the password of the server is not available")
+
+// ErrStopNotSupported is returned when nova can not stop a server, like bare metal
+// servers whose driver does not support powering them off.
+var ErrStopNotSupported = gErrors.New("stop is not supported by the server")
+
+// errServerInError is returned by waitForStatus when the server went into ERROR state.
+var errServerInError = gErrors.New("instance in ERROR state")
+
+// errMicroversionTooOld is returned by negotiateMicroversion when the highest
+// microversion supported by the service is older than the minimum we need.
+var errMicroversionTooOld = gErrors.New("microversion is older than the minimum microversion")
+
+// errWaitTimeout is returned by waitForStatus when the server did not reach the
+// desired state in time.
+var errWaitTimeout = gErrors.New("timed out waiting for server")
+
 func NewClient(cfg *config.Config, controllerID string) (*OpenstackClient, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	return NewClientForCloud(cfg, controllerID, cfg.Cloud, cfg.DefaultRegion())
+}
+
+// NewClientForCloud returns a client for the given cloud and region, which may differ from
+// the ones set in the config.
+func NewClientForCloud(cfg *config.Config, controllerID, cloud, region string) (*OpenstackClient, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("config is nil")
 	}
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("failed to validate credentials: %w", err)
 	}
+	if !cfg.Credentials.HasCloud(cloud) {
+		return nil, fmt.Errorf("cloud %s is not defined in clouds.yaml", cloud)
+	}
+	if region == "" && !cfg.Credentials.HasDefaultRegion(cloud) {
+		return nil, fmt.Errorf("missing region; cloud %s does not define a default region_name", cloud)
+	}
 
+	yamlOpts, err := newYAMLOpts(cfg, cloud)
+	if err != nil {
+		return nil, err
+	}
 	opts := clientconfig.ClientOpts{
-		Cloud:    cfg.Cloud,
-		YAMLOpts: &cfg.Credentials,
+		Cloud:      cloud,
+		RegionName: region,
+		YAMLOpts:   yamlOpts,
+	}
+	if cfg.ValidateAuthOnStartup {
+		if err := validateAuth(&opts); err != nil {
+			return nil, fmt.Errorf("failed to authenticate to cloud %s: %w", cloud, err)
+		}
 	}
+
 	compute, err := clientconfig.NewServiceClient("compute", &opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get compute client: %w", err)
 	}
 	// Enables filter by tags, metadata property in VM list and boot from volume.
-	compute.Microversion = "2.67"
+	compute.Microversion = defaultComputeMicroversion
+	if cfg.ComputeMicroversion != "" {
+		compute.Microversion = cfg.ComputeMicroversion
+	}
+	minVersion := defaultMinComputeMicroversion
+	if cfg.MinComputeMicroversion != "" {
+		minVersion = cfg.MinComputeMicroversion
+	}
+	if cfg.NegotiateComputeMicroversion {
+		microversion, err := negotiateMicroversion(compute, compute.Microversion, minVersion)
+		if err != nil {
+			if gErrors.Is(err, errMicroversionTooOld) {
+				return nil, fmt.Errorf("failed to negotiate compute microversion: %w", err)
+			}
+			log.Printf("failed to negotiate compute microversion, using %s: %s", compute.Microversion, err)
+		} else {
+			compute.Microversion = microversion
+		}
+	}
+	if cfg.VerifyComputeMicroversion {
+		if err := verifyMicroversion(compute, compute.Microversion, minVersion); err != nil {
+			return nil, fmt.Errorf("failed to verify compute microversion: %w", err)
+		}
+	}
 
 	glance, err := clientconfig.NewServiceClient("image", &opts)
 	if err != nil {
@@ -70,9 +248,43 @@ func NewClient(cfg *config.Config, controllerID string) (*OpenstackClient, error
 		return nil, fmt.Errorf("failed to get neutron client: %w", err)
 	}
 
+	// Runners that boot from image work on clouds without cinder, so we only fail once
+	// a runner needs volumes.
 	cinder, err := clientconfig.NewServiceClient("volume", &opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get cinder client: %w", err)
+		var notFound *gophercloud.ErrEndpointNotFound
+		if !gErrors.As(err, &notFound) {
+			return nil, fmt.Errorf("failed to get cinder client: %w", err)
+		}
+		log.Printf("cloud %s has no volume service, runners can not use volumes", cloud)
+		cinder = nil
+	}
+
+	for _, sc := range []*gophercloud.ServiceClient{compute, glance, neutron, cinder} {
+		enableReauth(sc, &opts)
+	}
+
+	retryMaxAttempts := defaultRetryMaxAttempts
+	if cfg.RetryMaxAttempts > 0 {
+		retryMaxAttempts = cfg.RetryMaxAttempts
+	}
+	retryBaseDelay := defaultRetryBaseDelay
+	if cfg.RetryBaseDelay > 0 {
+		retryBaseDelay = time.Duration(cfg.RetryBaseDelay) * time.Millisecond
+	}
+	pruneGracePeriod := defaultPruneGracePeriod
+	if cfg.PruneGracePeriod > 0 {
+		pruneGracePeriod = time.Duration(cfg.PruneGracePeriod) * time.Second
+	}
+	cacheTTL := time.Duration(cfg.ResourceCacheTTL) * time.Second
+	var cacheDir string
+	if cacheTTL > 0 {
+		stateDir, err := cfg.StateDirectory()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get state directory: %w", err)
+		}
+		// Flavors, images and networks differ between clouds and regions.
+		cacheDir = filepath.Join(stateDir, "cache", cloud, region)
 	}
 	return &OpenstackClient{
 		compute:      compute,
@@ -80,9 +292,177 @@ func NewClient(cfg *config.Config, controllerID string) (*OpenstackClient, error
 		network:      neutron,
 		volume:       cinder,
 		controllerID: controllerID,
+
+		controllerInstanceID:   cfg.ControllerInstanceID,
+		endpointInterface:      endpointInterface(&opts),
+		nameCollisionStrategy:  cfg.NameCollisionStrategy,
+		asyncCreate:            cfg.AsyncCreate,
+		allowDisabledFlavors:   cfg.AllowDisabledFlavors,
+		createTimeout:          cfg.CreateTimeout,
+		deleteTimeout:          cfg.DeleteTimeout,
+		errorGracePeriod:       cfg.ErrorServerGracePeriod,
+		pruneGracePeriod:       pruneGracePeriod,
+		pollInterval:           time.Duration(cfg.PollIntervalSeconds) * time.Second,
+		ignoreUnsupportedStop:  cfg.IgnoreUnsupportedStop,
+		softDelete:             !cfg.ForceDelete(),
+		excludeImageProperties: cfg.ExcludeImageProperties,
+		allowPartialList:       cfg.AllowPartialList,
+		listPageSize:           cfg.ListPageSize,
+
+		retryMaxAttempts: retryMaxAttempts,
+		retryBaseDelay:   retryBaseDelay,
+
+		flavorCache:  newResourceCache[flavors.Flavor](cacheTTL, filepath.Join(cacheDir, "flavors")),
+		imageCache:   newResourceCache[images.Image](cacheTTL, filepath.Join(cacheDir, "images")),
+		networkCache: newResourceCache[networks.Network](cacheTTL, filepath.Join(cacheDir, "networks")),
 	}, nil
 }
 
+// validateAuth requests a token from keystone using the credentials of the configured
+// cloud. The error returned by gophercloud may include the body of the response, so
+// we only return the status code to avoid leaking anything sensitive in the logs.
+func validateAuth(opts *clientconfig.ClientOpts) error {
+	if _, err := clientconfig.AuthenticatedClient(opts); err != nil {
+		var statusErr gophercloud.StatusCodeError
+		if gErrors.As(err, &statusErr) {
+			if statusErr.GetStatusCode() == http.StatusUnauthorized {
+				return fmt.Errorf("invalid credentials (HTTP %d)", statusErr.GetStatusCode())
+			}
+			return fmt.Errorf("token request failed with HTTP %d", statusErr.GetStatusCode())
+		}
+		return fmt.Errorf("token request failed: %w", err)
+	}
+	return nil
+}
+
+// parseMicroversion returns the major and minor parts of a microversion.
+func parseMicroversion(version string) (int, int, error) {
+	majorStr, minorStr, found := strings.Cut(version, ".")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid microversion: %q", version)
+	}
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid microversion: %q", version)
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid microversion: %q", version)
+	}
+	return major, minor, nil
+}
+
+// microversionAtLeast returns true if version is equal to or newer than minVersion.
+// Invalid microversions are never considered new enough.
+func microversionAtLeast(version, minVersion string) bool {
+	major, minor, err := parseMicroversion(version)
+	if err != nil {
+		return false
+	}
+	minMajor, minMinor, err := parseMicroversion(minVersion)
+	if err != nil {
+		return false
+	}
+	return major > minMajor || (major == minMajor && minor >= minMinor)
+}
+
+// getMicroversionRange queries the version document of the service and returns the
+// lowest and the highest microversions supported by the service.
+func getMicroversionRange(sc *gophercloud.ServiceClient) (string, string, error) {
+	var body struct {
+		Version struct {
+			MinVersion string `json:"min_version"`
+			Version    string `json:"version"`
+		} `json:"version"`
+	}
+	if _, err := sc.Get(sc.Endpoint, &body, &gophercloud.RequestOpts{OkCodes: []int{http.StatusOK}}); err != nil {
+		return "", "", fmt.Errorf("failed to get API version: %w", err)
+	}
+	if body.Version.Version == "" {
+		return "", "", fmt.Errorf("API does not support microversions")
+	}
+	if _, _, err := parseMicroversion(body.Version.Version); err != nil {
+		return "", "", err
+	}
+	return body.Version.MinVersion, body.Version.Version, nil
+}
+
+// negotiateMicroversion queries the version document of the service and returns the
+// lower of the highest microversion supported by the service and maxVersion. An error
+// wrapping errMicroversionTooOld is returned if that is older than minVersion.
+func negotiateMicroversion(sc *gophercloud.ServiceClient, maxVersion, minVersion string) (string, error) {
+	_, serverVersion, err := getMicroversionRange(sc)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := parseMicroversion(maxVersion); err != nil {
+		return "", err
+	}
+	if microversionAtLeast(serverVersion, maxVersion) {
+		return maxVersion, nil
+	}
+	if !microversionAtLeast(serverVersion, minVersion) {
+		return "", fmt.Errorf("%w %s: the highest microversion supported by %s is %s", errMicroversionTooOld, minVersion, sc.Endpoint, serverVersion)
+	}
+	return serverVersion, nil
+}
+
+// verifyMicroversion queries the version document of the service and returns an error
+// if version is not supported by the service, or if it is older than minVersion.
+func verifyMicroversion(sc *gophercloud.ServiceClient, version, minVersion string) error {
+	if !microversionAtLeast(version, minVersion) {
+		return fmt.Errorf("microversion %s is older than the minimum microversion %s", version, minVersion)
+	}
+	serverMinVersion, serverVersion, err := getMicroversionRange(sc)
+	if err != nil {
+		return err
+	}
+	if !microversionAtLeast(serverVersion, version) {
+		return fmt.Errorf("microversion %s is not supported, the highest microversion supported by %s is %s; pin a lower compute_microversion, or enable negotiate_compute_microversion", version, sc.Endpoint, serverVersion)
+	}
+	if serverMinVersion != "" && !microversionAtLeast(version, serverMinVersion) {
+		return fmt.Errorf("microversion %s is not supported, the lowest microversion supported by %s is %s", version, sc.Endpoint, serverMinVersion)
+	}
+	return nil
+}
+
+// withContext returns a copy of the service client whose requests are bound to ctx.
+// gophercloud v1 only accepts a context on the provider client, which is shared by all
+// requests, so we make a copy of it for every request. The copy gets the token from the
+// original provider client, and reauthenticates through it.
+func withContext(ctx context.Context, sc *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	if sc == nil || sc.ProviderClient == nil {
+		return sc
+	}
+	parent := sc.ProviderClient
+	provider := &gophercloud.ProviderClient{
+		IdentityBase:      parent.IdentityBase,
+		IdentityEndpoint:  parent.IdentityEndpoint,
+		EndpointLocator:   parent.EndpointLocator,
+		HTTPClient:        parent.HTTPClient,
+		UserAgent:         parent.UserAgent,
+		Throwaway:         parent.Throwaway,
+		Context:           ctx,
+		RetryBackoffFunc:  parent.RetryBackoffFunc,
+		MaxBackoffRetries: parent.MaxBackoffRetries,
+		RetryFunc:         parent.RetryFunc,
+	}
+	provider.CopyTokenFrom(parent)
+	if parent.ReauthFunc != nil {
+		provider.ReauthFunc = func() error {
+			// Reauthentication is skipped if the parent already has a newer token.
+			if err := parent.Reauthenticate(provider.Token()); err != nil {
+				return err
+			}
+			provider.CopyTokenFrom(parent)
+			return nil
+		}
+	}
+	client := *sc
+	client.ProviderClient = provider
+	return &client
+}
+
 type ServerWithExt struct {
 	servers.Server
 	availabilityzones.ServerAvailabilityZoneExt
@@ -90,6 +470,11 @@ type ServerWithExt struct {
 	diskconfig.ServerDiskConfigExt
 }
 
+// flavorExt holds the flavor fields that are not part of flavors.Flavor.
+type flavorExt struct {
+	Disabled bool `json:"OS-FLV-DISABLED:disabled"`
+}
+
 type OpenstackClient struct {
 	compute *gophercloud.ServiceClient
 	image   *gophercloud.ServiceClient
@@ -97,97 +482,531 @@ type OpenstackClient struct {
 	volume  *gophercloud.ServiceClient
 
 	controllerID string
+
+	nameCollisionStrategy  string
+	asyncCreate            bool
+	allowDisabledFlavors   bool
+	createTimeout          int
+	deleteTimeout          int
+	errorGracePeriod       int
+	pruneGracePeriod       time.Duration
+	pollInterval           time.Duration
+	ignoreUnsupportedStop  bool
+	softDelete             bool
+	controllerInstanceID   string
+	endpointInterface      string
+	excludeImageProperties map[string]string
+	allowPartialList       bool
+	listPageSize           int
+
+	retryMaxAttempts int
+	retryBaseDelay   time.Duration
+
+	// flavorCache, imageCache and networkCache are nil if resource_cache_ttl is 0.
+	flavorCache  *resourceCache[flavors.Flavor]
+	imageCache   *resourceCache[images.Image]
+	networkCache *resourceCache[networks.Network]
+}
+
+// ComputeMicroversion returns the nova microversion used by the client, which may have
+// been negotiated with nova.
+func (o *OpenstackClient) ComputeMicroversion() string {
+	return o.compute.Microversion
+}
+
+// Endpoints returns the endpoints of the services used by the client, keyed by the
+// service type.
+func (o *OpenstackClient) Endpoints() map[string]string {
+	endpoints := map[string]string{
+		"compute": redactURL(o.compute.Endpoint),
+		"image":   redactURL(o.image.Endpoint),
+		"network": redactURL(o.network.Endpoint),
+	}
+	if o.volume != nil {
+		endpoints["volume"] = redactURL(o.volume.Endpoint)
+	}
+	if o.compute.ProviderClient != nil && o.compute.IdentityEndpoint != "" {
+		endpoints["identity"] = redactURL(o.compute.IdentityEndpoint)
+	}
+	return endpoints
+}
+
+// HasVolumeService returns true if the cloud has a volume service.
+func (o *OpenstackClient) HasVolumeService() bool {
+	return o.volume != nil
+}
+
+// EndpointInterface returns the interface of the endpoints picked from the service
+// catalog: public, internal or admin.
+func (o *OpenstackClient) EndpointInterface() string {
+	if o.endpointInterface == "" {
+		return "public"
+	}
+	return o.endpointInterface
+}
+
+// redactURL removes any credentials from the URL, so it can be safely printed.
+func redactURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.User == nil {
+		return endpoint
+	}
+	u.User = url.User("REDACTED")
+	return u.String()
+}
+
+// endpointInterface returns the interface set for the cloud in clouds.yaml, in the same
+// way clientconfig picks the endpoints from the service catalog.
+func endpointInterface(opts *clientconfig.ClientOpts) string {
+	cloud, err := clientconfig.GetCloudFromYAML(opts)
+	if err != nil || cloud.EndpointType == "" {
+		return "public"
+	}
+	return strings.TrimSuffix(strings.ToLower(cloud.EndpointType), "url")
+}
+
+// activeTimeout returns the number of seconds we wait for a new server to become ACTIVE.
+// If the context has a deadline, we wait until the deadline, otherwise we use the
+// configured create timeout.
+func (o *OpenstackClient) activeTimeout(ctx context.Context) int {
+	if deadline, ok := ctx.Deadline(); ok {
+		return int(math.Ceil(time.Until(deadline).Seconds()))
+	}
+	if o.createTimeout > 0 {
+		return o.createTimeout
+	}
+	return defaultCreateTimeout
+}
+
+// deleteWaitTimeout returns the number of seconds we wait for a deleted server to go away.
+func (o *OpenstackClient) deleteWaitTimeout() int {
+	if o.deleteTimeout > 0 {
+		return o.deleteTimeout
+	}
+	return defaultDeleteTimeout
+}
+
+// cleanupFailedServer removes a server that failed to be created. If an error grace
+// period is set, servers that went into ERROR state are kept and tagged with the time
+// of the failure instead, so they can be inspected until CleanupErroredServers removes
+// them. Servers that could not be scheduled or failed to download their image are always
+// removed, as there is nothing to inspect, and the create may be retried.
+func (o *OpenstackClient) cleanupFailedServer(ctx context.Context, id, name string, createErr error) {
+	// Clean up even if the create was cancelled.
+	cleanupCtx := context.WithoutCancel(ctx)
+	if id == "" {
+		// Another runner may have the same name, so only a single match is removed.
+		err := o.DeleteServer(cleanupCtx, name, true, false)
+		if gErrors.Is(err, ErrMultipleServers) {
+			log.Printf("not cleaning up server %s, remove the one that failed to be created by hand: %s", name, err)
+		} else if err != nil {
+			log.Printf("failed to clean up server %s: %s", name, err)
+		}
+		return
+	}
+
+	if o.errorGracePeriod > 0 && gErrors.Is(createErr, errServerInError) {
+		errorTag := fmt.Sprintf("%s=%d", errorAtTagName, time.Now().Unix())
+		err := o.withRetry(cleanupCtx, func() error {
+			return tags.Add(withContext(cleanupCtx, o.compute), id, errorTag).ExtractErr()
+		})
+		if err == nil {
+			log.Printf("keeping server %s in ERROR state for %d seconds", id, o.errorGracePeriod)
+			return
+		}
+		log.Printf("failed to tag server %s in ERROR state, removing it: %s", id, err)
+	}
+	_ = o.DeleteServer(cleanupCtx, id, true, false)
+}
+
+// untaggedCreateOpts removes the tags from the body of a create request, for
+// microversions that do not accept them.
+type untaggedCreateOpts struct {
+	servers.CreateOptsBuilder
+}
+
+// ToServerCreateMap implements servers.CreateOptsBuilder.
+func (opts untaggedCreateOpts) ToServerCreateMap() (map[string]interface{}, error) {
+	m, err := opts.CreateOptsBuilder.ToServerCreateMap()
+	if err != nil {
+		return nil, err
+	}
+	if srv, ok := m["server"].(map[string]interface{}); ok {
+		delete(srv, "tags")
+	}
+	return m, nil
+}
+
+// createTags returns the tags to set after the server is created, and the options to
+// create it with. If the microversion accepts tags on create, no tags are returned and
+// the options are left as they are.
+func (o *OpenstackClient) createTags(createOpts servers.CreateOptsBuilder) ([]string, servers.CreateOptsBuilder, error) {
+	if o.compute.Microversion == "" || microversionAtLeast(o.compute.Microversion, createTagsMicroversion) {
+		return nil, createOpts, nil
+	}
+	m, err := createOpts.ToServerCreateMap()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build create request: %w", err)
+	}
+	srv, _ := m["server"].(map[string]interface{})
+	var serverTags []string
+	switch v := srv["tags"].(type) {
+	case []string:
+		serverTags = v
+	case []interface{}:
+		for _, tag := range v {
+			if tag, ok := tag.(string); ok {
+				serverTags = append(serverTags, tag)
+			}
+		}
+	}
+	if len(serverTags) == 0 {
+		return nil, createOpts, nil
+	}
+	return serverTags, untaggedCreateOpts{createOpts}, nil
+}
+
+// setCreateTags sets the tags of a server created on a microversion that does not
+// accept tags on create. Until then, the server does not look like it belongs to this
+// controller, so it is removed here if the tags can not be set.
+func (o *OpenstackClient) setCreateTags(ctx context.Context, id string, serverTags []string) error {
+	if len(serverTags) == 0 {
+		return nil
+	}
+	err := o.withRetry(ctx, func() error {
+		_, err := tags.ReplaceAll(withContext(ctx, o.compute), id, tags.ReplaceAllOpts{Tags: serverTags}).Extract()
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	cleanupCtx := context.WithoutCancel(ctx)
+	if delErr := o.deleteServerByID(cleanupCtx, id, true); delErr != nil {
+		log.Printf("failed to clean up untagged server %s: %s", id, delErr)
+	}
+	return fmt.Errorf("failed to set server tags: %w", err)
 }
 
 // CreateServerFromImage creates a new server from an image.
-func (o *OpenstackClient) CreateServerFromImage(createOpts servers.CreateOpts) (srv ServerWithExt, err error) {
+func (o *OpenstackClient) CreateServerFromImage(ctx context.Context, createOpts servers.CreateOptsBuilder, name string) (srv ServerWithExt, err error) {
 	defer func() {
 		if err != nil {
-			if srv.ID != "" {
-				_ = o.DeleteServer(srv.ID, true)
-			} else {
-				_ = o.DeleteServer(createOpts.Name, true)
-			}
+			o.cleanupFailedServer(ctx, srv.ID, name, err)
 		}
 	}()
 
-	if err = servers.Create(o.compute, createOpts).ExtractInto(&srv); err != nil {
+	serverTags, createOpts, err := o.createTags(createOpts)
+	if err != nil {
+		return srv, err
+	}
+	if err = o.withCreateRetry(ctx, func() error {
+		return servers.Create(withContext(ctx, o.compute), createOpts).ExtractInto(&srv)
+	}); err != nil {
 		return srv, fmt.Errorf("failed to create server: %w", err)
 	}
+	if err = o.setCreateTags(ctx, srv.ID, serverTags); err != nil {
+		// The server was already removed.
+		return ServerWithExt{}, err
+	}
 
-	if err := o.waitForStatus(srv.ID, "ACTIVE", 120); err != nil {
-		return srv, fmt.Errorf("server did not reach ACTIVE state after 120 seconds: %w", err)
+	// In async mode we return as soon as nova accepts the request, and leave it to
+	// garm to poll the server until it becomes ACTIVE.
+	if !o.asyncCreate {
+		timeout := o.activeTimeout(ctx)
+		if err := o.waitForStatus(ctx, srv.ID, "ACTIVE", timeout); err != nil {
+			return srv, fmt.Errorf("server did not reach ACTIVE state after %d seconds: %w", timeout, err)
+		}
 	}
 
-	return o.GetServer(srv.ID)
+	return o.GetServer(ctx, srv.ID)
 }
 
 // CreateServerFromVolume creates a new server from a volume.
-func (o *OpenstackClient) CreateServerFromVolume(createOpts bootfromvolume.CreateOptsExt, name string) (srv ServerWithExt, err error) {
+func (o *OpenstackClient) CreateServerFromVolume(ctx context.Context, createOpts bootfromvolume.CreateOptsExt, name string) (srv ServerWithExt, err error) {
+	// nova creates the volumes, but it needs cinder to do so. Without it, the request
+	// is accepted and the server fails to build.
+	if o.volume == nil {
+		return srv, fmt.Errorf("failed to create server: boot from volume and data disks need volumes: %w", ErrVolumeServiceUnavailable)
+	}
+
+	// Nova rejects the request on older microversions, but we check it here to give
+	// a better error message.
+	if o.compute.Microversion != "" && !microversionAtLeast(o.compute.Microversion, volumeTypeMicroversion) {
+		for _, bd := range createOpts.BlockDevice {
+			if bd.VolumeType != "" {
+				return srv, fmt.Errorf("setting the volume type of block devices needs compute microversion %s, but %s is used", volumeTypeMicroversion, o.compute.Microversion)
+			}
+		}
+	}
+
 	defer func() {
 		if err != nil {
-			if srv.ID != "" {
-				_ = o.DeleteServer(srv.ID, true)
-			} else {
-				_ = o.DeleteServer(name, true)
-			}
+			o.cleanupFailedServer(ctx, srv.ID, name, err)
 		}
 	}()
 
-	if err = bootfromvolume.Create(o.compute, createOpts).ExtractInto(&srv); err != nil {
+	serverTags, baseOpts, err := o.createTags(createOpts.CreateOptsBuilder)
+	if err != nil {
+		return srv, err
+	}
+	createOpts.CreateOptsBuilder = baseOpts
+	if err = o.withCreateRetry(ctx, func() error {
+		return bootfromvolume.Create(withContext(ctx, o.compute), createOpts).ExtractInto(&srv)
+	}); err != nil {
+		if isVolumeTypeError(err) {
+			return srv, fmt.Errorf("failed to create server: %w: %w", ErrVolumeCreateFailed, err)
+		}
 		return srv, fmt.Errorf("failed to create server: %w", err)
 	}
+	if err = o.setCreateTags(ctx, srv.ID, serverTags); err != nil {
+		// The server was already removed.
+		return ServerWithExt{}, err
+	}
+
+	// In async mode we return as soon as nova accepts the request, and leave it to
+	// garm to poll the server until it becomes ACTIVE.
+	if !o.asyncCreate {
+		timeout := o.activeTimeout(ctx)
+		if err := o.waitForStatus(ctx, srv.ID, "ACTIVE", timeout); err != nil {
+			return srv, fmt.Errorf("server did not reach ACTIVE state after %d seconds: %w", timeout, err)
+		}
+	}
+
+	return o.GetServer(ctx, srv.ID)
+}
+
+// CloneVolume creates a copy of an existing volume in the given availability zone, and
+// waits for it to become available. The copy is removed if it does not become available.
+func (o *OpenstackClient) CloneVolume(ctx context.Context, sourceID, name, availabilityZone string) (id string, err error) {
+	if o.volume == nil {
+		return "", fmt.Errorf("failed to clone volume %s: %w", sourceID, ErrVolumeServiceUnavailable)
+	}
+
+	var vol *volumes.Volume
+	if err := o.withCreateRetry(ctx, func() (err error) {
+		vol, err = volumes.Create(withContext(ctx, o.volume), volumes.CreateOpts{
+			Name:             name,
+			SourceVolID:      sourceID,
+			AvailabilityZone: availabilityZone,
+		}).Extract()
+		return err
+	}); err != nil {
+		return "", fmt.Errorf("failed to clone volume %s: %w", sourceID, err)
+	}
+	defer func() {
+		if err != nil {
+			if delErr := o.DeleteVolume(context.WithoutCancel(ctx), vol.ID); delErr != nil {
+				log.Printf("failed to clean up volume %s: %s", vol.ID, delErr)
+			}
+		}
+	}()
+
+	timeout := o.activeTimeout(ctx)
+	if err := o.waitForVolumeStatus(ctx, vol.ID, "available", timeout); err != nil {
+		return "", fmt.Errorf("failed to clone volume %s: %w", sourceID, err)
+	}
+	return vol.ID, nil
+}
 
-	if err := o.waitForStatus(srv.ID, "ACTIVE", 120); err != nil {
-		return srv, fmt.Errorf("server did not reach ACTIVE state after 120 seconds: %w", err)
+// waitForVolumeStatus polls the volume until it reaches the desired status, the timeout
+// expires or the context is cancelled.
+func (o *OpenstackClient) waitForVolumeStatus(ctx context.Context, id, status string, secs int) error {
+	timeout := time.NewTimer(time.Duration(secs) * time.Second)
+	defer timeout.Stop()
+	poll := time.NewTimer(pollDelay(o.pollInterval))
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for volume %s: %w", id, ctx.Err())
+		case <-timeout.C:
+			return fmt.Errorf("%w %s to reach %s state", errWaitTimeout, id, status)
+		case <-poll.C:
+		}
+		poll.Reset(pollDelay(o.pollInterval))
+
+		var current *volumes.Volume
+		err := o.withRetry(ctx, func() (err error) {
+			current, err = volumes.Get(withContext(ctx, o.volume), id).Extract()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not find volume %s: %w", id, err)
+		}
+
+		if current.Status == status {
+			return nil
+		}
+		if current.Status == "error" {
+			return fmt.Errorf("%w: volume %s went into error state", ErrVolumeCreateFailed, id)
+		}
 	}
+}
 
-	return o.GetServer(srv.ID)
+// DeleteVolume removes a volume. Volumes that do not exist are ignored.
+func (o *OpenstackClient) DeleteVolume(ctx context.Context, id string) error {
+	if o.volume == nil {
+		return fmt.Errorf("failed to delete volume %s: %w", id, ErrVolumeServiceUnavailable)
+	}
+	err := o.withRetry(ctx, func() error {
+		return volumes.Delete(withContext(ctx, o.volume), id, nil).ExtractErr()
+	})
+	if err != nil {
+		if _, ok := err.(gophercloud.ErrDefault404); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to delete volume %s: %w", id, err)
+	}
+	return nil
 }
 
 // GetServer creates a new server.
-func (o *OpenstackClient) GetServer(nameOrId string) (ServerWithExt, error) {
-	results, err := o.ListServersWithNameOrID(nameOrId)
+func (o *OpenstackClient) GetServer(ctx context.Context, nameOrId string) (ServerWithExt, error) {
+	results, err := o.ListServersWithNameOrID(ctx, nameOrId)
 	if err != nil {
 		return ServerWithExt{}, fmt.Errorf("failed to find server: %w", err)
 	}
 
 	if len(results) == 0 {
-		return ServerWithExt{}, fmt.Errorf("failed to find server with name or id %s", nameOrId)
+		return ServerWithExt{}, fmt.Errorf("failed to find server with name or id %s: %w", nameOrId, ErrInstanceNotFound)
 	}
 
 	if len(results) > 1 {
-		return ServerWithExt{}, fmt.Errorf("multiple servers with name or id %s; manual intervention required", nameOrId)
+		return o.resolveNameCollision(nameOrId, results)
 	}
 
 	return results[0], nil
 }
 
-func (o *OpenstackClient) ListServersWithTags(tags []string) ([]ServerWithExt, error) {
-	var srvResults []ServerWithExt
-	opts := servers.ListOpts{
-		Tags: strings.Join(tags, ","),
+// resolveNameCollision picks one server out of multiple servers with the same name,
+// according to the configured name collision strategy.
+func (o *OpenstackClient) resolveNameCollision(name string, results []ServerWithExt) (ServerWithExt, error) {
+	switch o.nameCollisionStrategy {
+	case config.NameCollisionPickNewest:
+		newest := results[0]
+		for _, srv := range results[1:] {
+			if srv.Created.After(newest.Created) {
+				newest = srv
+			}
+		}
+		return newest, nil
+	case config.NameCollisionPickByPoolTag:
+		var found []ServerWithExt
+		for _, srv := range results {
+			if srv.Tags == nil {
+				continue
+			}
+			for _, tag := range *srv.Tags {
+				if strings.HasPrefix(tag, poolIDTagName+"=") {
+					found = append(found, srv)
+					break
+				}
+			}
+		}
+		if len(found) == 1 {
+			return found[0], nil
+		}
+		return ServerWithExt{}, fmt.Errorf("found %d servers with name %s and a pool ID tag; manual intervention required", len(found), name)
 	}
-	pages, err := servers.List(o.compute, opts).AllPages()
+	return ServerWithExt{}, fmt.Errorf("multiple servers with name or id %s; manual intervention required", name)
+}
+
+// ListServersWithTags returns all the servers that have the given tags.
+func (o *OpenstackClient) ListServersWithTags(ctx context.Context, tags []string) ([]ServerWithExt, error) {
+	var srvResults []ServerWithExt
+	err := o.EachServerWithTags(ctx, tags, func(srv ServerWithExt) error {
+		srvResults = append(srvResults, srv)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list servers: %w", err)
+		// Return the servers we already fetched, so the caller can act on them.
+		if o.allowPartialList && len(srvResults) > 0 {
+			return srvResults, fmt.Errorf("%w: %w", ErrPartialList, err)
+		}
+		return nil, err
 	}
 
-	err = servers.ExtractServersInto(pages, &srvResults)
+	return srvResults, nil
+}
+
+// EachServerWithTags calls fn for every server that has the given tags. Servers are
+// fetched one page of list_page_size servers at a time, and passed to fn as each page
+// arrives, so the whole list is never held in memory. Listing stops at the first error
+// returned by fn, which is returned as is.
+func (o *OpenstackClient) EachServerWithTags(ctx context.Context, tags []string, fn func(ServerWithExt) error) error {
+	opts := servers.ListOpts{
+		Tags:  strings.Join(tags, ","),
+		Limit: o.listPageSize,
+	}
+	var fnErr error
+	err := servers.List(withContext(ctx, o.compute), opts).EachPage(func(page pagination.Page) (bool, error) {
+		var pageResults []ServerWithExt
+		if err := servers.ExtractServersInto(page, &pageResults); err != nil {
+			return false, fmt.Errorf("failed to extract server info: %w", err)
+		}
+		for _, srv := range pageResults {
+			if fnErr = fn(srv); fnErr != nil {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if fnErr != nil {
+		return fnErr
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract server info: %w", err)
+		return fmt.Errorf("failed to list servers: %w", err)
 	}
+	return nil
+}
 
-	return srvResults, nil
+// VerifyServerTags makes sure the server shows up when listing servers by the given
+// tags. Some clouds apply the tags set at create time with a delay, so the tags are set
+// again if the server is missing from the list, until it shows up or we run out of
+// attempts.
+func (o *OpenstackClient) VerifyServerTags(ctx context.Context, serverID string, serverTags []string) error {
+	for attempt := 1; ; attempt++ {
+		srvResults, err := o.ListServersWithTags(ctx, serverTags)
+		if err != nil {
+			return err
+		}
+		for _, srv := range srvResults {
+			if srv.ID == serverID {
+				return nil
+			}
+		}
+		if attempt >= verifyTagsMaxAttempts {
+			return fmt.Errorf("server %s is not listed with its tags after %d attempts", serverID, attempt)
+		}
+
+		if err := o.withRetry(ctx, func() error {
+			_, err := tags.ReplaceAll(withContext(ctx, o.compute), serverID, tags.ReplaceAllOpts{Tags: serverTags}).Extract()
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to set tags of server %s: %w", serverID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped verifying tags: %w", ctx.Err())
+		case <-time.After(backoffDelay(o.retryBaseDelay, attempt-1)):
+		}
+	}
 }
 
 // ListServersWithNameOrID will return an array of servers that match a name or ID. When passing
 // in an ID, there is no chance that this function will return an array larger than one element.
 // When passing in a name, the function may return an array larger than 1 element.
-func (o *OpenstackClient) ListServersWithNameOrID(nameOrId string) ([]ServerWithExt, error) {
+func (o *OpenstackClient) ListServersWithNameOrID(ctx context.Context, nameOrId string) ([]ServerWithExt, error) {
 	if isUUID(nameOrId) {
 		var srv ServerWithExt
-		if err := servers.Get(o.compute, nameOrId).ExtractInto(&srv); err != nil {
+		if err := o.withRetry(ctx, func() error {
+			return servers.Get(withContext(ctx, o.compute), nameOrId).ExtractInto(&srv)
+		}); err != nil {
+			if _, ok := err.(gophercloud.ErrDefault404); ok {
+				return nil, fmt.Errorf("failed to get server %s: %w", nameOrId, ErrInstanceNotFound)
+			}
 			return nil, fmt.Errorf("failed to get server: %w", err)
 		}
 		var controllerIDValue string
@@ -200,17 +1019,13 @@ func (o *OpenstackClient) ListServersWithNameOrID(nameOrId string) ([]ServerWith
 				}
 			}
 		}
-		if controllerIDValue != o.controllerID {
-			return nil, fmt.Errorf("server with name or ID %s not found", nameOrId)
+		if controllerIDValue != o.controllerID || !o.hasControllerInstanceTag(srv) {
+			return nil, fmt.Errorf("server with name or ID %s: %w", nameOrId, ErrInstanceNotFound)
 		}
 		return []ServerWithExt{srv}, nil
 	}
 
-	tags := []string{
-		controllerIDTagName + "=" + o.controllerID,
-	}
-
-	srvResults, err := o.ListServersWithTags(tags)
+	srvResults, err := o.ListServersWithTags(ctx, o.controllerTags())
 	if err != nil {
 		return nil, fmt.Errorf("failed to find server by name: %w", err)
 	}
@@ -226,41 +1041,247 @@ func (o *OpenstackClient) ListServersWithNameOrID(nameOrId string) ([]ServerWith
 }
 
 // ListServers creates a new server.
-func (o *OpenstackClient) ListServers(poolID string) ([]ServerWithExt, error) {
-	tags := []string{
-		poolIDTagName + "=" + poolID,
-		controllerIDTagName + "=" + o.controllerID,
-	}
+func (o *OpenstackClient) ListServers(ctx context.Context, poolID string) ([]ServerWithExt, error) {
+	tags := append([]string{poolIDTagName + "=" + poolID}, o.controllerTags()...)
 
-	return o.ListServersWithTags(tags)
+	return o.ListServersWithTags(ctx, tags)
 }
 
-func (o *OpenstackClient) waitForStatus(id, status string, secs int) error {
-	return gophercloud.WaitFor(secs, func() (bool, error) {
-		result := servers.Get(o.compute, id)
+// controllerTags returns the tags that identify the servers of this controller. If a
+// controller instance ID is set, only the servers that have it belong to us, even if
+// another controller uses the same controller ID.
+func (o *OpenstackClient) controllerTags() []string {
+	tags := []string{controllerIDTagName + "=" + o.controllerID}
+	if o.controllerInstanceID != "" {
+		tags = append(tags, controllerInstanceIDTagName+"="+o.controllerInstanceID)
+	}
+	return tags
+}
+
+// hasControllerInstanceTag returns true if the server has the controller instance ID
+// tag, or if no controller instance ID is set.
+func (o *OpenstackClient) hasControllerInstanceTag(srv ServerWithExt) bool {
+	if o.controllerInstanceID == "" {
+		return true
+	}
+	return srv.Tags != nil && slices.Contains(*srv.Tags, controllerInstanceIDTagName+"="+o.controllerInstanceID)
+}
+
+// RetagServers adds the controller instance ID tag to the servers of this controller
+// that were created before the controller instance ID was set. Servers that are tagged
+// with a different controller instance ID are left alone. The IDs of the servers that
+// were tagged are returned.
+func (o *OpenstackClient) RetagServers(ctx context.Context) ([]string, error) {
+	if o.controllerInstanceID == "" {
+		return nil, fmt.Errorf("no controller instance ID is set")
+	}
+	srvResults, err := o.ListServersWithTags(ctx, []string{controllerIDTagName + "=" + o.controllerID})
+	if err != nil {
+		return nil, err
+	}
 
-		current, err := result.Extract()
+	retagged := []string{}
+	instanceTag := controllerInstanceIDTagName + "=" + o.controllerInstanceID
+	for _, srv := range srvResults {
+		hasInstanceTag := false
+		if srv.Tags != nil {
+			for _, tag := range *srv.Tags {
+				if strings.HasPrefix(tag, controllerInstanceIDTagName+"=") {
+					hasInstanceTag = true
+					break
+				}
+			}
+		}
+		if hasInstanceTag {
+			continue
+		}
+		if err := o.withRetry(ctx, func() error {
+			return tags.Add(withContext(ctx, o.compute), srv.ID, instanceTag).ExtractErr()
+		}); err != nil {
+			return retagged, fmt.Errorf("failed to tag server %s: %w", srv.ID, err)
+		}
+		retagged = append(retagged, srv.ID)
+	}
+	return retagged, nil
+}
+
+// CleanupErroredServers removes the servers of this controller that have been in ERROR
+// state for longer than the error grace period. Servers in ERROR state that have no
+// error timestamp yet, like the ones created in async mode, are tagged with the current
+// time, so their grace period starts now. If no grace period is set, all servers in
+// ERROR state are removed. The IDs of the servers that were removed are
+// returned.
+func (o *OpenstackClient) CleanupErroredServers(ctx context.Context) ([]string, error) {
+	srvResults, err := o.ListServersWithTags(ctx, o.controllerTags())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	removed := []string{}
+	for _, srv := range srvResults {
+		if srv.Status != "ERROR" {
+			continue
+		}
+		errorAt, ok := serverErrorTime(srv)
+		if !ok && o.errorGracePeriod > 0 {
+			errorTag := fmt.Sprintf("%s=%d", errorAtTagName, now.Unix())
+			if err := o.withRetry(ctx, func() error {
+				return tags.Add(withContext(ctx, o.compute), srv.ID, errorTag).ExtractErr()
+			}); err != nil {
+				return removed, fmt.Errorf("failed to tag server %s: %w", srv.ID, err)
+			}
+			continue
+		}
+		if ok && now.Sub(errorAt) < time.Duration(o.errorGracePeriod)*time.Second {
+			continue
+		}
+		if err := o.deleteServerByID(ctx, srv.ID, false); err != nil {
+			return removed, fmt.Errorf("failed to delete server %s: %w", srv.ID, err)
+		}
+		removed = append(removed, srv.ID)
+	}
+	return removed, nil
+}
+
+// serverErrorTime returns the time recorded in the error timestamp tag of a server.
+func serverErrorTime(srv ServerWithExt) (time.Time, bool) {
+	if srv.Tags == nil {
+		return time.Time{}, false
+	}
+	for _, tag := range *srv.Tags {
+		value, ok := strings.CutPrefix(tag, errorAtTagName+"=")
+		if !ok {
+			continue
+		}
+		ts, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			if _, ok := err.(gophercloud.ErrDefault404); ok && status == "DELETED" {
-				return true, nil
+			return time.Time{}, false
+		}
+		return time.Unix(ts, 0), true
+	}
+	return time.Time{}, false
+}
+
+// InErrorGracePeriod returns true if the server is in ERROR state, and was tagged with
+// an error timestamp less than the error grace period ago.
+func (o *OpenstackClient) InErrorGracePeriod(srv ServerWithExt) bool {
+	if srv.Status != "ERROR" || o.errorGracePeriod <= 0 {
+		return false
+	}
+	errorAt, ok := serverErrorTime(srv)
+	return ok && time.Since(errorAt) < time.Duration(o.errorGracePeriod)*time.Second
+}
+
+// waitForStatus polls the server until it reaches the desired status, the timeout
+// expires or the context is cancelled.
+func (o *OpenstackClient) waitForStatus(ctx context.Context, id, status string, secs int) error {
+	return o.waitForStatusTimeout(ctx, id, status, time.Duration(secs)*time.Second)
+}
+
+// waitForStatusTimeout is like waitForStatus, with a timeout that is not limited to
+// whole seconds.
+func (o *OpenstackClient) waitForStatusTimeout(ctx context.Context, id, status string, d time.Duration) error {
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+	poll := time.NewTimer(pollDelay(o.pollInterval))
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for server %s: %w", id, ctx.Err())
+		case <-timeout.C:
+			return fmt.Errorf("%w %s to reach %s state", errWaitTimeout, id, status)
+		case <-poll.C:
+		}
+		poll.Reset(pollDelay(o.pollInterval))
+
+		var current *servers.Server
+		err := o.withRetry(ctx, func() (err error) {
+			current, err = servers.Get(withContext(ctx, o.compute), id).Extract()
+			return err
+		})
+		if err != nil {
+			if _, ok := err.(gophercloud.ErrDefault404); ok && (status == "DELETED" || status == "SOFT_DELETED") {
+				return nil
 			}
-			return false, fmt.Errorf("could not find server %s: %w", id, err)
+			return fmt.Errorf("could not find server %s: %w", id, err)
 		}
 
 		if current.Status == status {
-			return true, nil
+			return nil
 		}
 
 		if current.Status == "ERROR" {
-			return false, fmt.Errorf("instance in ERROR state")
+			if strings.Contains(strings.ToLower(current.Fault.Message), "no valid host") {
+				return fmt.Errorf("%w: %s", ErrNoValidHost, current.Fault.Message)
+			}
+			if isImageDownloadFault(current.Fault.Message) {
+				return fmt.Errorf("%w: %s", ErrImageDownloadFailed, current.Fault.Message)
+			}
+			if isVolumeCreateFault(current.Fault.Message) {
+				return fmt.Errorf("%w: %s", ErrVolumeCreateFailed, current.Fault.Message)
+			}
+			if current.Fault.Message != "" {
+				return fmt.Errorf("%w: %s (code %d)", errServerInError, current.Fault.Message, current.Fault.Code)
+			}
+			return errServerInError
 		}
+	}
+}
 
-		return false, nil
-	})
+// isImageDownloadFault returns true if the fault of a server says the compute host could
+// not download the image. Faults about the image itself, like an image that is missing or
+// can not be booted, are not transient and do not match.
+func isImageDownloadFault(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "image download failed") || strings.Contains(message, "failed to download image")
+}
+
+// isVolumeCreateFault returns true if the fault of a server says one of its volumes could
+// not be created. cinder sets the volume to error when no backend can hold it, and nova
+// gives up waiting for it. Nova also reports a failure prepping the block devices for
+// errors that another volume type does not fix, like an image that is larger than the
+// volume, so that fault does not match.
+func isVolumeCreateFault(message string) bool {
+	return strings.Contains(strings.ToLower(message), "did not finish being created")
+}
+
+// isVolumeTypeError returns true if nova rejected the create request because a volume
+// type of the block devices does not exist.
+func isVolumeTypeError(err error) bool {
+	var badRequest gophercloud.ErrDefault400
+	if !gErrors.As(err, &badRequest) {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(badRequest.Body)), "volume type")
 }
 
-func (o *OpenstackClient) deleteServerByID(id string, waitForDelete bool) error {
-	response := servers.ForceDelete(o.compute, id)
+// pollDelay returns the delay before the next status check of a server. A random jitter
+// of up to a fifth of the interval is added, so that servers that are created at the
+// same time are not all checked at the same time.
+func pollDelay(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	if jitter := int64(interval / 5); jitter > 0 {
+		interval += time.Duration(rand.Int64N(jitter + 1))
+	}
+	return interval
+}
+
+func (o *OpenstackClient) deleteServerByID(ctx context.Context, id string, waitForDelete bool) error {
+	// A normal delete only soft deletes the server, if nova is configured with a
+	// reclaim_instance_interval.
+	status := "DELETED"
+	var response gophercloud.ErrResult
+	if o.softDelete {
+		status = "SOFT_DELETED"
+		response = servers.Delete(withContext(ctx, o.compute), id).ErrResult
+	} else {
+		response = servers.ForceDelete(withContext(ctx, o.compute), id).ErrResult
+	}
 	if response.StatusCode == 404 {
 		return nil
 	}
@@ -270,7 +1291,11 @@ func (o *OpenstackClient) deleteServerByID(id string, waitForDelete bool) error
 	}
 
 	if waitForDelete {
-		if err := o.waitForStatus(id, "DELETED", 120); err != nil {
+		timeout := o.deleteWaitTimeout()
+		if err := o.waitForStatus(ctx, id, status, timeout); err != nil {
+			if gErrors.Is(err, errWaitTimeout) {
+				return fmt.Errorf("%w: server %s still exists after %d seconds", ErrStillDeleting, id, timeout)
+			}
 			return fmt.Errorf("failed to delete server: %w", err)
 		}
 	}
@@ -278,20 +1303,35 @@ func (o *OpenstackClient) deleteServerByID(id string, waitForDelete bool) error
 	return nil
 }
 
-// DeleteServer server deletes servers that match nameOrID.
-// Warning: If a name is passed in, all servers with the same name, that match the controller ID
-// set in the tags, will be deleted
-func (o *OpenstackClient) DeleteServer(nameOrID string, waitForDelete bool) error {
-	results, err := o.ListServersWithNameOrID(nameOrID)
+// DeleteServer server deletes the server that matches nameOrID. If a name is passed in and
+// more than one server with that name matches the controller ID set in the tags, nothing is
+// deleted and ErrMultipleServers is returned, unless allowMultiple is set, in which case all
+// of them are deleted.
+func (o *OpenstackClient) DeleteServer(ctx context.Context, nameOrID string, waitForDelete, allowMultiple bool) error {
+	results, err := o.ListServersWithNameOrID(ctx, nameOrID)
 	if err != nil {
-		// errors returned by gophercloud are not errors.Is compatible.
-		if _, ok := gErrors.Unwrap(err).(gophercloud.ErrDefault404); ok {
+		if gErrors.Is(err, ErrInstanceNotFound) {
 			return nil
 		}
 		return fmt.Errorf("failed to find server: %w", err)
 	}
+	toDelete := make([]ServerWithExt, 0, len(results))
 	for _, srv := range results {
-		if err := o.deleteServerByID(srv.ID, true); err != nil {
+		if srv.Status == "SOFT_DELETED" && o.softDelete {
+			// Already deleted, waiting to be reclaimed.
+			continue
+		}
+		toDelete = append(toDelete, srv)
+	}
+	if len(toDelete) > 1 && !allowMultiple {
+		ids := make([]string, 0, len(toDelete))
+		for _, srv := range toDelete {
+			ids = append(ids, srv.ID)
+		}
+		return fmt.Errorf("%w: %s matches servers %s", ErrMultipleServers, nameOrID, strings.Join(ids, ", "))
+	}
+	for _, srv := range toDelete {
+		if err := o.deleteServerByID(ctx, srv.ID, true); err != nil {
 			// errors returned by gophercloud are not errors.Is compatible.
 			if _, ok := gErrors.Unwrap(err).(gophercloud.ErrDefault404); ok {
 				continue
@@ -302,47 +1342,175 @@ func (o *OpenstackClient) DeleteServer(nameOrID string, waitForDelete bool) erro
 	return nil
 }
 
-// GetFlavor resolves a flavor name or ID to a flavor.
-func (o *OpenstackClient) GetFlavor(nameOrId string) (*flavors.Flavor, error) {
+// GetServerHost returns the compute host the server runs on. The host is only visible
+// to admins, so an empty host is returned for everyone else.
+func (o *OpenstackClient) GetServerHost(ctx context.Context, id string) (string, error) {
+	var result struct {
+		Host string `json:"OS-EXT-SRV-ATTR:host"`
+	}
+	err := o.withRetry(ctx, func() error {
+		return servers.Get(withContext(ctx, o.compute), id).ExtractInto(&result)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get server: %w", err)
+	}
+	return result.Host, nil
+}
+
+// ListHostAggregates returns the names of the host aggregates the compute host is part
+// of. Listing aggregates requires admin privileges.
+func (o *OpenstackClient) ListHostAggregates(ctx context.Context, host string) ([]string, error) {
+	pages, err := aggregates.List(withContext(ctx, o.compute)).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list aggregates: %w", err)
+	}
+	results, err := aggregates.ExtractAggregates(pages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract aggregates: %w", err)
+	}
+
+	ret := []string{}
+	for _, aggregate := range results {
+		for _, aggregateHost := range aggregate.Hosts {
+			if aggregateHost == host {
+				ret = append(ret, aggregate.Name)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// UpdateServerMetadata sets the given metadata keys on the server. Other keys are left
+// untouched.
+func (o *OpenstackClient) UpdateServerMetadata(ctx context.Context, id string, metadata map[string]string) error {
+	if _, err := servers.UpdateMetadata(withContext(ctx, o.compute), id, servers.MetadataOpts(metadata)).Extract(); err != nil {
+		return fmt.Errorf("failed to update server metadata: %w", err)
+	}
+	return nil
+}
+
+// GetKeyPair returns the nova keypair with the given name.
+func (o *OpenstackClient) GetKeyPair(ctx context.Context, name string) (*keypairs.KeyPair, error) {
+	keyPair, err := keypairs.Get(withContext(ctx, o.compute), name, nil).Extract()
+	if err != nil {
+		if _, ok := err.(gophercloud.ErrDefault404); ok {
+			return nil, fmt.Errorf("keypair %s not found", name)
+		}
+		return nil, fmt.Errorf("failed to get keypair: %w", err)
+	}
+	return keyPair, nil
+}
+
+// GetFlavor resolves a flavor name or ID to a flavor. Flavors are cached for
+// resource_cache_ttl seconds.
+func (o *OpenstackClient) GetFlavor(ctx context.Context, nameOrId string) (*flavors.Flavor, error) {
+	if flavor, ok := o.flavorCache.get(nameOrId); ok {
+		return &flavor, nil
+	}
+	flavor, err := o.getFlavor(ctx, nameOrId)
+	if err != nil {
+		return nil, err
+	}
+	o.flavorCache.set(nameOrId, *flavor)
+	return flavor, nil
+}
+
+func (o *OpenstackClient) getFlavor(ctx context.Context, nameOrId string) (*flavors.Flavor, error) {
 	var flavor *flavors.Flavor
+	var disabled bool
 	var err error
-	flavor, err = flavors.Get(o.compute, nameOrId).Extract()
+	var result flavors.GetResult
+	err = o.withRetry(ctx, func() error {
+		result = flavors.Get(withContext(ctx, o.compute), nameOrId)
+		return result.Err
+	})
 	if err == nil {
-		return flavor, nil
-	}
-
-	if err := flavors.ListDetail(o.compute, nil).EachPage(func(page pagination.Page) (bool, error) {
-		flavorResults, err := flavors.ExtractFlavors(page)
+		flavor, err = result.Extract()
 		if err != nil {
-			return false, fmt.Errorf("failed to extract flavors: %w", err)
+			return nil, fmt.Errorf("failed to extract flavor: %w", err)
+		}
+		var ext struct {
+			Flavor flavorExt `json:"flavor"`
 		}
+		if err := result.ExtractInto(&ext); err != nil {
+			return nil, fmt.Errorf("failed to extract flavor: %w", err)
+		}
+		disabled = ext.Flavor.Disabled
+	} else {
+		if err := flavors.ListDetail(withContext(ctx, o.compute), nil).EachPage(func(page pagination.Page) (bool, error) {
+			flavorResults, err := flavors.ExtractFlavors(page)
+			if err != nil {
+				return false, fmt.Errorf("failed to extract flavors: %w", err)
+			}
+			var exts []flavorExt
+			if err := page.(flavors.FlavorPage).ExtractIntoSlicePtr(&exts, "flavors"); err != nil {
+				return false, fmt.Errorf("failed to extract flavors: %w", err)
+			}
 
-		for _, res := range flavorResults {
-			if res.ID == nameOrId || res.Name == nameOrId {
-				// return the first one we find.
-				flavor = &res
-				return false, nil
+			for idx, res := range flavorResults {
+				if res.ID == nameOrId || res.Name == nameOrId {
+					// return the first one we find.
+					flavor = &res
+					disabled = exts[idx].Disabled
+					return false, nil
+				}
 			}
+			return true, nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to list flavors: %w", err)
 		}
-		return true, nil
-	}); err != nil {
-		return nil, fmt.Errorf("failed to list flavors: %w", err)
 	}
 
 	if flavor == nil {
 		return nil, fmt.Errorf("failed to find flavor with name or id %s", nameOrId)
 	}
 
+	if disabled && !o.allowDisabledFlavors {
+		return nil, fmt.Errorf("flavor %s is disabled", nameOrId)
+	}
+
 	return flavor, nil
 }
 
-// GetImage gets details of an image passed in by ID.
-func (o *OpenstackClient) GetImage(nameOrID, imageVisibility string) (*images.Image, error) {
+// GetFlavorExtraSpecs returns the extra specs of a flavor.
+func (o *OpenstackClient) GetFlavorExtraSpecs(ctx context.Context, flavorID string) (map[string]string, error) {
+	var extraSpecs map[string]string
+	if err := o.withRetry(ctx, func() (err error) {
+		extraSpecs, err = flavors.ListExtraSpecs(withContext(ctx, o.compute), flavorID).Extract()
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get extra specs of flavor %s: %w", flavorID, err)
+	}
+	return extraSpecs, nil
+}
+
+// GetImage gets details of an image passed in by name or ID. If owners are given, images
+// looked up by name are filtered by owner by glance, one owner at a time, in the given
+// order. Images are cached for resource_cache_ttl seconds.
+func (o *OpenstackClient) GetImage(ctx context.Context, nameOrID, imageVisibility string, owners []string) (*images.Image, error) {
+	key := imageVisibility + "/" + strings.Join(owners, ",") + "/" + nameOrID
+	if image, ok := o.imageCache.get(key); ok {
+		// The properties are changed by callers, and must not change the cached image.
+		image.Properties = maps.Clone(image.Properties)
+		return &image, nil
+	}
+	image, err := o.getImage(ctx, nameOrID, imageVisibility, owners)
+	if err != nil {
+		return nil, err
+	}
+	cached := *image
+	cached.Properties = maps.Clone(image.Properties)
+	o.imageCache.set(key, cached)
+	return image, nil
+}
+
+func (o *OpenstackClient) getImage(ctx context.Context, nameOrID, imageVisibility string, owners []string) (*images.Image, error) {
 	var result *images.Image
 	var err error
 
 	if isUUID(nameOrID) {
-		result, err = images.Get(o.image, nameOrID).Extract()
+		result, err = images.Get(withContext(ctx, o.image), nameOrID).Extract()
 		if err != nil {
 			return nil, fmt.Errorf("failed to find image: %w", err)
 		}
@@ -354,29 +1522,48 @@ func (o *OpenstackClient) GetImage(nameOrID, imageVisibility string) (*images.Im
 		imageVisibility = "public"
 	}
 
-	opts := images.ListOpts{
-		Name:       nameOrID,
-		Visibility: images.ImageVisibility(imageVisibility),
-		Status:     images.ImageStatusActive,
+	queryOwners := owners
+	if len(queryOwners) == 0 {
+		// An empty owner does not filter anything.
+		queryOwners = []string{""}
 	}
-	// perhaps it's a name. List all images and look for the image by name.
-	if err := images.List(o.image, opts).EachPage(func(page pagination.Page) (bool, error) {
-		imgResults, err := images.ExtractImages(page)
-		if err != nil {
-			return false, err
+	// perhaps it's a name. List the images with that name and look for one we can use.
+	for _, owner := range queryOwners {
+		opts := images.ListOpts{
+			Name:       nameOrID,
+			Owner:      owner,
+			Visibility: images.ImageVisibility(imageVisibility),
+			Status:     images.ImageStatusActive,
 		}
-		for _, img := range imgResults {
-			if img.ID == nameOrID || img.Name == nameOrID {
-				// return the first one we find.
-				result = &img
-				return false, nil
-			}
+		if err := o.withRetry(ctx, func() error {
+			return images.List(withContext(ctx, o.image), opts).EachPage(func(page pagination.Page) (bool, error) {
+				imgResults, err := images.ExtractImages(page)
+				if err != nil {
+					return false, err
+				}
+				for _, img := range imgResults {
+					if img.ID == nameOrID || img.Name == nameOrID {
+						if o.isExcludedImage(img) {
+							continue
+						}
+						// return the first one we find.
+						result = &img
+						return false, nil
+					}
+				}
+				return true, nil
+			})
+		}); err != nil {
+			return nil, fmt.Errorf("failed to get image with name or id %s: %w", nameOrID, err)
+		}
+		if result != nil {
+			break
 		}
-		return true, nil
-	}); err != nil {
-		return nil, fmt.Errorf("failed to get image with name or id %s: %w", nameOrID, err)
 	}
 
+	if result == nil && len(owners) > 0 {
+		return nil, fmt.Errorf("failed to find image with name or id %s, visibility '%s' and owners %v", nameOrID, imageVisibility, owners)
+	}
 	if result == nil {
 		return nil, fmt.Errorf("failed to find image with name or id %s and visibility '%s'", nameOrID, imageVisibility)
 	}
@@ -384,20 +1571,47 @@ func (o *OpenstackClient) GetImage(nameOrID, imageVisibility string) (*images.Im
 	return result, nil
 }
 
-// GetNetwork returns network details
-func (o *OpenstackClient) GetNetwork(nameOrID string) (*networks.Network, error) {
+// isExcludedImage returns true if any of the image properties matches one of the
+// excluded properties. Property values are compared as strings.
+func (o *OpenstackClient) isExcludedImage(img images.Image) bool {
+	for key, excluded := range o.excludeImageProperties {
+		if value, ok := img.Properties[key]; ok && fmt.Sprint(value) == excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNetwork returns network details. Networks are cached for resource_cache_ttl
+// seconds.
+func (o *OpenstackClient) GetNetwork(ctx context.Context, nameOrID string) (*networks.Network, error) {
+	if network, ok := o.networkCache.get(nameOrID); ok {
+		return &network, nil
+	}
+	network, err := o.getNetwork(ctx, nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	o.networkCache.set(nameOrID, *network)
+	return network, nil
+}
+
+func (o *OpenstackClient) getNetwork(ctx context.Context, nameOrID string) (*networks.Network, error) {
 	var net *networks.Network
 	var err error
 
 	if isUUID(nameOrID) {
-		net, err = networks.Get(o.network, nameOrID).Extract()
+		err = o.withRetry(ctx, func() (err error) {
+			net, err = networks.Get(withContext(ctx, o.network), nameOrID).Extract()
+			return err
+		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to get network: %w", err)
 		}
 		return net, nil
 	}
 
-	if err := networks.List(o.network, nil).EachPage(func(page pagination.Page) (bool, error) {
+	if err := networks.List(withContext(ctx, o.network), nil).EachPage(func(page pagination.Page) (bool, error) {
 		netResults, err := networks.ExtractNetworks(page)
 		if err != nil {
 			return false, fmt.Errorf("failed to extract networks: %w", err)
@@ -422,8 +1636,414 @@ func (o *OpenstackClient) GetNetwork(nameOrID string) (*networks.Network, error)
 	return net, nil
 }
 
-func (o *OpenstackClient) StopServer(nameOrID string) error {
-	srv, err := o.GetServer(nameOrID)
+// GetSubnet returns subnet details
+func (o *OpenstackClient) GetSubnet(ctx context.Context, id string) (*subnets.Subnet, error) {
+	var subnet *subnets.Subnet
+	err := o.withRetry(ctx, func() (err error) {
+		subnet, err = subnets.Get(withContext(ctx, o.network), id).Extract()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subnet: %w", err)
+	}
+	return subnet, nil
+}
+
+// GetPort returns port details
+func (o *OpenstackClient) GetPort(ctx context.Context, id string) (*ports.Port, error) {
+	var port *ports.Port
+	err := o.withRetry(ctx, func() (err error) {
+		port, err = ports.Get(withContext(ctx, o.network), id).Extract()
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(gophercloud.ErrDefault404); ok {
+			return nil, fmt.Errorf("port %s not found", id)
+		}
+		return nil, fmt.Errorf("failed to get port: %w", err)
+	}
+	return port, nil
+}
+
+// ListServerFloatingIPs returns the floating IP addresses associated with the ports of a
+// server, as reported by neutron.
+func (o *OpenstackClient) ListServerFloatingIPs(ctx context.Context, serverID string) ([]string, error) {
+	portPages, err := ports.List(withContext(ctx, o.network), ports.ListOpts{DeviceID: serverID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports: %w", err)
+	}
+	serverPorts, err := ports.ExtractPorts(portPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract ports: %w", err)
+	}
+
+	ret := []string{}
+	for _, port := range serverPorts {
+		fipPages, err := floatingips.List(withContext(ctx, o.network), floatingips.ListOpts{PortID: port.ID}).AllPages()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list floating IPs: %w", err)
+		}
+		fips, err := floatingips.ExtractFloatingIPs(fipPages)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract floating IPs: %w", err)
+		}
+		for _, fip := range fips {
+			ret = append(ret, fip.FloatingIP)
+		}
+	}
+	return ret, nil
+}
+
+// AssociateFloatingIP allocates a floating IP from the given external network, and
+// associates it with the first port of the server that has an IPv4 address. The
+// floating IP is tagged like the other auxiliary resources of the pool, so it is
+// removed by PruneOrphanedResources if it outlives the server. The floating IP
+// address is returned.
+func (o *OpenstackClient) AssociateFloatingIP(ctx context.Context, serverID, networkNameOrID, poolID string) (string, error) {
+	extNet, err := o.GetNetwork(ctx, networkNameOrID)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve floating IP network %s: %w", networkNameOrID, err)
+	}
+
+	var serverPorts []ports.Port
+	if err := o.withRetry(ctx, func() error {
+		portPages, err := ports.List(withContext(ctx, o.network), ports.ListOpts{DeviceID: serverID}).AllPages()
+		if err != nil {
+			return err
+		}
+		serverPorts, err = ports.ExtractPorts(portPages)
+		return err
+	}); err != nil {
+		return "", fmt.Errorf("failed to list ports: %w", err)
+	}
+
+	var portID, fixedIP string
+	for _, port := range serverPorts {
+		for _, ip := range port.FixedIPs {
+			if addr := net.ParseIP(ip.IPAddress); addr != nil && addr.To4() != nil {
+				portID, fixedIP = port.ID, ip.IPAddress
+				break
+			}
+		}
+		if portID != "" {
+			break
+		}
+	}
+	if portID == "" {
+		return "", fmt.Errorf("server %s has no port with an IPv4 address", serverID)
+	}
+
+	fip, err := floatingips.Create(withContext(ctx, o.network), floatingips.CreateOpts{
+		Description:       "Managed by garm",
+		FloatingNetworkID: extNet.ID,
+		PortID:            portID,
+		FixedIP:           fixedIP,
+	}).Extract()
+	if err != nil {
+		return "", fmt.Errorf("failed to create floating IP: %w", err)
+	}
+	if err := o.TagResource(ctx, ResourceFloatingIPs, fip.ID, poolID); err != nil {
+		// An untagged floating IP would not be released with the server.
+		if delErr := ignoreNotFound(floatingips.Delete(withContext(context.WithoutCancel(ctx), o.network), fip.ID).ExtractErr()); delErr != nil {
+			log.Printf("failed to delete floating IP %s: %s", fip.ID, delErr)
+		}
+		return "", err
+	}
+	return fip.FloatingIP, nil
+}
+
+// CreatePortOpts are the options of a port created for a server.
+type CreatePortOpts struct {
+	NetworkID string
+	// SubnetID is the subnet the fixed IP is requested from. If empty, neutron picks
+	// the subnet the fixed IP belongs to.
+	SubnetID string
+	FixedIP  string
+	// SecurityGroups are the IDs of the security groups of the port. Nova only sets the
+	// security groups of ports it creates itself.
+	SecurityGroups []string
+	// DNSNameservers are handed to the server by the neutron DHCP agent, instead of the
+	// nameservers of the subnet.
+	DNSNameservers []string
+}
+
+// CreatePort creates a port for a server. The port is tagged, so it is removed by
+// PruneOrphanedResources if it is left behind.
+func (o *OpenstackClient) CreatePort(ctx context.Context, opts CreatePortOpts, poolID string) (*ports.Port, error) {
+	portOpts := ports.CreateOpts{
+		NetworkID:   opts.NetworkID,
+		Description: "Managed by garm",
+	}
+	switch {
+	case opts.FixedIP != "" && opts.SubnetID != "":
+		portOpts.FixedIPs = []ports.IP{{SubnetID: opts.SubnetID, IPAddress: opts.FixedIP}}
+	case opts.FixedIP != "":
+		portOpts.FixedIPs = []map[string]string{{"ip_address": opts.FixedIP}}
+	}
+	if len(opts.SecurityGroups) > 0 {
+		portOpts.SecurityGroups = &opts.SecurityGroups
+	}
+	var createOpts ports.CreateOptsBuilder = portOpts
+	if dhcpOpts := dnsServerDHCPOpts(opts.DNSNameservers); len(dhcpOpts) > 0 {
+		createOpts = extradhcpopts.CreateOptsExt{
+			CreateOptsBuilder: portOpts,
+			ExtraDHCPOpts:     dhcpOpts,
+		}
+	}
+
+	port, err := ports.Create(withContext(ctx, o.network), createOpts).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create port: %w", err)
+	}
+	if err := o.TagResource(ctx, ResourcePorts, port.ID, poolID); err != nil {
+		// An untagged port would not be pruned if we fail to remove it later.
+		if delErr := o.DeletePort(context.WithoutCancel(ctx), port.ID); delErr != nil {
+			log.Printf("failed to delete port %s: %s", port.ID, delErr)
+		}
+		return nil, err
+	}
+	return port, nil
+}
+
+// dnsServerDHCPOpts returns the extra DHCP options that set the DNS nameservers of a
+// port. IPv4 and IPv6 nameservers are handed out by different DHCP options.
+func dnsServerDHCPOpts(dnsNameservers []string) []extradhcpopts.CreateExtraDHCPOpt {
+	var v4, v6 []string
+	for _, nameserver := range dnsNameservers {
+		ip := net.ParseIP(nameserver)
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() != nil:
+			v4 = append(v4, nameserver)
+		default:
+			v6 = append(v6, nameserver)
+		}
+	}
+
+	var opts []extradhcpopts.CreateExtraDHCPOpt
+	if len(v4) > 0 {
+		opts = append(opts, extradhcpopts.CreateExtraDHCPOpt{
+			OptName:   "dns-server",
+			OptValue:  strings.Join(v4, ","),
+			IPVersion: gophercloud.IPv4,
+		})
+	}
+	if len(v6) > 0 {
+		opts = append(opts, extradhcpopts.CreateExtraDHCPOpt{
+			OptName:   "dns-server",
+			OptValue:  strings.Join(v6, ","),
+			IPVersion: gophercloud.IPv6,
+		})
+	}
+	return opts
+}
+
+// DeletePort removes a port. Ports that are already gone are ignored.
+func (o *OpenstackClient) DeletePort(ctx context.Context, id string) error {
+	if err := ignoreNotFound(ports.Delete(withContext(ctx, o.network), id).ExtractErr()); err != nil {
+		return fmt.Errorf("failed to delete port %s: %w", id, err)
+	}
+	return nil
+}
+
+// ReleaseFloatingIP removes the floating IPs that were allocated by AssociateFloatingIP
+// for the server. Floating IPs that were associated with the server by someone else
+// are left alone.
+func (o *OpenstackClient) ReleaseFloatingIP(ctx context.Context, serverID string) error {
+	var serverPorts []ports.Port
+	if err := o.withRetry(ctx, func() error {
+		portPages, err := ports.List(withContext(ctx, o.network), ports.ListOpts{DeviceID: serverID}).AllPages()
+		if err != nil {
+			return err
+		}
+		serverPorts, err = ports.ExtractPorts(portPages)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to list ports: %w", err)
+	}
+
+	controllerTag := controllerIDTagName + "=" + o.controllerID
+	for _, port := range serverPorts {
+		var fips []floatingips.FloatingIP
+		if err := o.withRetry(ctx, func() error {
+			fipPages, err := floatingips.List(withContext(ctx, o.network), floatingips.ListOpts{PortID: port.ID, Tags: controllerTag}).AllPages()
+			if err != nil {
+				return err
+			}
+			fips, err = floatingips.ExtractFloatingIPs(fipPages)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to list floating IPs: %w", err)
+		}
+		for _, fip := range fips {
+			if err := o.withRetry(ctx, func() error {
+				return ignoreNotFound(floatingips.Delete(withContext(ctx, o.network), fip.ID).ExtractErr())
+			}); err != nil {
+				return fmt.Errorf("failed to delete floating IP %s: %w", fip.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// currentProjectID returns the ID of the project we are scoped to, if known.
+func (o *OpenstackClient) currentProjectID() string {
+	if o.network == nil || o.network.ProviderClient == nil {
+		return ""
+	}
+	result, ok := o.network.GetAuthResult().(tokens.CreateResult)
+	if !ok {
+		return ""
+	}
+	project, err := result.ExtractProject()
+	if err != nil || project == nil {
+		return ""
+	}
+	return project.ID
+}
+
+// GetDefaultSecurityGroup returns the "default" security group of the current project.
+func (o *OpenstackClient) GetDefaultSecurityGroup(ctx context.Context) (*groups.SecGroup, error) {
+	opts := groups.ListOpts{
+		Name:      "default",
+		ProjectID: o.currentProjectID(),
+	}
+	pages, err := groups.List(withContext(ctx, o.network), opts).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list security groups: %w", err)
+	}
+	results, err := groups.ExtractGroups(pages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract security groups: %w", err)
+	}
+
+	switch len(results) {
+	case 0:
+		return nil, fmt.Errorf("failed to find default security group")
+	case 1:
+		return &results[0], nil
+	default:
+		return nil, fmt.Errorf("multiple default security groups found; manual intervention required")
+	}
+}
+
+// ResolveSecurityGroups returns the IDs of the given security groups. Names are looked up
+// in the current project, and must match exactly one security group. nova resolves
+// names across all the projects that are visible to us, which may pick the wrong group.
+func (o *OpenstackClient) ResolveSecurityGroups(ctx context.Context, namesOrIDs []string) ([]string, error) {
+	projectID := o.currentProjectID()
+	ret := make([]string, 0, len(namesOrIDs))
+	for _, nameOrID := range namesOrIDs {
+		id := nameOrID
+		if !isUUID(nameOrID) {
+			// Without the project, the name could match security groups shared with
+			// us by other projects.
+			if projectID == "" {
+				return nil, fmt.Errorf("failed to resolve security group %s: the current project is unknown; use the ID instead", nameOrID)
+			}
+			var results []groups.SecGroup
+			if err := o.withRetry(ctx, func() error {
+				pages, err := groups.List(withContext(ctx, o.network), groups.ListOpts{
+					Name:      nameOrID,
+					ProjectID: projectID,
+				}).AllPages()
+				if err != nil {
+					return err
+				}
+				results, err = groups.ExtractGroups(pages)
+				return err
+			}); err != nil {
+				return nil, fmt.Errorf("failed to list security groups: %w", err)
+			}
+
+			switch len(results) {
+			case 0:
+				return nil, fmt.Errorf("failed to find security group %s", nameOrID)
+			case 1:
+				id = results[0].ID
+			default:
+				return nil, fmt.Errorf("security group name %s is ambiguous, %d security groups found; use the ID instead", nameOrID, len(results))
+			}
+		}
+		if !slices.Contains(ret, id) {
+			ret = append(ret, id)
+		}
+	}
+	return ret, nil
+}
+
+// checkQuotaLimit returns an error if requesting the given amount of a resource would
+// exceed the quota. A negative limit means the resource is unlimited.
+func checkQuotaLimit(resource string, limit, inUse, reserved, requested int) error {
+	if limit < 0 {
+		return nil
+	}
+	if available := limit - inUse - reserved; requested > available {
+		return fmt.Errorf("insufficient %s quota: requested %d, available %d (limit %d)", resource, requested, available, limit)
+	}
+	return nil
+}
+
+// CheckQuota verifies that the current project has enough quota left to create a server
+// with the given flavor. If volumes is larger than 0, the volume quota is checked as
+// well, for the given number of volumes with a total size of volumeSize GB.
+func (o *OpenstackClient) CheckQuota(ctx context.Context, flavor flavors.Flavor, volumes, volumeSize int) error {
+	projectID := o.currentProjectID()
+	if projectID == "" {
+		return fmt.Errorf("failed to determine the current project ID")
+	}
+
+	computeQuota, err := quotasets.GetDetail(withContext(ctx, o.compute), projectID).Extract()
+	if err != nil {
+		return fmt.Errorf("failed to get compute quota: %w", err)
+	}
+	for _, check := range []struct {
+		resource  string
+		detail    quotasets.QuotaDetail
+		requested int
+	}{
+		{"instances", computeQuota.Instances, 1},
+		{"cores", computeQuota.Cores, flavor.VCPUs},
+		{"ram", computeQuota.RAM, flavor.RAM},
+	} {
+		if err := checkQuotaLimit(check.resource, check.detail.Limit, check.detail.InUse, check.detail.Reserved, check.requested); err != nil {
+			return err
+		}
+	}
+
+	networkQuota, err := quotas.GetDetail(withContext(ctx, o.network), projectID).Extract()
+	if err != nil {
+		return fmt.Errorf("failed to get network quota: %w", err)
+	}
+	if err := checkQuotaLimit("port", networkQuota.Port.Limit, networkQuota.Port.Used, networkQuota.Port.Reserved, 1); err != nil {
+		return err
+	}
+
+	if volumes <= 0 {
+		return nil
+	}
+	if o.volume == nil {
+		return ErrVolumeServiceUnavailable
+	}
+	volumeQuota, err := volumequotas.GetUsage(withContext(ctx, o.volume), projectID).Extract()
+	if err != nil {
+		return fmt.Errorf("failed to get volume quota: %w", err)
+	}
+	if err := checkQuotaLimit("volumes", volumeQuota.Volumes.Limit, volumeQuota.Volumes.InUse, volumeQuota.Volumes.Reserved, volumes); err != nil {
+		return err
+	}
+	if err := checkQuotaLimit("gigabytes", volumeQuota.Gigabytes.Limit, volumeQuota.Gigabytes.InUse, volumeQuota.Gigabytes.Reserved, volumeSize); err != nil {
+		return err
+	}
+	return nil
+}
+
+// StopServer stops the server. Nova attempts a clean shutdown of the guest, before powering
+// it off. When force is set, we also wait for the server to reach SHUTOFF state and return
+// an error if it doesn't in a timely manner, instead of assuming the stop will succeed.
+func (o *OpenstackClient) StopServer(ctx context.Context, nameOrID string, force bool) error {
+	srv, err := o.GetServer(ctx, nameOrID)
 	if err != nil {
 		return fmt.Errorf("failed to get server: %w", err)
 	}
@@ -432,15 +2052,31 @@ func (o *OpenstackClient) StopServer(nameOrID string) error {
 		return nil
 	}
 
-	if err := startstop.Stop(o.compute, srv.ID).ExtractErr(); err != nil {
+	if err := startstop.Stop(withContext(ctx, o.compute), srv.ID).ExtractErr(); err != nil {
+		// nova returns 501 if the driver can not stop the server. A 409 only means the
+		// server can not be stopped in its current state, which may change.
+		var statusErr gophercloud.StatusCodeError
+		if gErrors.As(err, &statusErr) && statusErr.GetStatusCode() == http.StatusNotImplemented {
+			if o.ignoreUnsupportedStop {
+				log.Printf("server %s can not be stopped, ignoring: %s", srv.ID, err)
+				return nil
+			}
+			return fmt.Errorf("%w: %s: %w", ErrStopNotSupported, srv.ID, err)
+		}
 		return fmt.Errorf("failed to stop server: %w", err)
 	}
 
+	if force {
+		if err := o.waitForStatus(ctx, srv.ID, "SHUTOFF", forceStopTimeout); err != nil {
+			return fmt.Errorf("server did not reach SHUTOFF state after %d seconds: %w", forceStopTimeout, err)
+		}
+	}
+
 	return nil
 }
 
-func (o *OpenstackClient) StartServer(nameOrID string) error {
-	srv, err := o.GetServer(nameOrID)
+func (o *OpenstackClient) StartServer(ctx context.Context, nameOrID string) error {
+	srv, err := o.GetServer(ctx, nameOrID)
 	if err != nil {
 		return fmt.Errorf("failed to get server: %w", err)
 	}
@@ -449,13 +2085,293 @@ func (o *OpenstackClient) StartServer(nameOrID string) error {
 		return nil
 	}
 
-	if err := startstop.Start(o.compute, srv.ID).ExtractErr(); err != nil {
+	if err := startstop.Start(withContext(ctx, o.compute), srv.ID).ExtractErr(); err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 
 	return nil
 }
 
+// RebootServer reboots a server, and waits for it to become ACTIVE again. A soft reboot
+// asks the guest OS to restart, while a hard reboot power cycles the server.
+func (o *OpenstackClient) RebootServer(ctx context.Context, nameOrID string, hard bool) error {
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+
+	method := servers.SoftReboot
+	if hard {
+		method = servers.HardReboot
+	}
+	if err := servers.Reboot(withContext(ctx, o.compute), srv.ID, servers.RebootOpts{Type: method}).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to reboot server: %w", err)
+	}
+
+	// nova sets the status to REBOOT or HARD_REBOOT before accepting the request, so
+	// the server is not reported as ACTIVE until the reboot is done.
+	timeout := o.activeTimeout(ctx)
+	if err := o.waitForStatus(ctx, srv.ID, "ACTIVE", timeout); err != nil {
+		return fmt.Errorf("server did not reach ACTIVE state after %d seconds: %w", timeout, err)
+	}
+	return nil
+}
+
+// GetConsoleOutput returns the last length lines of the console log of a server. The whole
+// log is returned if length is not larger than 0.
+func (o *OpenstackClient) GetConsoleOutput(ctx context.Context, nameOrID string, length int) (string, error) {
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get server: %w", err)
+	}
+
+	opts := servers.ShowConsoleOutputOpts{}
+	if length > 0 {
+		opts.Length = length
+	}
+	output, err := servers.ShowConsoleOutput(withContext(ctx, o.compute), srv.ID, opts).Extract()
+	if err != nil {
+		// nova returns 501 if the driver can not get the console log, and 404 if the
+		// server does not have one.
+		var statusErr gophercloud.StatusCodeError
+		if gErrors.As(err, &statusErr) {
+			switch statusErr.GetStatusCode() {
+			case http.StatusNotImplemented, http.StatusNotFound:
+				return "", fmt.Errorf("%w: %s", ErrConsoleOutputNotSupported, srv.ID)
+			case http.StatusConflict:
+				return "", fmt.Errorf("server %s is in state %s, and its console output is not available yet", srv.ID, srv.Status)
+			}
+		}
+		return "", fmt.Errorf("failed to get console output: %w", err)
+	}
+	return output, nil
+}
+
+// GetServerPassword returns the admin password of a server, which the guest encrypts with
+// the public key of the key pair the server was created with, and posts to the metadata
+// service. This is how cloudbase-init sets the password of Windows runners. The password
+// is decrypted with privateKeyPEM, the RSA private key of that key pair, in PEM format.
+func (o *OpenstackClient) GetServerPassword(ctx context.Context, nameOrID, privateKeyPEM string) (string, error) {
+	privateKey, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return "", err
+	}
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get server: %w", err)
+	}
+	if srv.KeyName == "" {
+		return "", fmt.Errorf("%w: server %s was created without a key pair", ErrPasswordNotAvailable, srv.ID)
+	}
+
+	var result servers.GetPasswordResult
+	if err := o.withRetry(ctx, func() error {
+		result = servers.GetPassword(withContext(ctx, o.compute), srv.ID)
+		return result.Err
+	}); err != nil {
+		return "", fmt.Errorf("failed to get password: %w", err)
+	}
+	// Without a key, the password is returned as is, still encrypted.
+	encrypted, err := result.ExtractPassword(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get password: %w", err)
+	}
+	if encrypted == "" {
+		return "", fmt.Errorf("%w: server %s has not set its password yet", ErrPasswordNotAvailable, srv.ID)
+	}
+	password, err := result.ExtractPassword(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt password, the private key may not belong to key pair %s: %w", srv.KeyName, err)
+	}
+	return password, nil
+}
+
+// parseRSAPrivateKey parses an RSA private key in PKCS #1 or PKCS #8 PEM format. Nova
+// encrypts passwords with RSA, so other types of keys can not decrypt them.
+func parseRSAPrivateKey(privateKeyPEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key: no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is a %T, not an RSA key", key)
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %q, expected an RSA key in PEM format", block.Type)
+}
+
+// ResizeServer changes the flavor of a server, and waits for nova to finish the resize.
+// If confirm is set, the resize is confirmed right away. Otherwise, the server is left in
+// VERIFY_RESIZE, so the resize can be verified and then confirmed, or reverted using
+// RevertResizeServer. Resizing to the current flavor of the server does nothing.
+func (o *OpenstackClient) ResizeServer(ctx context.Context, nameOrID, flavorNameOrID string, confirm bool) error {
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	flavor, err := o.GetFlavor(ctx, flavorNameOrID)
+	if err != nil {
+		return fmt.Errorf("failed to get flavor: %w", err)
+	}
+
+	// Starting with microversion 2.47, nova returns the flavor details instead of
+	// the flavor ID.
+	if id, ok := srv.Flavor["id"].(string); ok && id == flavor.ID {
+		return nil
+	}
+	if name, ok := srv.Flavor["original_name"].(string); ok && name == flavor.Name {
+		return nil
+	}
+
+	if err := servers.Resize(withContext(ctx, o.compute), srv.ID, servers.ResizeOpts{FlavorRef: flavor.ID}).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to resize server: %w", err)
+	}
+	timeout := o.activeTimeout(ctx)
+	if err := o.waitForStatus(ctx, srv.ID, "VERIFY_RESIZE", timeout); err != nil {
+		return fmt.Errorf("server did not reach VERIFY_RESIZE state after %d seconds: %w", timeout, err)
+	}
+	if !confirm {
+		return nil
+	}
+
+	if err := servers.ConfirmResize(withContext(ctx, o.compute), srv.ID).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to confirm resize: %w", err)
+	}
+	if err := o.waitForStatus(ctx, srv.ID, "ACTIVE", timeout); err != nil {
+		return fmt.Errorf("server did not reach ACTIVE state after %d seconds: %w", timeout, err)
+	}
+	return nil
+}
+
+// RevertResizeServer reverts a resize that was not confirmed, and waits for the server
+// to become ACTIVE again with its previous flavor.
+func (o *OpenstackClient) RevertResizeServer(ctx context.Context, nameOrID string) error {
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	if srv.Status != "VERIFY_RESIZE" {
+		return fmt.Errorf("server %s has no resize to revert, its status is %s", srv.ID, srv.Status)
+	}
+
+	if err := servers.RevertResize(withContext(ctx, o.compute), srv.ID).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to revert resize: %w", err)
+	}
+	timeout := o.activeTimeout(ctx)
+	if err := o.waitForStatus(ctx, srv.ID, "ACTIVE", timeout); err != nil {
+		return fmt.Errorf("server did not reach ACTIVE state after %d seconds: %w", timeout, err)
+	}
+	return nil
+}
+
+// ShelveServer shelves a server, freeing up the resources it consumes on the hypervisor
+// while retaining its disks for a faster restart.
+func (o *OpenstackClient) ShelveServer(ctx context.Context, nameOrID string) error {
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+
+	if srv.Status == "SHELVED" || srv.Status == "SHELVED_OFFLOADED" {
+		return nil
+	}
+
+	if err := shelveunshelve.Shelve(withContext(ctx, o.compute), srv.ID).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to shelve server: %w", err)
+	}
+
+	return nil
+}
+
+// UnshelveServer restores a previously shelved server.
+func (o *OpenstackClient) UnshelveServer(ctx context.Context, nameOrID string) error {
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+
+	if srv.Status != "SHELVED" && srv.Status != "SHELVED_OFFLOADED" {
+		return nil
+	}
+
+	if err := shelveunshelve.Unshelve(withContext(ctx, o.compute), srv.ID, shelveunshelve.UnshelveOpts{}).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to unshelve server: %w", err)
+	}
+
+	return nil
+}
+
+// RescueServer boots a server from the rescue image, with its root disk attached as a
+// secondary disk, so logs can be recovered from a runner that no longer boots. The image
+// the server was created from is used if no rescue image is given. Servers booted from
+// volume have no image, and nova falls back to its default rescue image.
+func (o *OpenstackClient) RescueServer(ctx context.Context, nameOrID, rescueImage string) error {
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+
+	if srv.Status == "RESCUE" {
+		return nil
+	}
+
+	opts := rescueunrescue.RescueOpts{}
+	if rescueImage != "" {
+		image, err := o.GetImage(ctx, rescueImage, "", nil)
+		if err != nil {
+			return fmt.Errorf("failed to get rescue image: %w", err)
+		}
+		opts.RescueImageRef = image.ID
+	} else if id, ok := srv.Image["id"].(string); ok {
+		opts.RescueImageRef = id
+	}
+
+	if err := rescueunrescue.Rescue(withContext(ctx, o.compute), srv.ID, opts).Err; err != nil {
+		return fmt.Errorf("failed to rescue server: %w", err)
+	}
+	timeout := o.activeTimeout(ctx)
+	if err := o.waitForStatus(ctx, srv.ID, "RESCUE", timeout); err != nil {
+		return fmt.Errorf("server did not reach RESCUE state after %d seconds: %w", timeout, err)
+	}
+	return nil
+}
+
+// UnrescueServer boots a rescued server from its own root disk again, and waits for it
+// to become ACTIVE.
+func (o *OpenstackClient) UnrescueServer(ctx context.Context, nameOrID string) error {
+	srv, err := o.GetServer(ctx, nameOrID)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+
+	if srv.Status != "RESCUE" {
+		return nil
+	}
+
+	if err := rescueunrescue.Unrescue(withContext(ctx, o.compute), srv.ID).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to unrescue server: %w", err)
+	}
+	timeout := o.activeTimeout(ctx)
+	if err := o.waitForStatus(ctx, srv.ID, "ACTIVE", timeout); err != nil {
+		return fmt.Errorf("server did not reach ACTIVE state after %d seconds: %w", timeout, err)
+	}
+	return nil
+}
+
 func isUUID(data string) bool {
 	if _, err := uuid.Parse(data); err == nil {
 		return true
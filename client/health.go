@@ -0,0 +1,70 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/limits"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/pagination"
+)
+
+// The types of the services checked by CheckServices.
+const (
+	ServiceCompute = "compute"
+	ServiceImage   = "image"
+	ServiceNetwork = "network"
+	ServiceVolume  = "volume"
+)
+
+// firstPage stops paging after the first page.
+func firstPage(pagination.Page) (bool, error) {
+	return false, nil
+}
+
+// CheckServices makes a cheap request to each of the services used by the client, and
+// returns the error of every service that failed, keyed by the service type. Services
+// that answered are not in the map.
+func (o *OpenstackClient) CheckServices(ctx context.Context) map[string]error {
+	checks := map[string]func() error{
+		ServiceCompute: func() error {
+			return limits.Get(withContext(ctx, o.compute), nil).Err
+		},
+		ServiceImage: func() error {
+			return images.List(withContext(ctx, o.image), images.ListOpts{Limit: 1}).EachPage(firstPage)
+		},
+		ServiceNetwork: func() error {
+			return networks.List(withContext(ctx, o.network), networks.ListOpts{Limit: 1}).EachPage(firstPage)
+		},
+		ServiceVolume: func() error {
+			if o.volume == nil {
+				return ErrVolumeServiceUnavailable
+			}
+			return volumes.List(withContext(ctx, o.volume), volumes.ListOpts{Limit: 1}).EachPage(firstPage)
+		},
+	}
+
+	failed := map[string]error{}
+	for service, check := range checks {
+		if err := check(); err != nil {
+			failed[service] = fmt.Errorf("failed to reach %s service: %w", service, err)
+		}
+	}
+	return failed
+}
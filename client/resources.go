@@ -0,0 +1,451 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/servergroups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/attributestags"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// Neutron resource types that can be tagged.
+const (
+	ResourcePorts          = "ports"
+	ResourceFloatingIPs    = "floatingips"
+	ResourceSecurityGroups = "security-groups"
+)
+
+// defaultPruneGracePeriod is the time during which new auxiliary resources are not
+// pruned, if prune_grace_period is not set.
+const defaultPruneGracePeriod = time.Hour
+
+// resourceTags returns the tags set on the auxiliary resources created for a pool.
+func (o *OpenstackClient) resourceTags(poolID string) []string {
+	return []string{
+		poolIDTagName + "=" + poolID,
+		controllerIDTagName + "=" + o.controllerID,
+	}
+}
+
+// TagResource tags a neutron resource created for a pool, so it can be found and
+// removed by PruneOrphanedResources once the pool has no servers left that use it.
+func (o *OpenstackClient) TagResource(ctx context.Context, resourceType, id, poolID string) error {
+	opts := attributestags.ReplaceAllOpts{
+		Tags: o.resourceTags(poolID),
+	}
+	if _, err := attributestags.ReplaceAll(withContext(ctx, o.network), resourceType, id, opts).Extract(); err != nil {
+		return fmt.Errorf("failed to tag %s %s: %w", resourceType, id, err)
+	}
+	return nil
+}
+
+// serverGroupName returns the name of the server group of a pool. Nova server groups
+// can not be tagged, so the name is used to find the groups of this controller.
+func (o *OpenstackClient) serverGroupName(poolID string) string {
+	return fmt.Sprintf("garm-%s-%s", o.controllerID, poolID)
+}
+
+// newServerGroupName returns the name of a new server group of the pool. Nova does not
+// report when a server group was created, so the time is added to the name.
+func (o *OpenstackClient) newServerGroupName(poolID string) string {
+	return fmt.Sprintf("%s.%d", o.serverGroupName(poolID), time.Now().UnixNano())
+}
+
+// parseServerGroupName returns the pool and the creation time of a server group of this
+// controller. Groups created before the time was added to the name have a zero time.
+func (o *OpenstackClient) parseServerGroupName(name string) (poolID string, createdAt time.Time, ok bool) {
+	poolID, ok = strings.CutPrefix(name, o.serverGroupName(""))
+	if !ok {
+		return "", time.Time{}, false
+	}
+	if idx := strings.LastIndex(poolID, "."); idx != -1 {
+		nanos, err := strconv.ParseInt(poolID[idx+1:], 10, 64)
+		if err == nil {
+			return poolID[:idx], time.Unix(0, nanos), true
+		}
+	}
+	return poolID, time.Time{}, true
+}
+
+// EnsureServerGroup returns the server group of the pool, and creates it with the given
+// policy if it does not exist yet.
+func (o *OpenstackClient) EnsureServerGroup(ctx context.Context, poolID, policy string) (*servergroups.ServerGroup, error) {
+	group, err := o.findServerGroup(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	if group != nil {
+		return group, nil
+	}
+
+	name := o.newServerGroupName(poolID)
+	created, err := servergroups.Create(withContext(ctx, o.compute), servergroups.CreateOpts{
+		Name:   name,
+		Policy: policy,
+	}).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server group %s: %w", name, err)
+	}
+
+	// Another runner of the same pool may have created a group at the same time.
+	// Everyone agrees on the oldest group, and the others are removed.
+	group, err = o.findServerGroup(ctx, poolID)
+	if err != nil {
+		// The group has no members yet, and a later call creates a new one.
+		if delErr := ignoreNotFound(servergroups.Delete(withContext(ctx, o.compute), created.ID).ExtractErr()); delErr != nil {
+			log.Printf("failed to delete server group %s: %s", created.ID, delErr)
+		}
+		return nil, err
+	}
+	if group != nil && group.ID != created.ID {
+		if err := ignoreNotFound(servergroups.Delete(withContext(ctx, o.compute), created.ID).ExtractErr()); err != nil {
+			return nil, fmt.Errorf("failed to delete duplicate server group %s: %w", created.ID, err)
+		}
+		return group, nil
+	}
+	return created, nil
+}
+
+// poolServerGroups returns the server groups of this controller, keyed by pool. The
+// groups of a pool are sorted from oldest to newest, and by ID if they were created at
+// the same time.
+func (o *OpenstackClient) poolServerGroups(ctx context.Context) (map[string][]servergroups.ServerGroup, error) {
+	var results []servergroups.ServerGroup
+	err := o.withRetry(ctx, func() error {
+		pages, err := servergroups.List(withContext(ctx, o.compute), nil).AllPages()
+		if err != nil {
+			return err
+		}
+		results, err = servergroups.ExtractServerGroups(pages)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list server groups: %w", err)
+	}
+
+	ret := map[string][]servergroups.ServerGroup{}
+	for _, group := range results {
+		if poolID, _, ok := o.parseServerGroupName(group.Name); ok {
+			ret[poolID] = append(ret[poolID], group)
+		}
+	}
+	for _, groups := range ret {
+		slices.SortFunc(groups, func(a, b servergroups.ServerGroup) int {
+			_, aCreated, _ := o.parseServerGroupName(a.Name)
+			_, bCreated, _ := o.parseServerGroupName(b.Name)
+			if c := aCreated.Compare(bCreated); c != 0 {
+				return c
+			}
+			return strings.Compare(a.ID, b.ID)
+		})
+	}
+	return ret, nil
+}
+
+// findServerGroup returns the oldest server group of the pool, or nil if there is none.
+func (o *OpenstackClient) findServerGroup(ctx context.Context, poolID string) (*servergroups.ServerGroup, error) {
+	groups, err := o.poolServerGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups[poolID]) == 0 {
+		return nil, nil
+	}
+	return &groups[poolID][0], nil
+}
+
+// SecurityGroupRule is a rule of the managed security group of a pool.
+type SecurityGroupRule struct {
+	Direction      string
+	EtherType      string
+	Protocol       string
+	PortRangeMin   int
+	PortRangeMax   int
+	RemoteIPPrefix string
+	RemoteGroupID  string
+}
+
+// securityGroupRuleFromNeutron converts a neutron rule, so it can be compared to the
+// rules we want. Neutron reports a missing protocol as an empty string.
+func securityGroupRuleFromNeutron(rule rules.SecGroupRule) SecurityGroupRule {
+	return SecurityGroupRule{
+		Direction:      rule.Direction,
+		EtherType:      rule.EtherType,
+		Protocol:       rule.Protocol,
+		PortRangeMin:   rule.PortRangeMin,
+		PortRangeMax:   rule.PortRangeMax,
+		RemoteIPPrefix: rule.RemoteIPPrefix,
+		RemoteGroupID:  rule.RemoteGroupID,
+	}
+}
+
+// securityGroupName returns the name of the managed security group of a pool.
+func (o *OpenstackClient) securityGroupName(poolID string) string {
+	return fmt.Sprintf("garm-%s-%s", o.controllerID, poolID)
+}
+
+// EnsureSecurityGroup returns the managed security group of the pool, and creates it
+// if it does not exist yet. The rules of the group are reconciled with the given rules.
+// Missing rules are added, and rules that are not in the list are removed, including
+// the egress rules neutron adds to new groups.
+func (o *OpenstackClient) EnsureSecurityGroup(ctx context.Context, poolID string, wanted []SecurityGroupRule) (*groups.SecGroup, error) {
+	name := o.securityGroupName(poolID)
+	group, err := o.findSecurityGroup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		created, err := groups.Create(withContext(ctx, o.network), groups.CreateOpts{
+			Name:        name,
+			Description: "Managed by garm",
+		}).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create security group %s: %w", name, err)
+		}
+		if err := o.TagResource(ctx, ResourceSecurityGroups, created.ID, poolID); err != nil {
+			// An untagged group is never found or pruned, so it would be left behind.
+			if delErr := ignoreNotFound(groups.Delete(withContext(ctx, o.network), created.ID).ExtractErr()); delErr != nil {
+				log.Printf("failed to delete untagged security group %s: %s", created.ID, delErr)
+			}
+			return nil, err
+		}
+
+		// Another runner of the same pool may have created the group at the same time.
+		// Everyone agrees on the oldest group, and the others are removed.
+		group, err = o.findSecurityGroup(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if group == nil {
+			return nil, fmt.Errorf("security group %s not found after creating it", name)
+		}
+		if group.ID != created.ID {
+			if err := ignoreNotFound(groups.Delete(withContext(ctx, o.network), created.ID).ExtractErr()); err != nil {
+				return nil, fmt.Errorf("failed to delete duplicate security group %s: %w", created.ID, err)
+			}
+		}
+	}
+
+	if err := o.reconcileSecurityGroupRules(ctx, group, wanted); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// reconcileSecurityGroupRules makes the rules of the group match the wanted rules.
+func (o *OpenstackClient) reconcileSecurityGroupRules(ctx context.Context, group *groups.SecGroup, wanted []SecurityGroupRule) error {
+	existing := map[SecurityGroupRule]bool{}
+	for _, rule := range group.Rules {
+		converted := securityGroupRuleFromNeutron(rule)
+		if slices.Contains(wanted, converted) && !existing[converted] {
+			existing[converted] = true
+			continue
+		}
+		if err := ignoreNotFound(rules.Delete(withContext(ctx, o.network), rule.ID).ExtractErr()); err != nil {
+			return fmt.Errorf("failed to delete rule %s of security group %s: %w", rule.ID, group.ID, err)
+		}
+	}
+
+	for _, rule := range wanted {
+		if existing[rule] {
+			continue
+		}
+		_, err := rules.Create(withContext(ctx, o.network), rules.CreateOpts{
+			SecGroupID:     group.ID,
+			Direction:      rules.RuleDirection(rule.Direction),
+			EtherType:      rules.RuleEtherType(rule.EtherType),
+			Protocol:       rules.RuleProtocol(rule.Protocol),
+			PortRangeMin:   rule.PortRangeMin,
+			PortRangeMax:   rule.PortRangeMax,
+			RemoteIPPrefix: rule.RemoteIPPrefix,
+			RemoteGroupID:  rule.RemoteGroupID,
+		}).Extract()
+		// A concurrent create of a runner of the same pool may have added the rule.
+		if _, ok := err.(gophercloud.ErrDefault409); ok {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add rule to security group %s: %w", group.ID, err)
+		}
+		existing[rule] = true
+	}
+	return nil
+}
+
+// findSecurityGroup returns the managed security group with the given name, or nil if
+// it does not exist. If there are multiple groups with the same name, the oldest one is
+// returned, or the one with the lowest ID if they were created at the same time.
+func (o *OpenstackClient) findSecurityGroup(ctx context.Context, name string) (*groups.SecGroup, error) {
+	var found *groups.SecGroup
+	err := o.withRetry(ctx, func() error {
+		found = nil
+		pages, err := groups.List(withContext(ctx, o.network), groups.ListOpts{
+			Name: name,
+			Tags: controllerIDTagName + "=" + o.controllerID,
+		}).AllPages()
+		if err != nil {
+			return err
+		}
+		results, err := groups.ExtractGroups(pages)
+		if err != nil {
+			return err
+		}
+		for idx := range results {
+			if found == nil || results[idx].CreatedAt.Before(found.CreatedAt) ||
+				(results[idx].CreatedAt.Equal(found.CreatedAt) && results[idx].ID < found.ID) {
+				found = &results[idx]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list security groups: %w", err)
+	}
+	return found, nil
+}
+
+// poolIDFromTags returns the pool ID set in the tags of a resource.
+func poolIDFromTags(tags []string) string {
+	for _, tag := range tags {
+		if poolID, found := strings.CutPrefix(tag, poolIDTagName+"="); found {
+			return poolID
+		}
+	}
+	return ""
+}
+
+// inPruneGracePeriod returns true if a resource was created too recently to be pruned.
+// A runner that is being created may not be using it yet. Resources without a creation
+// time are old enough.
+func (o *OpenstackClient) inPruneGracePeriod(createdAt time.Time) bool {
+	return !createdAt.IsZero() && time.Since(createdAt) < o.pruneGracePeriod
+}
+
+// PruneOrphanedResources removes the tagged auxiliary resources of this controller that
+// are no longer associated with a server. Ports are removed if the server they were
+// attached to is gone, floating IPs are removed if they are not associated with a
+// port, and security groups and server groups are removed once their pool has no
+// servers left. Duplicate server groups are removed as well. Resources are kept during
+// the prune grace period after they were created.
+func (o *OpenstackClient) PruneOrphanedResources(ctx context.Context) error {
+	srvResults, err := o.ListServersWithTags(ctx, []string{controllerIDTagName + "=" + o.controllerID})
+	if err != nil {
+		return fmt.Errorf("failed to list servers: %w", err)
+	}
+	serverIDs := map[string]bool{}
+	pools := map[string]bool{}
+	for _, srv := range srvResults {
+		serverIDs[srv.ID] = true
+		if srv.Tags != nil {
+			pools[poolIDFromTags(*srv.Tags)] = true
+		}
+	}
+
+	controllerTag := controllerIDTagName + "=" + o.controllerID
+
+	portPages, err := ports.List(withContext(ctx, o.network), ports.ListOpts{Tags: controllerTag}).AllPages()
+	if err != nil {
+		return fmt.Errorf("failed to list ports: %w", err)
+	}
+	portResults, err := ports.ExtractPorts(portPages)
+	if err != nil {
+		return fmt.Errorf("failed to extract ports: %w", err)
+	}
+	for _, port := range portResults {
+		if serverIDs[port.DeviceID] || o.inPruneGracePeriod(port.CreatedAt) {
+			continue
+		}
+		if err := ignoreNotFound(ports.Delete(withContext(ctx, o.network), port.ID).ExtractErr()); err != nil {
+			return fmt.Errorf("failed to delete port %s: %w", port.ID, err)
+		}
+	}
+
+	fipPages, err := floatingips.List(withContext(ctx, o.network), floatingips.ListOpts{Tags: controllerTag}).AllPages()
+	if err != nil {
+		return fmt.Errorf("failed to list floating IPs: %w", err)
+	}
+	fips, err := floatingips.ExtractFloatingIPs(fipPages)
+	if err != nil {
+		return fmt.Errorf("failed to extract floating IPs: %w", err)
+	}
+	for _, fip := range fips {
+		if fip.PortID != "" || o.inPruneGracePeriod(fip.CreatedAt) {
+			continue
+		}
+		if err := ignoreNotFound(floatingips.Delete(withContext(ctx, o.network), fip.ID).ExtractErr()); err != nil {
+			return fmt.Errorf("failed to delete floating IP %s: %w", fip.ID, err)
+		}
+	}
+
+	groupPages, err := groups.List(withContext(ctx, o.network), groups.ListOpts{Tags: controllerTag}).AllPages()
+	if err != nil {
+		return fmt.Errorf("failed to list security groups: %w", err)
+	}
+	groupResults, err := groups.ExtractGroups(groupPages)
+	if err != nil {
+		return fmt.Errorf("failed to extract security groups: %w", err)
+	}
+	for _, group := range groupResults {
+		if pools[poolIDFromTags(group.Tags)] || o.inPruneGracePeriod(group.CreatedAt) {
+			continue
+		}
+		if err := ignoreNotFound(groups.Delete(withContext(ctx, o.network), group.ID).ExtractErr()); err != nil {
+			return fmt.Errorf("failed to delete security group %s: %w", group.ID, err)
+		}
+	}
+
+	// The oldest server group of a pool that has servers is kept, along with any other
+	// group that has members. Duplicates are only removed after the grace period, as a
+	// runner may have picked one of them before the others were created.
+	srvGroups, err := o.poolServerGroups(ctx)
+	if err != nil {
+		return err
+	}
+	for poolID, groups := range srvGroups {
+		for idx, group := range groups {
+			if _, createdAt, _ := o.parseServerGroupName(group.Name); o.inPruneGracePeriod(createdAt) {
+				continue
+			}
+			if pools[poolID] && (idx == 0 || len(group.Members) > 0) {
+				continue
+			}
+			if err := ignoreNotFound(servergroups.Delete(withContext(ctx, o.compute), group.ID).ExtractErr()); err != nil {
+				return fmt.Errorf("failed to delete server group %s: %w", group.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ignoreNotFound returns nil if the error is a 404, as the resource is already gone.
+func ignoreNotFound(err error) error {
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,417 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/testhelper"
+	"github.com/gophercloud/gophercloud/testhelper/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneOrphanedResources(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	// Resources created within the grace period are kept, as a runner that is being
+	// created may be about to use them.
+	recent := time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)
+	old := time.Now().UTC().Add(-2 * time.Hour).Format(time.RFC3339)
+	recentNanos := time.Now().Add(-time.Minute).UnixNano()
+	oldNanos := time.Now().Add(-2 * time.Hour).UnixNano()
+
+	var mux sync.Mutex
+	var deleted []string
+	handleDelete := func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "DELETE")
+		mux.Lock()
+		deleted = append(deleted, r.URL.Path)
+		mux.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	// One server is left, in pool-1.
+	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"servers": [{
+			"id": "server-1",
+			"name": "runner-1",
+			"status": "ACTIVE",
+			"tags": ["garm-controller-id=my-controller-id", "garm-pool-id=pool-1"]
+		}]}`)
+	})
+	testhelper.Mux.HandleFunc("/ports", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		testhelper.TestFormValues(t, r, map[string]string{"tags": "garm-controller-id=my-controller-id"})
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"ports": [
+			{"id": "port-used", "device_id": "server-1"},
+			{"id": "port-orphaned", "device_id": "server-2", "created_at": %q},
+			{"id": "port-detached", "device_id": ""},
+			{"id": "port-new", "device_id": "", "created_at": %q}
+		]}`, old, recent)
+	})
+	testhelper.Mux.HandleFunc("/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		testhelper.TestFormValues(t, r, map[string]string{"tags": "garm-controller-id=my-controller-id"})
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"floatingips": [
+			{"id": "fip-used", "port_id": "port-used"},
+			{"id": "fip-orphaned", "port_id": null, "created_at": %q},
+			{"id": "fip-new", "port_id": null, "created_at": %q}
+		]}`, old, recent)
+	})
+	testhelper.Mux.HandleFunc("/security-groups", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		testhelper.TestFormValues(t, r, map[string]string{"tags": "garm-controller-id=my-controller-id"})
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"security_groups": [
+			{"id": "sg-used", "tags": ["garm-controller-id=my-controller-id", "garm-pool-id=pool-1"]},
+			{"id": "sg-orphaned", "tags": ["garm-controller-id=my-controller-id", "garm-pool-id=pool-2"]},
+			{"id": "sg-new", "tags": ["garm-controller-id=my-controller-id", "garm-pool-id=pool-3"], "created_at": %q}
+		]}`, recent)
+	})
+	testhelper.Mux.HandleFunc("/os-server-groups", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"server_groups": [
+			{"id": "group-used", "name": "garm-my-controller-id-pool-1"},
+			{"id": "group-duplicate", "name": "garm-my-controller-id-pool-1.%d"},
+			{"id": "group-duplicate-members", "name": "garm-my-controller-id-pool-1.%d", "members": ["server-1"]},
+			{"id": "group-duplicate-new", "name": "garm-my-controller-id-pool-1.%d"},
+			{"id": "group-orphaned", "name": "garm-my-controller-id-pool-2"},
+			{"id": "group-new", "name": "garm-my-controller-id-pool-3.%d"},
+			{"id": "group-other", "name": "not-managed-by-garm"}
+		]}`, oldNanos, oldNanos, recentNanos, recentNanos)
+	})
+	for _, path := range []string{"/ports/port-orphaned", "/ports/port-detached", "/floatingips/fip-orphaned", "/security-groups/sg-orphaned", "/os-server-groups/group-orphaned", "/os-server-groups/group-duplicate"} {
+		testhelper.Mux.HandleFunc(path, handleDelete)
+	}
+
+	osClient := NewTestOpenStackClient(client.ServiceClient(), "my-controller-id")
+	osClient.pruneGracePeriod = time.Hour
+	err := osClient.PruneOrphanedResources(context.Background())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/ports/port-orphaned", "/ports/port-detached", "/floatingips/fip-orphaned", "/security-groups/sg-orphaned", "/os-server-groups/group-orphaned", "/os-server-groups/group-duplicate"}, deleted)
+}
+
+func TestTagResource(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	testhelper.Mux.HandleFunc("/security-groups/sg-1/tags", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "PUT")
+		testhelper.TestJSONRequest(t, r, `{"tags": ["garm-pool-id=pool-1", "garm-controller-id=my-controller-id"]}`)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"tags": ["garm-pool-id=pool-1", "garm-controller-id=my-controller-id"]}`)
+	})
+
+	osClient := NewTestOpenStackClient(client.ServiceClient(), "my-controller-id")
+	err := osClient.TagResource(context.Background(), ResourceSecurityGroups, "sg-1", "pool-1")
+	assert.NoError(t, err)
+}
+
+func TestEnsureServerGroup(t *testing.T) {
+	type group struct {
+		id   string
+		name string
+	}
+	tests := []struct {
+		name string
+		// existing are the groups of the pool that exist before the call.
+		existing []group
+		// concurrent is a group created by someone else at the same time.
+		concurrent    *group
+		expectedID    string
+		expectCreate  bool
+		expectDeleted bool
+	}{
+		{
+			name: "existing groups",
+			existing: []group{
+				{id: "a-group", name: "garm-my-controller-id-my-pool.300"},
+				{id: "b-group", name: "garm-my-controller-id-my-pool.200"},
+			},
+			expectedID: "b-group",
+		},
+		{
+			name: "group created before the time was added to the name",
+			existing: []group{
+				{id: "a-group", name: "garm-my-controller-id-my-pool.200"},
+				{id: "z-group", name: "garm-my-controller-id-my-pool"},
+			},
+			expectedID: "z-group",
+		},
+		{
+			name:         "new group",
+			expectedID:   "c-group",
+			expectCreate: true,
+		},
+		{
+			name:          "older group created concurrently",
+			concurrent:    &group{id: "z-group", name: "garm-my-controller-id-my-pool.100"},
+			expectedID:    "z-group",
+			expectCreate:  true,
+			expectDeleted: true,
+		},
+		{
+			name:         "newer group created concurrently",
+			concurrent:   &group{id: "a-group", name: fmt.Sprintf("garm-my-controller-id-my-pool.%d", time.Now().Add(time.Hour).UnixNano())},
+			expectedID:   "c-group",
+			expectCreate: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+
+			var mux sync.Mutex
+			groups := append([]group{{id: "0-group", name: "garm-my-controller-id-other-pool"}}, tt.existing...)
+			var created, deleted bool
+			testhelper.Mux.HandleFunc("/os-server-groups", func(w http.ResponseWriter, r *http.Request) {
+				mux.Lock()
+				defer mux.Unlock()
+				w.Header().Add("Content-Type", "application/json")
+				if r.Method == "POST" {
+					var req struct {
+						ServerGroup struct {
+							Name   string `json:"name"`
+							Policy string `json:"policy"`
+						} `json:"server_group"`
+					}
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+					assert.Regexp(t, `^garm-my-controller-id-my-pool\.[0-9]+$`, req.ServerGroup.Name)
+					assert.Equal(t, "soft-anti-affinity", req.ServerGroup.Policy)
+					created = true
+					groups = append(groups, group{id: "c-group", name: req.ServerGroup.Name})
+					if tt.concurrent != nil {
+						groups = append(groups, *tt.concurrent)
+					}
+					fmt.Fprintf(w, `{"server_group": {"id": "c-group", "name": %q, "policy": "soft-anti-affinity"}}`, req.ServerGroup.Name)
+					return
+				}
+				testhelper.TestMethod(t, r, "GET")
+				var items []string
+				for _, group := range groups {
+					items = append(items, fmt.Sprintf(`{"id": %q, "name": %q}`, group.id, group.name))
+				}
+				fmt.Fprintf(w, `{"server_groups": [%s]}`, strings.Join(items, ","))
+			})
+			testhelper.Mux.HandleFunc("/os-server-groups/c-group", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "DELETE")
+				deleted = true
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			osClient := NewTestOpenStackClient(client.ServiceClient(), "my-controller-id")
+			group, err := osClient.EnsureServerGroup(context.Background(), "my-pool", "soft-anti-affinity")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedID, group.ID)
+			assert.Equal(t, tt.expectCreate, created)
+			assert.Equal(t, tt.expectDeleted, deleted)
+		})
+	}
+}
+
+func TestEnsureServerGroupLookupFailure(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	var created, deleted atomic.Bool
+	testhelper.Mux.HandleFunc("/os-server-groups", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		if r.Method == "POST" {
+			created.Store(true)
+			fmt.Fprintf(w, `{"server_group": {"id": "c-group", "name": "garm-my-controller-id-my-pool.100", "policy": "soft-anti-affinity"}}`)
+			return
+		}
+		testhelper.TestMethod(t, r, "GET")
+		if created.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"server_groups": []}`)
+	})
+	testhelper.Mux.HandleFunc("/os-server-groups/c-group", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "DELETE")
+		deleted.Store(true)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	osClient := NewTestOpenStackClient(client.ServiceClient(), "my-controller-id")
+	_, err := osClient.EnsureServerGroup(context.Background(), "my-pool", "soft-anti-affinity")
+	assert.ErrorContains(t, err, "failed to list server groups")
+	assert.True(t, deleted.Load(), "new server group was not deleted")
+}
+
+func TestEnsureSecurityGroupTagFailure(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	var deleted atomic.Bool
+	testhelper.Mux.HandleFunc("/security-groups", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"security_group": {"id": "sg-1", "name": "garm-my-controller-id-my-pool"}}`)
+			return
+		}
+		testhelper.TestMethod(t, r, "GET")
+		fmt.Fprintf(w, `{"security_groups": []}`)
+	})
+	testhelper.Mux.HandleFunc("/security-groups/sg-1/tags", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "PUT")
+		w.WriteHeader(http.StatusForbidden)
+	})
+	testhelper.Mux.HandleFunc("/security-groups/sg-1", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "DELETE")
+		deleted.Store(true)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	osClient := NewTestOpenStackClient(client.ServiceClient(), "my-controller-id")
+	_, err := osClient.EnsureSecurityGroup(context.Background(), "my-pool", nil)
+	assert.ErrorContains(t, err, "failed to tag security-groups sg-1")
+	assert.True(t, deleted.Load(), "untagged security group was not deleted")
+}
+
+func TestEnsureSecurityGroup(t *testing.T) {
+	ssh := SecurityGroupRule{Direction: "ingress", EtherType: "IPv4", Protocol: "tcp", PortRangeMin: 22, PortRangeMax: 22, RemoteIPPrefix: "10.0.0.0/8"}
+	https := SecurityGroupRule{Direction: "ingress", EtherType: "IPv4", Protocol: "tcp", PortRangeMin: 443, PortRangeMax: 443, RemoteIPPrefix: "0.0.0.0/0"}
+
+	tests := []struct {
+		name string
+		// existingRules are the rules of the group, or nil if the group does not exist.
+		existingRules   []string
+		expectCreate    bool
+		expectDeleted   []string
+		expectedCreated []string
+	}{
+		{
+			name:         "new group",
+			expectCreate: true,
+			// Neutron adds egress rules to new groups.
+			expectDeleted: []string{"/security-group-rules/egress-v4", "/security-group-rules/egress-v6"},
+			expectedCreated: []string{
+				`{"security_group_rule": {"security_group_id": "sg-1", "direction": "ingress", "ethertype": "IPv4", "protocol": "tcp", "port_range_min": 22, "port_range_max": 22, "remote_ip_prefix": "10.0.0.0/8"}}`,
+				`{"security_group_rule": {"security_group_id": "sg-1", "direction": "ingress", "ethertype": "IPv4", "protocol": "tcp", "port_range_min": 443, "port_range_max": 443, "remote_ip_prefix": "0.0.0.0/0"}}`,
+			},
+		},
+		{
+			name: "rules changed",
+			existingRules: []string{
+				`{"id": "rule-ssh", "direction": "ingress", "ethertype": "IPv4", "protocol": "tcp", "port_range_min": 22, "port_range_max": 22, "remote_ip_prefix": "10.0.0.0/8", "remote_group_id": null}`,
+				`{"id": "rule-http", "direction": "ingress", "ethertype": "IPv4", "protocol": "tcp", "port_range_min": 80, "port_range_max": 80, "remote_ip_prefix": "0.0.0.0/0", "remote_group_id": null}`,
+			},
+			expectDeleted: []string{"/security-group-rules/rule-http"},
+			expectedCreated: []string{
+				`{"security_group_rule": {"security_group_id": "sg-1", "direction": "ingress", "ethertype": "IPv4", "protocol": "tcp", "port_range_min": 443, "port_range_max": 443, "remote_ip_prefix": "0.0.0.0/0"}}`,
+			},
+		},
+		{
+			name: "rules unchanged",
+			existingRules: []string{
+				`{"id": "rule-ssh", "direction": "ingress", "ethertype": "IPv4", "protocol": "tcp", "port_range_min": 22, "port_range_max": 22, "remote_ip_prefix": "10.0.0.0/8", "remote_group_id": null}`,
+				`{"id": "rule-https", "direction": "ingress", "ethertype": "IPv4", "protocol": "tcp", "port_range_min": 443, "port_range_max": 443, "remote_ip_prefix": "0.0.0.0/0", "remote_group_id": null}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+
+			var mux sync.Mutex
+			groupRules := tt.existingRules
+			exists := tt.existingRules != nil
+			var created bool
+			var deleted, createdRules []string
+			testhelper.Mux.HandleFunc("/security-groups", func(w http.ResponseWriter, r *http.Request) {
+				mux.Lock()
+				defer mux.Unlock()
+				w.Header().Add("Content-Type", "application/json")
+				if r.Method == "POST" {
+					testhelper.TestJSONRequest(t, r, `{"security_group": {"name": "garm-my-controller-id-my-pool", "description": "Managed by garm"}}`)
+					created = true
+					exists = true
+					w.WriteHeader(http.StatusCreated)
+					groupRules = []string{
+						`{"id": "egress-v4", "direction": "egress", "ethertype": "IPv4"}`,
+						`{"id": "egress-v6", "direction": "egress", "ethertype": "IPv6"}`,
+					}
+					fmt.Fprintf(w, `{"security_group": {"id": "sg-1", "name": "garm-my-controller-id-my-pool", "security_group_rules": [%s]}}`, strings.Join(groupRules, ","))
+					return
+				}
+				testhelper.TestMethod(t, r, "GET")
+				testhelper.TestFormValues(t, r, map[string]string{"name": "garm-my-controller-id-my-pool", "tags": "garm-controller-id=my-controller-id"})
+				if !exists {
+					fmt.Fprintf(w, `{"security_groups": []}`)
+					return
+				}
+				fmt.Fprintf(w, `{"security_groups": [{"id": "sg-1", "name": "garm-my-controller-id-my-pool", "security_group_rules": [%s]}]}`, strings.Join(groupRules, ","))
+			})
+			testhelper.Mux.HandleFunc("/security-groups/sg-1/tags", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "PUT")
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"tags": ["garm-pool-id=my-pool", "garm-controller-id=my-controller-id"]}`)
+			})
+			testhelper.Mux.HandleFunc("/security-group-rules/", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "DELETE")
+				mux.Lock()
+				deleted = append(deleted, r.URL.Path)
+				mux.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+			})
+			testhelper.Mux.HandleFunc("/security-group-rules", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				body, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				mux.Lock()
+				createdRules = append(createdRules, string(body))
+				mux.Unlock()
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprintf(w, `{"security_group_rule": {"id": "new-rule"}}`)
+			})
+
+			osClient := NewTestOpenStackClient(client.ServiceClient(), "my-controller-id")
+			group, err := osClient.EnsureSecurityGroup(context.Background(), "my-pool", []SecurityGroupRule{ssh, https})
+			assert.NoError(t, err)
+			assert.Equal(t, "sg-1", group.ID)
+			assert.Equal(t, tt.expectCreate, created)
+			assert.ElementsMatch(t, tt.expectDeleted, deleted)
+			assert.Len(t, createdRules, len(tt.expectedCreated))
+			for idx, expected := range tt.expectedCreated {
+				if idx < len(createdRules) {
+					assert.JSONEq(t, expected, createdRules[idx])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	gErrors "errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = 500 * time.Millisecond
+	// maxRetryDelay caps the backoff between two attempts.
+	maxRetryDelay = 30 * time.Second
+)
+
+// isTransientError returns true if the API returned a status code that indicates
+// the request may succeed if retried.
+func isTransientError(err error) bool {
+	var statusErr gophercloud.StatusCodeError
+	if !gErrors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.GetStatusCode() {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRejectedError returns true if the API returned a status code that means the request
+// was turned away before it was processed. Requests that create resources are only
+// retried on these errors, as a gateway error or timeout may hide a request that was
+// accepted, and retrying it would create the resource twice.
+func isRejectedError(err error) bool {
+	var statusErr gophercloud.StatusCodeError
+	if !gErrors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.GetStatusCode() {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// backoffDelay returns the delay before the next attempt. The delay doubles with every
+// attempt, and a random jitter of up to half the delay is subtracted from it, so that
+// clients that failed at the same time do not retry at the same time.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay -= time.Duration(rand.Int64N(half + 1))
+	}
+	return delay
+}
+
+// withRetry calls fn until it succeeds, returns an error that is not transient, or
+// the maximum number of attempts is reached. It must only be used for requests that
+// can safely be sent twice, like GET, PUT and DELETE requests.
+func (o *OpenstackClient) withRetry(ctx context.Context, fn func() error) error {
+	return o.withRetryIf(ctx, isTransientError, fn)
+}
+
+// withCreateRetry is like withRetry, for requests that create a resource. They are only
+// retried if the API rejected them.
+func (o *OpenstackClient) withCreateRetry(ctx context.Context, fn func() error) error {
+	return o.withRetryIf(ctx, isRejectedError, fn)
+}
+
+func (o *OpenstackClient) withRetryIf(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err) || attempt >= o.retryMaxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped retrying: %w", ctx.Err())
+		case <-time.After(backoffDelay(o.retryBaseDelay, attempt-1)):
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/testhelper"
+	"github.com/gophercloud/gophercloud/testhelper/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNetworkRetriesTransientErrors(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	var calls atomic.Int32
+	testhelper.Mux.HandleFunc("/networks/f5c3ef24-3a1b-4a1b-8b4a-8a3b1d1e5a10", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"network": {"id": "f5c3ef24-3a1b-4a1b-8b4a-8a3b1d1e5a10", "name": "test-network"}}`)
+	})
+
+	osClient := &OpenstackClient{
+		network:          client.ServiceClient(),
+		retryMaxAttempts: 3,
+		retryBaseDelay:   time.Millisecond,
+	}
+
+	net, err := osClient.GetNetwork(context.Background(), "f5c3ef24-3a1b-4a1b-8b4a-8a3b1d1e5a10")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-network", net.Name)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantCalls int32
+	}{
+		{
+			name:      "too many requests",
+			status:    http.StatusTooManyRequests,
+			wantCalls: 3,
+		},
+		{
+			name:      "gateway timeout",
+			status:    http.StatusGatewayTimeout,
+			wantCalls: 3,
+		},
+		{
+			name:      "not found is not retried",
+			status:    http.StatusNotFound,
+			wantCalls: 1,
+		},
+		{
+			name:      "internal server error is not retried",
+			status:    http.StatusInternalServerError,
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+
+			var calls atomic.Int32
+			testhelper.Mux.HandleFunc("/flavors/flavor-uuid", func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.status)
+			})
+
+			osClient := &OpenstackClient{
+				compute:          client.ServiceClient(),
+				retryMaxAttempts: 3,
+				retryBaseDelay:   time.Millisecond,
+			}
+			err := osClient.withRetry(context.Background(), func() error {
+				_, err := osClient.compute.Get(osClient.compute.ServiceURL("flavors", "flavor-uuid"), nil, nil)
+				return err
+			})
+			assert.Error(t, err)
+			assert.Equal(t, tt.wantCalls, calls.Load())
+		})
+	}
+}
+
+func TestWithCreateRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantCalls int32
+	}{
+		{
+			name:      "too many requests",
+			status:    http.StatusTooManyRequests,
+			wantCalls: 3,
+		},
+		{
+			name:      "service unavailable",
+			status:    http.StatusServiceUnavailable,
+			wantCalls: 3,
+		},
+		{
+			name:      "bad gateway is not retried",
+			status:    http.StatusBadGateway,
+			wantCalls: 1,
+		},
+		{
+			name:      "gateway timeout is not retried",
+			status:    http.StatusGatewayTimeout,
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+
+			var calls atomic.Int32
+			testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				calls.Add(1)
+				w.WriteHeader(tt.status)
+			})
+
+			osClient := &OpenstackClient{
+				compute:          client.ServiceClient(),
+				retryMaxAttempts: 3,
+				retryBaseDelay:   time.Millisecond,
+			}
+			err := osClient.withCreateRetry(context.Background(), func() error {
+				_, err := osClient.compute.Post(osClient.compute.ServiceURL("servers"), map[string]interface{}{}, nil, nil)
+				return err
+			})
+			assert.Error(t, err)
+			assert.Equal(t, tt.wantCalls, calls.Load())
+		})
+	}
+}
+
+func TestWithRetryCancelled(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	var calls atomic.Int32
+	testhelper.Mux.HandleFunc("/flavors/flavor-uuid", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	osClient := &OpenstackClient{
+		compute:          client.ServiceClient(),
+		retryMaxAttempts: 5,
+		retryBaseDelay:   time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := osClient.withRetry(ctx, func() error {
+		_, err := osClient.compute.Get(osClient.compute.ServiceURL("flavors", "flavor-uuid"), nil, nil)
+		return err
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := backoffDelay(100*time.Millisecond, attempt)
+		upper := 100 * time.Millisecond << attempt
+		if upper > maxRetryDelay {
+			upper = maxRetryDelay
+		}
+		assert.LessOrEqual(t, delay, upper)
+		assert.GreaterOrEqual(t, delay, upper/2)
+	}
+}
@@ -17,7 +17,11 @@
 
 package client
 
-import "github.com/gophercloud/gophercloud"
+import (
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
 
 func NewTestOpenStackClient(mockClient *gophercloud.ServiceClient, controllerID string) *OpenstackClient {
 	return &OpenstackClient{
@@ -26,5 +30,23 @@ func NewTestOpenStackClient(mockClient *gophercloud.ServiceClient, controllerID
 		network:      mockClient,
 		volume:       mockClient,
 		controllerID: controllerID,
+		// Tests do not need to wait a second between status checks.
+		pollInterval: time.Millisecond,
 	}
 }
+
+// SetAsyncCreate sets whether or not the create functions wait for the server to
+// become ACTIVE.
+func (o *OpenstackClient) SetAsyncCreate(asyncCreate bool) {
+	o.asyncCreate = asyncCreate
+}
+
+// SetControllerInstanceID sets the controller instance ID used to tag and list servers.
+func (o *OpenstackClient) SetControllerInstanceID(controllerInstanceID string) {
+	o.controllerInstanceID = controllerInstanceID
+}
+
+// SetErrorGracePeriod sets the number of seconds servers in ERROR state are kept.
+func (o *OpenstackClient) SetErrorGracePeriod(secs int) {
+	o.errorGracePeriod = secs
+}
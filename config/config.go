@@ -17,12 +17,65 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
 
 	"github.com/BurntSushi/toml"
+	"github.com/google/uuid"
 	"github.com/gophercloud/utils/openstack/clientconfig"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	// NameCollisionError returns an error when multiple servers share the same name.
+	NameCollisionError = "error"
+	// NameCollisionPickNewest picks the most recently created server when multiple
+	// servers share the same name.
+	NameCollisionPickNewest = "pick-newest"
+	// NameCollisionPickByPoolTag picks the only server that has a pool ID tag set,
+	// when multiple servers share the same name.
+	NameCollisionPickByPoolTag = "pick-by-pool-tag"
+)
+
+const (
+	// RegionSelectionRoundRobin cycles through the configured regions.
+	RegionSelectionRoundRobin = "round-robin"
+	// RegionSelectionRandom picks a random region for every runner.
+	RegionSelectionRandom = "random"
+)
+
+// Nova server group policies.
+const (
+	ServerGroupAffinity         = "affinity"
+	ServerGroupAntiAffinity     = "anti-affinity"
+	ServerGroupSoftAffinity     = "soft-affinity"
+	ServerGroupSoftAntiAffinity = "soft-anti-affinity"
+)
+
+// Nova keypair types.
+const (
+	KeyPairTypeSSH  = "ssh"
+	KeyPairTypeX509 = "x509"
+)
+
+// Architecture check modes.
+const (
+	ArchitectureCheckDisabled = "disabled"
+	ArchitectureCheckWarn     = "warn"
+	ArchitectureCheckEnforce  = "enforce"
+)
+
+// IP address families.
+const (
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// computeMicroversionRegex matches the nova 2.x microversions.
+var computeMicroversionRegex = regexp.MustCompile(`^2\.[0-9]+$`)
+
 // NewConfig returns a new Config
 func NewConfig(cfgFile string) (*Config, error) {
 	var config Config
@@ -41,7 +94,7 @@ type Config struct {
 	// must be defined in the supplied clouds.yaml file supplied in the
 	// credentials field.
 	//
-	// This option can NOT be overwritten using extra_specs.
+	// This option can be overwritten using extra_specs.
 	Cloud string `toml:"cloud"`
 
 	// Credentials holds information needed to connect to a cloud.
@@ -49,6 +102,93 @@ type Config struct {
 	// This option can NOT be overwritten using extra_specs.
 	Credentials Credentials `toml:"credentials"`
 
+	// Region is the name of the region that should be used. If empty, we use the
+	// region_name defined for the cloud in clouds.yaml, secure.yaml or the profile
+	// in clouds-public.yaml, or OS_REGION_NAME. One of the two must be set.
+	//
+	// This option can be overwritten using extra_specs.
+	Region string `toml:"region"`
+
+	// Regions is a list of regions of the cloud in which runners will be created. When
+	// set, every runner is created in one of these regions, picked according to the
+	// region selection strategy, and instances are looked up in all of them. If region
+	// is not set, the first region in this list is used as the default region.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	Regions []string `toml:"regions"`
+
+	// RegionSelectionStrategy determines how a region is picked out of the configured
+	// regions. Possible values are "round-robin" and "random". If empty, we default to
+	// "round-robin". The position of the round robin is kept in the state_dir, as garm
+	// runs the provider once for every runner.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	RegionSelectionStrategy string `toml:"region_selection_strategy"`
+
+	// StateDir is the directory in which the provider keeps the state it needs across
+	// runs, like the clouds and regions that pools target through extra_specs, so the
+	// runners created in them can be found again, and the resource cache. If empty,
+	// we default to garm-provider-openstack in $XDG_STATE_HOME, or in ~/.local/state.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	StateDir string `toml:"state_dir"`
+
+	// ValidateAuthOnStartup indicates whether or not to request a token from keystone
+	// when the client is created, so that invalid credentials are reported right away
+	// instead of failing every operation later on.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ValidateAuthOnStartup bool `toml:"validate_auth_on_startup"`
+
+	// ProjectDomainName overrides the project domain set for the cloud in clouds.yaml.
+	// This allows pools of different providers to use projects in different keystone
+	// domains, without duplicating the clouds.yaml entries. Requires keystone v3.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ProjectDomainName string `toml:"project_domain_name"`
+
+	// UserDomainName overrides the user domain set for the cloud in clouds.yaml.
+	// Requires keystone v3.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	UserDomainName string `toml:"user_domain_name"`
+
+	// ComputeMicroversion is the nova API microversion used by the provider. When
+	// NegotiateComputeMicroversion is enabled, this is the highest microversion we
+	// use. If empty, we default to 2.67.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ComputeMicroversion string `toml:"compute_microversion"`
+
+	// NegotiateComputeMicroversion indicates whether or not to query nova for the
+	// highest microversion it supports when the client is created, and use the lower
+	// of that and ComputeMicroversion. If the query fails, ComputeMicroversion is used.
+	// If nova only supports microversions older than MinComputeMicroversion, creating
+	// the client fails.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	NegotiateComputeMicroversion bool `toml:"negotiate_compute_microversion"`
+
+	// VerifyComputeMicroversion indicates whether or not to check, when the client is
+	// created, that nova supports the compute microversion we use. If it does not, or
+	// if the version document of nova can not be fetched, creating the client fails.
+	// On clouds that only support older microversions, ComputeMicroversion can be
+	// used to pin a lower microversion. Features that need a newer microversion are
+	// then degraded: below 2.52, the tags of a runner are set right after it is
+	// created, instead of in the create request, and below 2.67, setting the volume
+	// type of boot volumes is rejected.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	VerifyComputeMicroversion bool `toml:"verify_compute_microversion"`
+
+	// MinComputeMicroversion is the lowest compute microversion we accept when
+	// VerifyComputeMicroversion or NegotiateComputeMicroversion is enabled. If empty,
+	// we default to 2.26, which is needed to list servers by their tags. Older
+	// microversions are not supported.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	MinComputeMicroversion string `toml:"min_compute_microversion"`
+
 	// DefaultStorageBackend holds the name of the default storage backend
 	// to use. If this is is empty, we will default to whatever is the default
 	// in the cloud.
@@ -56,18 +196,138 @@ type Config struct {
 	// This option can be overwritten using extra_specs.
 	DefaultStorageBackend string `toml:"default_storage_backend"`
 
+	// DefaultRootVolumeType holds the name of the cinder volume type of the root
+	// volume of runners that boot from volume. This allows placing the root disk on
+	// a faster backend than the data volumes. If empty, we fall back to the
+	// DefaultStorageBackend.
+	//
+	// This option can be overwritten using extra_specs.
+	DefaultRootVolumeType string `toml:"default_root_volume_type"`
+
 	// DefaultSecurityGroups holds a list of security group IDs that will be
 	// added by default to runners.
 	//
 	// This option can be overwritten using extra_specs.
 	DefaultSecurityGroups []string `toml:"default_security_groups"`
 
+	// DefaultTags holds a list of tags that will be added to runners, on top of the
+	// tags garm uses to identify the runners of a controller and pool. Tags set in
+	// extra_specs are added to these. The tags garm uses always take precedence.
+	//
+	// This option can be extended using extra_specs.
+	DefaultTags []string `toml:"default_tags"`
+
+	// TagEntityHierarchy enables tagging runners with the garm entity they belong to,
+	// on top of the controller and pool. The enterprise, organization and repository
+	// are read from the URL the runner registers to, and are set as the garm-enterprise,
+	// garm-org and garm-repo tags and metadata keys. Levels that do not apply to the
+	// entity are not set.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	TagEntityHierarchy bool `toml:"tag_entity_hierarchy"`
+
+	// ControllerInstanceID is a UUID that identifies this garm deployment, in case more
+	// than one deployment uses the same controller ID by mistake. If set, runners are
+	// tagged with it, and only the servers that have the tag are listed. Servers
+	// created before it was set can be tagged with the -retag-servers flag.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ControllerInstanceID string `toml:"controller_instance_id"`
+
+	// ResolveDefaultSecurityGroup indicates whether or not to explicitly look up
+	// the "default" security group of the project and apply it to runners, when no
+	// security groups are set in the config or in extra_specs. If this is false, nova
+	// applies the project default on its own.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ResolveDefaultSecurityGroup bool `toml:"resolve_default_security_group"`
+
+	// DefaultFlavors maps an OS type (linux or windows) to the flavor that will be
+	// used for runners of that OS type, when the pool does not specify a flavor.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	DefaultFlavors map[string]string `toml:"default_flavors"`
+
+	// AllowDisabledFlavors indicates whether or not to allow creating runners with
+	// flavors that have been disabled in nova. By default, disabled flavors are
+	// rejected.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	AllowDisabledFlavors bool `toml:"allow_disabled_flavors"`
+
 	// DefaultNetworkID is the default network ID to use when creating a new runner.
 	//
 	// This value is mandatory.
 	// This value can be overwritten by extra_specs.
 	DefaultNetworkID string `toml:"network_id"`
 
+	// PreferredAddressType is the type of address (private or public) that is listed
+	// first when reporting the addresses of a runner to garm. If empty, addresses are
+	// listed in the order in which they are returned by nova.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	PreferredAddressType string `toml:"preferred_address_type"`
+
+	// AddressFamilyPreference is the IP address family (ipv4 or ipv6) garm needs to
+	// reach the runners. Addresses of this family are listed first when reporting the
+	// addresses of a runner to garm. If empty, addresses are not sorted by family.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	AddressFamilyPreference string `toml:"address_family_preference"`
+
+	// AddressFamilyMaxRecreates is the number of times a runner that came up without
+	// an address of the family set in address_family_preference, is deleted and created
+	// again. If the runner still has no such address after that, it is removed and the
+	// create fails. If 0, runners are not checked. This has no effect when async_create
+	// is enabled, as the addresses are not known by the time we return.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	AddressFamilyMaxRecreates int `toml:"address_family_max_recreates"`
+
+	// ImageDownloadRetries is the number of times a runner that went into ERROR state
+	// because its image could not be downloaded to the compute host, is created again.
+	// Image caches that occasionally fail to populate cause this, and a new attempt
+	// usually succeeds. If 0, the create fails right away. This has no effect when
+	// async_create is enabled, as the state of the runner is not known by the time we
+	// return.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ImageDownloadRetries int `toml:"image_download_retries"`
+
+	// ReportFloatingIPs indicates whether or not to query neutron for the floating IPs
+	// associated with the ports of a runner, and report them as public addresses. This
+	// costs extra API calls, but reports floating IPs that were attached after boot.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ReportFloatingIPs bool `toml:"report_floating_ips"`
+
+	// ListWorkers is the number of servers that are looked up in parallel when listing
+	// instances, to find their floating IPs, or the flavor and image names reported by
+	// -dump-instances. Defaults to 10.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ListWorkers int `toml:"list_workers"`
+
+	// ListPageSize is the number of servers requested from nova per page, when listing
+	// servers. Pages are fetched one at a time, and processed as they arrive. When not
+	// set, nova returns up to its configured max_limit servers per page.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ListPageSize int `toml:"list_page_size"`
+
+	// AllocateFloatingIP indicates whether or not to allocate a floating IP from the
+	// FloatingIPNetwork for every runner, once it is ACTIVE. The floating IP is released
+	// when the runner is removed. Can not be combined with AsyncCreate.
+	//
+	// This option can be overwritten using extra_specs.
+	AllocateFloatingIP bool `toml:"allocate_floating_ip"`
+
+	// FloatingIPNetwork is the name or ID of the external network floating IPs are
+	// allocated from, when AllocateFloatingIP is set.
+	//
+	// This option can be overwritten using extra_specs.
+	FloatingIPNetwork string `toml:"floating_ip_network"`
+
 	// BootFromVolume indicates whether or not to boot from a cinder volume.
 	//
 	// This value can be overwritten using extra_specs.
@@ -81,11 +341,56 @@ type Config struct {
 	// This option is ignored if BootFromVolume is set to false.
 	BootDiskSize *int64 `toml:"root_disk_size"`
 
+	// FlavorBootDiskSizes maps a flavor name or ID to the size in GB of the root disk
+	// of runners that boot from volume with that flavor. It is used when no boot disk
+	// size is set in the config or in extra_specs, before the root disk size of the
+	// flavor.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	FlavorBootDiskSizes map[string]int64 `toml:"flavor_boot_disk_sizes"`
+
 	// UseConfigDrive indicates whether to use config drive or not.
 	//
 	// This value can be overwritten using extra_specs.
 	UseConfigDrive bool `toml:"use_config_drive"`
 
+	// DefaultKeyPair is the name of the nova keypair that will be injected into
+	// the runners. Useful when debugging runners that fail to come online.
+	//
+	// This option can be overwritten using extra_specs.
+	DefaultKeyPair string `toml:"default_keypair"`
+
+	// DefaultKeyPairType is the type of the keypair set in DefaultKeyPair. Can be ssh
+	// or x509, which is used by Windows runners. If set, the type of the keypair in nova
+	// must match. If empty, the type is not checked.
+	//
+	// This option can be overwritten using extra_specs.
+	DefaultKeyPairType string `toml:"default_keypair_type"`
+
+	// ArchitectureCheck controls what happens when the architecture garm requests for a
+	// runner, the architecture property of the image and the arch extra spec of the
+	// flavor do not agree. Can be disabled, warn, which only logs the mismatch, or
+	// enforce, which fails the create. If empty, the check is disabled. Checking the
+	// flavors costs an extra API call for every flavor.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ArchitectureCheck string `toml:"architecture_check"`
+
+	// HostnameTemplate is a go template used to set the hostname of Linux runners via
+	// cloud-init. The template can use {{.Name}}, {{.PoolID}}, {{.OSType}} and {{.Suffix}},
+	// which is a short random string. The result is converted to a valid RFC 1123
+	// hostname. If empty, the hostname is set by cloud-init from the server name.
+	//
+	// This option can be overwritten using the hostname extra spec.
+	HostnameTemplate string `toml:"hostname_template"`
+
+	// CopyImageProperties is a list of image properties that will be copied into the
+	// metadata of the server, if they are set on the image. Useful for recording the
+	// provenance of the image, like a build ID or a git sha.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	CopyImageProperties []string `toml:"copy_image_properties"`
+
 	// AllowedImageOwners is a list of image owners that are allowed to be used.
 	// If this is empty, all images are allowed.
 	// If not empty, only images owned by the specified owners are allowed.
@@ -100,6 +405,14 @@ type Config struct {
 	// This value can be overwritten using extra_specs.
 	ImageVisibility string `toml:"image_visibility"`
 
+	// ExcludeImageProperties is a map of image properties and values. When looking up
+	// an image by name, images that have any of these properties set to the given value
+	// are skipped. For example, {deprecated = "true"} skips deprecated images. Images
+	// referenced by ID are never skipped.
+	//
+	// This value can NOT be overwritten using extra_specs.
+	ExcludeImageProperties map[string]string `toml:"exclude_image_properties"`
+
 	// DisableUdatesOnBoot indicates whether to install or update packages on boot during cloud-init.
 	// If set to true `PackageUpgrade` is set to false and `Packages` is set to an empty list in the cloud-init config.
 	//
@@ -112,6 +425,170 @@ type Config struct {
 	//
 	// This value can be overwritten using extra_specs.
 	EnableBootDebug bool `toml:"enable_boot_debug"`
+
+	// ValidateImageDiskFormat enables a pre-check that the disk format of the image
+	// is one of AllowedImageDiskFormats, before attempting to boot from volume. Images
+	// with unexpected disk formats (iso for example) may result in unusable volumes.
+	//
+	// This value can NOT be overwritten using extra_specs.
+	ValidateImageDiskFormat bool `toml:"validate_image_disk_format"`
+
+	// AllowedImageDiskFormats is the list of image disk formats that are accepted
+	// when booting from volume and ValidateImageDiskFormat is enabled. If empty, we
+	// default to "qcow2" and "raw".
+	//
+	// This value can NOT be overwritten using extra_specs.
+	AllowedImageDiskFormats []string `toml:"allowed_image_disk_formats"`
+
+	// AsyncCreate indicates whether or not to return as soon as the create request is
+	// accepted by nova, instead of waiting for the server to become ACTIVE. Servers
+	// created in async mode are tagged with garm-async-create=true and have the time
+	// of the create request set in the garm-created-at metadata key.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	AsyncCreate bool `toml:"async_create"`
+
+	// CreateTimeout is the maximum number of seconds a single create operation may
+	// take, including all retries and waiting for the server to become ACTIVE. If 0,
+	// we default to 120 seconds.
+	//
+	// This option can be overwritten using extra_specs.
+	CreateTimeout int `toml:"create_timeout"`
+
+	// DeleteTimeout is the number of seconds we wait for a deleted server to go
+	// away. Boot from volume servers may need more time, while their root volume
+	// is detached and deleted. If 0, we default to 120 seconds.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	DeleteTimeout int `toml:"delete_timeout"`
+
+	// ErrorServerGracePeriod is the number of seconds servers that went into ERROR state
+	// while being created are kept, so they can be inspected. Kept servers are tagged
+	// with garm-error-at=<unix timestamp>, and are removed by the -cleanup-errored-servers
+	// command once the grace period is over. Deleting a kept server before that, like
+	// garm does with runners that failed to be created, leaves it in place. If 0,
+	// servers in ERROR state are removed right away.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ErrorServerGracePeriod int `toml:"error_server_grace_period"`
+
+	// PruneGracePeriod is the number of seconds after they were created during which
+	// unused ports, floating IPs, security groups and server groups are not pruned, as
+	// a runner that is being created may be about to use them. If 0, we default to
+	// 3600 seconds.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	PruneGracePeriod int `toml:"prune_grace_period"`
+
+	// PollIntervalSeconds is the number of seconds between two status checks of a
+	// server we wait for, while it is created or deleted. A random jitter of up to a
+	// fifth of the interval is added, so runners created at the same time are not all
+	// checked at once. If 0, we default to 1 second.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	PollIntervalSeconds int `toml:"poll_interval_seconds"`
+
+	// IgnoreUnsupportedStop makes stopping a server that can not be stopped, like some
+	// bare metal servers, succeed without doing anything. A warning is logged instead.
+	// By default, an error is returned.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	IgnoreUnsupportedStop bool `toml:"ignore_unsupported_stop"`
+
+	// UseForceDelete indicates whether or not to force delete servers. Force deleted
+	// servers are deleted right away, even on clouds that have reclaim_instance_interval
+	// set in nova. If set to false, servers are deleted normally, and can be restored
+	// until they are reclaimed. Defaults to true.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	UseForceDelete *bool `toml:"use_force_delete"`
+
+	// ServerGroupPolicy is the policy of the nova server group the provider creates for
+	// every pool. When set, all runners of a pool are created in the server group of the
+	// pool, which is created on first use. Possible values are "affinity", "anti-affinity",
+	// "soft-affinity" and "soft-anti-affinity". If empty, no server groups are created.
+	// A server group set in the scheduler_hints extra spec takes precedence.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ServerGroupPolicy string `toml:"server_group_policy"`
+
+	// CreateMaxRetries is the maximum number of retries shared by all the operations
+	// of a single create (resolving the flavor, image and network), when they fail
+	// with a transient error. The server create itself is not retried, as nova may
+	// have accepted the request. If 0, we don't retry.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	CreateMaxRetries int `toml:"create_max_retries"`
+
+	// RetryMaxAttempts is the maximum number of attempts made for a single API request
+	// that fails with HTTP 429, 502, 503 or 504. Other errors are not retried. Server
+	// creates are only retried on 429 and 503, as nova may have accepted a request
+	// that failed with a gateway error. If 0, we default to 3 attempts.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	RetryMaxAttempts int `toml:"retry_max_attempts"`
+
+	// RetryBaseDelay is the number of milliseconds we wait before retrying a failed API
+	// request. The delay doubles with every attempt, with a random jitter. If 0, we
+	// default to 500 milliseconds.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	RetryBaseDelay int `toml:"retry_base_delay"`
+
+	// ResourceCacheTTL is the number of seconds the flavors, images and networks we look
+	// up are cached in the cache directory of StateDir, so that creating many runners
+	// at once does not look them up again for every runner. Changes made to them in the
+	// cloud may be missed for up to this many seconds. If 0, lookups are not cached.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	ResourceCacheTTL int `toml:"resource_cache_ttl"`
+
+	// CheckQuotaBeforeCreate enables a check of the compute, network and volume quotas
+	// of the project before creating a runner, so that we can fail early with a clear
+	// error. This costs a few extra API calls for every runner that is created.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	CheckQuotaBeforeCreate bool `toml:"check_quota_before_create"`
+
+	// RecordHostAggregates enables recording the names of the host aggregates a runner
+	// landed in, in the garm-host-aggregates metadata key of the server, once it is
+	// ACTIVE. This is useful for chargeback. Looking up the host of a server and listing
+	// the host aggregates requires admin privileges. Runners created with async_create
+	// are not recorded.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	RecordHostAggregates bool `toml:"record_host_aggregates"`
+
+	// VerifyTags enables checking that a new runner shows up when listing servers by
+	// its tags, once it was created. Some eventually consistent clouds apply the tags set
+	// at create time with a delay, which makes the runner briefly invisible to garm. If
+	// the runner is missing, the tags are set again. If it still does not show up, the
+	// runner is removed and the create fails.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	VerifyTags bool `toml:"verify_tags"`
+
+	// AllowPartialList indicates whether or not to return the servers that were already
+	// listed, when listing the servers of a pool fails midway. By default, listing either
+	// returns all servers or fails.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	AllowPartialList bool `toml:"allow_partial_list"`
+
+	// HideSoftDeletedServers indicates whether or not to leave out the servers that are
+	// SOFT_DELETED when listing the servers of a pool. On clouds with a reclaim window,
+	// deleted servers are kept around until they are reclaimed. By default, they are
+	// listed as deleting.
+	//
+	// This option can NOT be overwritten using extra_specs.
+	HideSoftDeletedServers bool `toml:"hide_soft_deleted_servers"`
+
+	// NameCollisionStrategy determines what happens when looking up a server by name
+	// returns multiple servers. Possible values are "error", "pick-newest" and
+	// "pick-by-pool-tag". If empty, we default to "error".
+	//
+	// This value can NOT be overwritten using extra_specs.
+	NameCollisionStrategy string `toml:"name_collision_strategy"`
 }
 
 func (c *Config) Validate() error {
@@ -121,6 +598,17 @@ func (c *Config) Validate() error {
 	if !c.Credentials.HasCloud(c.Cloud) {
 		return fmt.Errorf("cloud %s is not defined in clouds.yaml", c.Cloud)
 	}
+	if err := c.Credentials.ValidateCloudAuth(c.Cloud); err != nil {
+		return fmt.Errorf("invalid credentials for cloud %s: %w", c.Cloud, err)
+	}
+	for _, region := range c.Regions {
+		if region == "" {
+			return fmt.Errorf("invalid regions: region names must not be empty")
+		}
+	}
+	if c.DefaultRegion() == "" && !c.Credentials.HasDefaultRegion(c.Cloud) {
+		return fmt.Errorf("missing region; cloud %s does not define a default region_name", c.Cloud)
+	}
 
 	if c.DefaultNetworkID == "" {
 		return fmt.Errorf("missing network_id")
@@ -129,6 +617,195 @@ func (c *Config) Validate() error {
 	if !IsValidVisibilityOrEmpty(c.ImageVisibility) {
 		return fmt.Errorf("invalid image_visibility: %s", c.ImageVisibility)
 	}
+
+	for _, tag := range c.DefaultTags {
+		if err := ValidateServerTag(tag); err != nil {
+			return fmt.Errorf("invalid default_tags: %w", err)
+		}
+	}
+
+	if c.ControllerInstanceID != "" {
+		if _, err := uuid.Parse(c.ControllerInstanceID); err != nil {
+			return fmt.Errorf("invalid controller_instance_id: %s", c.ControllerInstanceID)
+		}
+	}
+
+	for osType := range c.DefaultFlavors {
+		if osType != "linux" && osType != "windows" {
+			return fmt.Errorf("invalid os type in default_flavors: %s", osType)
+		}
+	}
+
+	if c.AllocateFloatingIP {
+		if c.FloatingIPNetwork == "" {
+			return fmt.Errorf("allocate_floating_ip requires floating_ip_network")
+		}
+		if c.AsyncCreate {
+			return fmt.Errorf("allocate_floating_ip can not be combined with async_create")
+		}
+	}
+
+	for flavor, size := range c.FlavorBootDiskSizes {
+		if size <= 0 {
+			return fmt.Errorf("invalid boot disk size for flavor %s in flavor_boot_disk_sizes: %d", flavor, size)
+		}
+	}
+
+	if c.HostnameTemplate != "" {
+		if _, err := template.New("hostname").Parse(c.HostnameTemplate); err != nil {
+			return fmt.Errorf("invalid hostname_template: %w", err)
+		}
+	}
+
+	if c.CreateTimeout < 0 {
+		return fmt.Errorf("invalid create_timeout: %d", c.CreateTimeout)
+	}
+
+	if c.DeleteTimeout < 0 {
+		return fmt.Errorf("invalid delete_timeout: %d", c.DeleteTimeout)
+	}
+
+	if c.ErrorServerGracePeriod < 0 {
+		return fmt.Errorf("invalid error_server_grace_period: %d", c.ErrorServerGracePeriod)
+	}
+
+	if c.PollIntervalSeconds < 0 {
+		return fmt.Errorf("invalid poll_interval_seconds: %d", c.PollIntervalSeconds)
+	}
+
+	if c.CreateMaxRetries < 0 {
+		return fmt.Errorf("invalid create_max_retries: %d", c.CreateMaxRetries)
+	}
+
+	if c.RetryMaxAttempts < 0 {
+		return fmt.Errorf("invalid retry_max_attempts: %d", c.RetryMaxAttempts)
+	}
+
+	if c.RetryBaseDelay < 0 {
+		return fmt.Errorf("invalid retry_base_delay: %d", c.RetryBaseDelay)
+	}
+
+	if c.ResourceCacheTTL < 0 {
+		return fmt.Errorf("invalid resource_cache_ttl: %d", c.ResourceCacheTTL)
+	}
+
+	switch c.PreferredAddressType {
+	case "", "private", "public":
+	default:
+		return fmt.Errorf("invalid preferred_address_type: %s", c.PreferredAddressType)
+	}
+
+	switch c.AddressFamilyPreference {
+	case "", AddressFamilyIPv4, AddressFamilyIPv6:
+	default:
+		return fmt.Errorf("invalid address_family_preference: %s", c.AddressFamilyPreference)
+	}
+
+	if c.ImageDownloadRetries < 0 {
+		return fmt.Errorf("invalid image_download_retries: %d", c.ImageDownloadRetries)
+	}
+
+	if c.ListWorkers < 0 {
+		return fmt.Errorf("invalid list_workers: %d", c.ListWorkers)
+	}
+
+	if c.PruneGracePeriod < 0 {
+		return fmt.Errorf("invalid prune_grace_period: %d", c.PruneGracePeriod)
+	}
+
+	if c.ListPageSize < 0 {
+		return fmt.Errorf("invalid list_page_size: %d", c.ListPageSize)
+	}
+
+	if c.AddressFamilyMaxRecreates < 0 {
+		return fmt.Errorf("invalid address_family_max_recreates: %d", c.AddressFamilyMaxRecreates)
+	}
+	if c.AddressFamilyMaxRecreates > 0 && c.AddressFamilyPreference == "" {
+		return fmt.Errorf("address_family_max_recreates requires address_family_preference")
+	}
+
+	switch c.ArchitectureCheck {
+	case "", ArchitectureCheckDisabled, ArchitectureCheckWarn, ArchitectureCheckEnforce:
+	default:
+		return fmt.Errorf("invalid architecture_check: %s", c.ArchitectureCheck)
+	}
+
+	switch c.DefaultKeyPairType {
+	case "", KeyPairTypeSSH, KeyPairTypeX509:
+	default:
+		return fmt.Errorf("invalid default_keypair_type: %s", c.DefaultKeyPairType)
+	}
+
+	switch c.NameCollisionStrategy {
+	case "", NameCollisionError, NameCollisionPickNewest, NameCollisionPickByPoolTag:
+	default:
+		return fmt.Errorf("invalid name_collision_strategy: %s", c.NameCollisionStrategy)
+	}
+
+	switch c.RegionSelectionStrategy {
+	case "", RegionSelectionRoundRobin, RegionSelectionRandom:
+	default:
+		return fmt.Errorf("invalid region_selection_strategy: %s", c.RegionSelectionStrategy)
+	}
+
+	if c.ComputeMicroversion != "" && !computeMicroversionRegex.MatchString(c.ComputeMicroversion) {
+		return fmt.Errorf("invalid compute_microversion: %s", c.ComputeMicroversion)
+	}
+
+	if c.MinComputeMicroversion != "" && !computeMicroversionRegex.MatchString(c.MinComputeMicroversion) {
+		return fmt.Errorf("invalid min_compute_microversion: %s", c.MinComputeMicroversion)
+	}
+
+	switch c.ServerGroupPolicy {
+	case "", ServerGroupAffinity, ServerGroupAntiAffinity, ServerGroupSoftAffinity, ServerGroupSoftAntiAffinity:
+	default:
+		return fmt.Errorf("invalid server_group_policy: %s", c.ServerGroupPolicy)
+	}
+	return nil
+}
+
+// DefaultRegion returns the region that is used when no region is requested. If region
+// is not set, this is the first of the configured regions, if any.
+func (c *Config) DefaultRegion() string {
+	if c.Region == "" && len(c.Regions) > 0 {
+		return c.Regions[0]
+	}
+	return c.Region
+}
+
+// StateDirectory returns the directory in which the provider keeps its state.
+func (c *Config) StateDirectory() (string, error) {
+	if c.StateDir != "" {
+		return c.StateDir, nil
+	}
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, "garm-provider-openstack"), nil
+}
+
+// ForceDelete returns true if servers should be force deleted.
+func (c *Config) ForceDelete() bool {
+	return c.UseForceDelete == nil || *c.UseForceDelete
+}
+
+// ValidateServerTag checks that the tag can be set on a nova server. Tags can not be
+// empty, are limited to 60 characters, and can not contain commas or slashes.
+func ValidateServerTag(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("empty tag")
+	}
+	if len(tag) > 60 {
+		return fmt.Errorf("tag %q is longer than 60 characters", tag)
+	}
+	if strings.ContainsAny(tag, ",/") {
+		return fmt.Errorf("tag %q contains a comma or a slash", tag)
+	}
 	return nil
 }
 
@@ -174,6 +851,56 @@ func (c Credentials) HasCloud(name string) bool {
 	return true
 }
 
+// HasDefaultRegion returns true if clientconfig can find a region for the cloud when no
+// region is requested. This is the region_name of the cloud, once clouds.yaml,
+// clouds-public.yaml and secure.yaml are merged, or OS_REGION_NAME.
+func (c Credentials) HasDefaultRegion(name string) bool {
+	if os.Getenv("OS_REGION_NAME") != "" {
+		return true
+	}
+	cloud, err := clientconfig.GetCloudFromYAML(&clientconfig.ClientOpts{
+		Cloud:    name,
+		YAMLOpts: &c,
+	})
+	if err != nil {
+		return false
+	}
+	return cloud.RegionName != ""
+}
+
+// ValidateCloudAuth checks that the credentials required by the auth type of the cloud
+// are set, once clouds.yaml, clouds-public.yaml and secure.yaml are merged. Only
+// application credentials are checked for now.
+func (c Credentials) ValidateCloudAuth(name string) error {
+	cloud, err := clientconfig.GetCloudFromYAML(&clientconfig.ClientOpts{
+		Cloud:    name,
+		YAMLOpts: &c,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load cloud: %w", err)
+	}
+	if cloud.AuthType != clientconfig.AuthV3ApplicationCredential {
+		return nil
+	}
+	if cloud.AuthInfo == nil {
+		return fmt.Errorf("missing auth for application credential")
+	}
+	if cloud.AuthInfo.ApplicationCredentialSecret == "" {
+		return fmt.Errorf("missing application_credential_secret")
+	}
+	if cloud.AuthInfo.ApplicationCredentialID == "" {
+		// Application credentials can also be looked up by name, in which case keystone
+		// needs to know the user that owns them.
+		if cloud.AuthInfo.ApplicationCredentialName == "" {
+			return fmt.Errorf("missing application_credential_id")
+		}
+		if cloud.AuthInfo.UserID == "" && cloud.AuthInfo.Username == "" {
+			return fmt.Errorf("application_credential_name requires user_id or username")
+		}
+	}
+	return nil
+}
+
 func (c Credentials) Validate() error {
 	if _, err := c.LoadCloudsYAML(); err != nil {
 		return fmt.Errorf("failed to load clouds.yaml: %w", err)
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -42,6 +44,285 @@ func TestCredentials_Validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid name collision strategy",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:      "network",
+				NameCollisionStrategy: "invalid",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid preferred address type",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:     "network",
+				PreferredAddressType: "invalid",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid region selection strategy",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:        "network",
+				Regions:                 []string{"RegionOne", "RegionTwo"},
+				RegionSelectionStrategy: "least-used",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid server group policy",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:  "network",
+				ServerGroupPolicy: "spread",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid compute microversion",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:    "network",
+				ComputeMicroversion: "latest",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid architecture check",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:  "network",
+				ArchitectureCheck: "strict",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid default keypair type",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:   "network",
+				DefaultKeyPairType: "rsa",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid controller instance ID",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:     "network",
+				ControllerInstanceID: "my-deployment",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid min compute microversion",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:       "network",
+				MinComputeMicroversion: "2",
+			},
+			wantErr: true,
+		},
+		{
+			name: "address family recreates without preference",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:          "network",
+				AddressFamilyMaxRecreates: 2,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid default tag",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID: "network",
+				DefaultTags:      []string{"team=ci,cost-center=42"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid hostname template",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID: "network",
+				HostnameTemplate: "{{.PoolID",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid default flavors os type",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID: "network",
+				DefaultFlavors:   map[string]string{"freebsd": "m1.small"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "allocate floating IP without a network",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:   "network",
+				AllocateFloatingIP: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "allocate floating IP with async create",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:   "network",
+				AllocateFloatingIP: true,
+				FloatingIPNetwork:  "public",
+				AsyncCreate:        true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid flavor boot disk size",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:    "network",
+				FlavorBootDiskSizes: map[string]int64{"m1.large": 0},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative image download retries",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:     "network",
+				ImageDownloadRetries: -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative list workers",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID: "network",
+				ListWorkers:      -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative list page size",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID: "network",
+				ListPageSize:     -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative prune grace period",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID: "network",
+				PruneGracePeriod: -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative error server grace period",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:       "network",
+				ErrorServerGracePeriod: -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative poll interval",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID:    "network",
+				PollIntervalSeconds: -1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative resource cache ttl",
+			config: &Config{
+				Cloud: "mycloud",
+				Credentials: Credentials{
+					Clouds: "../testdata/clouds.yaml",
+				},
+				DefaultNetworkID: "network",
+				ResourceCacheTTL: -1,
+			},
+			wantErr: true,
+		},
 		{
 			name: "missing clouds.yaml",
 			config: &Config{
@@ -101,3 +382,158 @@ func TestIsValidVisibility(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateRegion(t *testing.T) {
+	dir := t.TempDir()
+	cloudsYAML := filepath.Join(dir, "clouds.yaml")
+	err := os.WriteFile(cloudsYAML, []byte("clouds:\n  noregion:\n    auth:\n      auth_url: http://keystone:5000/v3\n  withprofile:\n    profile: public\n"), 0o600)
+	assert.NoError(t, err)
+	secureYAML := filepath.Join(dir, "secure.yaml")
+	err = os.WriteFile(secureYAML, []byte("clouds:\n  noregion:\n    region_name: RegionOne\n"), 0o600)
+	assert.NoError(t, err)
+	publicYAML := filepath.Join(dir, "clouds-public.yaml")
+	err = os.WriteFile(publicYAML, []byte("clouds:\n  public:\n    region_name: RegionOne\n"), 0o600)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		cloud     string
+		clouds    string
+		secure    string
+		public    string
+		envRegion string
+		region    string
+		regions   []string
+		wantErr   bool
+	}{
+		{
+			name:   "default region in clouds.yaml",
+			cloud:  "mycloud",
+			clouds: "../testdata/clouds.yaml",
+		},
+		{
+			name:   "default region in secure.yaml",
+			cloud:  "noregion",
+			clouds: cloudsYAML,
+			secure: secureYAML,
+		},
+		{
+			name:   "default region in the profile",
+			cloud:  "withprofile",
+			clouds: cloudsYAML,
+			public: publicYAML,
+		},
+		{
+			name:      "default region in the environment",
+			cloud:     "noregion",
+			clouds:    cloudsYAML,
+			envRegion: "RegionOne",
+		},
+		{
+			name:   "region set in config",
+			cloud:  "noregion",
+			clouds: cloudsYAML,
+			region: "RegionTwo",
+		},
+		{
+			name:    "regions set in config",
+			cloud:   "noregion",
+			clouds:  cloudsYAML,
+			regions: []string{"RegionOne", "RegionTwo"},
+		},
+		{
+			name:    "no region",
+			cloud:   "noregion",
+			clouds:  cloudsYAML,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OS_REGION_NAME", tt.envRegion)
+			cfg := &Config{
+				Cloud: tt.cloud,
+				Credentials: Credentials{
+					Clouds:       tt.clouds,
+					SecureClouds: tt.secure,
+					PublicClouds: tt.public,
+				},
+				Region:           tt.region,
+				Regions:          tt.regions,
+				DefaultNetworkID: "network",
+			}
+			if tt.wantErr {
+				assert.ErrorContains(t, cfg.Validate(), "missing region")
+			} else {
+				assert.NoError(t, cfg.Validate())
+			}
+		})
+	}
+}
+
+func TestValidateApplicationCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		cloud     string
+		secure    string
+		errString string
+	}{
+		{
+			name:   "secret in secure.yaml",
+			cloud:  "appcred",
+			secure: "../testdata/secure-appcred.yaml",
+		},
+		{
+			name:      "secret missing from secure.yaml",
+			cloud:     "appcred",
+			errString: "invalid credentials for cloud appcred: missing application_credential_secret",
+		},
+		{
+			name:      "name without user",
+			cloud:     "appcred-by-name",
+			errString: "application_credential_name requires user_id or username",
+		},
+		{
+			name:      "no secret",
+			cloud:     "appcred-no-secret",
+			secure:    "../testdata/secure-appcred.yaml",
+			errString: "missing application_credential_secret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Cloud: tt.cloud,
+				Credentials: Credentials{
+					Clouds:       "../testdata/clouds-appcred.yaml",
+					SecureClouds: tt.secure,
+				},
+				DefaultNetworkID: "network",
+			}
+			err := cfg.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestStateDirectory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "/var/lib/state")
+	t.Setenv("HOME", "/home/garm")
+
+	dir, err := (&Config{StateDir: "/etc/garm/state"}).StateDirectory()
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/garm/state", dir)
+
+	dir, err = (&Config{}).StateDirectory()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("/var/lib/state", "garm-provider-openstack"), dir)
+
+	t.Setenv("XDG_STATE_HOME", "")
+	dir, err = (&Config{}).StateDirectory()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("/home/garm", ".local", "state", "garm-provider-openstack"), dir)
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -28,15 +29,138 @@ import (
 	"github.com/cloudbase/garm-provider-openstack/provider"
 )
 
+var dumpInstances = flag.String("dump-instances", "", "dump the details of all runners in the given pool as JSON and exit. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var providerInfo = flag.Bool("provider-info", false, "print the version of the provider, along with the compute microversion and service endpoints it uses, as JSON and exit. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var retagServers = flag.Bool("retag-servers", false, "tag the runners of the controller with the controller_instance_id from the config, print the IDs of the servers that were tagged as JSON and exit. Runners tagged with a different controller instance ID are left alone. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var cleanupErroredServers = flag.Bool("cleanup-errored-servers", false, "remove the runners that have been in ERROR state for longer than error_server_grace_period, print the IDs of the servers that were removed as JSON and exit. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var consoleOutput = flag.String("console-output", "", "print the console log of the given runner and exit. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var consoleLines = flag.Int("console-lines", 100, "the number of lines printed from the end of the console log by -console-output. The whole log is printed if set to 0.")
+
+var rescue = flag.String("rescue", "", "boot the given runner from a rescue image, with its root disk attached as a secondary disk, and exit. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var rescueImage = flag.String("rescue-image", "", "the name or ID of the image used by -rescue. The image the runner was created from is used if not set.")
+
+var unrescue = flag.String("unrescue", "", "boot the given rescued runner from its own root disk again and exit. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var healthz = flag.Bool("healthz", false, "check that the provider can authenticate and reach the compute, image, network and volume services in every region, print the result as JSON and exit. Exits with a non zero code if a service other than the volume service is unreachable. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var serverPassword = flag.String("server-password", "", "print the admin password of the given Windows runner, decrypted with the private key passed in -private-key, and exit. The runner must have been created with a key pair. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
+var privateKey = flag.String("private-key", "", "the path to the RSA private key, in PEM format, of the key pair used by -server-password.")
+
+var renderUserData = flag.String("render-userdata", "", "print the user data of a runner created from the bootstrap params in the given JSON file and exit, without creating anything. The instance token and the download token of the runner are redacted. The config file and controller ID are read from GARM_PROVIDER_CONFIG_FILE and GARM_CONTROLLER_ID.")
+
 var signals = []os.Signal{
 	os.Interrupt,
 	syscall.SIGTERM,
 }
 
 func main() {
+	flag.Parse()
 
 	ctx, stop := signal.NotifyContext(context.Background(), signals...)
 	defer stop()
+	go func() {
+		// Once the first signal cancels the context, restore the default
+		// signal behavior. In-flight operations get a chance to clean up,
+		// while a second signal terminates the process immediately.
+		<-ctx.Done()
+		stop()
+	}()
+
+	if *dumpInstances != "" {
+		result, err := provider.DumpInstances(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"), *dumpInstances)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, string(result))
+		return
+	}
+
+	if *providerInfo {
+		result, err := provider.DumpProviderInfo(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, string(result))
+		return
+	}
+
+	if *retagServers {
+		result, err := provider.RetagServers(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, string(result))
+		return
+	}
+
+	if *cleanupErroredServers {
+		result, err := provider.CleanupErroredServers(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, string(result))
+		return
+	}
+
+	if *consoleOutput != "" {
+		result, err := provider.ConsoleOutput(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"), *consoleOutput, *consoleLines)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprint(os.Stdout, result)
+		return
+	}
+
+	if *rescue != "" {
+		if err := provider.RescueInstance(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"), *rescue, *rescueImage); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *unrescue != "" {
+		if err := provider.UnrescueInstance(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"), *unrescue); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *healthz {
+		result, healthy, err := provider.Healthz(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, string(result))
+		if !healthy {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *serverPassword != "" {
+		result, err := provider.ServerPassword(ctx, os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"), *serverPassword, *privateKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, result)
+		return
+	}
+
+	if *renderUserData != "" {
+		result, err := provider.RenderUserData(os.Getenv("GARM_PROVIDER_CONFIG_FILE"), os.Getenv("GARM_CONTROLLER_ID"), *renderUserData)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprint(os.Stdout, string(result))
+		return
+	}
 
 	executionEnv, err := execution.GetEnvironment()
 	if err != nil {
@@ -0,0 +1,467 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/cloudbase/garm-provider-common/params"
+
+	"github.com/cloudbase/garm-provider-openstack/client"
+	"github.com/cloudbase/garm-provider-openstack/config"
+)
+
+// redactedValue replaces the secrets in the user data rendered by RenderUserData.
+const redactedValue = "REDACTED"
+
+// InstanceDetails holds the details of a runner, as exported by DumpInstances.
+type InstanceDetails struct {
+	ID               string           `json:"id"`
+	Name             string           `json:"name"`
+	Status           string           `json:"status"`
+	Addresses        []params.Address `json:"addresses"`
+	Flavor           string           `json:"flavor"`
+	Image            string           `json:"image"`
+	ImageName        string           `json:"image_name,omitempty"`
+	AvailabilityZone string           `json:"availability_zone"`
+	Cloud            string           `json:"cloud,omitempty"`
+	Region           string           `json:"region,omitempty"`
+	Tags             []string         `json:"tags"`
+}
+
+func (a *openstackProvider) serverToInstanceDetails(srv client.ServerWithExt) InstanceDetails {
+	details := InstanceDetails{
+		ID:               srv.ID,
+		Name:             srv.Name,
+		Status:           srv.Status,
+		Addresses:        a.serverToInstance(srv).Addresses,
+		AvailabilityZone: srv.AvailabilityZone,
+		Cloud:            srv.Metadata[cloudKey],
+		Region:           srv.Metadata[regionKey],
+		Tags:             []string{},
+	}
+	// Starting with microversion 2.47, nova returns the flavor details instead of
+	// the flavor ID.
+	if name, ok := srv.Flavor["original_name"].(string); ok {
+		details.Flavor = name
+	} else if id, ok := srv.Flavor["id"].(string); ok {
+		details.Flavor = id
+	}
+	// The image is empty for servers booted from volume.
+	if id, ok := srv.Image["id"].(string); ok {
+		details.Image = id
+	}
+	if srv.Tags != nil {
+		details.Tags = *srv.Tags
+	}
+	return details
+}
+
+// nameLookup resolves IDs to names, looking up every ID only once, even when called
+// from several goroutines at the same time.
+type nameLookup struct {
+	mux     sync.Mutex
+	entries map[string]*nameLookupEntry
+}
+
+type nameLookupEntry struct {
+	once sync.Once
+	name string
+}
+
+// get returns the name of id, calling lookup if id was not looked up before.
+func (l *nameLookup) get(id string, lookup func() string) string {
+	l.mux.Lock()
+	if l.entries == nil {
+		l.entries = map[string]*nameLookupEntry{}
+	}
+	entry, ok := l.entries[id]
+	if !ok {
+		entry = &nameLookupEntry{}
+		l.entries[id] = entry
+	}
+	l.mux.Unlock()
+
+	entry.once.Do(func() {
+		entry.name = lookup()
+	})
+	return entry.name
+}
+
+// addNames sets the name of the flavor, if nova only returned its ID, and the name of the
+// image of the runner. Failed lookups are logged, and leave the details as they are.
+func (a *openstackProvider) addNames(ctx context.Context, cli *client.OpenstackClient, srv client.ServerWithExt, details *InstanceDetails, flavorNames, imageNames *nameLookup) {
+	// Microversions older than 2.47 only return the flavor ID.
+	if flavorID, ok := srv.Flavor["id"].(string); ok && flavorID != "" {
+		details.Flavor = flavorNames.get(flavorID, func() string {
+			flavor, err := cli.GetFlavor(ctx, flavorID)
+			if err != nil {
+				log.Printf("failed to get flavor %s: %s", flavorID, err)
+				return flavorID
+			}
+			return flavor.Name
+		})
+	}
+	if details.Image != "" {
+		imageID := details.Image
+		details.ImageName = imageNames.get(imageID, func() string {
+			img, err := cli.GetImage(ctx, imageID, "", nil)
+			if err != nil {
+				log.Printf("failed to get image %s: %s", imageID, err)
+				return ""
+			}
+			return img.Name
+		})
+	}
+}
+
+// DumpInstances returns the details of all runners in a pool, as JSON.
+func DumpInstances(ctx context.Context, configPath, controllerID, poolID string) ([]byte, error) {
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return nil, err
+	}
+	return prov.dumpInstances(ctx, poolID)
+}
+
+func (a *openstackProvider) dumpInstances(ctx context.Context, poolID string) ([]byte, error) {
+	clients, err := a.targetClients()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clients: %w", err)
+	}
+
+	ret := []InstanceDetails{}
+	for _, cli := range clients {
+		servers, err := cli.ListServers(ctx, poolID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list servers: %w", err)
+		}
+		// Runners of a pool mostly share the same flavor and image, so each of them
+		// is only looked up once per region.
+		flavorNames := &nameLookup{}
+		imageNames := &nameLookup{}
+		details := make([]InstanceDetails, len(servers))
+		a.forEachParallel(len(servers), func(idx int) {
+			details[idx] = a.serverToInstanceDetails(servers[idx])
+			a.addNames(ctx, cli, servers[idx], &details[idx], flavorNames, imageNames)
+		})
+		ret = append(ret, details...)
+	}
+
+	asJs, err := json.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal instances: %w", err)
+	}
+	return asJs, nil
+}
+
+// RegionInfo holds the details of the connection to a region.
+type RegionInfo struct {
+	Region              string            `json:"region"`
+	ComputeMicroversion string            `json:"compute_microversion"`
+	Interface           string            `json:"interface"`
+	Endpoints           map[string]string `json:"endpoints"`
+}
+
+// ProviderInfo holds the version of the provider, and the details of the connections
+// to the configured regions. This helps debug issues caused by older clouds that do
+// not support the microversions we need.
+type ProviderInfo struct {
+	Version string       `json:"version"`
+	Regions []RegionInfo `json:"regions"`
+}
+
+// DumpProviderInfo returns the provider info, as JSON.
+func DumpProviderInfo(ctx context.Context, configPath, controllerID string) ([]byte, error) {
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := prov.GetProviderInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	asJs, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provider info: %w", err)
+	}
+	return asJs, nil
+}
+
+// GetProviderInfo returns the version of the provider, along with the compute
+// microversion and the service endpoints used in each region.
+func (a *openstackProvider) GetProviderInfo(ctx context.Context) (ProviderInfo, error) {
+	clients, err := a.regionClients()
+	if err != nil {
+		return ProviderInfo{}, fmt.Errorf("failed to get clients: %w", err)
+	}
+
+	regions := a.cfg.Regions
+	if len(regions) == 0 {
+		regions = []string{a.cfg.DefaultRegion()}
+	}
+	info := ProviderInfo{
+		Version: a.GetVersion(ctx),
+		Regions: make([]RegionInfo, 0, len(clients)),
+	}
+	for idx, cli := range clients {
+		info.Regions = append(info.Regions, RegionInfo{
+			Region:              regions[idx],
+			ComputeMicroversion: cli.ComputeMicroversion(),
+			Interface:           cli.EndpointInterface(),
+			Endpoints:           cli.Endpoints(),
+		})
+	}
+	return info, nil
+}
+
+// ServiceHealth holds the result of checking one service.
+type ServiceHealth struct {
+	Healthy bool `json:"healthy"`
+	// Optional services do not make the provider unhealthy when they fail.
+	Optional bool   `json:"optional,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RegionHealth holds the health of the services of a region, keyed by service type.
+type RegionHealth struct {
+	Region   string                   `json:"region"`
+	Services map[string]ServiceHealth `json:"services"`
+}
+
+// HealthReport holds the health of the services in all configured regions.
+type HealthReport struct {
+	Healthy bool           `json:"healthy"`
+	Regions []RegionHealth `json:"regions"`
+}
+
+// Healthz checks that the provider can authenticate and reach the services it needs in
+// every region, and returns the report as JSON, along with whether the provider is
+// healthy.
+func Healthz(ctx context.Context, configPath, controllerID string) ([]byte, bool, error) {
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return nil, false, err
+	}
+	report, err := prov.Healthz(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	asJs, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal health report: %w", err)
+	}
+	return asJs, report.Healthy, nil
+}
+
+// Healthz makes a cheap request to the compute, image, network and volume services of
+// every region. The volume service is optional, as runners that boot from image work on
+// clouds without cinder. An error is only returned if the clients can not be created,
+// which includes failing to authenticate.
+func (a *openstackProvider) Healthz(ctx context.Context) (HealthReport, error) {
+	clients, err := a.regionClients()
+	if err != nil {
+		return HealthReport{}, fmt.Errorf("failed to get clients: %w", err)
+	}
+
+	regions := a.cfg.Regions
+	if len(regions) == 0 {
+		regions = []string{a.cfg.DefaultRegion()}
+	}
+	report := HealthReport{
+		Healthy: true,
+		Regions: make([]RegionHealth, 0, len(clients)),
+	}
+	for idx, cli := range clients {
+		failed := cli.CheckServices(ctx)
+		region := RegionHealth{
+			Region:   regions[idx],
+			Services: map[string]ServiceHealth{},
+		}
+		for _, service := range []string{client.ServiceCompute, client.ServiceImage, client.ServiceNetwork, client.ServiceVolume} {
+			health := ServiceHealth{
+				Healthy:  true,
+				Optional: service == client.ServiceVolume,
+			}
+			if err, ok := failed[service]; ok {
+				health.Healthy = false
+				health.Error = err.Error()
+				if !health.Optional {
+					report.Healthy = false
+				}
+			}
+			region.Services[service] = health
+		}
+		report.Regions = append(report.Regions, region)
+	}
+	return report, nil
+}
+
+// RetagServers adds the controller instance ID tag to the servers of this controller
+// that were created before the controller instance ID was set, and returns the IDs of
+// the servers that were tagged, as JSON.
+func RetagServers(ctx context.Context, configPath, controllerID string) ([]byte, error) {
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return nil, err
+	}
+	retagged, err := prov.retagServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	asJs, err := json.MarshalIndent(retagged, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal servers: %w", err)
+	}
+	return asJs, nil
+}
+
+func (a *openstackProvider) retagServers(ctx context.Context) ([]string, error) {
+	clients, err := a.targetClients()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clients: %w", err)
+	}
+
+	ret := []string{}
+	for _, cli := range clients {
+		retagged, err := cli.RetagServers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retag servers: %w", err)
+		}
+		ret = append(ret, retagged...)
+	}
+	return ret, nil
+}
+
+// CleanupErroredServers removes the runners that have been in ERROR state for longer
+// than the error_server_grace_period, and returns the IDs of the servers that were
+// removed, as JSON.
+func CleanupErroredServers(ctx context.Context, configPath, controllerID string) ([]byte, error) {
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := prov.cleanupErroredServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	asJs, err := json.MarshalIndent(removed, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal servers: %w", err)
+	}
+	return asJs, nil
+}
+
+func (a *openstackProvider) cleanupErroredServers(ctx context.Context) ([]string, error) {
+	clients, err := a.targetClients()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clients: %w", err)
+	}
+
+	ret := []string{}
+	for _, cli := range clients {
+		removed, err := cli.CleanupErroredServers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to clean up servers in ERROR state: %w", err)
+		}
+		ret = append(ret, removed...)
+	}
+	return ret, nil
+}
+
+// ConsoleOutput returns the last length lines of the console log of a runner. The whole
+// log is returned if length is not larger than 0.
+func ConsoleOutput(ctx context.Context, configPath, controllerID, instance string, length int) (string, error) {
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return "", err
+	}
+	return prov.GetConsoleOutput(ctx, instance, length)
+}
+
+// RescueInstance boots a runner from a rescue image, with its root disk attached as a
+// secondary disk. The image of the runner is used if rescueImage is empty.
+func RescueInstance(ctx context.Context, configPath, controllerID, instance, rescueImage string) error {
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return err
+	}
+	return prov.Rescue(ctx, instance, rescueImage)
+}
+
+// UnrescueInstance boots a rescued runner from its own root disk again.
+func UnrescueInstance(ctx context.Context, configPath, controllerID, instance string) error {
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return err
+	}
+	return prov.Unrescue(ctx, instance)
+}
+
+// ServerPassword returns the admin password of a runner, decrypted with the RSA private
+// key in the given PEM file, which must belong to the key pair the runner was created with.
+func ServerPassword(ctx context.Context, configPath, controllerID, instance, privateKeyPath string) (string, error) {
+	privateKey, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read private key: %w", err)
+	}
+	prov, err := newOpenStackProvider(configPath, controllerID)
+	if err != nil {
+		return "", err
+	}
+	return prov.GetServerPassword(ctx, instance, string(privateKey))
+}
+
+// RenderUserData returns the user data of a runner created from the bootstrap params in
+// the given JSON file, without creating anything. The instance token and the download
+// token of the runner are redacted. The properties of the image and the static IPs of
+// ports are only known when the runner is created, so they are not applied.
+func RenderUserData(configPath, controllerID, paramsPath string) ([]byte, error) {
+	conf, err := config.NewConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+	contents, err := os.ReadFile(paramsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bootstrap params: %w", err)
+	}
+	var data params.BootstrapInstance
+	if err := json.Unmarshal(contents, &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal bootstrap params: %w", err)
+	}
+	return renderUserData(conf, controllerID, data)
+}
+
+func renderUserData(cfg *config.Config, controllerID string, data params.BootstrapInstance) ([]byte, error) {
+	data.InstanceToken = redactedValue
+	data.Tools = slices.Clone(data.Tools)
+	for idx := range data.Tools {
+		if data.Tools[idx].TempDownloadToken != nil {
+			data.Tools[idx].TempDownloadToken = Ptr(redactedValue)
+		}
+	}
+
+	spec, err := NewMachineSpec(data, cfg, controllerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate spec: %w", err)
+	}
+	return spec.ComposeUserData()
+}
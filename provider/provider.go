@@ -16,13 +16,31 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudbase/garm-provider-openstack/client"
 	"github.com/cloudbase/garm-provider-openstack/config"
 
 	execution "github.com/cloudbase/garm-provider-common/execution/v0.1.0"
 	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/servergroups"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
 )
 
 var _ execution.ExternalProvider = &openstackProvider{}
@@ -30,16 +48,50 @@ var _ execution.ExternalProvider = &openstackProvider{}
 var Version = "v0.0.0-unknown"
 
 const (
-	controllerIDTagName = "garm-controller-id"
-	poolIDTagName       = "garm-pool-id"
+	controllerIDTagName         = "garm-controller-id"
+	controllerInstanceIDTagName = "garm-controller-uuid"
+	poolIDTagName               = "garm-pool-id"
+	enterpriseTagName           = "garm-enterprise"
+	orgTagName                  = "garm-org"
+	repoTagName                 = "garm-repo"
+	asyncCreateTag              = "garm-async-create=true"
+	createdAtKey                = "garm-created-at"
+	flavorKey                   = "garm-flavor"
+	hostAggregatesKey           = "garm-host-aggregates"
+	floatingIPKey               = "garm-floating-ip"
+	staticPortsKey              = "garm-static-ports"
+	storageBackendKey           = "garm-storage-backend"
+	cloudKey                    = "garm-cloud"
+	regionKey                   = "garm-region"
+
+	// defaultListWorkers is the number of servers looked up in parallel when listing
+	// instances, if list_workers is not set.
+	defaultListWorkers = 10
 )
 
-var statusMap = map[string]string{
-	"ACTIVE":   "running",
-	"SHUTOFF":  "stopped",
-	"BUILD":    "pending_create",
-	"ERROR":    "error",
-	"DELETING": "pending_delete",
+// statusMap maps nova server statuses to garm instance statuses. Servers that are
+// rebooting, resizing or migrating keep running as far as garm is concerned.
+var statusMap = map[string]params.InstanceStatus{
+	"ACTIVE":            params.InstanceRunning,
+	"REBOOT":            params.InstanceRunning,
+	"HARD_REBOOT":       params.InstanceRunning,
+	"PASSWORD":          params.InstanceRunning,
+	"REBUILD":           params.InstanceRunning,
+	"RESIZE":            params.InstanceRunning,
+	"VERIFY_RESIZE":     params.InstanceRunning,
+	"REVERT_RESIZE":     params.InstanceRunning,
+	"MIGRATING":         params.InstanceRunning,
+	"SHUTOFF":           params.InstanceStopped,
+	"PAUSED":            params.InstanceStopped,
+	"SUSPENDED":         params.InstanceStopped,
+	"RESCUE":            params.InstanceStopped,
+	"SHELVED":           params.InstanceStopped,
+	"SHELVED_OFFLOADED": params.InstanceStopped,
+	"BUILD":             params.InstancePendingCreate,
+	"ERROR":             params.InstanceError,
+	"DELETING":          params.InstancePendingDelete,
+	"SOFT_DELETED":      params.InstanceDeleting,
+	"DELETED":           params.InstanceDeleting,
 }
 
 var addrTypeMap = map[string]params.AddressType{
@@ -48,6 +100,10 @@ var addrTypeMap = map[string]params.AddressType{
 }
 
 func NewOpenStackProvider(configPath, controllerID string) (execution.ExternalProvider, error) {
+	return newOpenStackProvider(configPath, controllerID)
+}
+
+func newOpenStackProvider(configPath, controllerID string) (*openstackProvider, error) {
 	conf, err := config.NewConfig(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("error loading config: %w", err)
@@ -68,12 +124,205 @@ type openstackProvider struct {
 	cfg          *config.Config
 	cli          *client.OpenstackClient
 	controllerID string
+
+	// clients holds the clients for clouds and regions other than the ones set
+	// in the config, keyed by cloud and region.
+	clients map[string]*client.OpenstackClient
+	mux     sync.Mutex
+}
+
+// selectRegion picks one of the configured regions, according to the region selection
+// strategy. If no regions are configured, the default region is returned. garm runs
+// the provider once for every runner, so the round robin position is kept in the state.
+func (a *openstackProvider) selectRegion() (string, error) {
+	if len(a.cfg.Regions) == 0 {
+		return a.cfg.Region, nil
+	}
+	if a.cfg.RegionSelectionStrategy == config.RegionSelectionRandom {
+		return a.cfg.Regions[rand.IntN(len(a.cfg.Regions))], nil
+	}
+
+	var region string
+	err := a.updateState(func(state *providerState) error {
+		region = a.cfg.Regions[state.NextRegion%len(a.cfg.Regions)]
+		state.NextRegion = (state.NextRegion + 1) % len(a.cfg.Regions)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update round robin state: %w", err)
+	}
+	return region, nil
+}
+
+// regionClients returns the clients of all the configured regions. If no regions are
+// configured, only the default client is returned.
+func (a *openstackProvider) regionClients() ([]*client.OpenstackClient, error) {
+	if len(a.cfg.Regions) == 0 {
+		return []*client.OpenstackClient{a.cli}, nil
+	}
+	ret := make([]*client.OpenstackClient, 0, len(a.cfg.Regions))
+	for _, region := range a.cfg.Regions {
+		cli, err := a.getClient(a.cfg.Cloud, region)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cli)
+	}
+	return ret, nil
+}
+
+// configuredTargets returns the cloud and regions set in the config.
+func (a *openstackProvider) configuredTargets() []target {
+	if len(a.cfg.Regions) == 0 {
+		return []target{a.targetFor("", "")}
+	}
+	ret := make([]target, 0, len(a.cfg.Regions))
+	for _, region := range a.cfg.Regions {
+		ret = append(ret, a.targetFor("", region))
+	}
+	return ret
+}
+
+// targetFor returns the target of a runner created in the given cloud and region, the
+// same way getClient picks the client for them.
+func (a *openstackProvider) targetFor(cloud, region string) target {
+	if cloud == "" {
+		cloud = a.cfg.Cloud
+	}
+	if region == "" {
+		region = a.cfg.DefaultRegion()
+	}
+	return target{Cloud: cloud, Region: region}
+}
+
+// recordTarget remembers the cloud and region a runner is created in, if the config
+// does not already cover them, so the runner is looked up there from now on.
+func (a *openstackProvider) recordTarget(t target) error {
+	if slices.Contains(a.configuredTargets(), t) {
+		return nil
+	}
+	// Most runners of a pool target the same cloud and region, so we only take the
+	// lock the first time.
+	if state, err := a.loadState(); err == nil && state.hasTarget(t) {
+		return nil
+	}
+	return a.updateState(func(state *providerState) error {
+		if !state.hasTarget(t) {
+			state.Targets = append(state.Targets, t)
+		}
+		return nil
+	})
+}
+
+// targetClients returns the clients of the configured regions, followed by the clients
+// of the clouds and regions that pools targeted through extra_specs. Runners may have
+// been created in any of them. Recorded targets we can no longer get a client for, for
+// example because the cloud was removed from clouds.yaml, are logged and skipped.
+func (a *openstackProvider) targetClients() ([]*client.OpenstackClient, error) {
+	clients, err := a.regionClients()
+	if err != nil {
+		return nil, err
+	}
+	state, err := a.loadState()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range state.Targets {
+		cli, err := a.getClient(t.Cloud, t.Region)
+		if err != nil {
+			log.Printf("skipping cloud %s region %s: %s", t.Cloud, t.Region, err)
+			continue
+		}
+		// The config may have changed to include a target recorded earlier.
+		if !slices.Contains(clients, cli) {
+			clients = append(clients, cli)
+		}
+	}
+	return clients, nil
+}
+
+// clientForServer returns the client of the cloud and region in which the server exists.
+func (a *openstackProvider) clientForServer(ctx context.Context, instance string) (*client.OpenstackClient, error) {
+	clients, err := a.targetClients()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clients: %w", err)
+	}
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+	cli, _, err := a.findServer(ctx, instance)
+	return cli, err
+}
+
+// findServer looks up a server in all the clouds and regions runners may have been
+// created in, and returns it along with the client it was found with.
+// client.ErrInstanceNotFound is only returned if none of them has the server and all
+// of them could be queried.
+func (a *openstackProvider) findServer(ctx context.Context, instance string) (*client.OpenstackClient, client.ServerWithExt, error) {
+	clients, err := a.targetClients()
+	if err != nil {
+		return nil, client.ServerWithExt{}, fmt.Errorf("failed to get clients: %w", err)
+	}
+	var notFoundErr, lookupErr error
+	for _, cli := range clients {
+		srv, err := cli.GetServer(ctx, instance)
+		if err == nil {
+			return cli, srv, nil
+		}
+		if errors.Is(err, client.ErrInstanceNotFound) {
+			notFoundErr = err
+		} else {
+			lookupErr = err
+		}
+	}
+	if lookupErr != nil {
+		return nil, client.ServerWithExt{}, lookupErr
+	}
+	return nil, client.ServerWithExt{}, notFoundErr
+}
+
+// getClient returns a client for the given cloud and region. Clients are cached, so we
+// don't authenticate again every time a pool targets a cloud other than the default one.
+func (a *openstackProvider) getClient(cloud, region string) (*client.OpenstackClient, error) {
+	if cloud == "" {
+		cloud = a.cfg.Cloud
+	}
+	if region == "" {
+		region = a.cfg.DefaultRegion()
+	}
+	if cloud == a.cfg.Cloud && region == a.cfg.DefaultRegion() {
+		return a.cli, nil
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	key := cloud + "/" + region
+	if cli, ok := a.clients[key]; ok {
+		return cli, nil
+	}
+	cli, err := client.NewClientForCloud(a.cfg, a.controllerID, cloud, region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client for cloud %s: %w", cloud, err)
+	}
+	if a.clients == nil {
+		a.clients = map[string]*client.OpenstackClient{}
+	}
+	a.clients[key] = cli
+	return cli, nil
 }
 
 func openstackServerToInstance(srv client.ServerWithExt) params.ProviderInstance {
+	// Sort the networks, so the addresses are always listed in the same order.
+	networks := make([]string, 0, len(srv.Addresses))
+	for name := range srv.Addresses {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+
 	addresses := []params.Address{}
-	for _, val := range srv.Addresses {
-		addrs, ok := val.([]interface{})
+	for _, name := range networks {
+		addrs, ok := srv.Addresses[name].([]interface{})
 		if !ok {
 			continue
 		}
@@ -99,6 +348,9 @@ func openstackServerToInstance(srv client.ServerWithExt) params.ProviderInstance
 			if addrTypeAsStr != "fixed" && addrTypeAsStr != "floating" {
 				continue
 			}
+			if !validAddressVersion(addrAsStr, addrDetails["version"]) {
+				continue
+			}
 			addresses = append(addresses, params.Address{
 				Address: addrAsStr,
 				Type:    addrTypeMap[addrTypeAsStr],
@@ -110,13 +362,16 @@ func openstackServerToInstance(srv client.ServerWithExt) params.ProviderInstance
 	osType := srv.Metadata["os_type"]
 	osName := srv.Metadata["os_name"]
 	osVersion := srv.Metadata["os_version"]
-	status := statusMap[srv.Status]
+	status, ok := statusMap[srv.Status]
+	if !ok {
+		status = params.InstanceStatusUnknown
+	}
 	instance := params.ProviderInstance{
 		ProviderID: srv.ID,
 		Name:       srv.Name,
 		OSArch:     params.OSArch(arch),
 		OSType:     params.OSType(osType),
-		Status:     params.InstanceStatus(status),
+		Status:     status,
 		OSName:     osName,
 		OSVersion:  osVersion,
 		Addresses:  addresses,
@@ -125,28 +380,368 @@ func openstackServerToInstance(srv client.ServerWithExt) params.ProviderInstance
 	return instance
 }
 
+// serverToInstance converts the server to a garm instance, listing the addresses of the
+// preferred type first, if one is configured.
+func (a *openstackProvider) serverToInstance(srv client.ServerWithExt) params.ProviderInstance {
+	instance := openstackServerToInstance(srv)
+	if a.cfg.PreferredAddressType != "" {
+		sort.SliceStable(instance.Addresses, func(i, j int) bool {
+			return string(instance.Addresses[i].Type) == a.cfg.PreferredAddressType && string(instance.Addresses[j].Type) != a.cfg.PreferredAddressType
+		})
+	}
+	if a.cfg.AddressFamilyPreference != "" {
+		sort.SliceStable(instance.Addresses, func(i, j int) bool {
+			return addressFamily(instance.Addresses[i].Address) == a.cfg.AddressFamilyPreference && addressFamily(instance.Addresses[j].Address) != a.cfg.AddressFamilyPreference
+		})
+	}
+	return instance
+}
+
+// addressFamily returns the family of the IP address.
+func addressFamily(address string) string {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return config.AddressFamilyIPv4
+	default:
+		return config.AddressFamilyIPv6
+	}
+}
+
+// validAddressVersion returns true if address is a valid IP address and matches the
+// IP version reported by nova, if any. garm has no field for the IP version, so the
+// family of an address is always derived from the address itself.
+func validAddressVersion(address string, version interface{}) bool {
+	family := addressFamily(address)
+	if family == "" {
+		return false
+	}
+	// The version is decoded from JSON as a float64.
+	v, ok := version.(float64)
+	if !ok {
+		return true
+	}
+	switch int(v) {
+	case 4:
+		return family == config.AddressFamilyIPv4
+	case 6:
+		return family == config.AddressFamilyIPv6
+	default:
+		return false
+	}
+}
+
+// hasAddressFamily returns true if the server has an address of the given family.
+func hasAddressFamily(srv client.ServerWithExt, family string) bool {
+	for _, addr := range openstackServerToInstance(srv).Addresses {
+		if addressFamily(addr.Address) == family {
+			return true
+		}
+	}
+	return false
+}
+
+// addFloatingIPs adds the floating IPs of the server, as reported by neutron, to the
+// addresses of the instance. Floating IPs attached after boot may take a while to show
+// up in the server addresses reported by nova.
+func (a *openstackProvider) addFloatingIPs(ctx context.Context, cli *client.OpenstackClient, instance *params.ProviderInstance) {
+	if !a.cfg.ReportFloatingIPs {
+		return
+	}
+
+	fips, err := cli.ListServerFloatingIPs(ctx, instance.ProviderID)
+	if err != nil {
+		log.Printf("failed to list floating IPs of %s: %s", instance.Name, err)
+		return
+	}
+	for _, fip := range fips {
+		found := false
+		for _, addr := range instance.Addresses {
+			if addr.Address == fip {
+				found = true
+				break
+			}
+		}
+		if !found {
+			instance.Addresses = append(instance.Addresses, params.Address{
+				Address: fip,
+				Type:    params.PublicAddress,
+			})
+		}
+	}
+}
+
+// checkKeyPairType returns an error if the keypair is not of the wanted type. An empty
+// type matches any keypair.
+func checkKeyPairType(keyPair *keypairs.KeyPair, keyPairType string) error {
+	if keyPairType == "" {
+		return nil
+	}
+	// nova only reports the type starting with microversion 2.2. Older keypairs are
+	// all ssh keypairs.
+	actual := keyPair.Type
+	if actual == "" {
+		actual = config.KeyPairTypeSSH
+	}
+	if actual != keyPairType {
+		return fmt.Errorf("keypair %s is of type %s, expected %s", keyPair.Name, actual, keyPairType)
+	}
+	return nil
+}
+
+// normalizeArch maps the different names used for an architecture by garm, glance and
+// nova to the names used by garm.
+func normalizeArch(arch string) string {
+	switch strings.ToLower(arch) {
+	case "x86_64", "amd64", "x64":
+		return string(params.Amd64)
+	case "aarch64", "arm64":
+		return string(params.Arm64)
+	case "i386", "i686", "x86":
+		return string(params.I386)
+	case "armv7l", "armv7", "armhf", "arm":
+		return string(params.Arm)
+	default:
+		return strings.ToLower(arch)
+	}
+}
+
+// checkArchitecture returns an error naming the component that does not match, if the
+// architecture requested by garm, the architecture property of the image and the arch
+// extra spec of the flavor do not agree. Components that do not set an architecture
+// match any architecture.
+func checkArchitecture(osArch params.OSArch, image images.Image, flavor flavors.Flavor, flavorExtraSpecs map[string]string) error {
+	requested := normalizeArch(string(osArch))
+	imageArch, _ := image.Properties["architecture"].(string)
+	imageArch = normalizeArch(imageArch)
+	flavorArch := normalizeArch(flavorExtraSpecs["arch"])
+
+	if requested != "" && imageArch != "" && requested != imageArch {
+		return fmt.Errorf("image %s has architecture %s, but the runner needs %s", image.Name, imageArch, requested)
+	}
+	if requested != "" && flavorArch != "" && requested != flavorArch {
+		return fmt.Errorf("flavor %s has architecture %s, but the runner needs %s", flavor.Name, flavorArch, requested)
+	}
+	if imageArch != "" && flavorArch != "" && imageArch != flavorArch {
+		return fmt.Errorf("image %s has architecture %s, but flavor %s has architecture %s", image.Name, imageArch, flavor.Name, flavorArch)
+	}
+	return nil
+}
+
+// verifyArchitecture checks that the architecture of the image and of every candidate
+// flavor match the architecture garm requested, according to the architecture_check
+// setting.
+func (a *openstackProvider) verifyArchitecture(ctx context.Context, cli *client.OpenstackClient, spec *machineSpec, image images.Image, candidateFlavors []flavors.Flavor) error {
+	if a.cfg.ArchitectureCheck == "" || a.cfg.ArchitectureCheck == config.ArchitectureCheckDisabled {
+		return nil
+	}
+	for _, flavor := range candidateFlavors {
+		extraSpecs, err := cli.GetFlavorExtraSpecs(ctx, flavor.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkArchitecture(spec.BootstrapParams.OSArch, image, flavor, extraSpecs); err != nil {
+			if a.cfg.ArchitectureCheck != config.ArchitectureCheckEnforce {
+				log.Printf("architecture mismatch for %s: %s", spec.BootstrapParams.Name, err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// setDefaultSecurityGroup explicitly applies the default security group of the project
+// if no security groups were set and the provider is configured to do so.
+func (a *openstackProvider) setDefaultSecurityGroup(ctx context.Context, cli *client.OpenstackClient, spec *machineSpec) error {
+	if !a.cfg.ResolveDefaultSecurityGroup || len(spec.SecurityGroups) > 0 {
+		return nil
+	}
+
+	secGroup, err := cli.GetDefaultSecurityGroup(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to resolve default security group: %w", err)
+	}
+	log.Printf("no security groups set for %s, using default security group %s", spec.BootstrapParams.Name, secGroup.ID)
+	spec.SecurityGroups = []string{secGroup.ID}
+	return nil
+}
+
+// toClientRule converts the rule to a managed security group rule. The ether type is
+// derived from the remote CIDR or the protocol, and defaults to IPv4.
+func (r securityGroupRule) toClientRule() client.SecurityGroupRule {
+	rule := client.SecurityGroupRule{
+		Direction:     r.Direction,
+		EtherType:     "IPv4",
+		Protocol:      r.Protocol,
+		PortRangeMin:  r.PortRangeMin,
+		PortRangeMax:  r.PortRangeMax,
+		RemoteGroupID: r.RemoteGroupID,
+	}
+	if rule.Direction == "" {
+		rule.Direction = "ingress"
+	}
+	if r.Protocol == "ipv6-icmp" {
+		rule.EtherType = "IPv6"
+	}
+	if r.RemoteIPPrefix != "" {
+		// Neutron stores the network address of the CIDR.
+		ip, cidr, _ := net.ParseCIDR(r.RemoteIPPrefix)
+		rule.RemoteIPPrefix = cidr.String()
+		if ip.To4() == nil {
+			rule.EtherType = "IPv6"
+		}
+	}
+	return rule
+}
+
+// setManagedSecurityGroup reconciles the security group managed for the pool, and adds
+// it to the security groups of the runner.
+func (a *openstackProvider) setManagedSecurityGroup(ctx context.Context, cli *client.OpenstackClient, budget *retryBudget, spec *machineSpec) error {
+	if len(spec.SecurityGroupRules) == 0 {
+		return nil
+	}
+	wanted := make([]client.SecurityGroupRule, 0, len(spec.SecurityGroupRules))
+	for _, rule := range spec.SecurityGroupRules {
+		wanted = append(wanted, rule.toClientRule())
+	}
+	var secGroup *groups.SecGroup
+	if err := budget.run(ctx, func() (err error) {
+		secGroup, err = cli.EnsureSecurityGroup(ctx, spec.BootstrapParams.PoolID, wanted)
+		return err
+	}); err != nil {
+		return err
+	}
+	spec.SecurityGroups = append(spec.SecurityGroups, secGroup.ID)
+	return nil
+}
+
 // CreateInstance creates a new compute instance in the provider.
 func (a *openstackProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
 	spec, err := NewMachineSpec(bootstrapParams, a.cfg, a.controllerID)
 	if err != nil {
 		return params.ProviderInstance{}, fmt.Errorf("failed to build machine spec: %w", err)
 	}
-	flavor, err := a.cli.GetFlavor(spec.Flavor)
+
+	// All operations below share the same retry budget, and are bound by the
+	// create timeout. This includes waiting for the server to become ACTIVE.
+	createTimeout := time.Duration(spec.CreateTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
+	budget := newRetryBudget(a.cfg.CreateMaxRetries, createTimeout, defaultRetryInterval)
+	if spec.Region == "" {
+		spec.Region, err = a.selectRegion()
+		if err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to select region: %w", err)
+		}
+	}
+	cli, err := a.getClient(spec.Cloud, spec.Region)
 	if err != nil {
-		return params.ProviderInstance{}, fmt.Errorf("failed to resolve flavor %s: %w", bootstrapParams.Flavor, err)
+		return params.ProviderInstance{}, fmt.Errorf("failed to get client: %w", err)
+	}
+	// The target is recorded before the server is created, so it can be found even
+	// if we fail halfway through.
+	target := a.targetFor(spec.Cloud, spec.Region)
+	if err := a.recordTarget(target); err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("failed to record cloud and region: %w", err)
+	}
+	spec.Properties[cloudKey] = target.Cloud
+	if target.Region != "" {
+		spec.Properties[regionKey] = target.Region
+	}
+	if (spec.BootFromVolume || len(spec.DataDisks) > 0) && !cli.HasVolumeService() {
+		return params.ProviderInstance{}, fmt.Errorf("boot_from_volume and data_disks can not be used: %w", client.ErrVolumeServiceUnavailable)
 	}
 
-	net, err := a.cli.GetNetwork(spec.NetworkID)
-	if err != nil {
+	if err := a.setDefaultSecurityGroup(ctx, cli, spec); err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("failed to set default security group: %w", err)
+	}
+
+	// The managed security group is added by ID, so we resolve the names first.
+	if len(spec.SecurityGroups) > 0 {
+		secGroups, err := cli.ResolveSecurityGroups(ctx, spec.SecurityGroups)
+		if err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to resolve security groups: %w", err)
+		}
+		spec.SecurityGroups = secGroups
+	}
+
+	if err := a.setManagedSecurityGroup(ctx, cli, budget, spec); err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("failed to set managed security group: %w", err)
+	}
+
+	if a.cfg.ServerGroupPolicy != "" && (spec.SchedulerHints == nil || spec.SchedulerHints.Group == "") {
+		var group *servergroups.ServerGroup
+		if err := budget.run(ctx, func() (err error) {
+			group, err = cli.EnsureServerGroup(ctx, bootstrapParams.PoolID, a.cfg.ServerGroupPolicy)
+			return err
+		}); err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to get server group: %w", err)
+		}
+		if spec.SchedulerHints == nil {
+			spec.SchedulerHints = &schedulerHints{}
+		}
+		spec.SchedulerHints.Group = group.ID
+	}
+
+	// Fail early if the keypair does not exist, instead of letting nova reject the boot.
+	if spec.KeyName != "" {
+		var keyPair *keypairs.KeyPair
+		if err := budget.run(ctx, func() (err error) {
+			keyPair, err = cli.GetKeyPair(ctx, spec.KeyName)
+			return err
+		}); err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to resolve keypair %s: %w", spec.KeyName, err)
+		}
+		if err := checkKeyPairType(keyPair, spec.KeyPairType); err != nil {
+			return params.ProviderInstance{}, err
+		}
+	}
+
+	// The fallback flavors are resolved upfront, so we fail early if any of them
+	// does not exist.
+	var candidateFlavors []flavors.Flavor
+	for _, flavorName := range append([]string{spec.Flavor}, spec.FlavorFallbacks...) {
+		var flavor *flavors.Flavor
+		if err := budget.run(ctx, func() (err error) {
+			flavor, err = cli.GetFlavor(ctx, flavorName)
+			return err
+		}); err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to resolve flavor %s: %w", flavorName, err)
+		}
+		candidateFlavors = append(candidateFlavors, *flavor)
+	}
+
+	net := &networks.Network{}
+	if len(spec.Ports) > 0 {
+		for _, portID := range spec.Ports {
+			if err := a.verifyPort(ctx, cli, budget, portID); err != nil {
+				return params.ProviderInstance{}, err
+			}
+		}
+	} else if len(spec.Networks) > 0 {
+		if err := a.resolveNetworks(ctx, cli, budget, spec); err != nil {
+			return params.ProviderInstance{}, err
+		}
+	} else if err := budget.run(ctx, func() (err error) {
+		net, err = cli.GetNetwork(ctx, spec.NetworkID)
+		return err
+	}); err != nil {
 		return params.ProviderInstance{}, fmt.Errorf("failed to resolve network %s: %w", spec.NetworkID, err)
 	}
 
-	image, err := a.cli.GetImage(spec.Image, spec.ImageVisibility)
-	if err != nil {
+	var image *images.Image
+	if err := budget.run(ctx, func() (err error) {
+		image, err = cli.GetImage(ctx, spec.Image, spec.ImageVisibility, spec.AllowedImageOwners)
+		return err
+	}); err != nil {
 		return params.ProviderInstance{}, fmt.Errorf("failed to resolve image info: %w", err)
 	}
 
-	// verify owner
+	// Images looked up by name are already filtered by owner, but images passed in by ID
+	// are not.
 	if len(spec.AllowedImageOwners) > 0 {
 		allowed := false
 		for _, owner := range spec.AllowedImageOwners {
@@ -160,71 +755,567 @@ func (a *openstackProvider) CreateInstance(ctx context.Context, bootstrapParams
 		}
 	}
 
+	if err := spec.ValidateImageDiskFormat(*image); err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("failed to validate image: %w", err)
+	}
+
 	spec.SetSpecFromImage(*image)
 
-	srvCreateOpts, err := spec.GetServerCreateOpts(*flavor, *net, *image)
+	if err := a.verifyArchitecture(ctx, cli, spec, *image, candidateFlavors); err != nil {
+		return params.ProviderInstance{}, fmt.Errorf("failed to verify architecture: %w", err)
+	}
+
+	if spec.ImageRefOverride != "" {
+		var overrideImage *images.Image
+		if err := budget.run(ctx, func() (err error) {
+			overrideImage, err = cli.GetImage(ctx, spec.ImageRefOverride, spec.ImageVisibility, nil)
+			return err
+		}); err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to resolve image_ref_override %s: %w", spec.ImageRefOverride, err)
+		}
+		spec.ImageRefOverride = overrideImage.ID
+		// The server boots as the override image, so its disk bus is used.
+		spec.SetDiskBusFromImage(*overrideImage)
+	}
+
+	createdPorts, err := a.createPorts(ctx, cli, budget, spec, *net)
 	if err != nil {
-		return params.ProviderInstance{}, fmt.Errorf("failed to get server create options: %w", err)
+		return params.ProviderInstance{}, fmt.Errorf("failed to create ports: %w", err)
 	}
+	created := false
+	defer func() {
+		// Once the runner is created, the ports are removed along with it.
+		if !created {
+			a.deletePorts(context.WithoutCancel(ctx), cli, createdPorts)
+		}
+	}()
 
 	var srv client.ServerWithExt
-	if !spec.BootFromVolume {
-		srv, err = a.cli.CreateServerFromImage(srvCreateOpts)
+	for attempt := 0; ; attempt++ {
+		srv, err = a.createServerWithFlavors(ctx, cli, spec, candidateFlavors, *net, *image)
 		if err != nil {
-			return params.ProviderInstance{}, fmt.Errorf("failed to create server: %w", err)
+			return params.ProviderInstance{}, err
 		}
-	} else {
-		createOption, err := spec.GetBootFromVolumeOpts(srvCreateOpts)
+		if a.cfg.AddressFamilyMaxRecreates == 0 || a.cfg.AsyncCreate || hasAddressFamily(srv, a.cfg.AddressFamilyPreference) {
+			break
+		}
+
+		// The runner is not reachable by garm, so we replace it.
+		if err := cli.DeleteServer(ctx, srv.ID, true, false); err != nil {
+			return params.ProviderInstance{}, fmt.Errorf("failed to delete server %s without an %s address: %w", srv.ID, a.cfg.AddressFamilyPreference, err)
+		}
+		if attempt >= a.cfg.AddressFamilyMaxRecreates {
+			return params.ProviderInstance{}, fmt.Errorf("server has no %s address after %d attempts", a.cfg.AddressFamilyPreference, attempt+1)
+		}
+		log.Printf("server %s of %s has no %s address, creating it again", srv.ID, spec.BootstrapParams.Name, a.cfg.AddressFamilyPreference)
+	}
+
+	if a.cfg.VerifyTags {
+		if err := cli.VerifyServerTags(ctx, srv.ID, spec.Tags); err != nil {
+			// A runner garm can not see is of no use, so we remove it and let garm retry.
+			if delErr := cli.DeleteServer(context.WithoutCancel(ctx), srv.ID, true, false); delErr != nil {
+				log.Printf("failed to delete server %s: %s", srv.ID, delErr)
+			}
+			return params.ProviderInstance{}, fmt.Errorf("failed to verify tags of server: %w", err)
+		}
+	}
+
+	var floatingIP string
+	if spec.AllocateFloatingIP {
+		floatingIP, err = a.associateFloatingIP(ctx, cli, spec, srv.ID)
 		if err != nil {
-			return params.ProviderInstance{}, fmt.Errorf("failed to get boot from volume create options: %w", err)
+			if delErr := cli.DeleteServer(context.WithoutCancel(ctx), srv.ID, true, false); delErr != nil {
+				log.Printf("failed to delete server %s: %s", srv.ID, delErr)
+			}
+			return params.ProviderInstance{}, fmt.Errorf("failed to associate floating IP: %w", err)
+		}
+	}
+
+	if a.cfg.RecordHostAggregates && !a.cfg.AsyncCreate {
+		// The runner is usable even if we fail to record the aggregates.
+		if err := a.recordHostAggregates(ctx, cli, srv.ID); err != nil {
+			log.Printf("failed to record host aggregates of %s: %s", srv.ID, err)
+		}
+	}
+
+	instance := a.serverToInstance(srv)
+	if floatingIP != "" {
+		// Nova reports the floating IP in the server addresses only once neutron
+		// notified it, so we add it ourselves.
+		instance.Addresses = append(instance.Addresses, params.Address{
+			Address: floatingIP,
+			Type:    params.PublicAddress,
+		})
+	}
+	created = true
+	return instance, nil
+}
+
+// associateFloatingIP allocates a floating IP for the server, and records it in the
+// metadata of the server, so we know it has to be released when the server is removed.
+// If the metadata can not be set, the floating IP is released right away.
+func (a *openstackProvider) associateFloatingIP(ctx context.Context, cli *client.OpenstackClient, spec *machineSpec, serverID string) (string, error) {
+	floatingIP, err := cli.AssociateFloatingIP(ctx, serverID, spec.FloatingIPNetwork, spec.BootstrapParams.PoolID)
+	if err != nil {
+		return "", err
+	}
+	if err := cli.UpdateServerMetadata(ctx, serverID, map[string]string{floatingIPKey: floatingIP}); err != nil {
+		if relErr := cli.ReleaseFloatingIP(context.WithoutCancel(ctx), serverID); relErr != nil {
+			log.Printf("failed to release floating IP of %s: %s", serverID, relErr)
 		}
-		srv, err = a.cli.CreateServerFromVolume(createOption, spec.BootstrapParams.Name)
+		return "", fmt.Errorf("failed to record floating IP: %w", err)
+	}
+	return floatingIP, nil
+}
+
+// releaseFloatingIP releases the floating IP allocated for the server, if any. Floating
+// IPs that we fail to release here are removed by PruneOrphanedResources, once the
+// server is gone.
+func (a *openstackProvider) releaseFloatingIP(ctx context.Context, cli *client.OpenstackClient, srv client.ServerWithExt) {
+	if srv.Metadata[floatingIPKey] == "" {
+		return
+	}
+	if err := cli.ReleaseFloatingIP(ctx, srv.ID); err != nil {
+		log.Printf("failed to release floating IP of %s: %s", srv.ID, err)
+	}
+}
+
+// createPorts creates the ports that nova can not create for the runner: ports with a
+// static IP, and ports with DNS nameservers. The ports are attached to the runner instead
+// of their network. The static network config of the runner is taken from the port, so it
+// always matches the port the runner gets. The ports are recorded in the metadata of the
+// server, so they are removed along with it.
+func (a *openstackProvider) createPorts(ctx context.Context, cli *client.OpenstackClient, budget *retryBudget, spec *machineSpec, net networks.Network) (portIDs []string, err error) {
+	defer func() {
 		if err != nil {
-			return params.ProviderInstance{}, fmt.Errorf("failed to create server: %w", err)
+			a.deletePorts(context.WithoutCancel(ctx), cli, portIDs)
+		}
+	}()
+
+	// Without networks in extra_specs, the runner is connected to the default network.
+	if len(spec.DNSNameservers) > 0 && len(spec.Networks) == 0 && len(spec.Ports) == 0 {
+		spec.Networks = []serverNetwork{{NetworkID: net.ID}}
+	}
+
+	for idx, network := range spec.Networks {
+		if network.PortID != "" || (!network.StaticIP && len(spec.DNSNameservers) == 0) {
+			continue
+		}
+		var subnet *subnets.Subnet
+		if network.StaticIP {
+			if err := budget.run(ctx, func() (err error) {
+				subnet, err = cli.GetSubnet(ctx, network.SubnetID)
+				return err
+			}); err != nil {
+				return portIDs, fmt.Errorf("failed to resolve subnet %s: %w", network.SubnetID, err)
+			}
+		}
+		port, err := cli.CreatePort(ctx, client.CreatePortOpts{
+			NetworkID:      network.NetworkID,
+			SubnetID:       network.SubnetID,
+			FixedIP:        network.FixedIP,
+			SecurityGroups: spec.SecurityGroups,
+			DNSNameservers: spec.DNSNameservers,
+		}, spec.BootstrapParams.PoolID)
+		if err != nil {
+			return portIDs, err
+		}
+		portIDs = append(portIDs, port.ID)
+		spec.Networks[idx] = serverNetwork{PortID: port.ID}
+
+		if !network.StaticIP {
+			continue
+		}
+		staticNetwork, err := newStaticNetwork(*port, *subnet, network.FixedIP)
+		if err != nil {
+			return portIDs, err
+		}
+		if len(spec.DNSNameservers) > 0 {
+			staticNetwork.DNSServers = spec.DNSNameservers
+		}
+		spec.StaticNetworks = append(spec.StaticNetworks, staticNetwork)
+	}
+	if len(portIDs) > 0 {
+		spec.Properties[staticPortsKey] = strings.Join(portIDs, ",")
+	}
+	return portIDs, nil
+}
+
+// deletePorts removes the ports created for the runner. Ports that we fail to remove
+// here are removed by PruneOrphanedResources.
+func (a *openstackProvider) deletePorts(ctx context.Context, cli *client.OpenstackClient, portIDs []string) {
+	for _, portID := range portIDs {
+		if err := cli.DeletePort(ctx, portID); err != nil {
+			log.Printf("failed to delete port %s: %s", portID, err)
+		}
+	}
+}
+
+// recordHostAggregates stores the names of the host aggregates of the compute host the
+// server runs on, in the metadata of the server.
+func (a *openstackProvider) recordHostAggregates(ctx context.Context, cli *client.OpenstackClient, serverID string) error {
+	host, err := cli.GetServerHost(ctx, serverID)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("the host of the server is not visible; admin privileges are required")
+	}
+	aggregates, err := cli.ListHostAggregates(ctx, host)
+	if err != nil {
+		return err
+	}
+	value := strings.Join(aggregates, ",")
+	if len(value) > maxMetadataValueLength {
+		return fmt.Errorf("host aggregates of host %s exceed the maximum metadata value length", host)
+	}
+	return cli.UpdateServerMetadata(ctx, serverID, map[string]string{hostAggregatesKey: value})
+}
+
+// createServerWithFlavors tries each flavor in order, until one of them can be scheduled.
+func (a *openstackProvider) createServerWithFlavors(ctx context.Context, cli *client.OpenstackClient, spec *machineSpec, candidateFlavors []flavors.Flavor, net networks.Network, image images.Image) (client.ServerWithExt, error) {
+	for idx, flavor := range candidateFlavors {
+		srv, err := a.createServerWithStorageBackends(ctx, cli, spec, flavor, net, image)
+		if err == nil {
+			return srv, nil
+		}
+		if !errors.Is(err, client.ErrNoValidHost) || idx == len(candidateFlavors)-1 {
+			return client.ServerWithExt{}, err
+		}
+		log.Printf("failed to schedule %s with flavor %s, trying the next flavor: %s", spec.BootstrapParams.Name, flavor.Name, err)
+	}
+	return client.ServerWithExt{}, fmt.Errorf("no flavors to try")
+}
+
+// createServerWithStorageBackends tries the volume type of the volumes and then each of the
+// storage backend fallbacks, until the volumes of the server can be created. The volume
+// type that was used is recorded in the server metadata.
+func (a *openstackProvider) createServerWithStorageBackends(ctx context.Context, cli *client.OpenstackClient, spec *machineSpec, flavor flavors.Flavor, net networks.Network, image images.Image) (client.ServerWithExt, error) {
+	volumeType := spec.fallbackVolumeType()
+	if len(spec.StorageBackendFallbacks) == 0 || volumeType == nil {
+		return a.createServerRetryingImageDownload(ctx, cli, spec, flavor, net, image)
+	}
+
+	backends := append([]string{*volumeType}, spec.StorageBackendFallbacks...)
+	// The next flavor starts over with the first volume type.
+	defer func() {
+		*volumeType = backends[0]
+	}()
+	for idx, backend := range backends {
+		*volumeType = backend
+		spec.Properties[storageBackendKey] = backend
+		srv, err := a.createServerRetryingImageDownload(ctx, cli, spec, flavor, net, image)
+		if err == nil {
+			return srv, nil
+		}
+		if !errors.Is(err, client.ErrVolumeCreateFailed) || idx == len(backends)-1 {
+			return srv, err
+		}
+		log.Printf("failed to create the volumes of %s with volume type %q, trying %q: %s", spec.BootstrapParams.Name, backend, backends[idx+1], err)
+	}
+	return client.ServerWithExt{}, fmt.Errorf("no storage backends to try")
+}
+
+// createServerRetryingImageDownload creates the server again, if it failed because the
+// compute host could not download the image, up to image_download_retries times.
+func (a *openstackProvider) createServerRetryingImageDownload(ctx context.Context, cli *client.OpenstackClient, spec *machineSpec, flavor flavors.Flavor, net networks.Network, image images.Image) (client.ServerWithExt, error) {
+	for attempt := 0; ; attempt++ {
+		srv, err := a.createServer(ctx, cli, spec, flavor, net, image)
+		if err == nil || !errors.Is(err, client.ErrImageDownloadFailed) || attempt >= a.cfg.ImageDownloadRetries {
+			return srv, err
+		}
+		log.Printf("failed to download the image of %s, creating it again: %s", spec.BootstrapParams.Name, err)
+	}
+}
+
+// verifyPort makes sure the port exists and is not attached to another server, so we
+// fail before asking nova to boot the server.
+func (a *openstackProvider) verifyPort(ctx context.Context, cli *client.OpenstackClient, budget *retryBudget, portID string) error {
+	var port *ports.Port
+	if err := budget.run(ctx, func() (err error) {
+		port, err = cli.GetPort(ctx, portID)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to resolve port %s: %w", portID, err)
+	}
+	if port.DeviceID != "" {
+		return fmt.Errorf("port %s is already attached to %s", portID, port.DeviceID)
+	}
+	return nil
+}
+
+// resolveNetworks verifies the ports and resolves the network names set in the networks
+// extra spec to IDs. It also verifies that the requested fixed IPs belong to the
+// requested subnets.
+func (a *openstackProvider) resolveNetworks(ctx context.Context, cli *client.OpenstackClient, budget *retryBudget, spec *machineSpec) error {
+	for idx, network := range spec.Networks {
+		if network.PortID != "" {
+			if err := a.verifyPort(ctx, cli, budget, network.PortID); err != nil {
+				return err
+			}
+			continue
+		}
+		var resolved *networks.Network
+		if err := budget.run(ctx, func() (err error) {
+			resolved, err = cli.GetNetwork(ctx, network.NetworkID)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to resolve network %s: %w", network.NetworkID, err)
+		}
+		spec.Networks[idx].NetworkID = resolved.ID
+
+		if network.SubnetID == "" {
+			continue
+		}
+		var subnet *subnets.Subnet
+		if err := budget.run(ctx, func() (err error) {
+			subnet, err = cli.GetSubnet(ctx, network.SubnetID)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to resolve subnet %s: %w", network.SubnetID, err)
+		}
+		if subnet.NetworkID != resolved.ID {
+			return fmt.Errorf("subnet %s does not belong to network %s", network.SubnetID, network.NetworkID)
+		}
+		_, cidr, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			return fmt.Errorf("failed to parse CIDR of subnet %s: %w", network.SubnetID, err)
+		}
+		if !cidr.Contains(net.ParseIP(network.FixedIP)) {
+			return fmt.Errorf("fixed IP %s is not in subnet %s (%s)", network.FixedIP, network.SubnetID, subnet.CIDR)
 		}
 	}
-	return openstackServerToInstance(srv), nil
+	return nil
+}
+
+// createServer creates the server using the given flavor. The flavor is recorded in
+// the server metadata.
+func (a *openstackProvider) createServer(ctx context.Context, cli *client.OpenstackClient, spec *machineSpec, flavor flavors.Flavor, net networks.Network, image images.Image) (client.ServerWithExt, error) {
+	spec.setBootDiskSizeForFlavor(flavor)
+	if a.cfg.CheckQuotaBeforeCreate {
+		volumes, volumeSize := len(spec.DataDisks), spec.dataDisksSize()
+		if spec.BootFromVolume {
+			volumes++
+			// The size of a copy of root_volume_id is the size of the original, which
+			// we don't look up.
+			if spec.RootVolumeID == "" {
+				volumeSize += int(spec.BootDiskSize)
+			}
+		}
+		if err := cli.CheckQuota(ctx, flavor, volumes, volumeSize); err != nil {
+			return client.ServerWithExt{}, fmt.Errorf("quota check failed: %w", err)
+		}
+	}
+
+	spec.Properties[flavorKey] = flavor.Name
+	srvCreateOpts, err := spec.GetServerCreateOpts(flavor, net, image)
+	if err != nil {
+		return client.ServerWithExt{}, fmt.Errorf("failed to get server create options: %w", err)
+	}
+
+	// The server create is not retried with the budget. A request that failed with a
+	// server error or timed out may still have been accepted by nova, and creating
+	// the server again would leave a duplicate runner behind.
+	var srv client.ServerWithExt
+	if !spec.BootFromVolume && len(spec.DataDisks) > 0 {
+		srv, err = cli.CreateServerFromVolume(ctx, spec.GetDataDisksOpts(srvCreateOpts), spec.BootstrapParams.Name)
+	} else if !spec.BootFromVolume {
+		srv, err = cli.CreateServerFromImage(ctx, spec.serverCreateOptsBuilder(srvCreateOpts), spec.BootstrapParams.Name)
+	} else {
+		createOption, optsErr := spec.GetBootFromVolumeOpts(srvCreateOpts)
+		if optsErr != nil {
+			return client.ServerWithExt{}, fmt.Errorf("failed to get boot from volume create options: %w", optsErr)
+		}
+		if spec.RootVolumeID == "" {
+			srv, err = cli.CreateServerFromVolume(ctx, createOption, spec.BootstrapParams.Name)
+		} else {
+			srv, err = a.createServerFromVolumeCopy(ctx, cli, spec, createOption)
+		}
+	}
+	if err != nil {
+		return client.ServerWithExt{}, fmt.Errorf("failed to create server: %w", err)
+	}
+	return srv, nil
 }
 
-// Delete instance will delete the instance in a provider.
+// createServerFromVolumeCopy creates a server that boots from its own copy of
+// root_volume_id, so runners never share a root disk. The copy is removed with the
+// server, or right away if the server could not be created.
+func (a *openstackProvider) createServerFromVolumeCopy(ctx context.Context, cli *client.OpenstackClient, spec *machineSpec, createOption bootfromvolume.CreateOptsExt) (client.ServerWithExt, error) {
+	volumeID, err := cli.CloneVolume(ctx, spec.RootVolumeID, spec.BootstrapParams.Name, spec.AvailabilityZone)
+	if err != nil {
+		return client.ServerWithExt{}, err
+	}
+	// GetBootFromVolumeOpts always puts the root volume first.
+	createOption.BlockDevice = slices.Clone(createOption.BlockDevice)
+	createOption.BlockDevice[0].UUID = volumeID
+	createOption.BlockDevice[0].DeleteOnTermination = true
+
+	srv, err := cli.CreateServerFromVolume(ctx, createOption, spec.BootstrapParams.Name)
+	if err != nil {
+		// A server kept in ERROR state still uses the copy, and removes it when it
+		// is deleted.
+		if delErr := cli.DeleteVolume(context.WithoutCancel(ctx), volumeID); delErr != nil {
+			log.Printf("failed to clean up volume %s: %s", volumeID, delErr)
+		}
+		return client.ServerWithExt{}, err
+	}
+	return srv, nil
+}
+
+// Delete instance will delete the instance in a provider. Servers that are kept in
+// ERROR state for error_server_grace_period are left in place until the grace period
+// is over.
 func (a *openstackProvider) DeleteInstance(ctx context.Context, instance string) error {
-	if err := a.cli.DeleteServer(instance, true); err != nil {
-		return fmt.Errorf("failed to delete server: %w", err)
+	clients, err := a.targetClients()
+	if err != nil {
+		return fmt.Errorf("failed to get clients: %w", err)
+	}
+	// The server may already be gone, in which case there is nothing to release.
+	srvCli, srv, findErr := a.findServer(ctx, instance)
+	if findErr == nil && srvCli.InErrorGracePeriod(srv) {
+		// garm removes runners that fail to be created right away. Servers kept in
+		// ERROR state are left for -cleanup-errored-servers, so they can be inspected.
+		log.Printf("keeping server %s in ERROR state until its grace period is over", srv.ID)
+		return nil
+	}
+	if findErr == nil {
+		// The floating IP has to be released while the port of the server still exists.
+		a.releaseFloatingIP(ctx, srvCli, srv)
+		// Delete the server we found, which is the one the name collision strategy
+		// picked, if other servers have the same name.
+		clients = []*client.OpenstackClient{srvCli}
+		instance = srv.ID
+	}
+	for _, cli := range clients {
+		if err := cli.DeleteServer(ctx, instance, true, false); err != nil {
+			return fmt.Errorf("failed to delete server: %w", err)
+		}
+	}
+	if findErr == nil && srv.Metadata[staticPortsKey] != "" {
+		a.deletePorts(ctx, srvCli, strings.Split(srv.Metadata[staticPortsKey], ","))
 	}
 	return nil
 }
 
-// GetInstance will return details about one instance.
+// GetInstance will return details about one instance. If the server does not exist,
+// the error wraps client.ErrInstanceNotFound, which garm reports as not found.
 func (a *openstackProvider) GetInstance(ctx context.Context, instance string) (params.ProviderInstance, error) {
-	srv, err := a.cli.GetServer(instance)
+	cli, srv, err := a.findServer(ctx, instance)
 	if err != nil {
 		return params.ProviderInstance{}, fmt.Errorf("failed to get server: %w", err)
 	}
-	return openstackServerToInstance(srv), nil
+	ret := a.serverToInstance(srv)
+	a.addFloatingIPs(ctx, cli, &ret)
+	return ret, nil
 }
 
 // ListInstances will list all instances for a provider.
 func (a *openstackProvider) ListInstances(ctx context.Context, poolID string) ([]params.ProviderInstance, error) {
-	servers, err := a.cli.ListServers(poolID)
+	clients, err := a.targetClients()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list servers: %w", err)
+		return nil, fmt.Errorf("failed to get clients: %w", err)
 	}
 
-	ret := make([]params.ProviderInstance, len(servers))
-	for idx, srv := range servers {
-		ret[idx] = openstackServerToInstance(srv)
+	ret := []params.ProviderInstance{}
+	for _, cli := range clients {
+		servers, err := cli.ListServers(ctx, poolID)
+		if err != nil {
+			// garm discards the result if we return an error, so we return the
+			// servers we know about instead.
+			if !errors.Is(err, client.ErrPartialList) {
+				return nil, fmt.Errorf("failed to list servers: %w", err)
+			}
+			log.Printf("returning a partial list of the servers in pool %s: %s", poolID, err)
+		}
+		instances := []params.ProviderInstance{}
+		for _, srv := range servers {
+			// Soft deleted servers are removed once the reclaim window of the cloud
+			// expires.
+			if a.cfg.HideSoftDeletedServers && srv.Status == "SOFT_DELETED" {
+				continue
+			}
+			instances = append(instances, a.serverToInstance(srv))
+		}
+		a.forEachParallel(len(instances), func(idx int) {
+			a.addFloatingIPs(ctx, cli, &instances[idx])
+		})
+		ret = append(ret, instances...)
 	}
 	return ret, nil
 }
 
-// RemoveAllInstances will remove all instances created by this provider.
+// forEachParallel calls fn for every index from 0 to n-1, running at most list_workers
+// calls at a time. Results should be stored by index, so their order does not depend
+// on which call finishes first.
+func (a *openstackProvider) forEachParallel(n int, fn func(idx int)) {
+	workers := a.cfg.ListWorkers
+	if workers <= 0 {
+		workers = defaultListWorkers
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for idx := 0; idx < n; idx++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(idx)
+		}()
+	}
+	wg.Wait()
+}
+
+// ListInstancesCreatedBefore returns the instances of the pool that were created before
+// the given time. This can be used to find long lived runners that should be retired.
+func (a *openstackProvider) ListInstancesCreatedBefore(ctx context.Context, poolID string, t time.Time) ([]params.ProviderInstance, error) {
+	clients, err := a.targetClients()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clients: %w", err)
+	}
+
+	ret := []params.ProviderInstance{}
+	for _, cli := range clients {
+		servers, err := cli.ListServers(ctx, poolID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list servers: %w", err)
+		}
+		for _, srv := range servers {
+			if !srv.Created.Before(t) {
+				continue
+			}
+			ret = append(ret, a.serverToInstance(srv))
+		}
+	}
+	return ret, nil
+}
+
+// RemoveAllInstances will remove all instances created by this provider. Servers are
+// removed by garm one by one, so we only clean up the auxiliary resources that are no
+// longer used by any server.
 func (a *openstackProvider) RemoveAllInstances(ctx context.Context) error {
+	clients, err := a.targetClients()
+	if err != nil {
+		return fmt.Errorf("failed to get clients: %w", err)
+	}
+	for _, cli := range clients {
+		if err := cli.PruneOrphanedResources(ctx); err != nil {
+			return fmt.Errorf("failed to prune orphaned resources: %w", err)
+		}
+	}
 	return nil
 }
 
 // Stop shuts down the instance.
 func (a *openstackProvider) Stop(ctx context.Context, instance string, force bool) error {
-	if err := a.cli.StopServer(instance); err != nil {
+	cli, err := a.clientForServer(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	if err := cli.StopServer(ctx, instance, force); err != nil {
 		return fmt.Errorf("failed to stop server: %w", err)
 	}
 	return nil
@@ -232,12 +1323,84 @@ func (a *openstackProvider) Stop(ctx context.Context, instance string, force boo
 
 // Start boots up an instance.
 func (a *openstackProvider) Start(ctx context.Context, instance string) error {
-	if err := a.cli.StartServer(instance); err != nil {
+	cli, err := a.clientForServer(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	if err := cli.StartServer(ctx, instance); err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 	return nil
 }
 
+// Reboot restarts an instance, which is lighter than recreating a runner that is stuck.
+// A soft reboot is done, unless hard is set.
+func (a *openstackProvider) Reboot(ctx context.Context, instance string, hard bool) error {
+	cli, err := a.clientForServer(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	if err := cli.RebootServer(ctx, instance, hard); err != nil {
+		return fmt.Errorf("failed to reboot server: %w", err)
+	}
+	return nil
+}
+
+// Rescue boots an instance from a rescue image, so the logs of a runner with a broken
+// root filesystem can be recovered before it is deleted. The image of the instance is
+// used if rescueImage is empty.
+func (a *openstackProvider) Rescue(ctx context.Context, instance, rescueImage string) error {
+	cli, err := a.clientForServer(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	if err := cli.RescueServer(ctx, instance, rescueImage); err != nil {
+		return fmt.Errorf("failed to rescue server: %w", err)
+	}
+	return nil
+}
+
+// Unrescue boots a rescued instance from its own root disk again.
+func (a *openstackProvider) Unrescue(ctx context.Context, instance string) error {
+	cli, err := a.clientForServer(ctx, instance)
+	if err != nil {
+		return fmt.Errorf("failed to get server: %w", err)
+	}
+	if err := cli.UnrescueServer(ctx, instance); err != nil {
+		return fmt.Errorf("failed to unrescue server: %w", err)
+	}
+	return nil
+}
+
+// GetConsoleOutput returns the last length lines of the console log of an instance,
+// which helps figure out why a runner never registered.
+func (a *openstackProvider) GetConsoleOutput(ctx context.Context, instance string, length int) (string, error) {
+	cli, err := a.clientForServer(ctx, instance)
+	if err != nil {
+		return "", fmt.Errorf("failed to get server: %w", err)
+	}
+	output, err := cli.GetConsoleOutput(ctx, instance, length)
+	if err != nil {
+		return "", fmt.Errorf("failed to get console output: %w", err)
+	}
+	return output, nil
+}
+
+// GetServerPassword returns the admin password of an instance, decrypted with the private
+// key of the key pair it was created with. Windows runners set up by cloudbase-init post
+// their password encrypted with that key pair.
+func (a *openstackProvider) GetServerPassword(ctx context.Context, instance, privateKeyPEM string) (string, error) {
+	cli, err := a.clientForServer(ctx, instance)
+	if err != nil {
+		return "", fmt.Errorf("failed to get server: %w", err)
+	}
+	password, err := cli.GetServerPassword(ctx, instance, privateKeyPEM)
+	if err != nil {
+		return "", fmt.Errorf("failed to get server password: %w", err)
+	}
+	return password, nil
+}
+
 // GetVersion returns the version of the provider.
 func (a *openstackProvider) GetVersion(ctx context.Context) string {
 	return Version
@@ -16,20 +16,64 @@ package provider
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	commonExecution "github.com/cloudbase/garm-provider-common/execution/common"
 	"github.com/cloudbase/garm-provider-common/params"
 	"github.com/cloudbase/garm-provider-openstack/client"
 	"github.com/cloudbase/garm-provider-openstack/config"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
 	"github.com/gophercloud/gophercloud/testhelper"
 	thclient "github.com/gophercloud/gophercloud/testhelper/client"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
+// handleSecurityGroupList mocks the neutron security group list, returning a single
+// security group with the name that is looked up.
+func handleSecurityGroupList(t *testing.T, path string) {
+	testhelper.Mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		name := r.URL.Query().Get("name")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"security_groups": [{"id": %q, "name": %q}]}`, "id-"+name, name)
+	})
+}
+
+// projectServiceClient returns a service client scoped to a project, as security group
+// names are only resolved within the current project.
+func projectServiceClient(t *testing.T) *gophercloud.ServiceClient {
+	sc := thclient.ServiceClient()
+	var authResult tokens.CreateResult
+	authResult.Header = http.Header{"X-Subject-Token": []string{thclient.TokenID}}
+	authResult.Body = map[string]interface{}{
+		"token": map[string]interface{}{
+			"project": map[string]interface{}{
+				"id": "e6d8b3b9a3c84d9b9c8a0a1e2e3b7d6f",
+			},
+		},
+	}
+	assert.NoError(t, sc.ProviderClient.SetTokenAndAuthResult(authResult))
+	return sc
+}
+
 func TestOpenstackServerToInstance(t *testing.T) {
 	srv := client.ServerWithExt{
 		Server: servers.Server{
@@ -72,10 +116,228 @@ func TestOpenstackServerToInstance(t *testing.T) {
 	assert.Equal(t, expectedInstance, instance)
 }
 
+func TestOpenstackServerToInstanceDualStack(t *testing.T) {
+	srv := client.ServerWithExt{
+		Server: servers.Server{
+			ID:   "d9072956-1560-487c-97f2-18bdf65ec749",
+			Name: "test-server",
+			Addresses: map[string]interface{}{
+				"public": []interface{}{
+					map[string]interface{}{
+						"OS-EXT-IPS:type": "fixed",
+						"addr":            "2001:db8::10",
+						"version":         float64(6),
+					},
+				},
+				"network": []interface{}{
+					map[string]interface{}{
+						"OS-EXT-IPS:type": "fixed",
+						"addr":            "10.10.0.4",
+						"version":         float64(4),
+					},
+					map[string]interface{}{
+						"OS-EXT-IPS:type": "fixed",
+						"addr":            "fd00::4",
+						"version":         float64(6),
+					},
+					map[string]interface{}{
+						"OS-EXT-IPS:type": "floating",
+						"addr":            "172.24.4.10",
+						"version":         float64(4),
+					},
+					// The version does not match the address.
+					map[string]interface{}{
+						"OS-EXT-IPS:type": "fixed",
+						"addr":            "10.10.0.5",
+						"version":         float64(6),
+					},
+					map[string]interface{}{
+						"OS-EXT-IPS:type": "fixed",
+						"addr":            "not-an-ip",
+					},
+				},
+			},
+			Status: "ACTIVE",
+		},
+	}
+	expectedAddresses := []params.Address{
+		{
+			Type:    params.PrivateAddress,
+			Address: "10.10.0.4",
+		},
+		{
+			Type:    params.PrivateAddress,
+			Address: "fd00::4",
+		},
+		{
+			Type:    params.PublicAddress,
+			Address: "172.24.4.10",
+		},
+		{
+			Type:    params.PrivateAddress,
+			Address: "2001:db8::10",
+		},
+	}
+
+	instance := openstackServerToInstance(srv)
+	assert.Equal(t, expectedAddresses, instance.Addresses)
+}
+
+func TestOpenstackServerToInstanceStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   params.InstanceStatus
+	}{
+		{status: "ACTIVE", want: params.InstanceRunning},
+		{status: "SHUTOFF", want: params.InstanceStopped},
+		{status: "SHELVED", want: params.InstanceStopped},
+		{status: "SHELVED_OFFLOADED", want: params.InstanceStopped},
+		{status: "BUILD", want: params.InstancePendingCreate},
+		{status: "ERROR", want: params.InstanceError},
+		{status: "DELETING", want: params.InstancePendingDelete},
+		{status: "SOFT_DELETED", want: params.InstanceDeleting},
+		{status: "DELETED", want: params.InstanceDeleting},
+		{status: "REBOOT", want: params.InstanceRunning},
+		{status: "HARD_REBOOT", want: params.InstanceRunning},
+		{status: "PASSWORD", want: params.InstanceRunning},
+		{status: "REBUILD", want: params.InstanceRunning},
+		{status: "RESIZE", want: params.InstanceRunning},
+		{status: "VERIFY_RESIZE", want: params.InstanceRunning},
+		{status: "REVERT_RESIZE", want: params.InstanceRunning},
+		{status: "MIGRATING", want: params.InstanceRunning},
+		{status: "PAUSED", want: params.InstanceStopped},
+		{status: "SUSPENDED", want: params.InstanceStopped},
+		{status: "RESCUE", want: params.InstanceStopped},
+		{status: "UNKNOWN", want: params.InstanceStatusUnknown},
+		{status: "", want: params.InstanceStatusUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			srv := client.ServerWithExt{
+				Server: servers.Server{
+					ID:     "d9072956-1560-487c-97f2-18bdf65ec749",
+					Status: tt.status,
+				},
+			}
+			instance := openstackServerToInstance(srv)
+			assert.Equal(t, tt.want, instance.Status)
+		})
+	}
+}
+
+func TestServerToInstancePreferredAddressType(t *testing.T) {
+	srv := client.ServerWithExt{
+		Server: servers.Server{
+			ID:   "d9072956-1560-487c-97f2-18bdf65ec749",
+			Name: "test-instance",
+			Addresses: map[string]interface{}{
+				"network": []interface{}{
+					map[string]interface{}{
+						"OS-EXT-IPS:type": "fixed",
+						"addr":            "10.10.0.4",
+					},
+					map[string]interface{}{
+						"OS-EXT-IPS:type": "floating",
+						"addr":            "172.24.4.10",
+					},
+				},
+			},
+		},
+	}
+	private := params.Address{Type: params.PrivateAddress, Address: "10.10.0.4"}
+	public := params.Address{Type: params.PublicAddress, Address: "172.24.4.10"}
+
+	tests := []struct {
+		preferred string
+		want      []params.Address
+	}{
+		{preferred: "", want: []params.Address{private, public}},
+		{preferred: "private", want: []params.Address{private, public}},
+		{preferred: "public", want: []params.Address{public, private}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.preferred, func(t *testing.T) {
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					PreferredAddressType: tt.preferred,
+				},
+			}
+			instance := provider.serverToInstance(srv)
+			assert.Equal(t, tt.want, instance.Addresses)
+		})
+	}
+}
+
+func TestSetDefaultSecurityGroup(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	// Mock the response for security group list
+	testhelper.Mux.HandleFunc("/security-groups", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+		{
+		"security_groups": [
+			{
+				"id": "85cc3048-abc3-43cc-89b3-377341426ac5",
+				"name": "default"
+			}
+		]
+		}`)
+	})
+
+	tests := []struct {
+		name           string
+		resolve        bool
+		securityGroups []string
+		want           []string
+	}{
+		{
+			name:           "resolve default security group",
+			resolve:        true,
+			securityGroups: nil,
+			want:           []string{"85cc3048-abc3-43cc-89b3-377341426ac5"},
+		},
+		{
+			name:           "security groups already set",
+			resolve:        true,
+			securityGroups: []string{"allow_ssh"},
+			want:           []string{"allow_ssh"},
+		},
+		{
+			name:           "resolving disabled",
+			resolve:        false,
+			securityGroups: nil,
+			want:           nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					ResolveDefaultSecurityGroup: tt.resolve,
+				},
+				cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+				controllerID: "my-controller-id",
+			}
+			spec := &machineSpec{
+				SecurityGroups: tt.securityGroups,
+			}
+			err := provider.setDefaultSecurityGroup(context.Background(), provider.cli, spec)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, spec.SecurityGroups)
+		})
+	}
+}
+
 func TestCreateInstance(t *testing.T) {
 	ctx := context.Background()
 	testhelper.SetupHTTP()
 	defer testhelper.TeardownHTTP()
+	handleSecurityGroupList(t, "/security-groups")
 	provider := &openstackProvider{
 		cfg: &config.Config{
 			Cloud: "mycloud",
@@ -91,7 +353,7 @@ func TestCreateInstance(t *testing.T) {
 		cli:          &client.OpenstackClient{},
 		controllerID: "my-controller-id",
 	}
-	serviceClient := thclient.ServiceClient()
+	serviceClient := projectServiceClient(t)
 	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
 	provider.cli = mockCli
 	data := params.BootstrapInstance{
@@ -263,141 +525,420 @@ func TestCreateInstance(t *testing.T) {
 	assert.Equal(t, expectedOutput, instance)
 }
 
-func TestDeleteInstance(t *testing.T) {
-	ctx := context.Background()
+func TestCreateInstanceFlavorFallbacks(t *testing.T) {
 	testhelper.SetupHTTP()
 	defer testhelper.TeardownHTTP()
+	handleSecurityGroupList(t, "/security-groups")
 	provider := &openstackProvider{
 		cfg: &config.Config{
 			Cloud: "mycloud",
 			Credentials: config.Credentials{
 				Clouds: "../testdata/clouds.yaml",
 			},
-			DefaultNetworkID:     "test-network",
-			AllowedImageOwners:   []string{"owner1", "owner2"},
-			ImageVisibility:      "public",
-			DisableUpdatesOnBoot: false,
-			EnableBootDebug:      true,
+			DefaultNetworkID: "test-network",
 		},
+		cli:          client.NewTestOpenStackClient(projectServiceClient(t), "my-controller-id"),
 		controllerID: "my-controller-id",
 	}
-	serviceClient := thclient.ServiceClient()
-	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
-	provider.cli = mockCli
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSArch: params.Amd64,
+		OSType: params.Linux,
+		Flavor: "m1.big",
+		Image:  "ubuntu-20.04",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{
+			"security_groups": ["default"],
+			"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6",
+			"flavor_fallbacks": ["m1.small"]
+		}`),
+		PoolID: "test-pool",
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return data.Tools[0], nil
+	}
 
-	// Mock the response for server get by ID
-	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
-		testhelper.TestMethod(t, r, "GET")
+	testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `
-		{
-		"server": {
-			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
-			"name": "test-server",
-			"status": "DELETED",
-			"tags": ["garm-controller-id=my-controller-id"],
-			"forceDelete": true
-		}
-		}`)
+		fmt.Fprintf(w, `{"flavors": [
+			{"id": "big", "name": "m1.big", "ram": 65536, "vcpus": 32, "disk": 100},
+			{"id": "small", "name": "m1.small", "ram": 2048, "vcpus": 2, "disk": 20}
+		]}`)
+	})
+	testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+	})
+	testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"images": [{"name": "ubuntu-20.04", "id": "aee1d242-730f-431f-88c1-87630c0f07ba", "status": "ACTIVE"}]}`)
 	})
 
-	// Mock the response for server deletion
-	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/action", func(w http.ResponseWriter, r *http.Request) {
+	const (
+		bigServerID   = "8e6c3b5a-2f0e-4d8e-9f5a-1c2b3d4e5f60"
+		smallServerID = "d9072956-1560-487c-97f2-18bdf65ec749"
+	)
+	var mux sync.Mutex
+	var createdFlavors []string
+	var usedFlavorMetadata string
+	testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
 		testhelper.TestMethod(t, r, "POST")
+		var body struct {
+			Server struct {
+				FlavorRef string            `json:"flavorRef"`
+				Metadata  map[string]string `json:"metadata"`
+			} `json:"server"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		mux.Lock()
+		createdFlavors = append(createdFlavors, body.Server.FlavorRef)
+		usedFlavorMetadata = body.Server.Metadata[flavorKey]
+		mux.Unlock()
+
+		id := bigServerID
+		if body.Server.FlavorRef == "small" {
+			id = smallServerID
+		}
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
-		fmt.Fprintf(w, `
-		{
-		"server": {
-			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
-			"name": "test-server",
-			"status": "DELETED",
-			"tags": ["garm-controller-id=my-controller-id"],
-			"forceDelete": true
+		fmt.Fprintf(w, `{"server": {"id": %q, "name": "test-instance", "status": "BUILD"}}`, id)
+	})
+
+	// The big flavor cannot be scheduled.
+	var deleted atomic.Bool
+	testhelper.Mux.HandleFunc("/servers/"+bigServerID, func(w http.ResponseWriter, r *http.Request) {
+		if deleted.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
-		}`)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"server": {
+			"id": %q,
+			"name": "test-instance",
+			"status": "ERROR",
+			"fault": {"code": 500, "message": "No valid host was found. There are not enough hosts available."},
+			"tags": ["garm-controller-id=my-controller-id"]
+		}}`, bigServerID)
+	})
+	testhelper.Mux.HandleFunc("/servers/"+bigServerID+"/action", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		deleted.Store(true)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	testhelper.Mux.HandleFunc("/servers/"+smallServerID, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"server": {
+			"id": %q,
+			"name": "test-instance",
+			"status": "ACTIVE",
+			"metadata": {"garm-flavor": "m1.small"},
+			"tags": ["garm-controller-id=my-controller-id"]
+		}}`, smallServerID)
 	})
 
-	err := provider.DeleteInstance(ctx, "d9072956-1560-487c-97f2-18bdf65ec749")
+	instance, err := provider.CreateInstance(context.Background(), data)
 	assert.NoError(t, err)
+	assert.Equal(t, smallServerID, instance.ProviderID)
+	assert.True(t, deleted.Load())
+
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal(t, []string{"big", "small"}, createdFlavors)
+	assert.Equal(t, "m1.small", usedFlavorMetadata)
 }
 
-func TestGetInstance(t *testing.T) {
-	ctx := context.Background()
+func TestCreateInstanceStaticIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		failCreate bool
+	}{
+		{
+			name: "port and user data match",
+		},
+		{
+			name:       "port is removed when the server can not be created",
+			failCreate: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+			handleSecurityGroupList(t, "/security-groups")
+
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					Cloud: "mycloud",
+					Credentials: config.Credentials{
+						Clouds: "../testdata/clouds.yaml",
+					},
+					DefaultNetworkID: "test-network",
+				},
+				cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+				controllerID: "my-controller-id",
+			}
+			data := params.BootstrapInstance{
+				Name:          "test-instance",
+				InstanceToken: "test-token",
+				OSArch:        params.Amd64,
+				OSType:        params.Linux,
+				Flavor:        "m1.micro",
+				Image:         "ubuntu-22.04",
+				Tools: []params.RunnerApplicationDownload{
+					{
+						OS:           Ptr("linux"),
+						Architecture: Ptr("x64"),
+						DownloadURL:  Ptr("http://test.com"),
+						Filename:     Ptr("runner.tar.gz"),
+					},
+				},
+				ExtraSpecs: json.RawMessage(`{
+					"use_config_drive": true,
+					"networks": [{
+						"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6",
+						"subnet_id": "8f2b5c0e-4a2f-4a48-9f0f-1d8b5f0e7c11",
+						"fixed_ip": "10.0.0.5",
+						"static_ip": true
+					}]
+				}`),
+				PoolID: "test-pool",
+			}
+			DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+				return tools[0], nil
+			}
+
+			testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"flavors": [{"id": "flavor-uuid", "name": "m1.micro", "ram": 1024, "vcpus": 1, "disk": 10}]}`)
+			})
+			testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "static-network"}}`)
+			})
+			testhelper.Mux.HandleFunc("/subnets/8f2b5c0e-4a2f-4a48-9f0f-1d8b5f0e7c11", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"subnet": {
+					"id": "8f2b5c0e-4a2f-4a48-9f0f-1d8b5f0e7c11",
+					"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6",
+					"cidr": "10.0.0.0/24",
+					"gateway_ip": "10.0.0.1",
+					"dns_nameservers": ["10.0.0.2"],
+					"enable_dhcp": false
+				}}`)
+			})
+			testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"images": [{"id": "aee1d242-730f-431f-88c1-87630c0f07ba", "name": "ubuntu-22.04", "status": "active"}]}`)
+			})
+
+			var portFixedIPs []map[string]string
+			testhelper.Mux.HandleFunc("/ports", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				var body struct {
+					Port struct {
+						NetworkID string              `json:"network_id"`
+						FixedIPs  []map[string]string `json:"fixed_ips"`
+					} `json:"port"`
+				}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				assert.Equal(t, "542b68dd-4b3d-459d-8531-34d5e779d4d6", body.Port.NetworkID)
+				portFixedIPs = body.Port.FixedIPs
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"port": {
+					"id": "port-1",
+					"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6",
+					"mac_address": "fa:16:3e:00:00:01",
+					"fixed_ips": [{"subnet_id": "8f2b5c0e-4a2f-4a48-9f0f-1d8b5f0e7c11", "ip_address": "10.0.0.5"}]
+				}}`)
+			})
+			testhelper.Mux.HandleFunc("/ports/port-1/tags", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "PUT")
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"tags": ["garm-pool-id=test-pool", "garm-controller-id=my-controller-id"]}`)
+			})
+			var portDeleted atomic.Bool
+			testhelper.Mux.HandleFunc("/ports/port-1", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "DELETE")
+				portDeleted.Store(true)
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			var createBody struct {
+				Server struct {
+					Networks    []map[string]string `json:"networks"`
+					Metadata    map[string]string   `json:"metadata"`
+					UserData    string              `json:"user_data"`
+					ConfigDrive bool                `json:"config_drive"`
+				} `json:"server"`
+			}
+			testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&createBody))
+				if tt.failCreate {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				fmt.Fprint(w, `{"server": {"id": "d9072956-1560-487c-97f2-18bdf65ec749", "name": "test-instance", "status": "ACTIVE"}}`)
+			})
+			testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"server": {
+					"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+					"name": "test-instance",
+					"status": "ACTIVE",
+					"addresses": {"static-network": [{"OS-EXT-IPS:type": "fixed", "addr": "10.0.0.5", "version": 4}]},
+					"tags": ["garm-controller-id=my-controller-id"]
+				}}`)
+			})
+
+			instance, err := provider.CreateInstance(context.Background(), data)
+			// The port is created with the requested fixed IP, and replaces the network.
+			assert.Equal(t, []map[string]string{{"subnet_id": "8f2b5c0e-4a2f-4a48-9f0f-1d8b5f0e7c11", "ip_address": "10.0.0.5"}}, portFixedIPs)
+			assert.Equal(t, []map[string]string{{"port": "port-1"}}, createBody.Server.Networks)
+			assert.Equal(t, "port-1", createBody.Server.Metadata["garm-static-ports"])
+			assert.True(t, createBody.Server.ConfigDrive)
+
+			// The static config in the user data matches the port.
+			udata, decodeErr := base64.StdEncoding.DecodeString(createBody.Server.UserData)
+			assert.NoError(t, decodeErr)
+			var cfg struct {
+				BootCmd []string `yaml:"bootcmd"`
+			}
+			assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+			if assert.Len(t, cfg.BootCmd, 1) {
+				assert.Contains(t, cfg.BootCmd[0], "macaddress: fa:16:3e:00:00:01")
+				assert.Contains(t, cfg.BootCmd[0], "- 10.0.0.5/24")
+				assert.Contains(t, cfg.BootCmd[0], "via: 10.0.0.1")
+				assert.Contains(t, cfg.BootCmd[0], "- 10.0.0.2")
+			}
+
+			if tt.failCreate {
+				assert.Error(t, err)
+				assert.True(t, portDeleted.Load())
+				return
+			}
+			assert.NoError(t, err)
+			assert.False(t, portDeleted.Load())
+			assert.Equal(t, []params.Address{{Address: "10.0.0.5", Type: params.PrivateAddress}}, instance.Addresses)
+		})
+	}
+}
+
+func TestCreateInstanceDNSNameservers(t *testing.T) {
 	testhelper.SetupHTTP()
 	defer testhelper.TeardownHTTP()
+	handleSecurityGroupList(t, "/security-groups")
+
 	provider := &openstackProvider{
 		cfg: &config.Config{
 			Cloud: "mycloud",
 			Credentials: config.Credentials{
 				Clouds: "../testdata/clouds.yaml",
 			},
-			DefaultNetworkID:     "test-network",
-			AllowedImageOwners:   []string{"owner1", "owner2"},
-			ImageVisibility:      "public",
-			DisableUpdatesOnBoot: false,
-			EnableBootDebug:      true,
+			DefaultNetworkID: "542b68dd-4b3d-459d-8531-34d5e779d4d6",
 		},
+		cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
 		controllerID: "my-controller-id",
 	}
-	serviceClient := thclient.ServiceClient()
-	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
-	provider.cli = mockCli
+	data := params.BootstrapInstance{
+		Name:          "test-instance",
+		InstanceToken: "test-token",
+		OSArch:        params.Amd64,
+		OSType:        params.Linux,
+		Flavor:        "m1.micro",
+		Image:         "ubuntu-22.04",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{
+			"security_groups": ["5b9ad83a-5f4a-4c0f-9c6c-1e2f3a4b5c6d"],
+			"dns_nameservers": ["10.1.0.53", "10.1.1.53"]
+		}`),
+		PoolID: "test-pool",
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
 
-	// Mock the response for server get by ID
-	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
-		testhelper.TestMethod(t, r, "GET")
+	testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `
-		{
-		"server": {
-			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
-			"name": "test-instance",
-			"addresses": {
-				"network": [
-					{
-						"OS-EXT-IPS:type": "fixed",
-						"addr": "10.10.0.4",
-						"version": 4
-					}
-				]
-			},
-			"metadata": {
-				"os_arch": "amd64",
-				"os_type": "linux",
-				"os_name": "ubuntu",
-				"os_version": "20.04"
-			},
-			"tags": ["garm-controller-id=my-controller-id"],
-			"status": "ACTIVE"
-		}
-		}`)
+		fmt.Fprint(w, `{"flavors": [{"id": "flavor-uuid", "name": "m1.micro", "ram": 1024, "vcpus": 1, "disk": 10}]}`)
+	})
+	testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+	})
+	testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"images": [{"id": "aee1d242-730f-431f-88c1-87630c0f07ba", "name": "ubuntu-22.04", "status": "active"}]}`)
 	})
 
-	expectedOutput := params.ProviderInstance{
-		ProviderID: "d9072956-1560-487c-97f2-18bdf65ec749",
-		Name:       "test-instance",
-		OSArch:     "amd64",
-		OSType:     "linux",
-		Status:     "running",
-		OSName:     "ubuntu",
-		OSVersion:  "20.04",
-		Addresses: []params.Address{
-			{
-				Type:    params.PrivateAddress,
-				Address: "10.10.0.4",
-			},
-		},
+	// The port of the default network is created with the nameservers and the
+	// security groups of the pool.
+	testhelper.Mux.HandleFunc("/ports", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		testhelper.TestJSONRequest(t, r, `{"port": {
+			"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6",
+			"description": "Managed by garm",
+			"security_groups": ["5b9ad83a-5f4a-4c0f-9c6c-1e2f3a4b5c6d"],
+			"extra_dhcp_opts": [{"opt_name": "dns-server", "opt_value": "10.1.0.53,10.1.1.53", "ip_version": 4}]
+		}}`)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"port": {"id": "port-1", "network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6"}}`)
+	})
+	testhelper.Mux.HandleFunc("/ports/port-1/tags", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "PUT")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"tags": ["garm-pool-id=test-pool", "garm-controller-id=my-controller-id"]}`)
+	})
+
+	var createBody struct {
+		Server struct {
+			Networks []map[string]string `json:"networks"`
+			Metadata map[string]string   `json:"metadata"`
+		} `json:"server"`
 	}
+	testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&createBody))
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"server": {"id": "d9072956-1560-487c-97f2-18bdf65ec749", "name": "test-instance", "status": "ACTIVE"}}`)
+	})
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-instance",
+			"status": "ACTIVE",
+			"tags": ["garm-controller-id=my-controller-id"]
+		}}`)
+	})
 
-	instance, err := provider.GetInstance(ctx, "d9072956-1560-487c-97f2-18bdf65ec749")
+	_, err := provider.CreateInstance(context.Background(), data)
 	assert.NoError(t, err)
-	assert.Equal(t, expectedOutput, instance)
+	assert.Equal(t, []map[string]string{{"port": "port-1"}}, createBody.Server.Networks)
+	assert.Equal(t, "port-1", createBody.Server.Metadata["garm-static-ports"])
 }
 
-func TestListInstances(t *testing.T) {
+func TestDeleteInstance(t *testing.T) {
 	ctx := context.Background()
 	testhelper.SetupHTTP()
 	defer testhelper.TeardownHTTP()
@@ -419,63 +960,286 @@ func TestListInstances(t *testing.T) {
 	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
 	provider.cli = mockCli
 
-	// Mock the response for server list
-	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+	// Mock the response for server get by ID
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
 		testhelper.TestMethod(t, r, "GET")
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, `
 		{
-		"servers": [
-			{
-				"id": "d9072956-1560-487c-97f2-18bdf65ec749",
-				"name": "test-instance",
-				"addresses": {
-					"network": [
-						{
-							"OS-EXT-IPS:type": "fixed",
-							"addr": "10.10.0.4"
-						}
-					]
-				},
-				"metadata": {
-					"os_arch": "amd64",
-					"os_type": "linux",
-					"os_name": "ubuntu",
-					"os_version": "20.04"
-				},
-				"tags": ["garm-controller-id=my-controller-id",
-				"garm-pool-id=test-pool"],
-				"status": "ACTIVE"
-			}
-		]
+		"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-server",
+			"status": "DELETED",
+			"tags": ["garm-controller-id=my-controller-id"],
+			"forceDelete": true
+		}
 		}`)
 	})
 
-	expectedOutput := []params.ProviderInstance{
+	// Mock the response for server deletion
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/action", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `
 		{
-			ProviderID: "d9072956-1560-487c-97f2-18bdf65ec749",
-			Name:       "test-instance",
-			OSArch:     "amd64",
-			OSType:     "linux",
-			Status:     "running",
-			OSName:     "ubuntu",
-			OSVersion:  "20.04",
-			Addresses: []params.Address{
-				{
-					Type:    params.PrivateAddress,
-					Address: "10.10.0.4",
+		"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-server",
+			"status": "DELETED",
+			"tags": ["garm-controller-id=my-controller-id"],
+			"forceDelete": true
+		}
+		}`)
+	})
+
+	err := provider.DeleteInstance(ctx, "d9072956-1560-487c-97f2-18bdf65ec749")
+	assert.NoError(t, err)
+}
+
+func TestDeleteInstanceErrorGracePeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod int
+		errorAt     time.Time
+		wantDeleted bool
+	}{
+		{
+			name:        "within grace period",
+			gracePeriod: 3600,
+			errorAt:     time.Now(),
+		},
+		{
+			name:        "grace period over",
+			gracePeriod: 3600,
+			errorAt:     time.Now().Add(-2 * time.Hour),
+			wantDeleted: true,
+		},
+		{
+			name:        "no grace period",
+			errorAt:     time.Now(),
+			wantDeleted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+
+			var deleted atomic.Bool
+			testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "GET")
+				status := "ERROR"
+				if deleted.Load() {
+					status = "DELETED"
+				}
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprintf(w, `{"server": {"id": "d9072956-1560-487c-97f2-18bdf65ec749", "name": "test-server", "status": %q, "tags": ["garm-controller-id=my-controller-id", "garm-error-at=%d"]}}`, status, tt.errorAt.Unix())
+			})
+			testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/action", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				deleted.Store(true)
+				w.WriteHeader(http.StatusAccepted)
+			})
+
+			mockCli := client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id")
+			mockCli.SetErrorGracePeriod(tt.gracePeriod)
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					Cloud: "mycloud",
+					Credentials: config.Credentials{
+						Clouds: "../testdata/clouds.yaml",
+					},
+					DefaultNetworkID: "test-network",
 				},
+				controllerID: "my-controller-id",
+				cli:          mockCli,
+			}
+
+			err := provider.DeleteInstance(context.Background(), "d9072956-1560-487c-97f2-18bdf65ec749")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantDeleted, deleted.Load())
+		})
+	}
+}
+
+func TestDeleteInstanceReleasesFloatingIP(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
 			},
+			DefaultNetworkID: "test-network",
 		},
+		cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+		controllerID: "my-controller-id",
 	}
 
-	instances, err := provider.ListInstances(ctx, "test-pool")
+	var released, deleted atomic.Bool
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		status := "ACTIVE"
+		if deleted.Load() {
+			status = "DELETED"
+		}
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-server",
+			"status": %q,
+			"metadata": {"garm-floating-ip": "203.0.113.10"},
+			"tags": ["garm-controller-id=my-controller-id"]
+		}}`, status)
+	})
+	testhelper.Mux.HandleFunc("/ports", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ports": [{"id": "port-1", "device_id": "d9072956-1560-487c-97f2-18bdf65ec749"}]}`)
+	})
+	testhelper.Mux.HandleFunc("/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingips": [{"id": "fip-1", "floating_ip_address": "203.0.113.10", "port_id": "port-1"}]}`)
+	})
+	testhelper.Mux.HandleFunc("/floatingips/fip-1", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "DELETE")
+		assert.False(t, deleted.Load(), "floating IP released after the server was deleted")
+		released.Store(true)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/action", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		deleted.Store(true)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	err := provider.DeleteInstance(context.Background(), "d9072956-1560-487c-97f2-18bdf65ec749")
 	assert.NoError(t, err)
-	assert.Equal(t, expectedOutput, instances)
+	assert.True(t, released.Load())
+	assert.True(t, deleted.Load())
 }
 
-func TestStart(t *testing.T) {
+func TestDeleteInstanceDeletesStaticPorts(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+		},
+		cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+		controllerID: "my-controller-id",
+	}
+
+	var deleted atomic.Bool
+	var portsDeleted atomic.Int32
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		status := "ACTIVE"
+		if deleted.Load() {
+			status = "DELETED"
+		}
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-server",
+			"status": %q,
+			"metadata": {"garm-static-ports": "port-1,port-2"},
+			"tags": ["garm-controller-id=my-controller-id"]
+		}}`, status)
+	})
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/action", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		deleted.Store(true)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	for _, portID := range []string{"port-1", "port-2"} {
+		testhelper.Mux.HandleFunc("/ports/"+portID, func(w http.ResponseWriter, r *http.Request) {
+			testhelper.TestMethod(t, r, "DELETE")
+			assert.True(t, deleted.Load(), "port deleted before the server")
+			portsDeleted.Add(1)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+
+	err := provider.DeleteInstance(context.Background(), "d9072956-1560-487c-97f2-18bdf65ec749")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), portsDeleted.Load())
+}
+
+func TestDeleteInstanceDuplicateNames(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+		},
+		cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+		controllerID: "my-controller-id",
+	}
+
+	serverIDs := []string{"d9072956-1560-487c-97f2-18bdf65ec749", "8c6f3f6d-0a7e-4b8a-9d31-4b3c2f5b9a10"}
+	var mux sync.Mutex
+	deleted := []string{}
+	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		mux.Lock()
+		defer mux.Unlock()
+		srvs := []string{}
+		for _, id := range serverIDs {
+			if slices.Contains(deleted, id) {
+				continue
+			}
+			srvs = append(srvs, fmt.Sprintf(`{
+				"id": %q,
+				"name": "test-server",
+				"status": "ACTIVE",
+				"tags": ["garm-controller-id=my-controller-id"]
+			}`, id))
+		}
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"servers": [%s]}`, strings.Join(srvs, ","))
+	})
+	for _, id := range serverIDs {
+		testhelper.Mux.HandleFunc("/servers/"+id, func(w http.ResponseWriter, r *http.Request) {
+			testhelper.TestMethod(t, r, "GET")
+			w.WriteHeader(http.StatusNotFound)
+		})
+		testhelper.Mux.HandleFunc("/servers/"+id+"/action", func(w http.ResponseWriter, r *http.Request) {
+			testhelper.TestMethod(t, r, "POST")
+			mux.Lock()
+			defer mux.Unlock()
+			deleted = append(deleted, id)
+			w.WriteHeader(http.StatusAccepted)
+		})
+	}
+
+	// Without a name collision strategy the runner can not be resolved, and none of the
+	// servers with its name are deleted.
+	err := provider.DeleteInstance(context.Background(), "test-server")
+	assert.ErrorIs(t, err, client.ErrMultipleServers)
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Empty(t, deleted)
+}
+
+func TestGetInstance(t *testing.T) {
 	ctx := context.Background()
 	testhelper.SetupHTTP()
 	defer testhelper.TeardownHTTP()
@@ -497,46 +1261,13 @@ func TestStart(t *testing.T) {
 	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
 	provider.cli = mockCli
 
-	// Mock the response for server list
-	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+	// Mock the response for server get by ID
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
 		testhelper.TestMethod(t, r, "GET")
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, `
 		{
-		"servers": [
-			{
-				"id": "d9072956-1560-487c-97f2-18bdf65ec749",
-				"name": "test-instance",
-				"addresses": {
-					"network": [
-						{
-							"OS-EXT-IPS:type": "fixed",
-							"addr": "10.10.0.4"
-						}
-					]
-				},
-				"metadata": {
-					"os_arch": "amd64",
-					"os_type": "linux",
-					"os_name": "ubuntu",
-					"os_version": "20.04"
-				},
-				"tags": ["garm-controller-id=my-controller-id",
-				"garm-pool-id=test-pool"],
-				"status": "SHUTOFF"
-			}
-		]
-		}`)
-	})
-
-	// Mock the response for server stop
-	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/action", func(w http.ResponseWriter, r *http.Request) {
-		testhelper.TestMethod(t, r, "POST")
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(http.StatusAccepted)
-		fmt.Fprintf(w, `
-		{
 		"server": {
 			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
 			"name": "test-instance",
@@ -561,6 +1292,1877 @@ func TestStart(t *testing.T) {
 		}`)
 	})
 
-	err := provider.Start(ctx, "test-instance")
-	assert.NoError(t, err)
+	expectedOutput := params.ProviderInstance{
+		ProviderID: "d9072956-1560-487c-97f2-18bdf65ec749",
+		Name:       "test-instance",
+		OSArch:     "amd64",
+		OSType:     "linux",
+		Status:     "running",
+		OSName:     "ubuntu",
+		OSVersion:  "20.04",
+		Addresses: []params.Address{
+			{
+				Type:    params.PrivateAddress,
+				Address: "10.10.0.4",
+			},
+		},
+	}
+
+	instance, err := provider.GetInstance(ctx, "d9072956-1560-487c-97f2-18bdf65ec749")
+	assert.NoError(t, err)
+	assert.Equal(t, expectedOutput, instance)
+}
+
+func TestGetInstanceReportFloatingIPs(t *testing.T) {
+	ctx := context.Background()
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID:  "test-network",
+			ReportFloatingIPs: true,
+		},
+		controllerID: "my-controller-id",
+	}
+	serviceClient := thclient.ServiceClient()
+	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
+	provider.cli = mockCli
+
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+		{
+		"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-instance",
+			"addresses": {
+				"network": [
+					{
+						"OS-EXT-IPS:type": "fixed",
+						"addr": "10.10.0.4"
+					}
+				]
+			},
+			"tags": ["garm-controller-id=my-controller-id"],
+			"status": "ACTIVE"
+		}
+		}`)
+	})
+
+	testhelper.Mux.HandleFunc("/ports", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		testhelper.TestFormValues(t, r, map[string]string{"device_id": "d9072956-1560-487c-97f2-18bdf65ec749"})
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+		{
+		"ports": [
+			{
+				"id": "ce531f90-199f-48c0-816c-13e38010b442",
+				"device_id": "d9072956-1560-487c-97f2-18bdf65ec749"
+			}
+		]
+		}`)
+	})
+
+	testhelper.Mux.HandleFunc("/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		testhelper.TestFormValues(t, r, map[string]string{"port_id": "ce531f90-199f-48c0-816c-13e38010b442"})
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+		{
+		"floatingips": [
+			{
+				"id": "2f245a7b-796b-4f26-9cf9-9e82d248fda7",
+				"floating_ip_address": "172.24.4.228",
+				"fixed_ip_address": "10.10.0.4",
+				"port_id": "ce531f90-199f-48c0-816c-13e38010b442"
+			}
+		]
+		}`)
+	})
+
+	instance, err := provider.GetInstance(ctx, "d9072956-1560-487c-97f2-18bdf65ec749")
+	assert.NoError(t, err)
+	assert.Equal(t, []params.Address{
+		{
+			Type:    params.PrivateAddress,
+			Address: "10.10.0.4",
+		},
+		{
+			Type:    params.PublicAddress,
+			Address: "172.24.4.228",
+		},
+	}, instance.Addresses)
+}
+
+func TestGetInstanceNotFound(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		expectNotFound bool
+	}{
+		{
+			name:           "server is gone",
+			status:         http.StatusNotFound,
+			expectNotFound: true,
+		},
+		{
+			name:   "nova is down",
+			status: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+
+			testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "GET")
+				w.WriteHeader(tt.status)
+			})
+
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					Cloud: "mycloud",
+				},
+				cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+				controllerID: "my-controller-id",
+			}
+
+			_, err := provider.GetInstance(context.Background(), "d9072956-1560-487c-97f2-18bdf65ec749")
+			assert.Error(t, err)
+			assert.Equal(t, tt.expectNotFound, errors.Is(err, client.ErrInstanceNotFound))
+			expectExitCode := 1
+			if tt.expectNotFound {
+				expectExitCode = commonExecution.ExitCodeNotFound
+			}
+			assert.Equal(t, expectExitCode, commonExecution.ResolveErrorToExitCode(err))
+		})
+	}
+}
+
+func TestListInstances(t *testing.T) {
+	ctx := context.Background()
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID:     "test-network",
+			AllowedImageOwners:   []string{"owner1", "owner2"},
+			ImageVisibility:      "public",
+			DisableUpdatesOnBoot: false,
+			EnableBootDebug:      true,
+		},
+		controllerID: "my-controller-id",
+	}
+	serviceClient := thclient.ServiceClient()
+	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
+	provider.cli = mockCli
+
+	// Mock the response for server list
+	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+		{
+		"servers": [
+			{
+				"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+				"name": "test-instance",
+				"addresses": {
+					"network": [
+						{
+							"OS-EXT-IPS:type": "fixed",
+							"addr": "10.10.0.4"
+						}
+					]
+				},
+				"metadata": {
+					"os_arch": "amd64",
+					"os_type": "linux",
+					"os_name": "ubuntu",
+					"os_version": "20.04"
+				},
+				"tags": ["garm-controller-id=my-controller-id",
+				"garm-pool-id=test-pool"],
+				"status": "ACTIVE"
+			}
+		]
+		}`)
+	})
+
+	expectedOutput := []params.ProviderInstance{
+		{
+			ProviderID: "d9072956-1560-487c-97f2-18bdf65ec749",
+			Name:       "test-instance",
+			OSArch:     "amd64",
+			OSType:     "linux",
+			Status:     "running",
+			OSName:     "ubuntu",
+			OSVersion:  "20.04",
+			Addresses: []params.Address{
+				{
+					Type:    params.PrivateAddress,
+					Address: "10.10.0.4",
+				},
+			},
+		},
+	}
+
+	instances, err := provider.ListInstances(ctx, "test-pool")
+	assert.NoError(t, err)
+	assert.Equal(t, expectedOutput, instances)
+}
+
+func TestStart(t *testing.T) {
+	ctx := context.Background()
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID:     "test-network",
+			AllowedImageOwners:   []string{"owner1", "owner2"},
+			ImageVisibility:      "public",
+			DisableUpdatesOnBoot: false,
+			EnableBootDebug:      true,
+		},
+		controllerID: "my-controller-id",
+	}
+	serviceClient := thclient.ServiceClient()
+	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
+	provider.cli = mockCli
+
+	// Mock the response for server list
+	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+		{
+		"servers": [
+			{
+				"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+				"name": "test-instance",
+				"addresses": {
+					"network": [
+						{
+							"OS-EXT-IPS:type": "fixed",
+							"addr": "10.10.0.4"
+						}
+					]
+				},
+				"metadata": {
+					"os_arch": "amd64",
+					"os_type": "linux",
+					"os_name": "ubuntu",
+					"os_version": "20.04"
+				},
+				"tags": ["garm-controller-id=my-controller-id",
+				"garm-pool-id=test-pool"],
+				"status": "SHUTOFF"
+			}
+		]
+		}`)
+	})
+
+	// Mock the response for server stop
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/action", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `
+		{
+		"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-instance",
+			"addresses": {
+				"network": [
+					{
+						"OS-EXT-IPS:type": "fixed",
+						"addr": "10.10.0.4",
+						"version": 4
+					}
+				]
+			},
+			"metadata": {
+				"os_arch": "amd64",
+				"os_type": "linux",
+				"os_name": "ubuntu",
+				"os_version": "20.04"
+			},
+			"tags": ["garm-controller-id=my-controller-id"],
+			"status": "ACTIVE"
+		}
+		}`)
+	})
+
+	err := provider.Start(ctx, "test-instance")
+	assert.NoError(t, err)
+}
+
+func TestRenderUserData(t *testing.T) {
+	cloudsPath, err := filepath.Abs("../testdata/clouds.yaml")
+	assert.NoError(t, err)
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	err = os.WriteFile(configPath, []byte(fmt.Sprintf("cloud = \"mycloud\"\nnetwork_id = \"network\"\n\n[credentials]\nclouds = %q\n", cloudsPath)), 0o600)
+	assert.NoError(t, err)
+
+	data := params.BootstrapInstance{
+		Name:          "test-instance",
+		InstanceToken: "super-secret-instance-token",
+		CallbackURL:   "https://garm.example.com/api/v1/callbacks",
+		MetadataURL:   "https://garm.example.com/api/v1/metadata",
+		OSArch:        params.Amd64,
+		OSType:        params.Linux,
+		Flavor:        "m1.small",
+		Image:         "ubuntu-22.04",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:                Ptr("linux"),
+				Architecture:      Ptr("x64"),
+				DownloadURL:       Ptr("https://example.com/actions-runner-linux-x64.tar.gz"),
+				Filename:          Ptr("actions-runner-linux-x64.tar.gz"),
+				TempDownloadToken: Ptr("super-secret-download-token"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{"extra_packages": ["jq"]}`),
+		PoolID:     "test-pool",
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+	contents, err := json.Marshal(data)
+	assert.NoError(t, err)
+	paramsPath := filepath.Join(t.TempDir(), "bootstrap.json")
+	assert.NoError(t, os.WriteFile(paramsPath, contents, 0o600))
+
+	udata, err := RenderUserData(configPath, "my-controller-id", paramsPath)
+	assert.NoError(t, err)
+	var cfg struct {
+		Packages   []string `yaml:"packages"`
+		WriteFiles []struct {
+			Path    string `yaml:"path"`
+			Content string `yaml:"content"`
+		} `yaml:"write_files"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	assert.Contains(t, cfg.Packages, "jq")
+
+	var installScript string
+	for _, file := range cfg.WriteFiles {
+		if file.Path == "/install_runner.sh" {
+			decoded, err := base64.StdEncoding.DecodeString(file.Content)
+			assert.NoError(t, err)
+			installScript = string(decoded)
+		}
+	}
+	assert.Contains(t, installScript, "https://example.com/actions-runner-linux-x64.tar.gz")
+	assert.Contains(t, installScript, `BEARER_TOKEN="REDACTED"`)
+	assert.Contains(t, installScript, "Authorization: Bearer REDACTED")
+	for _, rendered := range []string{string(udata), installScript} {
+		assert.NotContains(t, rendered, "super-secret-instance-token")
+		assert.NotContains(t, rendered, "super-secret-download-token")
+	}
+}
+
+func TestDumpInstances(t *testing.T) {
+	ctx := context.Background()
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+		},
+		controllerID: "my-controller-id",
+	}
+	serviceClient := thclient.ServiceClient()
+	mockCli := client.NewTestOpenStackClient(serviceClient, "my-controller-id")
+	provider.cli = mockCli
+
+	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `
+		{
+		"servers": [
+			{
+				"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+				"name": "test-instance",
+				"addresses": {
+					"network": [
+						{
+							"OS-EXT-IPS:type": "fixed",
+							"addr": "10.10.0.4"
+						}
+					]
+				},
+				"flavor": {
+					"original_name": "m1.small",
+					"vcpus": 1,
+					"ram": 2048,
+					"disk": 20
+				},
+				"image": {
+					"id": "aee1d242-730f-431f-88c1-87630c0f07ba"
+				},
+				"OS-EXT-AZ:availability_zone": "nova",
+				"tags": ["garm-controller-id=my-controller-id",
+				"garm-pool-id=test-pool"],
+				"status": "ACTIVE"
+			}
+		]
+		}`)
+	})
+
+	testhelper.Mux.HandleFunc("/images/aee1d242-730f-431f-88c1-87630c0f07ba", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "aee1d242-730f-431f-88c1-87630c0f07ba", "name": "ubuntu-22.04", "status": "active"}`)
+	})
+
+	result, err := provider.dumpInstances(ctx, "test-pool")
+	assert.NoError(t, err)
+
+	var instances []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(result, &instances))
+	assert.Len(t, instances, 1)
+	assert.Equal(t, map[string]interface{}{
+		"id":     "d9072956-1560-487c-97f2-18bdf65ec749",
+		"name":   "test-instance",
+		"status": "ACTIVE",
+		"addresses": []interface{}{
+			map[string]interface{}{
+				"address": "10.10.0.4",
+				"type":    "private",
+			},
+		},
+		"flavor":            "m1.small",
+		"image":             "aee1d242-730f-431f-88c1-87630c0f07ba",
+		"image_name":        "ubuntu-22.04",
+		"availability_zone": "nova",
+		"tags":              []interface{}{"garm-controller-id=my-controller-id", "garm-pool-id=test-pool"},
+	}, instances[0])
+}
+
+func TestDumpInstancesManyServers(t *testing.T) {
+	ctx := context.Background()
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+			ListWorkers:      4,
+		},
+		controllerID: "my-controller-id",
+	}
+	provider.cli = client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id")
+
+	const serverCount = 100
+	flavorIDs := []string{"1", "2", "3"}
+	imageIDs := []string{"aee1d242-730f-431f-88c1-87630c0f07ba", "6f7e2d9c-0c1a-4a43-9c5b-2d0f7f5e8b11"}
+
+	// Microversions older than 2.47 only return the flavor ID of a server.
+	srvs := make([]string, serverCount)
+	for i := range srvs {
+		srvs[i] = fmt.Sprintf(`{
+			"id": "server-%03d",
+			"name": "runner-%03d",
+			"flavor": {"id": %q},
+			"image": {"id": %q},
+			"tags": ["garm-controller-id=my-controller-id", "garm-pool-id=test-pool"],
+			"status": "ACTIVE"
+		}`, i, i, flavorIDs[i%len(flavorIDs)], imageIDs[i%len(imageIDs)])
+	}
+	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"servers": [%s]}`, strings.Join(srvs, ","))
+	})
+
+	var mux sync.Mutex
+	lookups := map[string]int{}
+	for _, id := range flavorIDs {
+		testhelper.Mux.HandleFunc("/flavors/"+id, func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			lookups["flavor-"+id]++
+			mux.Unlock()
+			// Give the other workers a chance to ask for the same flavor.
+			time.Sleep(10 * time.Millisecond)
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"flavor": {"id": %q, "name": "flavor-%s"}}`, id, id)
+		})
+	}
+	for idx, id := range imageIDs {
+		testhelper.Mux.HandleFunc("/images/"+id, func(w http.ResponseWriter, r *http.Request) {
+			mux.Lock()
+			lookups["image-"+id]++
+			mux.Unlock()
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id": %q, "name": "image-%d", "status": "active"}`, id, idx)
+		})
+	}
+
+	result, err := provider.dumpInstances(ctx, "test-pool")
+	assert.NoError(t, err)
+
+	var instances []InstanceDetails
+	assert.NoError(t, json.Unmarshal(result, &instances))
+	assert.Len(t, instances, serverCount)
+	for i, instance := range instances {
+		assert.Equal(t, fmt.Sprintf("runner-%03d", i), instance.Name)
+		assert.Equal(t, "flavor-"+flavorIDs[i%len(flavorIDs)], instance.Flavor)
+		assert.Equal(t, imageIDs[i%len(imageIDs)], instance.Image)
+		assert.Equal(t, fmt.Sprintf("image-%d", i%len(imageIDs)), instance.ImageName)
+	}
+	assert.Equal(t, map[string]int{
+		"flavor-1": 1,
+		"flavor-2": 1,
+		"flavor-3": 1,
+		"image-aee1d242-730f-431f-88c1-87630c0f07ba": 1,
+		"image-6f7e2d9c-0c1a-4a43-9c5b-2d0f7f5e8b11": 1,
+	}, lookups)
+}
+
+func TestHealthz(t *testing.T) {
+	tests := []struct {
+		name        string
+		failing     []string
+		wantHealthy bool
+	}{
+		{
+			name:        "all services healthy",
+			wantHealthy: true,
+		},
+		{
+			name:        "volume service down",
+			failing:     []string{"volume"},
+			wantHealthy: true,
+		},
+		{
+			name:        "image and volume services down",
+			failing:     []string{"image", "volume"},
+			wantHealthy: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					Cloud: "mycloud",
+					Credentials: config.Credentials{
+						Clouds: "../testdata/clouds.yaml",
+					},
+					DefaultNetworkID: "test-network",
+				},
+				cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+				controllerID: "my-controller-id",
+			}
+
+			handle := func(service, path, body string) {
+				testhelper.Mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+					testhelper.TestMethod(t, r, "GET")
+					if slices.Contains(tt.failing, service) {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					w.Header().Add("Content-Type", "application/json")
+					fmt.Fprint(w, body)
+				})
+			}
+			handle("compute", "/limits", `{"limits": {"absolute": {}, "rate": []}}`)
+			handle("image", "/images", `{"images": []}`)
+			handle("network", "/networks", `{"networks": []}`)
+			handle("volume", "/volumes/detail", `{"volumes": []}`)
+
+			report, err := provider.Healthz(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantHealthy, report.Healthy)
+			assert.Len(t, report.Regions, 1)
+			services := report.Regions[0].Services
+			assert.Len(t, services, 4)
+			for service, health := range services {
+				failing := slices.Contains(tt.failing, service)
+				assert.Equal(t, !failing, health.Healthy, service)
+				assert.Equal(t, service == "volume", health.Optional, service)
+				if failing {
+					assert.Contains(t, health.Error, "failed to reach "+service+" service")
+				} else {
+					assert.Empty(t, health.Error, service)
+				}
+			}
+		})
+	}
+}
+
+func TestGetClient(t *testing.T) {
+	defaultCli := client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id")
+	otherCli := client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id")
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+		},
+		controllerID: "my-controller-id",
+		cli:          defaultCli,
+		clients: map[string]*client.OpenstackClient{
+			"othercloud/RegionTwo": otherCli,
+		},
+	}
+
+	cli, err := provider.getClient("", "")
+	assert.NoError(t, err)
+	assert.Same(t, defaultCli, cli)
+
+	cli, err = provider.getClient("mycloud", "")
+	assert.NoError(t, err)
+	assert.Same(t, defaultCli, cli)
+
+	cli, err = provider.getClient("othercloud", "RegionTwo")
+	assert.NoError(t, err)
+	assert.Same(t, otherCli, cli)
+
+	_, err = provider.getClient("missingcloud", "RegionTwo")
+	assert.ErrorContains(t, err, "cloud missingcloud is not defined in clouds.yaml")
+}
+
+func TestRecordTarget(t *testing.T) {
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+			Regions:          []string{"RegionOne", "RegionTwo"},
+			StateDir:         t.TempDir(),
+		},
+		controllerID: "my-controller-id",
+	}
+
+	// Configured targets are not recorded.
+	assert.NoError(t, provider.recordTarget(provider.targetFor("", "RegionTwo")))
+	state, err := provider.loadState()
+	assert.NoError(t, err)
+	assert.Empty(t, state.Targets)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, provider.recordTarget(provider.targetFor("othercloud", "RegionTwo")))
+	}
+	assert.NoError(t, provider.recordTarget(provider.targetFor("", "RegionThree")))
+	state, err = provider.loadState()
+	assert.NoError(t, err)
+	assert.Equal(t, []target{
+		{Cloud: "othercloud", Region: "RegionTwo"},
+		{Cloud: "mycloud", Region: "RegionThree"},
+	}, state.Targets)
+}
+
+func TestListInstancesRecordedTarget(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	regionClient := func(prefix, servers string) *client.OpenstackClient {
+		testhelper.Mux.HandleFunc(prefix+"servers/detail", func(w http.ResponseWriter, r *http.Request) {
+			testhelper.TestMethod(t, r, "GET")
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"servers": [%s]}`, servers)
+		})
+		sc := thclient.ServiceClient()
+		sc.Endpoint = testhelper.Endpoint() + prefix
+		return client.NewTestOpenStackClient(sc, "my-controller-id")
+	}
+
+	stateDir := t.TempDir()
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+			StateDir:         stateDir,
+		},
+		controllerID: "my-controller-id",
+		cli:          regionClient("/default/", ""),
+		clients: map[string]*client.OpenstackClient{
+			"othercloud/RegionTwo": regionClient("/other/", `{
+				"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+				"name": "test-instance",
+				"metadata": {"garm-cloud": "othercloud", "garm-region": "RegionTwo"},
+				"tags": ["garm-controller-id=my-controller-id", "garm-pool-id=test-pool"],
+				"status": "ACTIVE"
+			}`),
+		},
+	}
+
+	instances, err := provider.ListInstances(context.Background(), "test-pool")
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+
+	// Runners are looked up in the clouds and regions pools created them in, as well as
+	// the configured ones. Clouds that were removed from clouds.yaml are skipped.
+	assert.NoError(t, provider.recordTarget(target{Cloud: "othercloud", Region: "RegionTwo"}))
+	assert.NoError(t, provider.recordTarget(target{Cloud: "missingcloud", Region: "RegionTwo"}))
+	instances, err = provider.ListInstances(context.Background(), "test-pool")
+	assert.NoError(t, err)
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, "d9072956-1560-487c-97f2-18bdf65ec749", instances[0].ProviderID)
+	}
+}
+
+func TestCreateInstanceRegionsRoundRobin(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	var mux sync.Mutex
+	var createdIn []string
+	regionClient := func(region string) *client.OpenstackClient {
+		prefix := "/" + region + "/"
+		handleSecurityGroupList(t, prefix+"security-groups")
+		testhelper.Mux.HandleFunc(prefix+"flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"flavors": [{"id": "flavor-uuid", "name": "m1.small", "ram": 2048, "vcpus": 2, "disk": 20}]}`)
+		})
+		testhelper.Mux.HandleFunc(prefix+"networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+		})
+		testhelper.Mux.HandleFunc(prefix+"images", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"images": [{"name": "ubuntu-20.04", "id": "aee1d242-730f-431f-88c1-87630c0f07ba", "status": "ACTIVE"}]}`)
+		})
+		testhelper.Mux.HandleFunc(prefix+"servers", func(w http.ResponseWriter, r *http.Request) {
+			testhelper.TestMethod(t, r, "POST")
+			mux.Lock()
+			createdIn = append(createdIn, region)
+			mux.Unlock()
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, `{"server": {"id": "d9072956-1560-487c-97f2-18bdf65ec749", "name": "test-instance", "status": "BUILD"}}`)
+		})
+		testhelper.Mux.HandleFunc(prefix+"servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"server": {
+				"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+				"name": "test-instance",
+				"status": "BUILD",
+				"tags": ["garm-controller-id=my-controller-id"]
+			}}`)
+		})
+
+		sc := projectServiceClient(t)
+		sc.Endpoint = testhelper.Endpoint() + region + "/"
+		return client.NewTestOpenStackClient(sc, "my-controller-id")
+	}
+
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID:      "542b68dd-4b3d-459d-8531-34d5e779d4d6",
+		DefaultSecurityGroups: []string{"default"},
+		Regions:               []string{"RegionOne", "RegionTwo"},
+		StateDir:              t.TempDir(),
+	}
+	regionOne, regionTwo := regionClient("RegionOne"), regionClient("RegionTwo")
+	// Don't wait for the servers to become ACTIVE.
+	regionOne.SetAsyncCreate(true)
+	regionTwo.SetAsyncCreate(true)
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSArch: params.Amd64,
+		OSType: params.Linux,
+		Flavor: "m1.small",
+		Image:  "ubuntu-20.04",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		PoolID: "test-pool",
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return data.Tools[0], nil
+	}
+	// garm runs the provider once for every runner, so every runner is created by a
+	// new provider.
+	for i := 0; i < 4; i++ {
+		provider := &openstackProvider{
+			cfg:          cfg,
+			controllerID: "my-controller-id",
+			cli:          regionOne,
+			clients: map[string]*client.OpenstackClient{
+				"mycloud/RegionTwo": regionTwo,
+			},
+		}
+		_, err := provider.CreateInstance(context.Background(), data)
+		assert.NoError(t, err)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal(t, []string{"RegionOne", "RegionTwo", "RegionOne", "RegionTwo"}, createdIn)
+}
+
+func TestCheckKeyPairType(t *testing.T) {
+	tests := []struct {
+		name        string
+		keyPair     keypairs.KeyPair
+		keyPairType string
+		errString   string
+	}{
+		{
+			name:        "type matches",
+			keyPair:     keypairs.KeyPair{Name: "windows-key", Type: "x509"},
+			keyPairType: "x509",
+		},
+		{
+			name:        "type does not match",
+			keyPair:     keypairs.KeyPair{Name: "debug-key", Type: "ssh"},
+			keyPairType: "x509",
+			errString:   "keypair debug-key is of type ssh, expected x509",
+		},
+		{
+			name:        "type not reported by nova",
+			keyPair:     keypairs.KeyPair{Name: "debug-key"},
+			keyPairType: "ssh",
+		},
+		{
+			name:    "type not checked",
+			keyPair: keypairs.KeyPair{Name: "windows-key", Type: "x509"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkKeyPairType(&tt.keyPair, tt.keyPairType)
+			if tt.errString != "" {
+				assert.EqualError(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCheckArchitecture(t *testing.T) {
+	tests := []struct {
+		name       string
+		osArch     params.OSArch
+		imageArch  string
+		flavorArch string
+		errString  string
+	}{
+		{
+			name:       "all agree",
+			osArch:     params.Arm64,
+			imageArch:  "aarch64",
+			flavorArch: "arm64",
+		},
+		{
+			name:   "nothing set on the image and flavor",
+			osArch: params.Amd64,
+		},
+		{
+			name:      "requested and image mismatch",
+			osArch:    params.Arm64,
+			imageArch: "x86_64",
+			errString: "image ubuntu-22.04 has architecture amd64, but the runner needs arm64",
+		},
+		{
+			name:       "requested and flavor mismatch",
+			osArch:     params.Amd64,
+			imageArch:  "x86_64",
+			flavorArch: "aarch64",
+			errString:  "flavor m1.small has architecture arm64, but the runner needs amd64",
+		},
+		{
+			name:       "image and flavor mismatch",
+			imageArch:  "x86_64",
+			flavorArch: "aarch64",
+			errString:  "image ubuntu-22.04 has architecture amd64, but flavor m1.small has architecture arm64",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := images.Image{Name: "ubuntu-22.04", Properties: map[string]interface{}{}}
+			if tt.imageArch != "" {
+				image.Properties["architecture"] = tt.imageArch
+			}
+			extraSpecs := map[string]string{}
+			if tt.flavorArch != "" {
+				extraSpecs["arch"] = tt.flavorArch
+			}
+			err := checkArchitecture(tt.osArch, image, flavors.Flavor{ID: "1", Name: "m1.small"}, extraSpecs)
+			if tt.errString != "" {
+				assert.EqualError(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestVerifyArchitecture(t *testing.T) {
+	tests := []struct {
+		name              string
+		architectureCheck string
+		expectLookup      bool
+		errString         string
+	}{
+		{
+			name:              "enforce",
+			architectureCheck: config.ArchitectureCheckEnforce,
+			expectLookup:      true,
+			errString:         "flavor m1.arm has architecture arm64, but the runner needs amd64",
+		},
+		{
+			name:              "warn",
+			architectureCheck: config.ArchitectureCheckWarn,
+			expectLookup:      true,
+		},
+		{
+			name: "disabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+
+			var lookedUp atomic.Bool
+			testhelper.Mux.HandleFunc("/flavors/2/os-extra_specs", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "GET")
+				lookedUp.Store(true)
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"extra_specs": {"arch": "aarch64", "hw:cpu_policy": "dedicated"}}`)
+			})
+
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					ArchitectureCheck: tt.architectureCheck,
+				},
+				controllerID: "my-controller-id",
+			}
+			cli := client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id")
+			spec := &machineSpec{
+				BootstrapParams: params.BootstrapInstance{Name: "garm-runner", OSArch: params.Amd64},
+			}
+			image := images.Image{Name: "ubuntu-22.04", Properties: map[string]interface{}{"architecture": "x86_64"}}
+
+			err := provider.verifyArchitecture(context.Background(), cli, spec, image, []flavors.Flavor{{ID: "2", Name: "m1.arm"}})
+			assert.Equal(t, tt.expectLookup, lookedUp.Load())
+			if tt.errString != "" {
+				assert.EqualError(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRecordHostAggregates(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"server": {"id": "d9072956-1560-487c-97f2-18bdf65ec749", "status": "ACTIVE", "OS-EXT-SRV-ATTR:host": "compute-02"}}`)
+	})
+	testhelper.Mux.HandleFunc("/os-aggregates", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"aggregates": [
+			{"id": 1, "name": "gpu", "hosts": ["compute-01"]},
+			{"id": 2, "name": "billing-team-a", "hosts": ["compute-01", "compute-02"]},
+			{"id": 3, "name": "nvme", "hosts": ["compute-02"]}
+		]}`)
+	})
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/metadata", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		testhelper.TestJSONRequest(t, r, `{"metadata": {"garm-host-aggregates": "billing-team-a,nvme"}}`)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"metadata": {"garm-host-aggregates": "billing-team-a,nvme"}}`)
+	})
+
+	provider := &openstackProvider{
+		cfg:          &config.Config{RecordHostAggregates: true},
+		controllerID: "my-controller-id",
+	}
+	mockCli := client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id")
+	err := provider.recordHostAggregates(context.Background(), mockCli, "d9072956-1560-487c-97f2-18bdf65ec749")
+	assert.NoError(t, err)
+}
+
+func TestCreateInstanceErrorFault(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	handleSecurityGroupList(t, "/security-groups")
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+		},
+		cli:          client.NewTestOpenStackClient(projectServiceClient(t), "my-controller-id"),
+		controllerID: "my-controller-id",
+	}
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSArch: params.Amd64,
+		OSType: params.Linux,
+		Flavor: "m1.small",
+		Image:  "ubuntu-20.04",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{
+			"security_groups": ["default"],
+			"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6"
+		}`),
+		PoolID: "test-pool",
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return data.Tools[0], nil
+	}
+
+	testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"flavors": [{"id": "small", "name": "m1.small", "ram": 2048, "vcpus": 2, "disk": 20}]}`)
+	})
+	testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+	})
+	testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"images": [{"name": "ubuntu-20.04", "id": "aee1d242-730f-431f-88c1-87630c0f07ba", "status": "ACTIVE"}]}`)
+	})
+	testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"server": {"id": "d9072956-1560-487c-97f2-18bdf65ec749", "name": "test-instance", "status": "BUILD"}}`)
+	})
+	var deleted atomic.Bool
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+		if deleted.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"server": {
+			"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+			"name": "test-instance",
+			"status": "ERROR",
+			"fault": {"code": 500, "message": "Build of instance d9072956-1560-487c-97f2-18bdf65ec749 aborted: Volume quota exceeded"},
+			"tags": ["garm-controller-id=my-controller-id"]
+		}}`)
+	})
+	testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749/action", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		deleted.Store(true)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	_, err := provider.CreateInstance(context.Background(), data)
+	assert.ErrorContains(t, err, "instance in ERROR state: Build of instance d9072956-1560-487c-97f2-18bdf65ec749 aborted: Volume quota exceeded (code 500)")
+	assert.True(t, deleted.Load())
+}
+
+func TestCreateInstanceServerCreateNotRetried(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	handleSecurityGroupList(t, "/security-groups")
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "542b68dd-4b3d-459d-8531-34d5e779d4d6",
+			CreateMaxRetries: 3,
+		},
+		cli:          client.NewTestOpenStackClient(projectServiceClient(t), "my-controller-id"),
+		controllerID: "my-controller-id",
+	}
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSArch: params.Amd64,
+		OSType: params.Linux,
+		Flavor: "m1.small",
+		Image:  "ubuntu-20.04",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{"security_groups": ["default"]}`),
+		PoolID:     "test-pool",
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return data.Tools[0], nil
+	}
+
+	testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"flavors": [{"id": "small", "name": "m1.small", "ram": 2048, "vcpus": 2, "disk": 20}]}`)
+	})
+	testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+	})
+	testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"images": [{"name": "ubuntu-20.04", "id": "aee1d242-730f-431f-88c1-87630c0f07ba", "status": "ACTIVE"}]}`)
+	})
+	// Nova may have accepted a request that failed with a server error, so creating
+	// the server again could leave a duplicate runner behind.
+	var creates atomic.Int32
+	testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		creates.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"servers": []}`)
+	})
+
+	_, err := provider.CreateInstance(context.Background(), data)
+	assert.ErrorContains(t, err, "failed to create server")
+	assert.Equal(t, int32(1), creates.Load())
+}
+
+func TestCreateInstanceImageDownloadRetry(t *testing.T) {
+	tests := []struct {
+		name                 string
+		imageDownloadRetries int
+		errString            string
+		expectedCreates      int32
+	}{
+		{
+			name:                 "retry succeeds",
+			imageDownloadRetries: 1,
+			expectedCreates:      2,
+		},
+		{
+			name:            "retries disabled",
+			errString:       "image download failed: Build of instance 8e6c3b5a-2f0e-4d8e-9f5a-1c2b3d4e5f60 aborted: Image download failed",
+			expectedCreates: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+			handleSecurityGroupList(t, "/security-groups")
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					Cloud: "mycloud",
+					Credentials: config.Credentials{
+						Clouds: "../testdata/clouds.yaml",
+					},
+					DefaultNetworkID:     "test-network",
+					ImageDownloadRetries: tt.imageDownloadRetries,
+				},
+				cli:          client.NewTestOpenStackClient(projectServiceClient(t), "my-controller-id"),
+				controllerID: "my-controller-id",
+			}
+			data := params.BootstrapInstance{
+				Name:   "test-instance",
+				OSArch: params.Amd64,
+				OSType: params.Linux,
+				Flavor: "m1.small",
+				Image:  "ubuntu-20.04",
+				Tools: []params.RunnerApplicationDownload{
+					{
+						OS:           Ptr("linux"),
+						Architecture: Ptr("x64"),
+						DownloadURL:  Ptr("http://test.com"),
+						Filename:     Ptr("runner.tar.gz"),
+					},
+				},
+				ExtraSpecs: json.RawMessage(`{
+					"security_groups": ["default"],
+					"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6"
+				}`),
+				PoolID: "test-pool",
+			}
+			DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+				return data.Tools[0], nil
+			}
+
+			testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"flavors": [{"id": "small", "name": "m1.small", "ram": 2048, "vcpus": 2, "disk": 20}]}`)
+			})
+			testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+			})
+			testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"images": [{"name": "ubuntu-20.04", "id": "aee1d242-730f-431f-88c1-87630c0f07ba", "status": "ACTIVE"}]}`)
+			})
+
+			const (
+				faultedServerID = "8e6c3b5a-2f0e-4d8e-9f5a-1c2b3d4e5f60"
+				activeServerID  = "d9072956-1560-487c-97f2-18bdf65ec749"
+			)
+			var creates atomic.Int32
+			testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				// The first server fails to download its image.
+				id := activeServerID
+				if creates.Add(1) == 1 {
+					id = faultedServerID
+				}
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				fmt.Fprintf(w, `{"server": {"id": %q, "name": "test-instance", "status": "BUILD"}}`, id)
+			})
+			var deleted atomic.Bool
+			testhelper.Mux.HandleFunc("/servers/"+faultedServerID, func(w http.ResponseWriter, r *http.Request) {
+				if deleted.Load() {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"server": {
+					"id": %q,
+					"name": "test-instance",
+					"status": "ERROR",
+					"fault": {"code": 500, "message": "Build of instance %s aborted: Image download failed"},
+					"tags": ["garm-controller-id=my-controller-id"]
+				}}`, faultedServerID, faultedServerID)
+			})
+			testhelper.Mux.HandleFunc("/servers/"+faultedServerID+"/action", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				deleted.Store(true)
+				w.WriteHeader(http.StatusAccepted)
+			})
+			testhelper.Mux.HandleFunc("/servers/"+activeServerID, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"server": {
+					"id": %q,
+					"name": "test-instance",
+					"status": "ACTIVE",
+					"tags": ["garm-controller-id=my-controller-id"]
+				}}`, activeServerID)
+			})
+
+			instance, err := provider.CreateInstance(context.Background(), data)
+			assert.True(t, deleted.Load())
+			assert.Equal(t, tt.expectedCreates, creates.Load())
+			if tt.errString != "" {
+				assert.ErrorContains(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, activeServerID, instance.ProviderID)
+		})
+	}
+}
+
+func TestCreateInstanceStorageBackendFallback(t *testing.T) {
+	tests := []struct {
+		name             string
+		extraSpecs       string
+		expectedTypes    []string
+		expectedMetadata string
+	}{
+		{
+			name: "storage backend",
+			extraSpecs: `{
+				"boot_from_volume": true,
+				"boot_disk_size": 50,
+				"storage_backend": "nvme",
+				"storage_backend_fallbacks": ["ssd", "hdd"]
+			}`,
+			expectedTypes:    []string{"nvme", "ssd", "hdd"},
+			expectedMetadata: "hdd",
+		},
+		{
+			name: "root volume type",
+			extraSpecs: `{
+				"boot_from_volume": true,
+				"boot_disk_size": 50,
+				"root_volume_type": "nvme",
+				"storage_backend": "standard",
+				"storage_backend_fallbacks": ["ssd", "hdd"]
+			}`,
+			expectedTypes:    []string{"nvme", "ssd", "hdd"},
+			expectedMetadata: "hdd",
+		},
+		{
+			name: "no volumes",
+			extraSpecs: `{
+				"storage_backend": "nvme",
+				"storage_backend_fallbacks": ["ssd", "hdd"]
+			}`,
+			expectedTypes: []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+			handleSecurityGroupList(t, "/security-groups")
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					Cloud: "mycloud",
+					Credentials: config.Credentials{
+						Clouds: "../testdata/clouds.yaml",
+					},
+					DefaultNetworkID: "test-network",
+				},
+				cli:          client.NewTestOpenStackClient(projectServiceClient(t), "my-controller-id"),
+				controllerID: "my-controller-id",
+			}
+			var extraSpecs map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(tt.extraSpecs), &extraSpecs))
+			extraSpecs["security_groups"] = []string{"default"}
+			extraSpecs["network_id"] = "542b68dd-4b3d-459d-8531-34d5e779d4d6"
+			rawExtraSpecs, err := json.Marshal(extraSpecs)
+			assert.NoError(t, err)
+			data := params.BootstrapInstance{
+				Name:   "test-instance",
+				OSArch: params.Amd64,
+				OSType: params.Linux,
+				Flavor: "m1.small",
+				Image:  "ubuntu-20.04",
+				Tools: []params.RunnerApplicationDownload{
+					{
+						OS:           Ptr("linux"),
+						Architecture: Ptr("x64"),
+						DownloadURL:  Ptr("http://test.com"),
+						Filename:     Ptr("runner.tar.gz"),
+					},
+				},
+				ExtraSpecs: rawExtraSpecs,
+				PoolID:     "test-pool",
+			}
+			DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+				return data.Tools[0], nil
+			}
+
+			testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"flavors": [{"id": "small", "name": "m1.small", "ram": 2048, "vcpus": 2, "disk": 20}]}`)
+			})
+			testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+			})
+			testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"images": [{"name": "ubuntu-20.04", "id": "aee1d242-730f-431f-88c1-87630c0f07ba", "status": "ACTIVE", "disk_format": "qcow2"}]}`)
+			})
+
+			const (
+				faultedServerID = "8e6c3b5a-2f0e-4d8e-9f5a-1c2b3d4e5f60"
+				activeServerID  = "d9072956-1560-487c-97f2-18bdf65ec749"
+			)
+			var mux sync.Mutex
+			var volumeTypes []string
+			var storageBackendMetadata string
+			testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				var body struct {
+					Server struct {
+						Metadata           map[string]string `json:"metadata"`
+						BlockDeviceMapping []struct {
+							VolumeType string `json:"volume_type"`
+						} `json:"block_device_mapping_v2"`
+					} `json:"server"`
+				}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+				var volumeType string
+				if len(body.Server.BlockDeviceMapping) > 0 {
+					volumeType = body.Server.BlockDeviceMapping[0].VolumeType
+				}
+				mux.Lock()
+				defer mux.Unlock()
+				volumeTypes = append(volumeTypes, volumeType)
+				storageBackendMetadata = body.Server.Metadata[storageBackendKey]
+				w.Header().Add("Content-Type", "application/json")
+				switch volumeType {
+				case "nvme":
+					// The nvme volume type does not exist in this cloud.
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"badRequest": {"code": 400, "message": "Volume type nvme could not be found."}}`)
+				case "ssd":
+					// The ssd backend is out of capacity.
+					w.WriteHeader(http.StatusAccepted)
+					fmt.Fprintf(w, `{"server": {"id": %q, "name": "test-instance", "status": "BUILD"}}`, faultedServerID)
+				default:
+					w.WriteHeader(http.StatusAccepted)
+					fmt.Fprintf(w, `{"server": {"id": %q, "name": "test-instance", "status": "BUILD"}}`, activeServerID)
+				}
+			})
+			var deleted atomic.Bool
+			testhelper.Mux.HandleFunc("/servers/"+faultedServerID, func(w http.ResponseWriter, r *http.Request) {
+				if deleted.Load() {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"server": {
+					"id": %q,
+					"name": "test-instance",
+					"status": "ERROR",
+					"fault": {"code": 500, "message": "Build of instance %s aborted: Volume 0f6a2c1e-7a55-4a1e-9f0e-6a8e9b2f3c4d did not finish being created even after we waited 3 seconds or 1 attempts. And its status is error."},
+					"tags": ["garm-controller-id=my-controller-id"]
+				}}`, faultedServerID, faultedServerID)
+			})
+			testhelper.Mux.HandleFunc("/servers/"+faultedServerID+"/action", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				deleted.Store(true)
+				w.WriteHeader(http.StatusAccepted)
+			})
+			testhelper.Mux.HandleFunc("/servers/"+activeServerID, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"server": {
+					"id": %q,
+					"name": "test-instance",
+					"status": "ACTIVE",
+					"tags": ["garm-controller-id=my-controller-id"]
+				}}`, activeServerID)
+			})
+
+			instance, err := provider.CreateInstance(context.Background(), data)
+			assert.NoError(t, err)
+			assert.Equal(t, activeServerID, instance.ProviderID)
+			assert.Equal(t, tt.expectedTypes, volumeTypes)
+			assert.Equal(t, tt.expectedMetadata, storageBackendMetadata)
+			assert.Equal(t, len(tt.expectedTypes) > 1, deleted.Load())
+		})
+	}
+}
+
+func TestCreateInstanceRootVolumeCopy(t *testing.T) {
+	tests := []struct {
+		name         string
+		createStatus int
+		wantErr      bool
+		wantDeleted  bool
+	}{
+		{
+			name:         "boots from the copy",
+			createStatus: http.StatusAccepted,
+		},
+		{
+			name:         "copy removed when the server create fails",
+			createStatus: http.StatusBadRequest,
+			wantErr:      true,
+			wantDeleted:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+			handleSecurityGroupList(t, "/security-groups")
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					Cloud: "mycloud",
+					Credentials: config.Credentials{
+						Clouds: "../testdata/clouds.yaml",
+					},
+					DefaultNetworkID: "test-network",
+				},
+				cli:          client.NewTestOpenStackClient(projectServiceClient(t), "my-controller-id"),
+				controllerID: "my-controller-id",
+			}
+			data := params.BootstrapInstance{
+				Name:   "test-instance",
+				OSArch: params.Amd64,
+				OSType: params.Linux,
+				Flavor: "m1.small",
+				Image:  "ubuntu-20.04",
+				Tools: []params.RunnerApplicationDownload{
+					{
+						OS:           Ptr("linux"),
+						Architecture: Ptr("x64"),
+						DownloadURL:  Ptr("http://test.com"),
+						Filename:     Ptr("runner.tar.gz"),
+					},
+				},
+				ExtraSpecs: json.RawMessage(`{
+					"security_groups": ["default"],
+					"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6",
+					"boot_from_volume": true,
+					"root_volume_id": "6f2c1a9e-4b3d-4e5f-8a7b-9c0d1e2f3a4b"
+				}`),
+				PoolID: "test-pool",
+			}
+			DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+				return data.Tools[0], nil
+			}
+
+			testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"flavors": [{"id": "small", "name": "m1.small", "ram": 2048, "vcpus": 2, "disk": 20}]}`)
+			})
+			testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+			})
+			testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"images": [{"name": "ubuntu-20.04", "id": "aee1d242-730f-431f-88c1-87630c0f07ba", "status": "ACTIVE", "disk_format": "qcow2"}]}`)
+			})
+
+			const copyID = "0f6a2c1e-7a55-4a1e-9f0e-6a8e9b2f3c4d"
+			testhelper.Mux.HandleFunc("/volumes", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				testhelper.TestJSONRequest(t, r, `{"volume": {"name": "test-instance", "source_volid": "6f2c1a9e-4b3d-4e5f-8a7b-9c0d1e2f3a4b"}}`)
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				fmt.Fprintf(w, `{"volume": {"id": %q, "status": "creating"}}`, copyID)
+			})
+			var deleted atomic.Bool
+			testhelper.Mux.HandleFunc("/volumes/"+copyID, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodDelete {
+					deleted.Store(true)
+					w.WriteHeader(http.StatusAccepted)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"volume": {"id": %q, "status": "available"}}`, copyID)
+			})
+			testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "POST")
+				var body struct {
+					Server struct {
+						BlockDeviceMapping []struct {
+							SourceType          string `json:"source_type"`
+							UUID                string `json:"uuid"`
+							DeleteOnTermination bool   `json:"delete_on_termination"`
+						} `json:"block_device_mapping_v2"`
+					} `json:"server"`
+				}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				assert.Len(t, body.Server.BlockDeviceMapping, 1)
+				assert.Equal(t, "volume", body.Server.BlockDeviceMapping[0].SourceType)
+				assert.Equal(t, copyID, body.Server.BlockDeviceMapping[0].UUID)
+				assert.True(t, body.Server.BlockDeviceMapping[0].DeleteOnTermination)
+
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(tt.createStatus)
+				if tt.createStatus != http.StatusAccepted {
+					fmt.Fprint(w, `{"badRequest": {"code": 400, "message": "Invalid request."}}`)
+					return
+				}
+				fmt.Fprint(w, `{"server": {"id": "d9072956-1560-487c-97f2-18bdf65ec749", "name": "test-instance", "status": "BUILD"}}`)
+			})
+			testhelper.Mux.HandleFunc("/servers/d9072956-1560-487c-97f2-18bdf65ec749", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				fmt.Fprint(w, `{"server": {"id": "d9072956-1560-487c-97f2-18bdf65ec749", "name": "test-instance", "status": "ACTIVE", "tags": ["garm-controller-id=my-controller-id"]}}`)
+			})
+
+			instance, err := provider.CreateInstance(context.Background(), data)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "d9072956-1560-487c-97f2-18bdf65ec749", instance.ProviderID)
+			}
+			assert.Equal(t, tt.wantDeleted, deleted.Load())
+		})
+	}
+}
+
+func TestCreateInstanceAddressFamilyRecreate(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	handleSecurityGroupList(t, "/security-groups")
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID:          "test-network",
+			AddressFamilyPreference:   config.AddressFamilyIPv4,
+			AddressFamilyMaxRecreates: 2,
+		},
+		cli:          client.NewTestOpenStackClient(projectServiceClient(t), "my-controller-id"),
+		controllerID: "my-controller-id",
+	}
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSArch: params.Amd64,
+		OSType: params.Linux,
+		Flavor: "m1.small",
+		Image:  "ubuntu-20.04",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{
+			"security_groups": ["default"],
+			"network_id": "542b68dd-4b3d-459d-8531-34d5e779d4d6"
+		}`),
+		PoolID: "test-pool",
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return data.Tools[0], nil
+	}
+
+	testhelper.Mux.HandleFunc("/flavors/detail", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"flavors": [{"id": "small", "name": "m1.small", "ram": 2048, "vcpus": 2, "disk": 20}]}`)
+	})
+	testhelper.Mux.HandleFunc("/networks/542b68dd-4b3d-459d-8531-34d5e779d4d6", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"network": {"id": "542b68dd-4b3d-459d-8531-34d5e779d4d6", "name": "test-network"}}`)
+	})
+	testhelper.Mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"images": [{"name": "ubuntu-20.04", "id": "aee1d242-730f-431f-88c1-87630c0f07ba", "status": "ACTIVE"}]}`)
+	})
+
+	// The first server only gets an IPv6 address, the second one gets an IPv4 address.
+	serverIDs := []string{"d9072956-1560-487c-97f2-18bdf65ec749", "e8b0a6f4-3d1c-4f0e-9a57-2c6b8f1d0e32"}
+	serverAddresses := []string{"2001:db8::10", "10.0.0.10"}
+	var created atomic.Int32
+	testhelper.Mux.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		idx := created.Add(1) - 1
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"server": {"id": %q, "name": "test-instance", "status": "BUILD"}}`, serverIDs[idx])
+	})
+	var deleted atomic.Bool
+	for idx, id := range serverIDs {
+		testhelper.Mux.HandleFunc("/servers/"+id, func(w http.ResponseWriter, r *http.Request) {
+			if idx == 0 && deleted.Load() {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Add("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"server": {
+				"id": %q,
+				"name": "test-instance",
+				"status": "ACTIVE",
+				"addresses": {"test-network": [{"addr": %q, "OS-EXT-IPS:type": "fixed"}]},
+				"tags": ["garm-controller-id=my-controller-id"]
+			}}`, id, serverAddresses[idx])
+		})
+	}
+	testhelper.Mux.HandleFunc("/servers/"+serverIDs[0]+"/action", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "POST")
+		deleted.Store(true)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	instance, err := provider.CreateInstance(context.Background(), data)
+	assert.NoError(t, err)
+	assert.Equal(t, serverIDs[1], instance.ProviderID)
+	assert.Equal(t, []params.Address{{Address: "10.0.0.10", Type: params.PrivateAddress}}, instance.Addresses)
+	assert.Equal(t, int32(2), created.Load())
+	assert.True(t, deleted.Load())
+}
+
+func TestListInstancesSoftDeleted(t *testing.T) {
+	tests := []struct {
+		name       string
+		hide       bool
+		wantStatus []params.InstanceStatus
+	}{
+		{
+			name:       "soft deleted servers are listed as deleting",
+			wantStatus: []params.InstanceStatus{params.InstanceRunning, params.InstanceDeleting},
+		},
+		{
+			name:       "soft deleted servers are hidden",
+			hide:       true,
+			wantStatus: []params.InstanceStatus{params.InstanceRunning},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testhelper.SetupHTTP()
+			defer testhelper.TeardownHTTP()
+			provider := &openstackProvider{
+				cfg: &config.Config{
+					Cloud: "mycloud",
+					Credentials: config.Credentials{
+						Clouds: "../testdata/clouds.yaml",
+					},
+					DefaultNetworkID:       "test-network",
+					HideSoftDeletedServers: tt.hide,
+				},
+				cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+				controllerID: "my-controller-id",
+			}
+
+			testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+				testhelper.TestMethod(t, r, "GET")
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprintf(w, `
+				{
+				"servers": [
+					{
+						"id": "d9072956-1560-487c-97f2-18bdf65ec749",
+						"name": "active-instance",
+						"tags": ["garm-controller-id=my-controller-id", "garm-pool-id=test-pool"],
+						"status": "ACTIVE"
+					},
+					{
+						"id": "8c0b1b2a-4d4e-4b3c-9a7e-2f1d3c4b5a69",
+						"name": "soft-deleted-instance",
+						"tags": ["garm-controller-id=my-controller-id", "garm-pool-id=test-pool"],
+						"status": "SOFT_DELETED"
+					}
+				]
+				}`)
+			})
+
+			instances, err := provider.ListInstances(context.Background(), "test-pool")
+			assert.NoError(t, err)
+			status := []params.InstanceStatus{}
+			for _, instance := range instances {
+				status = append(status, instance.Status)
+			}
+			assert.Equal(t, tt.wantStatus, status)
+		})
+	}
+}
+
+func TestListInstancesCreatedBefore(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Cloud: "mycloud",
+			Credentials: config.Credentials{
+				Clouds: "../testdata/clouds.yaml",
+			},
+			DefaultNetworkID: "test-network",
+		},
+		cli:          client.NewTestOpenStackClient(thclient.ServiceClient(), "my-controller-id"),
+		controllerID: "my-controller-id",
+	}
+
+	testhelper.Mux.HandleFunc("/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		testhelper.TestMethod(t, r, "GET")
+		testhelper.TestFormValues(t, r, map[string]string{"tags": "garm-pool-id=test-pool,garm-controller-id=my-controller-id"})
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"servers": [
+			{"id": "old-server", "name": "old-runner", "status": "ACTIVE", "created": "2026-10-01T10:00:00Z"},
+			{"id": "cutoff-server", "name": "cutoff-runner", "status": "ACTIVE", "created": "2026-10-10T00:00:00Z"},
+			{"id": "new-server", "name": "new-runner", "status": "ACTIVE", "created": "2026-10-16T08:30:00Z"}
+		]}`)
+	})
+
+	cutoff := time.Date(2026, 10, 10, 0, 0, 0, 0, time.UTC)
+	instances, err := provider.ListInstancesCreatedBefore(context.Background(), "test-pool", cutoff)
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, "old-server", instances[0].ProviderID)
+
+	instances, err = provider.ListInstancesCreatedBefore(context.Background(), "test-pool", cutoff.AddDate(0, 0, 7))
+	assert.NoError(t, err)
+	assert.Len(t, instances, 3)
+}
+
+func TestGetProviderInfo(t *testing.T) {
+	testhelper.SetupHTTP()
+	defer testhelper.TeardownHTTP()
+
+	serviceClient := thclient.ServiceClient()
+	serviceClient.Microversion = "2.60"
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			Region: "RegionOne",
+		},
+		cli:          client.NewTestOpenStackClient(serviceClient, "my-controller-id"),
+		controllerID: "my-controller-id",
+	}
+
+	info, err := provider.GetProviderInfo(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, Version, info.Version)
+	assert.Len(t, info.Regions, 1)
+	assert.Equal(t, "RegionOne", info.Regions[0].Region)
+	assert.Equal(t, "2.60", info.Regions[0].ComputeMicroversion)
+	assert.Equal(t, "public", info.Regions[0].Interface)
+	assert.Equal(t, serviceClient.Endpoint, info.Regions[0].Endpoints["compute"])
+}
+
+func TestSecurityGroupRuleToClientRule(t *testing.T) {
+	rule := securityGroupRule{Protocol: "tcp", PortRangeMin: 22, PortRangeMax: 22, RemoteIPPrefix: "2001:db8::1/64"}
+	assert.Equal(t, client.SecurityGroupRule{
+		Direction:      "ingress",
+		EtherType:      "IPv6",
+		Protocol:       "tcp",
+		PortRangeMin:   22,
+		PortRangeMax:   22,
+		RemoteIPPrefix: "2001:db8::/64",
+	}, rule.toClientRule())
+
+	rule = securityGroupRule{Direction: "egress"}
+	assert.Equal(t, client.SecurityGroupRule{Direction: "egress", EtherType: "IPv4"}, rule.toClientRule())
 }
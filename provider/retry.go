@@ -0,0 +1,84 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+var errRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// defaultRetryInterval is the time we wait between retries.
+var defaultRetryInterval = 2 * time.Second
+
+// retryBudget bounds the number of retries and the total time spent retrying by all
+// the operations of a single CreateInstance call.
+type retryBudget struct {
+	retriesLeft int
+	deadline    time.Time
+	interval    time.Duration
+}
+
+// newRetryBudget returns a budget that allows at most maxRetries retries. If timeout is
+// larger than 0, no retry is attempted once it elapses.
+func newRetryBudget(maxRetries int, timeout, interval time.Duration) *retryBudget {
+	budget := &retryBudget{
+		retriesLeft: maxRetries,
+		interval:    interval,
+	}
+	if timeout > 0 {
+		budget.deadline = time.Now().Add(timeout)
+	}
+	return budget
+}
+
+// isRetryable returns true for errors that are likely transient.
+func isRetryable(err error) bool {
+	var statusErr gophercloud.StatusCodeError
+	if errors.As(err, &statusErr) {
+		code := statusErr.GetStatusCode()
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// run calls fn until it succeeds, returns an error that is not retryable or the budget
+// is exhausted.
+func (b *retryBudget) run(ctx context.Context, fn func() error) error {
+	for {
+		err := fn()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		if b.retriesLeft <= 0 || (!b.deadline.IsZero() && time.Now().Add(b.interval).After(b.deadline)) {
+			return fmt.Errorf("%w: %w", errRetryBudgetExhausted, err)
+		}
+		b.retriesLeft--
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped retrying: %w", ctx.Err())
+		case <-time.After(b.interval):
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func transientError() error {
+	return fmt.Errorf("failed to get flavor: %w", gophercloud.ErrDefault503{
+		ErrUnexpectedResponseCode: gophercloud.ErrUnexpectedResponseCode{Actual: 503},
+	})
+}
+
+func TestRetryBudgetShared(t *testing.T) {
+	ctx := context.Background()
+	budget := newRetryBudget(3, 0, time.Millisecond)
+
+	calls := 0
+	err := budget.run(ctx, func() error {
+		calls++
+		if calls < 3 {
+			return transientError()
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// Only one retry is left for the next operation.
+	calls = 0
+	err = budget.run(ctx, func() error {
+		calls++
+		return transientError()
+	})
+	assert.ErrorIs(t, err, errRetryBudgetExhausted)
+	assert.Equal(t, 2, calls)
+
+	// Once the budget is exhausted, no more retries are attempted.
+	calls = 0
+	err = budget.run(ctx, func() error {
+		calls++
+		return transientError()
+	})
+	assert.ErrorIs(t, err, errRetryBudgetExhausted)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryBudgetDeadline(t *testing.T) {
+	budget := newRetryBudget(100, 50*time.Millisecond, 20*time.Millisecond)
+
+	calls := 0
+	err := budget.run(context.Background(), func() error {
+		calls++
+		return transientError()
+	})
+	assert.ErrorIs(t, err, errRetryBudgetExhausted)
+	assert.Less(t, calls, 4)
+}
+
+func TestRetryBudgetNotRetryable(t *testing.T) {
+	budget := newRetryBudget(3, 0, time.Millisecond)
+
+	calls := 0
+	err := budget.run(context.Background(), func() error {
+		calls++
+		return fmt.Errorf("failed to find flavor with name or id m1.small")
+	})
+	assert.ErrorContains(t, err, "failed to find flavor")
+	assert.NotErrorIs(t, err, errRetryBudgetExhausted)
+	assert.Equal(t, 1, calls)
+}
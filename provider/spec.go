@@ -15,17 +15,33 @@
 package provider
 
 import (
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cloudbase/garm-provider-common/cloudconfig"
 	"github.com/cloudbase/garm-provider-common/params"
 	"github.com/cloudbase/garm-provider-common/util"
+	"github.com/google/uuid"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/schedulerhints"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
 	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
 	"github.com/invopop/jsonschema"
 	"github.com/xeipuuv/gojsonschema"
 
@@ -34,6 +50,29 @@ import (
 
 var defaultBootDiskSize int64 = 50
 
+// defaultCreateTimeout is the number of seconds we wait for a server to be created.
+var defaultCreateTimeout = 120
+
+var defaultAllowedImageDiskFormats = []string{"qcow2", "raw"}
+
+const (
+	// maxMetadataItems is the default nova quota for metadata items on a server.
+	maxMetadataItems = 128
+	// maxMetadataKeyLength is the maximum length nova accepts for a metadata key.
+	maxMetadataKeyLength = 255
+	// maxMetadataValueLength is the maximum length nova accepts for a metadata value.
+	maxMetadataValueLength = 255
+	// maxUserDataSize is the maximum size nova accepts for the base64 encoded user data.
+	maxUserDataSize = 65535
+	// maxInjectedFilePathLength is the default nova limit for the path of an injected file.
+	maxInjectedFilePathLength = 255
+)
+
+// runnerLabelRegex matches the runner labels and runner group names we accept. They are
+// passed to the runner config script, so we only allow characters that are safe to
+// use in a shell command.
+var runnerLabelRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,256}$`)
+
 type ToolFetchFunc func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error)
 
 type GetCloudConfigFunc func(bootstrapParams params.BootstrapInstance, tools params.RunnerApplicationDownload, runnerName string) (string, error)
@@ -43,18 +82,195 @@ var (
 	DefaultGetCloudconfig GetCloudConfigFunc = cloudconfig.GetCloudConfig
 )
 
+// serverNetwork describes one of the networks the runner is connected to.
+type serverNetwork struct {
+	NetworkID string `json:"network_id,omitempty" jsonschema:"description=The network to connect the runner to. Nova creates a port in this network. Mutually exclusive with port_id."`
+	PortID    string `json:"port_id,omitempty" jsonschema:"description=The ID of an existing port to attach to the runner. Mutually exclusive with network_id. A port can only be attached to one server at a time so pools that set it must have max_runners set to 1."`
+	FixedIP   string `json:"fixed_ip,omitempty" jsonschema:"description=The fixed IP address to request on the network. Only one runner can have the address so the pool needs max_runners 1. Requires network_id."`
+	SubnetID  string `json:"subnet_id,omitempty" jsonschema:"description=The ID of the subnet the fixed IP must belong to. Requires network_id and fixed_ip."`
+	StaticIP  bool   `json:"static_ip,omitempty" jsonschema:"description=Configure the fixed IP statically in the runner for networks without DHCP. The gateway and DNS servers are taken from the subnet. Requires fixed_ip and subnet_id. Only supported on Linux images that use netplan and with use_config_drive."`
+}
+
+// Validate checks that the network is either a network or an existing port.
+func (n serverNetwork) Validate() error {
+	if (n.NetworkID == "") == (n.PortID == "") {
+		return fmt.Errorf("exactly one of network_id or port_id must be set")
+	}
+	if n.FixedIP != "" {
+		if n.NetworkID == "" {
+			return fmt.Errorf("fixed_ip requires network_id")
+		}
+		if net.ParseIP(n.FixedIP) == nil {
+			return fmt.Errorf("invalid fixed_ip: %q", n.FixedIP)
+		}
+	}
+	if n.SubnetID != "" && n.FixedIP == "" {
+		return fmt.Errorf("subnet_id requires fixed_ip")
+	}
+	if n.StaticIP && n.SubnetID == "" {
+		return fmt.Errorf("static_ip requires fixed_ip and subnet_id")
+	}
+	return nil
+}
+
+// staticNetwork is the static network config of a port, for networks without DHCP.
+type staticNetwork struct {
+	MACAddress string
+	// Address is the fixed IP of the port, in CIDR notation.
+	Address    string
+	Gateway    string
+	DNSServers []string
+}
+
+// newStaticNetwork returns the static network config of a port created with the given
+// fixed IP. It fails if neutron did not assign the fixed IP from the subnet to the port,
+// or if the gateway of the subnet is not usable, so the runner does not come up with
+// an address that does not match its port.
+func newStaticNetwork(port ports.Port, subnet subnets.Subnet, fixedIP string) (staticNetwork, error) {
+	ip := net.ParseIP(fixedIP)
+	assigned := false
+	for _, portIP := range port.FixedIPs {
+		if portIP.SubnetID == subnet.ID && ip.Equal(net.ParseIP(portIP.IPAddress)) {
+			assigned = true
+			break
+		}
+	}
+	if !assigned {
+		return staticNetwork{}, fmt.Errorf("port %s does not have the fixed IP %s from subnet %s", port.ID, fixedIP, subnet.ID)
+	}
+	if port.MACAddress == "" {
+		return staticNetwork{}, fmt.Errorf("port %s has no MAC address", port.ID)
+	}
+
+	_, cidr, err := net.ParseCIDR(subnet.CIDR)
+	if err != nil {
+		return staticNetwork{}, fmt.Errorf("failed to parse CIDR of subnet %s: %w", subnet.ID, err)
+	}
+	if !cidr.Contains(ip) {
+		return staticNetwork{}, fmt.Errorf("fixed IP %s is not in subnet %s (%s)", fixedIP, subnet.ID, subnet.CIDR)
+	}
+	if subnet.GatewayIP != "" {
+		gateway := net.ParseIP(subnet.GatewayIP)
+		if gateway == nil || !cidr.Contains(gateway) {
+			return staticNetwork{}, fmt.Errorf("gateway %s of subnet %s is not in %s", subnet.GatewayIP, subnet.ID, subnet.CIDR)
+		}
+		if gateway.Equal(ip) {
+			return staticNetwork{}, fmt.Errorf("fixed IP %s is the gateway of subnet %s", fixedIP, subnet.ID)
+		}
+	}
+
+	prefixLen, _ := cidr.Mask.Size()
+	return staticNetwork{
+		MACAddress: port.MACAddress,
+		Address:    fmt.Sprintf("%s/%d", ip, prefixLen),
+		Gateway:    subnet.GatewayIP,
+		DNSServers: subnet.DNSNameservers,
+	}, nil
+}
+
+// securityGroupRule is a rule of the security group managed for a pool.
+type securityGroupRule struct {
+	Direction      string `json:"direction,omitempty" jsonschema:"enum=ingress,enum=egress,description=The direction of the traffic the rule applies to. Default is ingress."`
+	Protocol       string `json:"protocol,omitempty" jsonschema:"enum=tcp,enum=udp,enum=icmp,enum=ipv6-icmp,description=The protocol the rule applies to. If not set the rule applies to all protocols."`
+	PortRangeMin   int    `json:"port_range_min,omitempty" jsonschema:"minimum=1,maximum=65535,description=The first port of the range the rule applies to. Only supported for tcp and udp."`
+	PortRangeMax   int    `json:"port_range_max,omitempty" jsonschema:"minimum=1,maximum=65535,description=The last port of the range the rule applies to. Only supported for tcp and udp."`
+	RemoteIPPrefix string `json:"remote_ip_prefix,omitempty" jsonschema:"description=The CIDR the traffic comes from or goes to. Mutually exclusive with remote_group_id."`
+	RemoteGroupID  string `json:"remote_group_id,omitempty" jsonschema:"description=The ID of the security group the traffic comes from or goes to. Mutually exclusive with remote_ip_prefix."`
+}
+
+// Validate checks the protocol, the port range and the remote of the rule.
+func (r securityGroupRule) Validate() error {
+	switch r.Direction {
+	case "", "ingress", "egress":
+	default:
+		return fmt.Errorf("invalid direction: %q", r.Direction)
+	}
+	switch r.Protocol {
+	case "", "tcp", "udp", "icmp", "ipv6-icmp":
+	default:
+		return fmt.Errorf("invalid protocol: %q", r.Protocol)
+	}
+	if r.PortRangeMin != 0 || r.PortRangeMax != 0 {
+		if r.Protocol != "tcp" && r.Protocol != "udp" {
+			return fmt.Errorf("port ranges are only supported for tcp and udp")
+		}
+		if r.PortRangeMin < 1 || r.PortRangeMax > 65535 || r.PortRangeMin > r.PortRangeMax {
+			return fmt.Errorf("invalid port range: %d-%d", r.PortRangeMin, r.PortRangeMax)
+		}
+	}
+	if r.RemoteIPPrefix != "" {
+		if r.RemoteGroupID != "" {
+			return fmt.Errorf("remote_ip_prefix and remote_group_id are mutually exclusive")
+		}
+		if _, _, err := net.ParseCIDR(r.RemoteIPPrefix); err != nil {
+			return fmt.Errorf("invalid remote_ip_prefix: %q", r.RemoteIPPrefix)
+		}
+	}
+	return nil
+}
+
+// schedulerHints are the nova scheduler hints set on the runners.
+type schedulerHints struct {
+	Group                string                 `json:"group,omitempty" jsonschema:"description=The UUID of the server group in which runners will be created. Use a server group with an anti-affinity policy to spread runners across hypervisors."`
+	AdditionalProperties map[string]interface{} `json:"additional_properties,omitempty" jsonschema:"description=Additional scheduler hints that are passed to nova as they are. For example same_host or different_host."`
+}
+
+// dataDisk describes an additional volume that is attached to the runner.
+type dataDisk struct {
+	Size                int    `json:"size" jsonschema:"minimum=1,description=The size of the volume in GB."`
+	VolumeType          string `json:"volume_type,omitempty" jsonschema:"description=The cinder volume type of the volume. If empty the storage_backend is used."`
+	DeleteOnTermination *bool  `json:"delete_on_termination,omitempty" jsonschema:"description=Whether the volume is deleted together with the runner. Default is true."`
+}
+
 type extraSpecs struct {
-	SecurityGroups     []string `json:"security_groups,omitempty"`
-	AllowedImageOwners []string `json:"allowed_image_owners,omitempty" jsonschema:"description=A list of image owners to allow when creating the instance. If not specified, all images will be allowed."`
-	ImageVisibility    string   `json:"image_visibility,omitempty" jsonschema:"description=The visibility of the image to use."`
-	NetworkID          string   `json:"network_id,omitempty" jsonschema:"description=The tenant network to which runners will be connected to."`
-	StorageBackend     string   `json:"storage_backend,omitempty" jsonschema:"description=The cinder backend to use when creating volumes."`
-	BootFromVolume     *bool    `json:"boot_from_volume,omitempty" jsonschema:"description=Whether to boot from volume or not. Use this option if the root disk size defined by the flavor is not enough."`
-	BootDiskSize       *int64   `json:"boot_disk_size,omitempty" jsonschema:"description=The size of the root disk in GB. Default is 50 GB."`
-	UseConfigDrive     *bool    `json:"use_config_drive,omitempty" jsonschema:"description=Use config drive."`
-	EnableBootDebug    *bool    `json:"enable_boot_debug,omitempty" jsonschema:"description=Enable cloud-init debug mode. Adds 'set -x' into the cloud-init script."`
-	DisableUpdates     *bool    `json:"disable_updates,omitempty" jsonschema:"description=Disable automatic updates on the VM."`
-	ExtraPackages      []string `json:"extra_packages,omitempty" jsonschema:"description=Extra packages to install on the VM."`
+	SecurityGroups     []string            `json:"security_groups,omitempty"`
+	SecurityGroupRules []securityGroupRule `json:"security_group_rules,omitempty" jsonschema:"description=A list of rules of a security group that is managed for the pool and added to the runners. Rules that are not in the list are removed from the group."`
+	AllowedImageOwners []string            `json:"allowed_image_owners,omitempty" jsonschema:"description=A list of image owners to allow when creating the instance. If not specified, all images will be allowed."`
+	ImageVisibility    string              `json:"image_visibility,omitempty" jsonschema:"description=The visibility of the image to use."`
+	NetworkID          string              `json:"network_id,omitempty" jsonschema:"description=The tenant network to which runners will be connected to."`
+	Networks           []serverNetwork     `json:"networks,omitempty" jsonschema:"description=A list of networks and ports to attach to the runner. Overrides network_id."`
+	SchedulerHints     *schedulerHints     `json:"scheduler_hints,omitempty" jsonschema:"description=The nova scheduler hints set on the runners."`
+	Ports              []string            `json:"ports,omitempty" jsonschema:"description=A list of IDs of existing ports to attach to the runner instead of letting nova create a port in network_id. Can not be combined with network_id or networks. A port can only be attached to one server at a time so pools that set ports must have max_runners set to 1."`
+	AvailabilityZone   string              `json:"availability_zone,omitempty" jsonschema:"description=The availability zone in which runners will be created. If empty the scheduler picks one."`
+	Flavor             string              `json:"flavor,omitempty" jsonschema:"description=The name or ID of the flavor of the runners. Overrides the flavor of the pool."`
+	Image              string              `json:"image,omitempty" jsonschema:"description=The name or ID of the image of the runners. Overrides the image of the pool."`
+	FlavorFallbacks    []string            `json:"flavor_fallbacks,omitempty" jsonschema:"description=A list of flavors to try in order if the pool flavor cannot be scheduled."`
+	CreateTimeout      *int                `json:"create_timeout,omitempty" jsonschema:"minimum=1,description=The maximum number of seconds to wait for a runner to be created and become ACTIVE. Useful for large images that take a long time to spawn."`
+	KeyName            string              `json:"key_name,omitempty" jsonschema:"description=The name of the nova keypair that will be injected into the runners."`
+	KeyPairType        string              `json:"key_pair_type,omitempty" jsonschema:"enum=ssh,enum=x509,description=The type of the nova keypair. If set the type of the keypair in nova must match. Use x509 for Windows runners."`
+	Cloud              string              `json:"cloud,omitempty" jsonschema:"description=The name of the cloud from clouds.yaml in which runners will be created. Overrides the cloud set in the provider config."`
+	Region             string              `json:"region,omitempty" jsonschema:"description=The region in which runners will be created. Overrides the region set in the provider config."`
+	StorageBackend     string              `json:"storage_backend,omitempty" jsonschema:"description=The cinder backend to use when creating volumes."`
+	AllocateFloatingIP *bool               `json:"allocate_floating_ip,omitempty" jsonschema:"description=Whether to allocate a floating IP from floating_ip_network for the runner. The floating IP is released when the runner is removed."`
+	FloatingIPNetwork  string              `json:"floating_ip_network,omitempty" jsonschema:"description=The name or ID of the external network floating IPs are allocated from."`
+	RootVolumeType     string              `json:"root_volume_type,omitempty" jsonschema:"description=The cinder volume type of the root volume when booting from volume. Defaults to storage_backend."`
+	BootFromVolume     *bool               `json:"boot_from_volume,omitempty" jsonschema:"description=Whether to boot from volume or not. Use this option if the root disk size defined by the flavor is not enough."`
+	BootDiskSize       *int64              `json:"boot_disk_size,omitempty" jsonschema:"description=The size of the root disk in GB. If not set the size depends on the flavor and defaults to 50 GB."`
+	RootVolumeID       string              `json:"root_volume_id,omitempty" jsonschema:"description=The ID of an existing cinder volume that is copied for each runner to boot from instead of creating the root volume from the image. The copy is deleted with the runner while the original is kept. Requires boot_from_volume."`
+	DataDisks          []dataDisk          `json:"data_disks,omitempty" jsonschema:"description=A list of additional volumes to attach to the runner. Useful for scratch space that is larger or faster than the root disk."`
+	UseConfigDrive     *bool               `json:"use_config_drive,omitempty" jsonschema:"description=Use config drive."`
+	EnableBootDebug    *bool               `json:"enable_boot_debug,omitempty" jsonschema:"description=Enable cloud-init debug mode. Adds 'set -x' into the cloud-init script."`
+	DisableUpdates     *bool               `json:"disable_updates,omitempty" jsonschema:"description=Disable automatic updates on the VM."`
+	ExtraPackages      []string            `json:"extra_packages,omitempty" jsonschema:"description=Extra packages to install on the VM."`
+	RunnerLabels       []string            `json:"runner_labels,omitempty" jsonschema:"description=A list of labels that are added to the labels garm sets when registering the runner. Labels may contain letters and digits and the characters . _ and -."`
+	RunnerGroup        string              `json:"runner_group,omitempty" jsonschema:"description=The GitHub runner group the runner is added to. Overrides the runner group set by garm."`
+	Metadata           map[string]string   `json:"metadata,omitempty" jsonschema:"description=Key/value pairs that are added to the metadata of the runner. The metadata set by garm can not be overwritten."`
+	Tags               []string            `json:"tags,omitempty" jsonschema:"description=A list of tags to set on the runner on top of the default_tags from the provider config. Useful for chargeback."`
+	NTPServers         []string            `json:"ntp_servers,omitempty" jsonschema:"description=A list of NTP servers the runner will sync time with. Linux only."`
+	DNSNameservers     []string            `json:"dns_nameservers,omitempty" jsonschema:"description=A list of IP addresses of DNS nameservers the runner will use instead of the nameservers of the subnet. A port with the nameservers set is created for every network of the runner. Can not be combined with ports."`
+	PackageMirror      string              `json:"package_mirror,omitempty" jsonschema:"description=The URL of an apt or yum mirror that is used to install packages on the runner. Linux only."`
+	RegistryMirrors    []string            `json:"registry_mirrors,omitempty" jsonschema:"description=A list of registry mirrors for docker.io that will be configured for docker and containerd. Linux only."`
+	RegistryCA         []string            `json:"registry_ca,omitempty" jsonschema:"description=A list of PEM encoded CA certificates that will be trusted when pulling container images. Linux only."`
+	ImageRefOverride   string              `json:"image_ref_override,omitempty" jsonschema:"description=The name or ID of the image that will be recorded as the image of the server when booting from volume. The root volume is still created from the pool image."`
+	// RunnerServiceOverride is a systemd drop-in, applied to the runner service.
+	RunnerServiceOverride []byte `json:"runner_service_override,omitempty" jsonschema:"description=A base64 encoded systemd drop-in that will be applied to the runner service. Can be used to tune resource limits or the restart policy of the runner. Linux only."`
+	CompletionCallbackURL string `json:"completion_callback_url,omitempty" jsonschema:"description=A URL that the runner sends a POST request to once it finished bootstrapping. Linux only."`
+	// InjectFiles maps paths on the runner to the contents of the files written there.
+	InjectFiles map[string][]byte `json:"inject_files,omitempty" jsonschema:"description=A map of absolute paths on the runner to base64 encoded file contents. The files are written by cloud-init before packages are installed and before the runner is set up. Linux only."`
+	Hostname    string            `json:"hostname,omitempty" jsonschema:"description=A go template for the hostname that cloud-init sets on the runner. Overrides hostname_template and takes the same values. Must render differently for every runner. The server keeps the runner name. Linux only."`
+	// StorageBackendFallbacks are tried in order when the volumes can not be created with
+	// the root volume type or the storage backend.
+	StorageBackendFallbacks []string `json:"storage_backend_fallbacks,omitempty" jsonschema:"description=A list of cinder volume types that are tried in order when the volumes of the runner can not be created. They replace root_volume_type if it is set and storage_backend otherwise. Only used with boot_from_volume or data_disks. The volume type that was used is recorded in the server metadata."`
 	// The Cloudconfig struct from common package
 	cloudconfig.CloudConfigSpec
 }
@@ -99,19 +315,83 @@ func extraSpecsFromBootstrapData(data params.BootstrapInstance) (extraSpecs, err
 	return spec, nil
 }
 
-func getTags(controllerID, poolID string) []string {
-	return []string{
+// hierarchyTagNames are the tags and metadata keys of the garm entity levels, from
+// the top one down.
+var hierarchyTagNames = []string{enterpriseTagName, orgTagName, repoTagName}
+
+// entityHierarchy returns the enterprise, organization and repository a runner belongs
+// to, keyed by their tag names. They are read from the URL the runner registers to,
+// which is https://<host>/enterprises/<enterprise> for enterprises, https://<host>/<org>
+// for organizations and https://<host>/<org>/<repo> for repositories. Levels that do
+// not apply are left out, and nil is returned if the URL can not be parsed.
+func entityHierarchy(repoURL string) map[string]string {
+	parsed, err := url.Parse(repoURL)
+	if err != nil || parsed.Host == "" {
+		return nil
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "enterprises":
+		return map[string]string{enterpriseTagName: parts[1]}
+	case len(parts) == 1 && parts[0] != "":
+		return map[string]string{orgTagName: parts[0]}
+	case len(parts) == 2:
+		return map[string]string{orgTagName: parts[0], repoTagName: parts[1]}
+	}
+	return nil
+}
+
+// getTags returns the tags of a runner. The custom tags are added after the tags garm
+// uses to find the runners of a controller and pool, and the entity hierarchy tags.
+// Hierarchy tags that are not valid server tags are skipped. Duplicates are removed,
+// and custom tags that set the pool, controller or controller instance ID are dropped,
+// so they can not hide the runner from garm.
+func getTags(controllerID, controllerInstanceID, poolID string, hierarchy map[string]string, customTags ...[]string) []string {
+	tags := []string{
 		fmt.Sprintf("%s=%s", poolIDTagName, poolID),
 		fmt.Sprintf("%s=%s", controllerIDTagName, controllerID),
 	}
+	if controllerInstanceID != "" {
+		tags = append(tags, fmt.Sprintf("%s=%s", controllerInstanceIDTagName, controllerInstanceID))
+	}
+	for _, name := range hierarchyTagNames {
+		value, ok := hierarchy[name]
+		if !ok {
+			continue
+		}
+		tag := fmt.Sprintf("%s=%s", name, value)
+		if err := config.ValidateServerTag(tag); err != nil {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		seen[tag] = true
+	}
+	for _, tag := range slices.Concat(customTags...) {
+		if seen[tag] || strings.HasPrefix(tag, poolIDTagName+"=") || strings.HasPrefix(tag, controllerIDTagName+"=") || strings.HasPrefix(tag, controllerInstanceIDTagName+"=") {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
 }
 
-func getProperties(data params.BootstrapInstance, controllerID string) map[string]string {
-	ret := map[string]string{
-		"os_arch":           string(data.OSArch),
-		"os_type":           string(data.OSType),
-		poolIDTagName:       data.PoolID,
-		controllerIDTagName: controllerID,
+// getProperties returns the metadata of a runner. The custom metadata is added to the
+// metadata garm sets, including the entity hierarchy, but can not overwrite it.
+func getProperties(data params.BootstrapInstance, controllerID string, hierarchy map[string]string, customMetadata map[string]string) map[string]string {
+	ret := map[string]string{}
+	for key, val := range customMetadata {
+		ret[key] = val
+	}
+	ret["os_arch"] = string(data.OSArch)
+	ret["os_type"] = string(data.OSType)
+	ret[poolIDTagName] = data.PoolID
+	ret[controllerIDTagName] = controllerID
+	for key, val := range hierarchy {
+		ret[key] = val
 	}
 
 	return ret
@@ -132,6 +412,21 @@ func NewMachineSpec(data params.BootstrapInstance, cfg *config.Config, controlle
 		return nil, fmt.Errorf("failed to get extra specs: %w", err)
 	}
 
+	var hierarchy map[string]string
+	if cfg.TagEntityHierarchy {
+		hierarchy = entityHierarchy(data.RepoURL)
+	}
+
+	allowedDiskFormats := defaultAllowedImageDiskFormats
+	if len(cfg.AllowedImageDiskFormats) > 0 {
+		allowedDiskFormats = cfg.AllowedImageDiskFormats
+	}
+
+	createTimeout := defaultCreateTimeout
+	if cfg.CreateTimeout > 0 {
+		createTimeout = cfg.CreateTimeout
+	}
+
 	bootDiskSize := defaultBootDiskSize
 	if cfg.BootDiskSize != nil {
 		bootDiskSize = *cfg.BootDiskSize
@@ -145,25 +440,73 @@ func NewMachineSpec(data params.BootstrapInstance, cfg *config.Config, controlle
 		data.UserDataOptions.EnableBootDebug = true
 	}
 
+	flavor := data.Flavor
+	if flavor == "" {
+		flavor = cfg.DefaultFlavors[string(data.OSType)]
+	}
+
 	spec := &machineSpec{
-		StorageBackend:     cfg.DefaultStorageBackend,
-		SecurityGroups:     cfg.DefaultSecurityGroups,
-		AllowedImageOwners: cfg.AllowedImageOwners,
-		ImageVisibility:    cfg.ImageVisibility,
-		NetworkID:          cfg.DefaultNetworkID,
-		BootFromVolume:     cfg.BootFromVolume,
-		BootDiskSize:       bootDiskSize,
-		UseConfigDrive:     cfg.UseConfigDrive,
-		Flavor:             data.Flavor,
-		Image:              data.Image,
-		Tools:              tools,
-		Tags:               getTags(controllerID, data.PoolID),
-		BootstrapParams:    data,
-		Properties:         getProperties(data, controllerID),
-		ExtraPackages:      extraSpec.ExtraPackages,
+		StorageBackend:      cfg.DefaultStorageBackend,
+		RootVolumeType:      cfg.DefaultRootVolumeType,
+		AllocateFloatingIP:  cfg.AllocateFloatingIP,
+		FloatingIPNetwork:   cfg.FloatingIPNetwork,
+		SecurityGroups:      cfg.DefaultSecurityGroups,
+		AllowedImageOwners:  cfg.AllowedImageOwners,
+		ImageVisibility:     cfg.ImageVisibility,
+		NetworkID:           cfg.DefaultNetworkID,
+		KeyName:             cfg.DefaultKeyPair,
+		KeyPairType:         cfg.DefaultKeyPairType,
+		Cloud:               cfg.Cloud,
+		Region:              cfg.Region,
+		BootFromVolume:      cfg.BootFromVolume,
+		BootDiskSize:        bootDiskSize,
+		CreateTimeout:       createTimeout,
+		UseConfigDrive:      cfg.UseConfigDrive,
+		HostnameTemplate:    cfg.HostnameTemplate,
+		CopyImageProperties: cfg.CopyImageProperties,
+		Flavor:              flavor,
+		Image:               data.Image,
+		Tools:               tools,
+		Tags:                getTags(controllerID, cfg.ControllerInstanceID, data.PoolID, hierarchy, cfg.DefaultTags, extraSpec.Tags),
+		BootstrapParams:     data,
+		Properties:          getProperties(data, controllerID, hierarchy, extraSpec.Metadata),
+		ExtraPackages:       extraSpec.ExtraPackages,
+		RunnerLabels:        extraSpec.RunnerLabels,
+		RunnerGroup:         extraSpec.RunnerGroup,
+	}
+	if cfg.ValidateImageDiskFormat {
+		spec.AllowedImageDiskFormats = allowedDiskFormats
+	}
+	// Unless a boot disk size is set, it depends on the flavor the runner is created with.
+	if cfg.BootDiskSize == nil {
+		spec.BootDiskSizeFromFlavor = true
+		spec.FlavorBootDiskSizes = cfg.FlavorBootDiskSizes
+	}
+	// When multiple regions are configured, the provider picks one of them, unless the
+	// region is set in extra_specs.
+	if len(cfg.Regions) > 0 {
+		spec.Region = ""
+	}
+	if cfg.AsyncCreate {
+		spec.Tags = append(spec.Tags, asyncCreateTag)
+		spec.Properties[createdAtKey] = time.Now().UTC().Format(time.RFC3339)
 	}
 	spec.MergeExtraSpecs(extraSpec)
 
+	// In async mode the server may not have a port yet when we return.
+	if spec.AllocateFloatingIP && cfg.AsyncCreate {
+		return nil, fmt.Errorf("allocate_floating_ip can not be combined with async_create")
+	}
+
+	if spec.Cloud != cfg.Cloud {
+		if !cfg.Credentials.HasCloud(spec.Cloud) {
+			return nil, fmt.Errorf("cloud %s is not defined in clouds.yaml", spec.Cloud)
+		}
+		if err := cfg.Credentials.ValidateCloudAuth(spec.Cloud); err != nil {
+			return nil, fmt.Errorf("invalid credentials for cloud %s: %w", spec.Cloud, err)
+		}
+	}
+
 	if err := spec.Validate(); err != nil {
 		return nil, fmt.Errorf("failed to validate spec: %w", err)
 	}
@@ -172,35 +515,160 @@ func NewMachineSpec(data params.BootstrapInstance, cfg *config.Config, controlle
 }
 
 type machineSpec struct {
-	StorageBackend     string
-	SecurityGroups     []string
-	AllowedImageOwners []string
-	ImageVisibility    string
-	NetworkID          string
-	BootFromVolume     bool
-	BootDiskSize       int64
-	UseConfigDrive     bool
-	Flavor             string
-	Image              string
-	DisableUpdates     bool
-	ExtraPackages      []string
-	Tools              params.RunnerApplicationDownload
-	Tags               []string
-	Properties         map[string]string
-	BootstrapParams    params.BootstrapInstance
+	StorageBackend          string
+	RootVolumeType          string
+	StorageBackendFallbacks []string
+	AllocateFloatingIP      bool
+	FloatingIPNetwork       string
+	SecurityGroups          []string
+	SecurityGroupRules      []securityGroupRule
+	AllowedImageOwners      []string
+	AllowedImageDiskFormats []string
+	ImageVisibility         string
+	NetworkID               string
+	Networks                []serverNetwork
+	StaticNetworks          []staticNetwork
+	Ports                   []string
+	SchedulerHints          *schedulerHints
+	AvailabilityZone        string
+	KeyName                 string
+	KeyPairType             string
+	Cloud                   string
+	Region                  string
+	BootFromVolume          bool
+	BootDiskSize            int64
+	BootDiskSizeFromFlavor  bool
+	FlavorBootDiskSizes     map[string]int64
+	RootVolumeID            string
+	DataDisks               []dataDisk
+	CreateTimeout           int
+	UseConfigDrive          bool
+	Flavor                  string
+	FlavorFallbacks         []string
+	Image                   string
+	ImageRefOverride        string
+	DisableUpdates          bool
+	ExtraPackages           []string
+	RunnerLabels            []string
+	RunnerGroup             string
+	NTPServers              []string
+	DNSNameservers          []string
+	PackageMirror           string
+	CompletionCallbackURL   string
+	HostnameTemplate        string
+	Hostname                string
+	RegistryMirrors         []string
+	RegistryCA              []string
+	RunnerServiceOverride   []byte
+	InjectFiles             map[string][]byte
+	Tools                   params.RunnerApplicationDownload
+	Tags                    []string
+	Properties              map[string]string
+	ImageDiskBus            string
+	CopyImageProperties     []string
+	BootstrapParams         params.BootstrapInstance
 }
 
 func (m *machineSpec) Validate() error {
-	if m.NetworkID == "" {
+	if m.NetworkID == "" && len(m.Networks) == 0 && len(m.Ports) == 0 {
 		return fmt.Errorf("missing network ID")
 	}
 
-	if m.BootFromVolume {
+	for _, label := range m.RunnerLabels {
+		if !runnerLabelRegex.MatchString(label) {
+			return fmt.Errorf("invalid runner label: %q", label)
+		}
+	}
+
+	if m.RunnerGroup != "" && !runnerLabelRegex.MatchString(m.RunnerGroup) {
+		return fmt.Errorf("invalid runner group: %q", m.RunnerGroup)
+	}
+
+	switch m.KeyPairType {
+	case "", config.KeyPairTypeSSH, config.KeyPairTypeX509:
+	default:
+		return fmt.Errorf("invalid key_pair_type: %s", m.KeyPairType)
+	}
+
+	if m.SchedulerHints != nil && m.SchedulerHints.Group != "" {
+		if _, err := uuid.Parse(m.SchedulerHints.Group); err != nil {
+			return fmt.Errorf("scheduler hint group must be a server group UUID: %q", m.SchedulerHints.Group)
+		}
+	}
+
+	if len(m.Ports) > 0 {
+		if m.NetworkID != "" || len(m.Networks) > 0 {
+			return fmt.Errorf("ports can not be combined with network_id or networks")
+		}
+		seen := map[string]bool{}
+		for _, port := range m.Ports {
+			if port == "" {
+				return fmt.Errorf("empty port ID")
+			}
+			if seen[port] {
+				return fmt.Errorf("port %s is set more than once", port)
+			}
+			seen[port] = true
+		}
+	}
+
+	for idx, network := range m.Networks {
+		if err := network.Validate(); err != nil {
+			return fmt.Errorf("invalid network at index %d: %w", idx, err)
+		}
+		if network.StaticIP {
+			if m.BootstrapParams.OSType != params.Linux {
+				return fmt.Errorf("static_ip is only supported on Linux")
+			}
+			// Without DHCP, the runner can not reach the metadata service to get its
+			// user data.
+			if !m.UseConfigDrive {
+				return fmt.Errorf("static_ip requires use_config_drive")
+			}
+		}
+	}
+
+	if m.BootFromVolume && m.RootVolumeID == "" {
 		if m.BootDiskSize == 0 {
 			return fmt.Errorf("boot from volume is enabled, and boot disk size is 0")
 		}
 	}
 
+	if m.AllocateFloatingIP && m.FloatingIPNetwork == "" {
+		return fmt.Errorf("allocate_floating_ip requires floating_ip_network")
+	}
+
+	if m.RootVolumeID != "" {
+		if !m.BootFromVolume {
+			return fmt.Errorf("root_volume_id is only supported when booting from volume")
+		}
+		if _, err := uuid.Parse(m.RootVolumeID); err != nil {
+			return fmt.Errorf("invalid root_volume_id: %q", m.RootVolumeID)
+		}
+		// The size of the root disk is the size of the existing volume.
+		if m.BootDiskSize != 0 {
+			return fmt.Errorf("root_volume_id can not be combined with boot_disk_size")
+		}
+	}
+
+	for _, volumeType := range m.StorageBackendFallbacks {
+		if volumeType == "" {
+			return fmt.Errorf("invalid storage_backend_fallbacks: empty volume type")
+		}
+	}
+
+	for idx, rule := range m.SecurityGroupRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("invalid security group rule at index %d: %w", idx, err)
+		}
+	}
+
+	for idx, disk := range m.DataDisks {
+		if disk.Size <= 0 {
+			return fmt.Errorf("invalid data disk at index %d: size must be a positive number of GB", idx)
+		}
+	}
+
 	if m.Flavor == "" {
 		return fmt.Errorf("missing flavor")
 	}
@@ -212,6 +680,11 @@ func (m *machineSpec) Validate() error {
 	if len(m.Tags) == 0 {
 		return fmt.Errorf("missing tags; at least the controller ID and pool ID must be set")
 	}
+	for _, tag := range m.Tags {
+		if err := config.ValidateServerTag(tag); err != nil {
+			return fmt.Errorf("invalid tags: %w", err)
+		}
+	}
 
 	if m.Tools.DownloadURL == nil {
 		return fmt.Errorf("missing tools")
@@ -220,9 +693,124 @@ func (m *machineSpec) Validate() error {
 	if m.BootstrapParams.Name == "" {
 		return fmt.Errorf("missing bootstrap params")
 	}
+
+	if m.ImageRefOverride != "" && !m.BootFromVolume {
+		return fmt.Errorf("image_ref_override is only supported when booting from volume")
+	}
+
+	if len(m.NTPServers) > 0 && m.BootstrapParams.OSType != params.Linux {
+		return fmt.Errorf("ntp_servers is only supported on Linux")
+	}
+
+	for _, nameserver := range m.DNSNameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("invalid DNS nameserver: %q", nameserver)
+		}
+	}
+	if len(m.DNSNameservers) > 0 && len(m.Ports) > 0 {
+		return fmt.Errorf("dns_nameservers can not be combined with ports")
+	}
+
+	if m.PackageMirror != "" {
+		if m.BootstrapParams.OSType != params.Linux {
+			return fmt.Errorf("package_mirror is only supported on Linux")
+		}
+		u, err := url.Parse(m.PackageMirror)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid package mirror: %q", m.PackageMirror)
+		}
+	}
+
+	if m.CompletionCallbackURL != "" {
+		if m.BootstrapParams.OSType != params.Linux {
+			return fmt.Errorf("completion_callback_url is only supported on Linux")
+		}
+		u, err := url.Parse(m.CompletionCallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid completion callback URL: %q", m.CompletionCallbackURL)
+		}
+	}
+
+	if m.Hostname != "" {
+		if m.BootstrapParams.OSType != params.Linux {
+			return fmt.Errorf("hostname is only supported on Linux")
+		}
+		// Two runners must never get the same hostname, so the template has to
+		// render differently for two runners with different names.
+		first, err := renderHostname(m.Hostname, params.BootstrapInstance{Name: "garm-runner-1"})
+		if err != nil {
+			return fmt.Errorf("invalid hostname: %w", err)
+		}
+		second, err := renderHostname(m.Hostname, params.BootstrapInstance{Name: "garm-runner-2"})
+		if err != nil {
+			return fmt.Errorf("invalid hostname: %w", err)
+		}
+		if first == second {
+			return fmt.Errorf("invalid hostname: %q renders the same hostname for every runner; use {{.Name}} or {{.Suffix}}", m.Hostname)
+		}
+	}
+
+	if len(m.RegistryMirrors) > 0 || len(m.RegistryCA) > 0 {
+		if m.BootstrapParams.OSType != params.Linux {
+			return fmt.Errorf("registry_mirrors and registry_ca are only supported on Linux")
+		}
+		for _, mirror := range m.RegistryMirrors {
+			u, err := url.Parse(mirror)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid registry mirror: %q", mirror)
+			}
+		}
+		for idx, ca := range m.RegistryCA {
+			if ok := x509.NewCertPool().AppendCertsFromPEM([]byte(ca)); !ok {
+				return fmt.Errorf("failed to parse registry CA at index %d", idx)
+			}
+		}
+	}
+
+	if len(m.RunnerServiceOverride) > 0 {
+		if m.BootstrapParams.OSType != params.Linux {
+			return fmt.Errorf("runner_service_override is only supported on Linux")
+		}
+		if err := validateSystemdUnit(m.RunnerServiceOverride); err != nil {
+			return fmt.Errorf("invalid runner_service_override: %w", err)
+		}
+	}
+
+	if len(m.InjectFiles) > 0 {
+		if m.BootstrapParams.OSType != params.Linux {
+			return fmt.Errorf("inject_files is only supported on Linux")
+		}
+		size := 0
+		for filePath, content := range m.InjectFiles {
+			if !path.IsAbs(filePath) || path.Clean(filePath) != filePath || len(filePath) > maxInjectedFilePathLength {
+				return fmt.Errorf("invalid inject_files path: %q", filePath)
+			}
+			size += base64.StdEncoding.EncodedLen(len(content))
+		}
+		// The files are part of the user data, so this is only a quick check. The size
+		// of the whole user data is checked once it is rendered.
+		if size > maxUserDataSize {
+			return fmt.Errorf("inject_files is too large: %d bytes (max %d)", size, maxUserDataSize)
+		}
+	}
 	return nil
 }
 
+// ValidateImageDiskFormat verifies that the disk format of the image is one we expect
+// when booting from volume. The check is skipped if no allowed disk formats are set.
+func (m *machineSpec) ValidateImageDiskFormat(img images.Image) error {
+	if !m.BootFromVolume || len(m.AllowedImageDiskFormats) == 0 {
+		return nil
+	}
+
+	for _, format := range m.AllowedImageDiskFormats {
+		if img.DiskFormat == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s has disk format %q, which is not one of %v", img.ID, img.DiskFormat, m.AllowedImageDiskFormats)
+}
+
 // SetSpecFromImage looks for aditional info in the image metadata that can be set
 // on a machine for later retrieval.
 func (m *machineSpec) SetSpecFromImage(img images.Image) {
@@ -239,6 +827,51 @@ func (m *machineSpec) SetSpecFromImage(img images.Image) {
 			m.Properties["os_version"] = val
 		}
 	}
+
+	m.SetDiskBusFromImage(img)
+
+	for _, key := range m.CopyImageProperties {
+		prop, ok := img.Properties[key]
+		if !ok || prop == nil {
+			continue
+		}
+		val, err := imagePropertyToString(prop)
+		if err != nil {
+			log.Printf("not copying image property %s: %s", key, err)
+			continue
+		}
+		if len(val) > maxMetadataValueLength {
+			log.Printf("not copying image property %s: value is longer than %d characters", key, maxMetadataValueLength)
+			continue
+		}
+		m.Properties[key] = val
+	}
+}
+
+// SetDiskBusFromImage records the hw_disk_bus property of the image the server boots from,
+// which is set on the root block device when booting from volume.
+func (m *machineSpec) SetDiskBusFromImage(img images.Image) {
+	m.ImageDiskBus, _ = img.Properties["hw_disk_bus"].(string)
+}
+
+// imagePropertyToString converts the value of an image property to a string that can
+// be set as server metadata. Glance properties are usually strings, but some may be
+// numbers, booleans or even JSON objects.
+func imagePropertyToString(prop interface{}) (string, error) {
+	switch val := prop.(type) {
+	case string:
+		return val, nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	default:
+		asJs, err := json.Marshal(val)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal value: %w", err)
+		}
+		return string(asJs), nil
+	}
 }
 
 func (m *machineSpec) MergeExtraSpecs(spec extraSpecs) {
@@ -246,22 +879,106 @@ func (m *machineSpec) MergeExtraSpecs(spec extraSpecs) {
 		m.StorageBackend = spec.StorageBackend
 	}
 
+	if spec.RootVolumeType != "" {
+		m.RootVolumeType = spec.RootVolumeType
+	}
+
+	if len(spec.StorageBackendFallbacks) > 0 {
+		m.StorageBackendFallbacks = spec.StorageBackendFallbacks
+	}
+
+	if spec.AllocateFloatingIP != nil {
+		m.AllocateFloatingIP = *spec.AllocateFloatingIP
+	}
+
+	if spec.FloatingIPNetwork != "" {
+		m.FloatingIPNetwork = spec.FloatingIPNetwork
+	}
+
 	if spec.BootDiskSize != nil {
 		m.BootDiskSize = *spec.BootDiskSize
+		m.BootDiskSizeFromFlavor = false
 	}
 
 	if spec.BootFromVolume != nil {
 		m.BootFromVolume = *spec.BootFromVolume
 	}
 
+	if spec.RootVolumeID != "" {
+		m.RootVolumeID = spec.RootVolumeID
+		// The boot disk size from the provider config does not apply to an existing
+		// volume. A boot disk size set in extra_specs is rejected by Validate.
+		if spec.BootDiskSize == nil {
+			m.BootDiskSize = 0
+		}
+	}
+
+	if len(spec.DataDisks) > 0 {
+		m.DataDisks = spec.DataDisks
+	}
+
+	if spec.CreateTimeout != nil {
+		m.CreateTimeout = *spec.CreateTimeout
+	}
+
+	if len(spec.Ports) > 0 {
+		m.Ports = spec.Ports
+		// The default network is replaced by the ports.
+		m.NetworkID = ""
+	}
+
 	if spec.NetworkID != "" {
 		m.NetworkID = spec.NetworkID
 	}
 
+	if len(spec.Networks) > 0 {
+		m.Networks = spec.Networks
+	}
+
+	if spec.SchedulerHints != nil {
+		m.SchedulerHints = spec.SchedulerHints
+	}
+
+	if spec.AvailabilityZone != "" {
+		m.AvailabilityZone = spec.AvailabilityZone
+	}
+
+	if spec.KeyName != "" {
+		m.KeyName = spec.KeyName
+	}
+
+	if spec.KeyPairType != "" {
+		m.KeyPairType = spec.KeyPairType
+	}
+
+	if spec.Flavor != "" {
+		m.Flavor = spec.Flavor
+	}
+
+	if spec.Image != "" {
+		m.Image = spec.Image
+	}
+
+	if len(spec.FlavorFallbacks) > 0 {
+		m.FlavorFallbacks = spec.FlavorFallbacks
+	}
+
+	if spec.Cloud != "" {
+		m.Cloud = spec.Cloud
+	}
+
+	if spec.Region != "" {
+		m.Region = spec.Region
+	}
+
 	if len(spec.SecurityGroups) > 0 {
 		m.SecurityGroups = spec.SecurityGroups
 	}
 
+	if len(spec.SecurityGroupRules) > 0 {
+		m.SecurityGroupRules = spec.SecurityGroupRules
+	}
+
 	if spec.UseConfigDrive != nil {
 		m.UseConfigDrive = *spec.UseConfigDrive
 	}
@@ -278,6 +995,46 @@ func (m *machineSpec) MergeExtraSpecs(spec extraSpecs) {
 		m.DisableUpdates = *spec.DisableUpdates
 	}
 
+	if len(spec.RunnerServiceOverride) > 0 {
+		m.RunnerServiceOverride = spec.RunnerServiceOverride
+	}
+
+	if len(spec.InjectFiles) > 0 {
+		m.InjectFiles = spec.InjectFiles
+	}
+
+	if spec.ImageRefOverride != "" {
+		m.ImageRefOverride = spec.ImageRefOverride
+	}
+
+	if len(spec.NTPServers) > 0 {
+		m.NTPServers = spec.NTPServers
+	}
+
+	if len(spec.DNSNameservers) > 0 {
+		m.DNSNameservers = spec.DNSNameservers
+	}
+
+	if spec.PackageMirror != "" {
+		m.PackageMirror = spec.PackageMirror
+	}
+
+	if spec.CompletionCallbackURL != "" {
+		m.CompletionCallbackURL = spec.CompletionCallbackURL
+	}
+
+	if spec.Hostname != "" {
+		m.Hostname = spec.Hostname
+	}
+
+	if len(spec.RegistryMirrors) > 0 {
+		m.RegistryMirrors = spec.RegistryMirrors
+	}
+
+	if len(spec.RegistryCA) > 0 {
+		m.RegistryCA = spec.RegistryCA
+	}
+
 	// an empty visibility in the extra specs should not override the
 	// the config's visibility
 	if config.IsValidVisibility(spec.ImageVisibility) {
@@ -289,9 +1046,24 @@ func (m *machineSpec) ComposeUserData() ([]byte, error) {
 	bootstrapParams := m.BootstrapParams
 	bootstrapParams.UserDataOptions.DisableUpdatesOnBoot = m.DisableUpdates
 	bootstrapParams.UserDataOptions.ExtraPackages = m.ExtraPackages
+	bootstrapParams.Labels = slices.Clone(bootstrapParams.Labels)
+	for _, label := range m.RunnerLabels {
+		if !slices.Contains(bootstrapParams.Labels, label) {
+			bootstrapParams.Labels = append(bootstrapParams.Labels, label)
+		}
+	}
+	if m.RunnerGroup != "" {
+		bootstrapParams.GitHubRunnerGroup = m.RunnerGroup
+	}
 	bootstrapParams.UserDataOptions.EnableBootDebug = m.BootstrapParams.UserDataOptions.EnableBootDebug
 	switch m.BootstrapParams.OSType {
-	case params.Linux, params.Windows:
+	case params.Linux:
+		udata, err := m.composeCloudInit(bootstrapParams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate userdata: %w", err)
+		}
+		return []byte(udata), nil
+	case params.Windows:
 		udata, err := cloudconfig.GetCloudConfig(bootstrapParams, m.Tools, bootstrapParams.Name)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate userdata: %w", err)
@@ -301,26 +1073,99 @@ func (m *machineSpec) ComposeUserData() ([]byte, error) {
 	return nil, fmt.Errorf("unsupported OS type for cloud config: %s", bootstrapParams.OSType)
 }
 
+// validateMetadata ensures the server metadata fits within the limits enforced by nova,
+// so we can fail early with a clear error instead of having the create request rejected.
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataItems {
+		return fmt.Errorf("too many metadata items: %d (max %d)", len(metadata), maxMetadataItems)
+	}
+	for key, val := range metadata {
+		if len(key) == 0 || len(key) > maxMetadataKeyLength {
+			return fmt.Errorf("invalid metadata key length for %q: %d (must be between 1 and %d)", key, len(key), maxMetadataKeyLength)
+		}
+		if len(val) > maxMetadataValueLength {
+			return fmt.Errorf("metadata value for key %q is too long: %d (max %d)", key, len(val), maxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
 func (m *machineSpec) GetServerCreateOpts(flavor flavors.Flavor, net networks.Network, img images.Image) (servers.CreateOpts, error) {
+	if err := validateMetadata(m.Properties); err != nil {
+		return servers.CreateOpts{}, fmt.Errorf("failed to validate metadata: %w", err)
+	}
+
 	udata, err := m.ComposeUserData()
 	if err != nil {
 		return servers.CreateOpts{}, fmt.Errorf("failed to get user data: %w", err)
 	}
+	if size := base64.StdEncoding.EncodedLen(len(udata)); size > maxUserDataSize {
+		return servers.CreateOpts{}, fmt.Errorf("user data is too large: %d bytes (max %d)", size, maxUserDataSize)
+	}
 	return servers.CreateOpts{
-		Name:           m.BootstrapParams.Name,
-		ImageRef:       img.ID,
-		FlavorRef:      flavor.ID,
-		SecurityGroups: m.SecurityGroups,
-		Networks: []servers.Network{
+		Name:             m.BootstrapParams.Name,
+		ImageRef:         img.ID,
+		FlavorRef:        flavor.ID,
+		AvailabilityZone: m.AvailabilityZone,
+		SecurityGroups:   m.SecurityGroups,
+		Networks:         m.serverNetworks(net),
+		Metadata:         m.Properties,
+		ConfigDrive:      &m.UseConfigDrive,
+		Tags:             m.Tags,
+		UserData:         udata,
+	}, nil
+}
+
+// serverNetworks returns the networks the server is connected to. If no networks or
+// ports are set in extra_specs, the server is connected to the given network.
+func (m *machineSpec) serverNetworks(net networks.Network) []servers.Network {
+	if len(m.Ports) > 0 {
+		ret := make([]servers.Network, 0, len(m.Ports))
+		for _, port := range m.Ports {
+			ret = append(ret, servers.Network{Port: port})
+		}
+		return ret
+	}
+
+	if len(m.Networks) == 0 {
+		return []servers.Network{
 			{
 				UUID: net.ID,
 			},
-		},
-		Metadata:    m.Properties,
-		ConfigDrive: &m.UseConfigDrive,
-		Tags:        m.Tags,
-		UserData:    udata,
-	}, nil
+		}
+	}
+
+	ret := make([]servers.Network, 0, len(m.Networks))
+	for _, network := range m.Networks {
+		ret = append(ret, servers.Network{
+			UUID:    network.NetworkID,
+			Port:    network.PortID,
+			FixedIP: network.FixedIP,
+		})
+	}
+	return ret
+}
+
+// serverCreateOptsBuilder adds the keypair and the scheduler hints, if they are set, to
+// the server create options.
+func (m *machineSpec) serverCreateOptsBuilder(srvOpts servers.CreateOpts) servers.CreateOptsBuilder {
+	var builder servers.CreateOptsBuilder = srvOpts
+	if m.KeyName != "" {
+		builder = keypairs.CreateOptsExt{
+			CreateOptsBuilder: builder,
+			KeyName:           m.KeyName,
+		}
+	}
+	if m.SchedulerHints != nil {
+		builder = schedulerhints.CreateOptsExt{
+			CreateOptsBuilder: builder,
+			SchedulerHints: schedulerhints.SchedulerHints{
+				Group:                strings.ToLower(m.SchedulerHints.Group),
+				AdditionalProperties: m.SchedulerHints.AdditionalProperties,
+			},
+		}
+	}
+	return builder
 }
 
 func (m *machineSpec) GetBootFromVolumeOpts(srvOpts servers.CreateOpts) (bootfromvolume.CreateOptsExt, error) {
@@ -331,18 +1176,150 @@ func (m *machineSpec) GetBootFromVolumeOpts(srvOpts servers.CreateOpts) (bootfro
 		UUID:                srvOpts.ImageRef,
 		VolumeSize:          int(m.BootDiskSize),
 	}
-	if m.StorageBackend != "" {
-		rootDisk.VolumeType = m.StorageBackend
+	if m.RootVolumeID != "" {
+		// The existing volume is attached as is, and outlives the server. createServer
+		// replaces it with a copy made for the runner, which is removed with the server.
+		rootDisk = bootfromvolume.BlockDevice{
+			DestinationType: bootfromvolume.DestinationVolume,
+			SourceType:      bootfromvolume.SourceVolume,
+			UUID:            m.RootVolumeID,
+		}
+		// The server boots from the volume, not from the pool image.
+		srvOpts.ImageRef = ""
+	} else {
+		rootDisk.VolumeType = m.rootVolumeType()
+	}
+	// Cinder copies the image properties into the volume image metadata when creating
+	// the root volume from the image, which is where nova reads the hw_* properties from
+	// when booting from volume. The disk bus however is also a block device mapping
+	// attribute, which takes precedence, so we set it explicitly.
+	rootDisk.DiskBus = m.ImageDiskBus
+	// There is no way to set the availability zone of the root volume in the block device
+	// mapping. Nova creates the volume in the availability zone of the server, which we
+	// set in the server create options, unless cross_az_attach is allowed in nova.
+
+	// The root volume is created from the pool image, while the server records the
+	// override image as its image reference.
+	if m.ImageRefOverride != "" {
+		srvOpts.ImageRef = m.ImageRefOverride
 	}
 	blockDevices := []bootfromvolume.BlockDevice{
 		rootDisk,
 	}
 	return bootfromvolume.CreateOptsExt{
-		CreateOptsBuilder: srvOpts,
-		BlockDevice:       blockDevices,
+		CreateOptsBuilder: m.serverCreateOptsBuilder(srvOpts),
+		BlockDevice:       append(blockDevices, m.dataDiskBlockDevices()...),
 	}, nil
 }
 
+// GetDataDisksOpts returns the create options of a server that boots from the image on
+// the local disk of the hypervisor, and has the data disks attached. Nova creates the
+// data volumes and attaches them before the server boots, so we don't have to wait for
+// the server to become ACTIVE to attach them, and the volumes are cleaned up by nova if
+// the server fails to spawn.
+func (m *machineSpec) GetDataDisksOpts(srvOpts servers.CreateOpts) bootfromvolume.CreateOptsExt {
+	rootDisk := bootfromvolume.BlockDevice{
+		BootIndex:           0,
+		DeleteOnTermination: true,
+		DestinationType:     bootfromvolume.DestinationLocal,
+		SourceType:          bootfromvolume.SourceImage,
+		UUID:                srvOpts.ImageRef,
+	}
+	blockDevices := []bootfromvolume.BlockDevice{
+		rootDisk,
+	}
+	return bootfromvolume.CreateOptsExt{
+		CreateOptsBuilder: m.serverCreateOptsBuilder(srvOpts),
+		BlockDevice:       append(blockDevices, m.dataDiskBlockDevices()...),
+	}
+}
+
+// setBootDiskSizeForFlavor sets the boot disk size for the flavor the runner is about
+// to be created with, unless a boot disk size was set in the config or in extra_specs.
+// The size from flavor_boot_disk_sizes is used first, then the root disk size of the
+// flavor, and finally the default of 50 GB.
+func (m *machineSpec) setBootDiskSizeForFlavor(flavor flavors.Flavor) {
+	if !m.BootFromVolume || !m.BootDiskSizeFromFlavor || m.RootVolumeID != "" {
+		return
+	}
+	if size, ok := m.FlavorBootDiskSizes[flavor.Name]; ok {
+		m.BootDiskSize = size
+		return
+	}
+	if size, ok := m.FlavorBootDiskSizes[flavor.ID]; ok {
+		m.BootDiskSize = size
+		return
+	}
+	if flavor.Disk > 0 {
+		m.BootDiskSize = int64(flavor.Disk)
+		return
+	}
+	m.BootDiskSize = defaultBootDiskSize
+}
+
+// rootVolumeType returns the volume type of the root volume. If no root volume type is
+// set, the root volume uses the storage backend, like the data volumes.
+func (m *machineSpec) rootVolumeType() string {
+	if m.RootVolumeType != "" {
+		return m.RootVolumeType
+	}
+	return m.StorageBackend
+}
+
+// fallbackVolumeType returns the volume type that the storage backend fallbacks replace.
+// This is the volume type of the root volume when booting from a volume that is created
+// for the server, and the storage backend otherwise. It returns nil if the server has no
+// volumes that are created with that volume type.
+func (m *machineSpec) fallbackVolumeType() *string {
+	if m.BootFromVolume && m.RootVolumeID == "" {
+		if m.RootVolumeType != "" {
+			return &m.RootVolumeType
+		}
+		return &m.StorageBackend
+	}
+	for _, disk := range m.DataDisks {
+		if disk.VolumeType == "" {
+			return &m.StorageBackend
+		}
+	}
+	return nil
+}
+
+// dataDiskBlockDevices returns the block device mappings of the data disks. The data
+// disks are blank volumes, which follow the root disk in the boot order. Data disks
+// that have no volume type use the storage backend.
+func (m *machineSpec) dataDiskBlockDevices() []bootfromvolume.BlockDevice {
+	var blockDevices []bootfromvolume.BlockDevice
+	for idx, disk := range m.DataDisks {
+		deleteOnTermination := true
+		if disk.DeleteOnTermination != nil {
+			deleteOnTermination = *disk.DeleteOnTermination
+		}
+		volumeType := disk.VolumeType
+		if volumeType == "" {
+			volumeType = m.StorageBackend
+		}
+		blockDevices = append(blockDevices, bootfromvolume.BlockDevice{
+			BootIndex:           idx + 1,
+			DeleteOnTermination: deleteOnTermination,
+			DestinationType:     bootfromvolume.DestinationVolume,
+			SourceType:          bootfromvolume.SourceBlank,
+			VolumeSize:          disk.Size,
+			VolumeType:          volumeType,
+		})
+	}
+	return blockDevices
+}
+
+// dataDisksSize returns the total size in GB of the data disks.
+func (m *machineSpec) dataDisksSize() int {
+	var size int
+	for _, disk := range m.DataDisks {
+		size += disk.Size
+	}
+	return size
+}
+
 func Ptr[T any](v T) *T {
 	return &v
 }
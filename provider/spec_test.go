@@ -16,12 +16,23 @@ package provider
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudbase/garm-provider-common/cloudconfig"
 	"github.com/cloudbase/garm-provider-common/params"
 	"github.com/cloudbase/garm-provider-openstack/config"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/imageservice/v2/images"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 func Test_machineSpec_MergeExtraSpecs(t *testing.T) {
@@ -76,6 +87,17 @@ func Test_machineSpec_MergeExtraSpecs(t *testing.T) {
 	}
 }
 
+func TestMergeExtraSpecsRegion(t *testing.T) {
+	m := &machineSpec{
+		Region: "RegionOne",
+	}
+	m.MergeExtraSpecs(extraSpecs{})
+	assert.Equal(t, "RegionOne", m.Region)
+
+	m.MergeExtraSpecs(extraSpecs{Region: "RegionTwo"})
+	assert.Equal(t, "RegionTwo", m.Region)
+}
+
 func TestExtraSpecsFromBootstrapParams(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -529,6 +551,7 @@ func TestNewMachineSpec(t *testing.T) {
 		return data.Tools[0], nil
 	}
 	expectedOutput := &machineSpec{
+		Cloud:              "mycloud",
 		StorageBackend:     "cinder_nvme",
 		SecurityGroups:     []string{"allow_ssh", "allow_web"},
 		AllowedImageOwners: []string{"123456"},
@@ -536,6 +559,7 @@ func TestNewMachineSpec(t *testing.T) {
 		NetworkID:          "542b68dd-4b3d-459d-8531-34d5e779d4d6",
 		BootFromVolume:     true,
 		BootDiskSize:       int64(150),
+		CreateTimeout:      120,
 		UseConfigDrive:     false,
 		Flavor:             "m1.small",
 		Image:              "ubuntu-20.04",
@@ -713,3 +737,1820 @@ func TestMachineSpecValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateMetadata(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= maxMetadataItems; i++ {
+		tooMany[fmt.Sprintf("key-%d", i)] = "value"
+	}
+
+	tests := []struct {
+		name      string
+		metadata  map[string]string
+		errString string
+	}{
+		{
+			name: "valid",
+			metadata: map[string]string{
+				"os_arch": "amd64",
+				"os_type": "linux",
+			},
+			errString: "",
+		},
+		{
+			name:      "too many items",
+			metadata:  tooMany,
+			errString: "too many metadata items: 129 (max 128)",
+		},
+		{
+			name: "key too long",
+			metadata: map[string]string{
+				strings.Repeat("k", maxMetadataKeyLength+1): "value",
+			},
+			errString: "invalid metadata key length",
+		},
+		{
+			name: "value too long",
+			metadata: map[string]string{
+				"key": strings.Repeat("v", maxMetadataValueLength+1),
+			},
+			errString: "metadata value for key \"key\" is too long: 256 (max 255)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetadata(tt.metadata)
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestGetServerCreateOptsMetadataOverLimit(t *testing.T) {
+	spec := &machineSpec{
+		Properties: map[string]string{
+			"os_arch": strings.Repeat("a", maxMetadataValueLength+1),
+		},
+	}
+	_, err := spec.GetServerCreateOpts(flavors.Flavor{}, networks.Network{}, images.Image{})
+	assert.ErrorContains(t, err, "failed to validate metadata")
+}
+
+func TestValidateImageDiskFormat(t *testing.T) {
+	tests := []struct {
+		name           string
+		bootFromVolume bool
+		allowedFormats []string
+		diskFormat     string
+		errString      string
+	}{
+		{
+			name:           "check disabled",
+			bootFromVolume: true,
+			allowedFormats: nil,
+			diskFormat:     "iso",
+			errString:      "",
+		},
+		{
+			name:           "not booting from volume",
+			bootFromVolume: false,
+			allowedFormats: defaultAllowedImageDiskFormats,
+			diskFormat:     "iso",
+			errString:      "",
+		},
+		{
+			name:           "allowed format",
+			bootFromVolume: true,
+			allowedFormats: defaultAllowedImageDiskFormats,
+			diskFormat:     "qcow2",
+			errString:      "",
+		},
+		{
+			name:           "iso format with check enabled",
+			bootFromVolume: true,
+			allowedFormats: defaultAllowedImageDiskFormats,
+			diskFormat:     "iso",
+			errString:      "has disk format \"iso\", which is not one of [qcow2 raw]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &machineSpec{
+				BootFromVolume:          tt.bootFromVolume,
+				AllowedImageDiskFormats: tt.allowedFormats,
+			}
+			err := spec.ValidateImageDiskFormat(images.Image{ID: "image-id", DiskFormat: tt.diskFormat})
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestSetSpecFromImageCopyImageProperties(t *testing.T) {
+	spec := &machineSpec{
+		Properties:          map[string]string{},
+		CopyImageProperties: []string{"build_id", "git_sha", "build_info", "missing"},
+	}
+	spec.SetSpecFromImage(images.Image{
+		Properties: map[string]interface{}{
+			"build_id":   float64(1234),
+			"git_sha":    "4b825dc642cb6eb9a060e54bf8d69288fbee4904",
+			"build_info": map[string]interface{}{"pipeline": "nightly"},
+			"other":      "not copied",
+		},
+	})
+	assert.Equal(t, map[string]string{
+		"build_id":   "1234",
+		"git_sha":    "4b825dc642cb6eb9a060e54bf8d69288fbee4904",
+		"build_info": `{"pipeline":"nightly"}`,
+	}, spec.Properties)
+}
+
+func TestGetBootFromVolumeOptsImageDiskBus(t *testing.T) {
+	tests := []struct {
+		name          string
+		overrideImage *images.Image
+		wantDiskBus   string
+	}{
+		{
+			name:        "pool image",
+			wantDiskBus: "scsi",
+		},
+		{
+			name: "override image",
+			overrideImage: &images.Image{
+				ID: "b7c2b9c4-1d0e-4b6f-9f35-8d2f5a0c6e11",
+				Properties: map[string]interface{}{
+					"hw_disk_bus": "virtio",
+				},
+			},
+			wantDiskBus: "virtio",
+		},
+		{
+			name: "override image without disk bus",
+			overrideImage: &images.Image{
+				ID:         "b7c2b9c4-1d0e-4b6f-9f35-8d2f5a0c6e11",
+				Properties: map[string]interface{}{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &machineSpec{
+				BootFromVolume: true,
+				BootDiskSize:   50,
+				Properties:     map[string]string{},
+			}
+			spec.SetSpecFromImage(images.Image{
+				ID: "aee1d242-730f-431f-88c1-87630c0f07ba",
+				Properties: map[string]interface{}{
+					"hw_disk_bus":         "scsi",
+					"hw_qemu_guest_agent": "yes",
+					"os_distro":           "ubuntu",
+				},
+			})
+			if tt.overrideImage != nil {
+				spec.ImageRefOverride = tt.overrideImage.ID
+				spec.SetDiskBusFromImage(*tt.overrideImage)
+			}
+
+			opts, err := spec.GetBootFromVolumeOpts(servers.CreateOpts{
+				ImageRef: "aee1d242-730f-431f-88c1-87630c0f07ba",
+			})
+			assert.NoError(t, err)
+			assert.Len(t, opts.BlockDevice, 1)
+			assert.Equal(t, tt.wantDiskBus, opts.BlockDevice[0].DiskBus)
+			assert.Equal(t, "aee1d242-730f-431f-88c1-87630c0f07ba", opts.BlockDevice[0].UUID)
+		})
+	}
+}
+
+func TestNewMachineSpecDefaultFlavors(t *testing.T) {
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID: "network",
+		DefaultFlavors: map[string]string{
+			"linux":   "m1.small",
+			"windows": "m1.large",
+		},
+	}
+	tools := params.RunnerApplicationDownload{
+		OS:           Ptr("linux"),
+		Architecture: Ptr("x64"),
+		DownloadURL:  Ptr("http://test.com"),
+		Filename:     Ptr("runner.tar.gz"),
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+
+	tests := []struct {
+		name       string
+		osType     params.OSType
+		flavor     string
+		wantFlavor string
+		errString  string
+	}{
+		{
+			name:       "linux default flavor",
+			osType:     params.Linux,
+			wantFlavor: "m1.small",
+		},
+		{
+			name:       "windows default flavor",
+			osType:     params.Windows,
+			wantFlavor: "m1.large",
+		},
+		{
+			name:       "pool flavor takes precedence",
+			osType:     params.Linux,
+			flavor:     "m1.xlarge",
+			wantFlavor: "m1.xlarge",
+		},
+		{
+			name:      "no default for os type",
+			osType:    params.OSType("freebsd"),
+			errString: "missing flavor",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:   "test-instance",
+				OSArch: params.Amd64,
+				OSType: tt.osType,
+				Flavor: tt.flavor,
+				Image:  "ubuntu-20.04",
+				Tools:  []params.RunnerApplicationDownload{tools},
+				PoolID: "test-pool",
+			}
+			spec, err := NewMachineSpec(data, cfg, "controllerID")
+			if tt.errString != "" {
+				assert.ErrorContains(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantFlavor, spec.Flavor)
+		})
+	}
+}
+
+func TestNewMachineSpecFlavorAndImageOverride(t *testing.T) {
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID: "network",
+	}
+	tools := params.RunnerApplicationDownload{
+		OS:           Ptr("linux"),
+		Architecture: Ptr("x64"),
+		DownloadURL:  Ptr("http://test.com"),
+		Filename:     Ptr("runner.tar.gz"),
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+
+	tests := []struct {
+		name       string
+		flavor     string
+		image      string
+		extraSpecs string
+		wantFlavor string
+		wantImage  string
+		errString  string
+	}{
+		{
+			name:       "pool flavor and image",
+			flavor:     "m1.small",
+			image:      "ubuntu-20.04",
+			wantFlavor: "m1.small",
+			wantImage:  "ubuntu-20.04",
+		},
+		{
+			name:       "extra specs win",
+			flavor:     "m1.small",
+			image:      "ubuntu-20.04",
+			extraSpecs: `{"flavor": "m1.large", "image": "ubuntu-22.04"}`,
+			wantFlavor: "m1.large",
+			wantImage:  "ubuntu-22.04",
+		},
+		{
+			name:       "only the flavor is overridden",
+			flavor:     "m1.small",
+			image:      "ubuntu-20.04",
+			extraSpecs: `{"flavor": "m1.large"}`,
+			wantFlavor: "m1.large",
+			wantImage:  "ubuntu-20.04",
+		},
+		{
+			name:       "extra specs fill in a missing flavor and image",
+			extraSpecs: `{"flavor": "m1.large", "image": "ubuntu-22.04"}`,
+			wantFlavor: "m1.large",
+			wantImage:  "ubuntu-22.04",
+		},
+		{
+			name:       "empty extra specs image does not hide a missing image",
+			flavor:     "m1.small",
+			extraSpecs: `{"image": ""}`,
+			errString:  "missing image",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:   "test-instance",
+				OSArch: params.Amd64,
+				OSType: params.Linux,
+				Flavor: tt.flavor,
+				Image:  tt.image,
+				Tools:  []params.RunnerApplicationDownload{tools},
+				PoolID: "test-pool",
+			}
+			if tt.extraSpecs != "" {
+				data.ExtraSpecs = json.RawMessage(tt.extraSpecs)
+			}
+			spec, err := NewMachineSpec(data, cfg, "controllerID")
+			if tt.errString != "" {
+				assert.ErrorContains(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantFlavor, spec.Flavor)
+			assert.Equal(t, tt.wantImage, spec.Image)
+		})
+	}
+}
+
+func TestGetBootFromVolumeOptsImageRefOverride(t *testing.T) {
+	spec := &machineSpec{
+		BootFromVolume:   true,
+		BootDiskSize:     50,
+		ImageRefOverride: "c4b5e2f3-7a0e-4c3b-8d4d-0c3f2a1b9e8d",
+	}
+	opts, err := spec.GetBootFromVolumeOpts(servers.CreateOpts{
+		Name:      "test-instance",
+		ImageRef:  "aee1d242-730f-431f-88c1-87630c0f07ba",
+		FlavorRef: "1",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, opts.BlockDevice, 1)
+	assert.Equal(t, "aee1d242-730f-431f-88c1-87630c0f07ba", opts.BlockDevice[0].UUID)
+
+	srvOpts, ok := opts.CreateOptsBuilder.(servers.CreateOpts)
+	assert.True(t, ok)
+	assert.Equal(t, "c4b5e2f3-7a0e-4c3b-8d4d-0c3f2a1b9e8d", srvOpts.ImageRef)
+}
+
+func TestNewMachineSpecUnknownCloud(t *testing.T) {
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID: "network",
+	}
+	data := params.BootstrapInstance{
+		Name:       "test-instance",
+		OSArch:     params.Amd64,
+		OSType:     params.Linux,
+		Flavor:     "m1.small",
+		Image:      "ubuntu-20.04",
+		PoolID:     "test-pool",
+		ExtraSpecs: json.RawMessage(`{"cloud": "othercloud"}`),
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+
+	_, err := NewMachineSpec(data, cfg, "controllerID")
+	assert.ErrorContains(t, err, "cloud othercloud is not defined in clouds.yaml")
+}
+
+func TestNewMachineSpecAsyncCreate(t *testing.T) {
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID: "network",
+		AsyncCreate:      true,
+	}
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSArch: params.Amd64,
+		OSType: params.Linux,
+		Flavor: "m1.small",
+		Image:  "ubuntu-20.04",
+		PoolID: "test-pool",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+
+	before := time.Now().UTC().Truncate(time.Second)
+	spec, err := NewMachineSpec(data, cfg, "controllerID")
+	assert.NoError(t, err)
+	assert.Contains(t, spec.Tags, "garm-async-create=true")
+
+	createdAt, err := time.Parse(time.RFC3339, spec.Properties["garm-created-at"])
+	assert.NoError(t, err)
+	assert.False(t, createdAt.Before(before))
+	assert.False(t, createdAt.After(time.Now().UTC()))
+}
+
+func TestGetServerCreateOptsAvailabilityZone(t *testing.T) {
+	_, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"availability_zone": ""}`),
+	})
+	assert.NoError(t, err)
+
+	extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"availability_zone": "az-gpu"}`),
+	})
+	assert.NoError(t, err)
+
+	spec := newTestUserDataSpec()
+	spec.Properties = map[string]string{}
+	spec.MergeExtraSpecs(extra)
+
+	opts, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+	assert.Equal(t, "az-gpu", opts.AvailabilityZone)
+
+	spec.BootFromVolume = true
+	spec.BootDiskSize = 50
+	bfvOpts, err := spec.GetBootFromVolumeOpts(opts)
+	assert.NoError(t, err)
+	srvOpts, ok := bfvOpts.CreateOptsBuilder.(servers.CreateOpts)
+	assert.True(t, ok)
+	assert.Equal(t, "az-gpu", srvOpts.AvailabilityZone)
+}
+
+func TestServerCreateOptsKeyName(t *testing.T) {
+	extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"key_name": "debug-key"}`),
+	})
+	assert.NoError(t, err)
+
+	spec := newTestUserDataSpec()
+	spec.Properties = map[string]string{}
+	spec.KeyName = "default-key"
+	spec.MergeExtraSpecs(extra)
+	assert.Equal(t, "debug-key", spec.KeyName)
+
+	opts, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+
+	asMap, err := spec.serverCreateOptsBuilder(opts).ToServerCreateMap()
+	assert.NoError(t, err)
+	assert.Equal(t, "debug-key", asMap["server"].(map[string]interface{})["key_name"])
+
+	spec.BootFromVolume = true
+	spec.BootDiskSize = 50
+	bfvOpts, err := spec.GetBootFromVolumeOpts(opts)
+	assert.NoError(t, err)
+	asMap, err = bfvOpts.ToServerCreateMap()
+	assert.NoError(t, err)
+	assert.Equal(t, "debug-key", asMap["server"].(map[string]interface{})["key_name"])
+
+	spec.KeyName = ""
+	_, ok := spec.serverCreateOptsBuilder(opts).(servers.CreateOpts)
+	assert.True(t, ok)
+}
+
+func TestNewMachineSpecCreateTimeout(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{
+			OS:           Ptr("win"),
+			Architecture: Ptr("x64"),
+			DownloadURL:  Ptr("http://test.com"),
+			Filename:     Ptr("runner.zip"),
+		}, nil
+	}
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID: "network",
+	}
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSType: params.Windows,
+		Flavor: "m1.large",
+		Image:  "windows-2022",
+		PoolID: "test-pool",
+	}
+
+	spec, err := NewMachineSpec(data, cfg, "controllerID")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 120, spec.CreateTimeout)
+
+	cfg.CreateTimeout = 300
+	spec, err = NewMachineSpec(data, cfg, "controllerID")
+	assert.NoError(t, err)
+	assert.Equal(t, 300, spec.CreateTimeout)
+
+	data.ExtraSpecs = json.RawMessage(`{"create_timeout": 900}`)
+	spec, err = NewMachineSpec(data, cfg, "controllerID")
+	assert.NoError(t, err)
+	assert.Equal(t, 900, spec.CreateTimeout)
+
+	data.ExtraSpecs = json.RawMessage(`{"create_timeout": 0}`)
+	_, err = NewMachineSpec(data, cfg, "controllerID")
+	assert.Error(t, err)
+}
+
+func TestGetServerCreateOptsNetworks(t *testing.T) {
+	extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"networks": [
+			{"network_id": "private"},
+			{"port_id": "port-uuid"},
+			{"network_id": "provider", "fixed_ip": "10.0.0.10", "subnet_id": "subnet-uuid"}
+		]}`),
+	})
+	assert.NoError(t, err)
+
+	spec := newTestUserDataSpec()
+	spec.Properties = map[string]string{}
+	spec.MergeExtraSpecs(extra)
+	for _, network := range spec.Networks {
+		assert.NoError(t, network.Validate())
+	}
+
+	opts, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+	assert.Equal(t, []servers.Network{
+		{UUID: "private"},
+		{Port: "port-uuid"},
+		{UUID: "provider", FixedIP: "10.0.0.10"},
+	}, opts.Networks)
+
+	spec.Networks = nil
+	opts, err = spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+	assert.Equal(t, []servers.Network{{UUID: "network"}}, opts.Networks)
+}
+
+func TestServerNetworkValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		network   serverNetwork
+		errString string
+	}{
+		{
+			name:    "network",
+			network: serverNetwork{NetworkID: "network"},
+		},
+		{
+			name:    "port",
+			network: serverNetwork{PortID: "port"},
+		},
+		{
+			name:    "network with fixed IP and subnet",
+			network: serverNetwork{NetworkID: "network", FixedIP: "2001:db8::10", SubnetID: "subnet"},
+		},
+		{
+			name:      "network and port",
+			network:   serverNetwork{NetworkID: "network", PortID: "port"},
+			errString: "exactly one of network_id or port_id must be set",
+		},
+		{
+			name:      "neither network nor port",
+			network:   serverNetwork{FixedIP: "10.0.0.10"},
+			errString: "exactly one of network_id or port_id must be set",
+		},
+		{
+			name:      "port with fixed IP",
+			network:   serverNetwork{PortID: "port", FixedIP: "10.0.0.10"},
+			errString: "fixed_ip requires network_id",
+		},
+		{
+			name:      "invalid fixed IP",
+			network:   serverNetwork{NetworkID: "network", FixedIP: "10.0.0"},
+			errString: "invalid fixed_ip",
+		},
+		{
+			name:      "subnet without fixed IP",
+			network:   serverNetwork{NetworkID: "network", SubnetID: "subnet"},
+			errString: "subnet_id requires fixed_ip",
+		},
+		{
+			name:      "static IP without subnet",
+			network:   serverNetwork{NetworkID: "network", FixedIP: "10.0.0.5", StaticIP: true},
+			errString: "static_ip requires fixed_ip and subnet_id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.network.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestGetServerCreateOptsPorts(t *testing.T) {
+	extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"ports": ["port-1", "port-2"]}`),
+	})
+	assert.NoError(t, err)
+
+	spec := newTestUserDataSpec()
+	spec.Properties = map[string]string{}
+	spec.NetworkID = "default-network"
+	spec.MergeExtraSpecs(extra)
+	assert.Empty(t, spec.NetworkID)
+
+	opts, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+	assert.Equal(t, []servers.Network{
+		{Port: "port-1"},
+		{Port: "port-2"},
+	}, opts.Networks)
+}
+
+func TestMachineSpecValidatePorts(t *testing.T) {
+	tests := []struct {
+		name       string
+		extraSpecs string
+		errString  string
+	}{
+		{
+			name:       "ports only",
+			extraSpecs: `{"ports": ["port-1"]}`,
+		},
+		{
+			name:       "ports and network_id",
+			extraSpecs: `{"ports": ["port-1"], "network_id": "network"}`,
+			errString:  "ports can not be combined with network_id or networks",
+		},
+		{
+			name:       "ports and networks",
+			extraSpecs: `{"ports": ["port-1"], "networks": [{"network_id": "network"}]}`,
+			errString:  "ports can not be combined with network_id or networks",
+		},
+		{
+			name:       "duplicate port",
+			extraSpecs: `{"ports": ["port-1", "port-1"]}`,
+			errString:  "port port-1 is set more than once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+				ExtraSpecs: json.RawMessage(tt.extraSpecs),
+			})
+			assert.NoError(t, err)
+
+			spec := newTestUserDataSpec()
+			spec.NetworkID = "default-network"
+			spec.Flavor = "m1.small"
+			spec.Image = "ubuntu"
+			spec.Tags = []string{"garm-pool-id=test-pool"}
+			spec.MergeExtraSpecs(extra)
+			err = spec.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestServerCreateOptsSchedulerHints(t *testing.T) {
+	extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"scheduler_hints": {
+			"group": "8ED2C58E-3A5C-4C5C-8B5E-4F6B5B0B2D40",
+			"additional_properties": {"different_host": ["a0cf03a5-d921-4877-bb5c-86d26cf818e1"]}
+		}}`),
+	})
+	assert.NoError(t, err)
+
+	spec := newTestUserDataSpec()
+	spec.Properties = map[string]string{}
+	spec.KeyName = "debug-key"
+	spec.MergeExtraSpecs(extra)
+
+	opts, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+
+	expectedHints := map[string]interface{}{
+		"group":          "8ed2c58e-3a5c-4c5c-8b5e-4f6b5b0b2d40",
+		"different_host": []interface{}{"a0cf03a5-d921-4877-bb5c-86d26cf818e1"},
+	}
+	asMap, err := spec.serverCreateOptsBuilder(opts).ToServerCreateMap()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedHints, asMap["os:scheduler_hints"])
+	assert.Equal(t, "debug-key", asMap["server"].(map[string]interface{})["key_name"])
+
+	spec.BootFromVolume = true
+	spec.BootDiskSize = 50
+	bfvOpts, err := spec.GetBootFromVolumeOpts(opts)
+	assert.NoError(t, err)
+	asMap, err = bfvOpts.ToServerCreateMap()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedHints, asMap["os:scheduler_hints"])
+	assert.Contains(t, asMap["server"], "block_device_mapping_v2")
+}
+
+func TestMachineSpecValidateSchedulerHints(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.NetworkID = "network"
+	spec.Flavor = "m1.small"
+	spec.Image = "ubuntu"
+	spec.Tags = []string{"garm-pool-id=test-pool"}
+
+	spec.SchedulerHints = &schedulerHints{Group: "8ed2c58e-3a5c-4c5c-8b5e-4f6b5b0b2d40"}
+	assert.NoError(t, spec.Validate())
+
+	spec.SchedulerHints = &schedulerHints{Group: "anti-affinity"}
+	assert.ErrorContains(t, spec.Validate(), "scheduler hint group must be a server group UUID")
+}
+
+func TestSetBootDiskSizeForFlavor(t *testing.T) {
+	flavorBootDiskSizes := map[string]int64{
+		"m1.large":                             80,
+		"5c4b3a2e-1f0d-4c9b-8a7e-6d5c4b3a2f1e": 120,
+	}
+	tests := []struct {
+		name       string
+		cfg        *config.Config
+		extraSpecs string
+		flavor     flavors.Flavor
+		expected   int64
+	}{
+		{
+			name:     "flavor name in the map",
+			cfg:      &config.Config{FlavorBootDiskSizes: flavorBootDiskSizes},
+			flavor:   flavors.Flavor{ID: "1", Name: "m1.large", Disk: 20},
+			expected: 80,
+		},
+		{
+			name:     "flavor ID in the map",
+			cfg:      &config.Config{FlavorBootDiskSizes: flavorBootDiskSizes},
+			flavor:   flavors.Flavor{ID: "5c4b3a2e-1f0d-4c9b-8a7e-6d5c4b3a2f1e", Name: "gpu.xlarge"},
+			expected: 120,
+		},
+		{
+			name:     "flavor disk",
+			cfg:      &config.Config{FlavorBootDiskSizes: flavorBootDiskSizes},
+			flavor:   flavors.Flavor{ID: "2", Name: "m1.small", Disk: 20},
+			expected: 20,
+		},
+		{
+			name:     "default size",
+			cfg:      &config.Config{FlavorBootDiskSizes: flavorBootDiskSizes},
+			flavor:   flavors.Flavor{ID: "3", Name: "m1.volume"},
+			expected: defaultBootDiskSize,
+		},
+		{
+			name:     "size set in the config",
+			cfg:      &config.Config{BootDiskSize: Ptr(int64(30)), FlavorBootDiskSizes: flavorBootDiskSizes},
+			flavor:   flavors.Flavor{ID: "1", Name: "m1.large", Disk: 20},
+			expected: 30,
+		},
+		{
+			name:       "size set in extra specs",
+			cfg:        &config.Config{FlavorBootDiskSizes: flavorBootDiskSizes},
+			extraSpecs: `{"boot_disk_size": 150}`,
+			flavor:     flavors.Flavor{ID: "1", Name: "m1.large", Disk: 20},
+			expected:   150,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Cloud = "mycloud"
+			tt.cfg.Credentials = config.Credentials{Clouds: "../testdata/clouds.yaml"}
+			tt.cfg.DefaultNetworkID = "network"
+			tt.cfg.BootFromVolume = true
+			data := params.BootstrapInstance{
+				Name:   "garm-instance",
+				Flavor: "m1.large",
+				Image:  "ubuntu",
+				OSType: params.Linux,
+				OSArch: params.Amd64,
+				PoolID: "test-pool",
+				Tools: []params.RunnerApplicationDownload{
+					{
+						OS:           Ptr("linux"),
+						Architecture: Ptr("x64"),
+						DownloadURL:  Ptr("https://example.com/runner.tar.gz"),
+						Filename:     Ptr("runner.tar.gz"),
+					},
+				},
+			}
+			if tt.extraSpecs != "" {
+				data.ExtraSpecs = json.RawMessage(tt.extraSpecs)
+			}
+			spec, err := NewMachineSpec(data, tt.cfg, "my-controller-id")
+			assert.NoError(t, err)
+
+			spec.setBootDiskSizeForFlavor(tt.flavor)
+			assert.Equal(t, tt.expected, spec.BootDiskSize)
+		})
+	}
+}
+
+func TestGetBootFromVolumeOptsRootVolumeType(t *testing.T) {
+	tests := []struct {
+		name             string
+		storageBackend   string
+		rootVolumeType   string
+		dataVolumeType   string
+		expectedRootType string
+		expectedDataType string
+	}{
+		{
+			name:             "root volume type",
+			storageBackend:   "hdd",
+			rootVolumeType:   "nvme",
+			expectedRootType: "nvme",
+			expectedDataType: "hdd",
+		},
+		{
+			name:             "falls back to storage backend",
+			storageBackend:   "hdd",
+			expectedRootType: "hdd",
+			expectedDataType: "hdd",
+		},
+		{
+			name:             "data disk volume type",
+			storageBackend:   "hdd",
+			rootVolumeType:   "nvme",
+			dataVolumeType:   "ssd",
+			expectedRootType: "nvme",
+			expectedDataType: "ssd",
+		},
+		{
+			name: "cloud default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &machineSpec{
+				BootFromVolume: true,
+				BootDiskSize:   50,
+				StorageBackend: tt.storageBackend,
+				RootVolumeType: tt.rootVolumeType,
+				DataDisks:      []dataDisk{{Size: 100, VolumeType: tt.dataVolumeType}},
+			}
+			opts, err := spec.GetBootFromVolumeOpts(servers.CreateOpts{
+				Name:      "test-instance",
+				ImageRef:  "aee1d242-730f-431f-88c1-87630c0f07ba",
+				FlavorRef: "1",
+			})
+			assert.NoError(t, err)
+			assert.Len(t, opts.BlockDevice, 2)
+			assert.Equal(t, tt.expectedRootType, opts.BlockDevice[0].VolumeType)
+			assert.Equal(t, tt.expectedDataType, opts.BlockDevice[1].VolumeType)
+		})
+	}
+}
+
+func TestMergeExtraSpecsRootVolumeType(t *testing.T) {
+	extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"root_volume_type": "nvme"}`),
+	})
+	assert.NoError(t, err)
+
+	spec := &machineSpec{
+		StorageBackend: "hdd",
+		RootVolumeType: "ssd",
+	}
+	spec.MergeExtraSpecs(extra)
+	assert.Equal(t, "nvme", spec.RootVolumeType)
+	assert.Equal(t, "hdd", spec.StorageBackend)
+}
+
+func TestGetBootFromVolumeOptsRootVolumeID(t *testing.T) {
+	spec := &machineSpec{
+		BootFromVolume: true,
+		StorageBackend: "ssd",
+		RootVolumeID:   "6f2c1a9e-4b3d-4e5f-8a7b-9c0d1e2f3a4b",
+		DataDisks:      []dataDisk{{Size: 100}},
+	}
+	opts, err := spec.GetBootFromVolumeOpts(servers.CreateOpts{
+		Name:      "test-instance",
+		ImageRef:  "aee1d242-730f-431f-88c1-87630c0f07ba",
+		FlavorRef: "1",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, opts.BlockDevice, 2)
+	assert.Equal(t, bootfromvolume.BlockDevice{
+		DestinationType: bootfromvolume.DestinationVolume,
+		SourceType:      bootfromvolume.SourceVolume,
+		UUID:            "6f2c1a9e-4b3d-4e5f-8a7b-9c0d1e2f3a4b",
+	}, opts.BlockDevice[0])
+	assert.Equal(t, bootfromvolume.SourceBlank, opts.BlockDevice[1].SourceType)
+
+	srvOpts, ok := opts.CreateOptsBuilder.(servers.CreateOpts)
+	assert.True(t, ok)
+	assert.Empty(t, srvOpts.ImageRef)
+
+	asMap, err := opts.ToServerCreateMap()
+	assert.NoError(t, err)
+	bdm := asMap["server"].(map[string]interface{})["block_device_mapping_v2"].([]map[string]interface{})
+	assert.Equal(t, "volume", bdm[0]["source_type"])
+	assert.Equal(t, false, bdm[0]["delete_on_termination"])
+}
+
+func TestMachineSpecValidateRootVolumeID(t *testing.T) {
+	tests := []struct {
+		name       string
+		extraSpecs string
+		errString  string
+	}{
+		{
+			name:       "boot from existing volume",
+			extraSpecs: `{"boot_from_volume": true, "root_volume_id": "6f2c1a9e-4b3d-4e5f-8a7b-9c0d1e2f3a4b"}`,
+		},
+		{
+			name:       "not booting from volume",
+			extraSpecs: `{"root_volume_id": "6f2c1a9e-4b3d-4e5f-8a7b-9c0d1e2f3a4b"}`,
+			errString:  "root_volume_id is only supported when booting from volume",
+		},
+		{
+			name:       "boot disk size set",
+			extraSpecs: `{"boot_from_volume": true, "boot_disk_size": 100, "root_volume_id": "6f2c1a9e-4b3d-4e5f-8a7b-9c0d1e2f3a4b"}`,
+			errString:  "root_volume_id can not be combined with boot_disk_size",
+		},
+		{
+			name:       "invalid volume ID",
+			extraSpecs: `{"boot_from_volume": true, "root_volume_id": "runner-root"}`,
+			errString:  "invalid root_volume_id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+				ExtraSpecs: json.RawMessage(tt.extraSpecs),
+			})
+			assert.NoError(t, err)
+
+			spec := newTestUserDataSpec()
+			spec.NetworkID = "default-network"
+			spec.Flavor = "m1.small"
+			spec.Image = "ubuntu"
+			spec.Tags = []string{"garm-pool-id=test-pool"}
+			// The default boot disk size does not apply to an existing volume.
+			spec.BootDiskSize = defaultBootDiskSize
+			spec.MergeExtraSpecs(extra)
+			err = spec.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestDataDisks(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       machineSpec
+		expected   []bootfromvolume.BlockDevice
+		expectSize int
+	}{
+		{
+			name: "one data disk",
+			spec: machineSpec{
+				DataDisks: []dataDisk{
+					{Size: 100},
+				},
+			},
+			expected: []bootfromvolume.BlockDevice{
+				{BootIndex: 1, DeleteOnTermination: true, DestinationType: bootfromvolume.DestinationVolume, SourceType: bootfromvolume.SourceBlank, VolumeSize: 100},
+			},
+			expectSize: 100,
+		},
+		{
+			name: "multiple data disks",
+			spec: machineSpec{
+				DataDisks: []dataDisk{
+					{Size: 100, VolumeType: "ssd"},
+					{Size: 20, DeleteOnTermination: Ptr(false)},
+				},
+			},
+			expected: []bootfromvolume.BlockDevice{
+				{BootIndex: 1, DeleteOnTermination: true, DestinationType: bootfromvolume.DestinationVolume, SourceType: bootfromvolume.SourceBlank, VolumeSize: 100, VolumeType: "ssd"},
+				{BootIndex: 2, DeleteOnTermination: false, DestinationType: bootfromvolume.DestinationVolume, SourceType: bootfromvolume.SourceBlank, VolumeSize: 20},
+			},
+			expectSize: 120,
+		},
+	}
+
+	srvOpts := servers.CreateOpts{
+		Name:      "test-instance",
+		ImageRef:  "aee1d242-730f-431f-88c1-87630c0f07ba",
+		FlavorRef: "1",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Boot from volume.
+			tt.spec.BootFromVolume = true
+			tt.spec.BootDiskSize = 50
+			opts, err := tt.spec.GetBootFromVolumeOpts(srvOpts)
+			assert.NoError(t, err)
+			assert.Len(t, opts.BlockDevice, len(tt.expected)+1)
+			assert.Equal(t, bootfromvolume.SourceImage, opts.BlockDevice[0].SourceType)
+			assert.Equal(t, bootfromvolume.DestinationVolume, opts.BlockDevice[0].DestinationType)
+			assert.Equal(t, tt.expected, opts.BlockDevice[1:])
+
+			// Boot from image.
+			tt.spec.BootFromVolume = false
+			opts = tt.spec.GetDataDisksOpts(srvOpts)
+			assert.Len(t, opts.BlockDevice, len(tt.expected)+1)
+			assert.Equal(t, bootfromvolume.BlockDevice{
+				DeleteOnTermination: true,
+				DestinationType:     bootfromvolume.DestinationLocal,
+				SourceType:          bootfromvolume.SourceImage,
+				UUID:                srvOpts.ImageRef,
+			}, opts.BlockDevice[0])
+			assert.Equal(t, tt.expected, opts.BlockDevice[1:])
+
+			assert.Equal(t, tt.expectSize, tt.spec.dataDisksSize())
+		})
+	}
+}
+
+func TestMachineSpecValidateDataDisks(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.NetworkID = "default-network"
+	spec.Flavor = "m1.small"
+	spec.Image = "ubuntu"
+	spec.Tags = []string{"garm-pool-id=test-pool"}
+	spec.DataDisks = []dataDisk{{Size: 10}, {Size: 0}}
+	err := spec.Validate()
+	assert.ErrorContains(t, err, "invalid data disk at index 1: size must be a positive number of GB")
+
+	_, err = extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"data_disks": [{"size": -1}]}`),
+	})
+	assert.Error(t, err)
+}
+
+func TestMachineSpecValidatePackageMirror(t *testing.T) {
+	tests := []struct {
+		name      string
+		mirror    string
+		osType    params.OSType
+		errString string
+	}{
+		{
+			name:   "valid mirror",
+			mirror: "https://mirror.example.com/ubuntu",
+			osType: params.Linux,
+		},
+		{
+			name:      "not a URL",
+			mirror:    "mirror.example.com",
+			osType:    params.Linux,
+			errString: "invalid package mirror",
+		},
+		{
+			name:      "windows",
+			mirror:    "https://mirror.example.com/ubuntu",
+			osType:    params.Windows,
+			errString: "package_mirror is only supported on Linux",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := newTestUserDataSpec()
+			spec.NetworkID = "default-network"
+			spec.Flavor = "m1.small"
+			spec.Image = "ubuntu"
+			spec.Tags = []string{"garm-pool-id=test-pool"}
+			spec.BootstrapParams.OSType = tt.osType
+			spec.PackageMirror = tt.mirror
+			err := spec.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestMachineSpecValidateDNSNameservers(t *testing.T) {
+	tests := []struct {
+		name        string
+		nameservers []string
+		ports       []string
+		errString   string
+	}{
+		{
+			name:        "valid nameservers",
+			nameservers: []string{"10.0.0.2", "fd00::2"},
+		},
+		{
+			name:        "not an IP",
+			nameservers: []string{"10.0.0.2", "dns.example.com"},
+			errString:   `invalid DNS nameserver: "dns.example.com"`,
+		},
+		{
+			name:        "with ports",
+			nameservers: []string{"10.0.0.2"},
+			ports:       []string{"port-1"},
+			errString:   "dns_nameservers can not be combined with ports",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := newTestUserDataSpec()
+			spec.NetworkID = "default-network"
+			spec.Flavor = "m1.small"
+			spec.Image = "ubuntu"
+			spec.Tags = []string{"garm-pool-id=test-pool"}
+			spec.DNSNameservers = tt.nameservers
+			if len(tt.ports) > 0 {
+				spec.NetworkID = ""
+				spec.Ports = tt.ports
+			}
+			err := spec.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestMachineSpecValidateHostname(t *testing.T) {
+	tests := []struct {
+		name      string
+		hostname  string
+		osType    params.OSType
+		errString string
+	}{
+		{
+			name:     "suffix",
+			hostname: "build-{{.Suffix}}",
+			osType:   params.Linux,
+		},
+		{
+			name:     "runner name",
+			hostname: "{{.Name}}",
+			osType:   params.Linux,
+		},
+		{
+			name:      "fixed hostname",
+			hostname:  "build-01",
+			osType:    params.Linux,
+			errString: `invalid hostname: "build-01" renders the same hostname for every runner`,
+		},
+		{
+			name:      "varying part truncated",
+			hostname:  strings.Repeat("a", 64) + "{{.Suffix}}",
+			osType:    params.Linux,
+			errString: "renders the same hostname for every runner",
+		},
+		{
+			name:      "unknown field",
+			hostname:  "build-{{.Missing}}",
+			osType:    params.Linux,
+			errString: "invalid hostname: failed to render hostname template",
+		},
+		{
+			name:      "invalid template",
+			hostname:  "build-{{.Name",
+			osType:    params.Linux,
+			errString: "invalid hostname: failed to parse hostname template",
+		},
+		{
+			name:      "windows",
+			hostname:  "build-{{.Suffix}}",
+			osType:    params.Windows,
+			errString: "hostname is only supported on Linux",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := newTestUserDataSpec()
+			spec.NetworkID = "default-network"
+			spec.Flavor = "m1.small"
+			spec.Image = "ubuntu"
+			spec.Tags = []string{"garm-pool-id=test-pool"}
+			spec.BootstrapParams.OSType = tt.osType
+			spec.Hostname = tt.hostname
+			err := spec.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestMachineSpecValidateInjectFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string][]byte
+		osType    params.OSType
+		errString string
+	}{
+		{
+			name:   "valid files",
+			files:  map[string][]byte{"/etc/apt/apt.conf.d/90proxy": []byte("proxy")},
+			osType: params.Linux,
+		},
+		{
+			name:      "relative path",
+			files:     map[string][]byte{"etc/apt/apt.conf.d/90proxy": []byte("proxy")},
+			osType:    params.Linux,
+			errString: `invalid inject_files path: "etc/apt/apt.conf.d/90proxy"`,
+		},
+		{
+			name:      "path not clean",
+			files:     map[string][]byte{"/etc/apt/../shadow": []byte("proxy")},
+			osType:    params.Linux,
+			errString: `invalid inject_files path: "/etc/apt/../shadow"`,
+		},
+		{
+			name:      "path too long",
+			files:     map[string][]byte{"/" + strings.Repeat("a", maxInjectedFilePathLength): []byte("proxy")},
+			osType:    params.Linux,
+			errString: "invalid inject_files path",
+		},
+		{
+			name:      "too large",
+			files:     map[string][]byte{"/opt/big": make([]byte, maxUserDataSize)},
+			osType:    params.Linux,
+			errString: "inject_files is too large",
+		},
+		{
+			name:      "windows",
+			files:     map[string][]byte{"/etc/apt/apt.conf.d/90proxy": []byte("proxy")},
+			osType:    params.Windows,
+			errString: "inject_files is only supported on Linux",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := newTestUserDataSpec()
+			spec.NetworkID = "default-network"
+			spec.Flavor = "m1.small"
+			spec.Image = "ubuntu"
+			spec.Tags = []string{"garm-pool-id=test-pool"}
+			spec.BootstrapParams.OSType = tt.osType
+			spec.InjectFiles = tt.files
+			err := spec.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestGetServerCreateOptsUserDataTooLarge(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.NetworkID = "default-network"
+	spec.Flavor = "m1.small"
+	spec.Image = "ubuntu"
+	spec.Tags = []string{"garm-pool-id=test-pool"}
+	spec.Properties = map[string]string{}
+	// The file fits on its own, but the user data is encoded once more when sent to nova.
+	spec.InjectFiles = map[string][]byte{
+		"/opt/big": make([]byte, 49000),
+	}
+	assert.NoError(t, spec.Validate())
+
+	_, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.ErrorContains(t, err, "user data is too large")
+}
+
+func TestGetServerCreateOptsHostname(t *testing.T) {
+	extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"hostname": "build-{{.Suffix}}"}`),
+	})
+	assert.NoError(t, err)
+
+	spec := newTestUserDataSpec()
+	spec.Properties = map[string]string{}
+	spec.HostnameTemplate = "runner-{{.Suffix}}"
+	spec.MergeExtraSpecs(extra)
+
+	opts, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+	assert.Equal(t, spec.BootstrapParams.Name, opts.Name)
+
+	var cfg struct {
+		Hostname string `yaml:"hostname"`
+	}
+	assert.NoError(t, yaml.Unmarshal(opts.UserData, &cfg))
+	assert.Regexp(t, `^build-[a-z0-9]{6}$`, cfg.Hostname)
+}
+
+func TestMachineSpecValidateCompletionCallbackURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		callbackURL string
+		osType      params.OSType
+		errString   string
+	}{
+		{
+			name:        "valid URL",
+			callbackURL: "https://garm.example.com/callback",
+			osType:      params.Linux,
+		},
+		{
+			name:        "not a URL",
+			callbackURL: "garm.example.com/callback",
+			osType:      params.Linux,
+			errString:   "invalid completion callback URL",
+		},
+		{
+			name:        "windows",
+			callbackURL: "https://garm.example.com/callback",
+			osType:      params.Windows,
+			errString:   "completion_callback_url is only supported on Linux",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := newTestUserDataSpec()
+			spec.NetworkID = "default-network"
+			spec.Flavor = "m1.small"
+			spec.Image = "ubuntu"
+			spec.Tags = []string{"garm-pool-id=test-pool"}
+			spec.BootstrapParams.OSType = tt.osType
+			spec.CompletionCallbackURL = tt.callbackURL
+			err := spec.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestMachineSpecValidateRunnerLabels(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      []string
+		runnerGroup string
+		errString   string
+	}{
+		{
+			name:        "valid labels and group",
+			labels:      []string{"gpu", "ubuntu-22.04", "x86_64"},
+			runnerGroup: "ml-team",
+		},
+		{
+			name:      "label with a comma",
+			labels:    []string{"gpu,cuda"},
+			errString: "invalid runner label",
+		},
+		{
+			name:      "empty label",
+			labels:    []string{""},
+			errString: "invalid runner label",
+		},
+		{
+			name:        "group with a space",
+			runnerGroup: "ml team",
+			errString:   "invalid runner group",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := newTestUserDataSpec()
+			spec.NetworkID = "default-network"
+			spec.Flavor = "m1.small"
+			spec.Image = "ubuntu"
+			spec.Tags = []string{"garm-pool-id=test-pool"}
+			spec.RunnerLabels = tt.labels
+			spec.RunnerGroup = tt.runnerGroup
+			err := spec.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
+
+func TestNewMachineSpecCustomTags(t *testing.T) {
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID:     "network",
+		DefaultTags:          []string{"team=ci", "cost-center=42"},
+		ControllerInstanceID: "0b7d8f2e-3c4a-4e5b-9f6a-7b8c9d0e1f2a",
+	}
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSArch: params.Amd64,
+		OSType: params.Linux,
+		Flavor: "m1.small",
+		Image:  "ubuntu-20.04",
+		PoolID: "test-pool",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		// The user attempts to move the runner to another pool and controller.
+		ExtraSpecs: json.RawMessage(`{"tags": ["project=garm", "team=ci", "garm-pool-id=other-pool", "garm-controller-id=other-controller", "garm-controller-uuid=other-instance"]}`),
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+
+	spec, err := NewMachineSpec(data, cfg, "controllerID")
+	assert.NoError(t, err)
+
+	opts, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"garm-pool-id=test-pool",
+		"garm-controller-id=controllerID",
+		"garm-controller-uuid=0b7d8f2e-3c4a-4e5b-9f6a-7b8c9d0e1f2a",
+		"team=ci",
+		"cost-center=42",
+		"project=garm",
+	}, opts.Tags)
+}
+
+func TestMachineSpecValidateTags(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.NetworkID = "default-network"
+	spec.Flavor = "m1.small"
+	spec.Image = "ubuntu"
+	spec.Tags = getTags("controllerID", "", "test-pool", nil, []string{"path=a/b"})
+	err := spec.Validate()
+	assert.ErrorContains(t, err, `invalid tags: tag "path=a/b" contains a comma or a slash`)
+}
+
+func TestNewMachineSpecMetadata(t *testing.T) {
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID: "network",
+	}
+	data := params.BootstrapInstance{
+		Name:   "test-instance",
+		OSArch: params.Amd64,
+		OSType: params.Linux,
+		Flavor: "m1.small",
+		Image:  "ubuntu-20.04",
+		PoolID: "test-pool",
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{"metadata": {
+			"team": "ci",
+			"os_arch": "arm64",
+			"os_type": "windows",
+			"garm-pool-id": "other-pool",
+			"garm-controller-id": "other-controller"
+		}}`),
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+
+	spec, err := NewMachineSpec(data, cfg, "controllerID")
+	assert.NoError(t, err)
+
+	opts, err := spec.GetServerCreateOpts(flavors.Flavor{ID: "1"}, networks.Network{ID: "network"}, images.Image{ID: "image"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"team":               "ci",
+		"os_arch":            "amd64",
+		"os_type":            "linux",
+		"garm-pool-id":       "test-pool",
+		"garm-controller-id": "controllerID",
+	}, opts.Metadata)
+
+	// Metadata values must be strings.
+	data.ExtraSpecs = json.RawMessage(`{"metadata": {"replicas": 3}}`)
+	_, err = NewMachineSpec(data, cfg, "controllerID")
+	assert.ErrorContains(t, err, "failed to get extra specs")
+}
+
+func TestEntityHierarchy(t *testing.T) {
+	tests := []struct {
+		name     string
+		repoURL  string
+		expected map[string]string
+	}{
+		{
+			name:     "repository",
+			repoURL:  "https://github.com/my-org/my-repo",
+			expected: map[string]string{"garm-org": "my-org", "garm-repo": "my-repo"},
+		},
+		{
+			name:     "organization",
+			repoURL:  "https://ghes.example.com/my-org/",
+			expected: map[string]string{"garm-org": "my-org"},
+		},
+		{
+			name:     "enterprise",
+			repoURL:  "https://github.com/enterprises/my-enterprise",
+			expected: map[string]string{"garm-enterprise": "my-enterprise"},
+		},
+		{
+			name:    "empty URL",
+			repoURL: "",
+		},
+		{
+			name:    "no path",
+			repoURL: "https://github.com",
+		},
+		{
+			name:    "unknown path",
+			repoURL: "https://github.com/my-org/my-repo/settings",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, entityHierarchy(tt.repoURL))
+		})
+	}
+}
+
+func TestNewMachineSpecEntityHierarchy(t *testing.T) {
+	cfg := &config.Config{
+		Cloud: "mycloud",
+		Credentials: config.Credentials{
+			Clouds: "../testdata/clouds.yaml",
+		},
+		DefaultNetworkID:   "network",
+		TagEntityHierarchy: true,
+	}
+	data := params.BootstrapInstance{
+		Name:    "test-instance",
+		OSArch:  params.Amd64,
+		OSType:  params.Linux,
+		Flavor:  "m1.small",
+		Image:   "ubuntu-20.04",
+		PoolID:  "test-pool",
+		RepoURL: "https://github.com/my-org/" + strings.Repeat("r", 60),
+		Tools: []params.RunnerApplicationDownload{
+			{
+				OS:           Ptr("linux"),
+				Architecture: Ptr("x64"),
+				DownloadURL:  Ptr("http://test.com"),
+				Filename:     Ptr("runner.tar.gz"),
+			},
+		},
+		ExtraSpecs: json.RawMessage(`{"metadata": {"garm-org": "other-org"}}`),
+	}
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return tools[0], nil
+	}
+
+	spec, err := NewMachineSpec(data, cfg, "controllerID")
+	assert.NoError(t, err)
+	// The repository tag would be longer than 60 characters, so it is only set in
+	// the metadata.
+	assert.Equal(t, []string{
+		"garm-pool-id=test-pool",
+		"garm-controller-id=controllerID",
+		"garm-org=my-org",
+	}, spec.Tags)
+	assert.Equal(t, map[string]string{
+		"os_arch":            "amd64",
+		"os_type":            "linux",
+		"garm-pool-id":       "test-pool",
+		"garm-controller-id": "controllerID",
+		"garm-org":           "my-org",
+		"garm-repo":          strings.Repeat("r", 60),
+	}, spec.Properties)
+
+	cfg.TagEntityHierarchy = false
+	spec, err = NewMachineSpec(data, cfg, "controllerID")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"garm-pool-id=test-pool",
+		"garm-controller-id=controllerID",
+	}, spec.Tags)
+	assert.Equal(t, "other-org", spec.Properties["garm-org"])
+	assert.NotContains(t, spec.Properties, "garm-repo")
+}
+
+func TestNewStaticNetwork(t *testing.T) {
+	port := ports.Port{
+		ID:         "port",
+		MACAddress: "fa:16:3e:00:00:01",
+		FixedIPs:   []ports.IP{{SubnetID: "subnet", IPAddress: "10.0.0.5"}},
+	}
+	subnet := subnets.Subnet{
+		ID:             "subnet",
+		CIDR:           "10.0.0.0/24",
+		GatewayIP:      "10.0.0.1",
+		DNSNameservers: []string{"10.0.0.2"},
+	}
+
+	tests := []struct {
+		name      string
+		port      func(ports.Port) ports.Port
+		subnet    func(subnets.Subnet) subnets.Subnet
+		fixedIP   string
+		expected  staticNetwork
+		errString string
+	}{
+		{
+			name: "valid",
+			expected: staticNetwork{
+				MACAddress: "fa:16:3e:00:00:01",
+				Address:    "10.0.0.5/24",
+				Gateway:    "10.0.0.1",
+				DNSServers: []string{"10.0.0.2"},
+			},
+		},
+		{
+			name: "no gateway",
+			subnet: func(s subnets.Subnet) subnets.Subnet {
+				s.GatewayIP = ""
+				return s
+			},
+			expected: staticNetwork{
+				MACAddress: "fa:16:3e:00:00:01",
+				Address:    "10.0.0.5/24",
+				DNSServers: []string{"10.0.0.2"},
+			},
+		},
+		{
+			name: "port got another IP",
+			port: func(p ports.Port) ports.Port {
+				p.FixedIPs = []ports.IP{{SubnetID: "subnet", IPAddress: "10.0.0.6"}}
+				return p
+			},
+			errString: "port port does not have the fixed IP 10.0.0.5 from subnet subnet",
+		},
+		{
+			name: "no MAC address",
+			port: func(p ports.Port) ports.Port {
+				p.MACAddress = ""
+				return p
+			},
+			errString: "port port has no MAC address",
+		},
+		{
+			name: "gateway outside of the subnet",
+			subnet: func(s subnets.Subnet) subnets.Subnet {
+				s.GatewayIP = "10.0.1.1"
+				return s
+			},
+			errString: "gateway 10.0.1.1 of subnet subnet is not in 10.0.0.0/24",
+		},
+		{
+			name: "fixed IP is the gateway",
+			port: func(p ports.Port) ports.Port {
+				p.FixedIPs = []ports.IP{{SubnetID: "subnet", IPAddress: "10.0.0.1"}}
+				return p
+			},
+			fixedIP:   "10.0.0.1",
+			errString: "fixed IP 10.0.0.1 is the gateway of subnet subnet",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, s, fixedIP := port, subnet, "10.0.0.5"
+			if tt.port != nil {
+				p = tt.port(p)
+			}
+			if tt.subnet != nil {
+				s = tt.subnet(s)
+			}
+			if tt.fixedIP != "" {
+				fixedIP = tt.fixedIP
+			}
+			staticNet, err := newStaticNetwork(p, s, fixedIP)
+			if tt.errString != "" {
+				assert.EqualError(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, staticNet)
+		})
+	}
+}
+
+func TestSecurityGroupRuleValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      securityGroupRule
+		errString string
+	}{
+		{
+			name: "tcp port range from CIDR",
+			rule: securityGroupRule{Protocol: "tcp", PortRangeMin: 8000, PortRangeMax: 8080, RemoteIPPrefix: "10.0.0.0/8"},
+		},
+		{
+			name: "egress to any",
+			rule: securityGroupRule{Direction: "egress"},
+		},
+		{
+			name:      "invalid protocol",
+			rule:      securityGroupRule{Protocol: "sctp"},
+			errString: `invalid protocol: "sctp"`,
+		},
+		{
+			name:      "ports without protocol",
+			rule:      securityGroupRule{PortRangeMin: 22, PortRangeMax: 22},
+			errString: "port ranges are only supported for tcp and udp",
+		},
+		{
+			name:      "reversed port range",
+			rule:      securityGroupRule{Protocol: "udp", PortRangeMin: 53, PortRangeMax: 1},
+			errString: "invalid port range: 53-1",
+		},
+		{
+			name:      "invalid CIDR",
+			rule:      securityGroupRule{RemoteIPPrefix: "10.0.0.0/33"},
+			errString: `invalid remote_ip_prefix: "10.0.0.0/33"`,
+		},
+		{
+			name:      "CIDR and remote group",
+			rule:      securityGroupRule{RemoteIPPrefix: "10.0.0.0/8", RemoteGroupID: "sg-1"},
+			errString: "remote_ip_prefix and remote_group_id are mutually exclusive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFileName = "state.json"
+	lockFileName  = "state.lock"
+)
+
+// target is a cloud and region in which runners are created.
+type target struct {
+	Cloud  string `json:"cloud"`
+	Region string `json:"region"`
+}
+
+// providerState holds what the provider needs to remember across runs. garm runs the
+// provider once for every operation, so this can not be kept in memory.
+type providerState struct {
+	// Targets holds the clouds and regions, other than the configured ones, in which
+	// runners were created because a pool requested them through extra_specs.
+	Targets []target `json:"targets,omitempty"`
+	// NextRegion is the index of the next region picked by the round robin region
+	// selection strategy.
+	NextRegion int `json:"next_region,omitempty"`
+}
+
+func (s *providerState) hasTarget(t target) bool {
+	for _, existing := range s.Targets {
+		if existing == t {
+			return true
+		}
+	}
+	return false
+}
+
+// loadState reads the state of the provider. A missing state file is not an error, as
+// nothing has been recorded yet. The state file is replaced atomically, so this does
+// not need to take the lock.
+func (a *openstackProvider) loadState() (providerState, error) {
+	dir, err := a.cfg.StateDirectory()
+	if err != nil {
+		return providerState{}, err
+	}
+	return readStateFile(filepath.Join(dir, stateFileName))
+}
+
+func readStateFile(path string) (providerState, error) {
+	var state providerState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return state, nil
+		}
+		return state, fmt.Errorf("failed to read state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// updateState calls fn with the current state, and saves the state if fn does not
+// return an error. Multiple instances of the provider may run at the same time, so the
+// state is locked for the duration of the update.
+func (a *openstackProvider) updateState(fn func(state *providerState) error) error {
+	dir, err := a.cfg.StateDirectory()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open state lock: %w", err)
+	}
+	// Closing the file also releases the lock.
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("failed to lock state: %w", err)
+	}
+
+	path := filepath.Join(dir, stateFileName)
+	state, err := readStateFile(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(&state); err != nil {
+		return err
+	}
+	return writeStateFile(path, state)
+}
+
+// writeStateFile writes the state to a temporary file, and moves it in place, so readers
+// never see a partially written state.
+func writeStateFile(path string, state providerState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), stateFileName+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
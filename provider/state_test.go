@@ -0,0 +1,81 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cloudbase/garm-provider-openstack/config"
+)
+
+func TestUpdateStateConcurrent(t *testing.T) {
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			StateDir: filepath.Join(t.TempDir(), "state"),
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := provider.updateState(func(state *providerState) error {
+				state.Targets = append(state.Targets, target{Cloud: "mycloud", Region: fmt.Sprintf("Region%d", i)})
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	state, err := provider.loadState()
+	assert.NoError(t, err)
+	assert.Len(t, state.Targets, 20)
+}
+
+func TestUpdateStateError(t *testing.T) {
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			StateDir: t.TempDir(),
+		},
+	}
+
+	err := provider.updateState(func(state *providerState) error {
+		state.Targets = append(state.Targets, target{Cloud: "mycloud"})
+		return fmt.Errorf("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	_, err = os.Stat(filepath.Join(provider.cfg.StateDir, stateFileName))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoadStateInvalid(t *testing.T) {
+	provider := &openstackProvider{
+		cfg: &config.Config{
+			StateDir: t.TempDir(),
+		},
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(provider.cfg.StateDir, stateFileName), []byte("{"), 0o600))
+
+	_, err := provider.loadState()
+	assert.ErrorContains(t, err, "failed to parse state file")
+}
@@ -0,0 +1,552 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/cloudbase/garm-provider-common/cloudconfig"
+	"github.com/cloudbase/garm-provider-common/defaults"
+	"github.com/cloudbase/garm-provider-common/params"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	runnerServiceOverridePath = "/etc/garm/runner-service-override.conf"
+	// staticNetworkConfigPath is the netplan config of the ports with a static IP.
+	// netplan does not let one file override an interface configured in another file
+	// under a different name, so the ports are removed from the config that cloud-init
+	// wrote to cloudInitNetplanPath, and cloud-init is told not to write it again.
+	staticNetworkConfigPath = "/etc/netplan/90-garm-static.yaml"
+	cloudInitNetplanPath    = "/etc/netplan/50-cloud-init.yaml"
+	// cloudInitNetworkDisabledPath disables the network config of cloud-init on the
+	// next boots.
+	cloudInitNetworkDisabledPath = "/etc/cloud/cloud.cfg.d/99-garm-disable-network-config.cfg"
+	// runnerServiceOverrideCmd copies the drop-in into the unit directory of every
+	// runner service installed by the runner install script, and restarts the
+	// runner service so the drop-in takes effect.
+	runnerServiceOverrideCmd = `for unit in /etc/systemd/system/actions.runner.*.service; do [ -e "$unit" ] || continue; mkdir -p "$unit.d" && cp ` + runnerServiceOverridePath + ` "$unit.d/garm-override.conf"; done; systemctl daemon-reload && systemctl try-restart 'actions.runner.*'`
+
+	// registryMirrorsPath holds the registry mirrors, which mergeRegistryConfigScript
+	// adds to the docker daemon config.
+	registryMirrorsPath     = "/etc/garm/registry-mirrors.json"
+	mergeRegistryConfigPath = "/etc/garm/merge-registry-config.py"
+	containerdHostsPath     = "/etc/containerd/certs.d/docker.io/hosts.toml"
+	// containerRuntimeRestartCmd restarts the container runtimes, if they are already
+	// running, so they pick up the registry config.
+	containerRuntimeRestartCmd = "systemctl try-restart docker.service containerd.service || true"
+)
+
+// removeStaticPortsScript removes the interfaces with the MAC addresses given as
+// arguments from the netplan config written by cloud-init, keeping the other
+// interfaces. PyYAML is always available, as cloud-init needs it.
+const removeStaticPortsScript = `import sys
+import yaml
+
+path = sys.argv[1]
+macs = {mac.lower() for mac in sys.argv[2:]}
+try:
+    with open(path) as f:
+        cfg = yaml.safe_load(f) or {}
+except FileNotFoundError:
+    sys.exit(0)
+ethernets = (cfg.get("network") or {}).get("ethernets") or {}
+for name, ethernet in list(ethernets.items()):
+    mac = ((ethernet or {}).get("match") or {}).get("macaddress", "")
+    if str(mac).lower() in macs:
+        del ethernets[name]
+with open(path, "w") as f:
+    yaml.safe_dump(cfg, f, default_flow_style=False)
+`
+
+// mergeRegistryConfigScript adds the registry mirrors to the docker daemon config, and
+// points containerd at the hosts.toml files, keeping the settings that the image
+// already has. Containerd only reads hosts.toml files if config_path is set. It runs
+// with python3, which is always available, as cloud-init needs it.
+const mergeRegistryConfigScript = `import json
+import os
+import re
+
+DOCKER_CONFIG = "/etc/docker/daemon.json"
+CONTAINERD_CONFIG = "/etc/containerd/config.toml"
+CONFIG_PATH = 'config_path = "/etc/containerd/certs.d"'
+
+with open("` + registryMirrorsPath + `") as f:
+    mirrors = json.load(f)
+
+config = {}
+if os.path.exists(DOCKER_CONFIG):
+    with open(DOCKER_CONFIG) as f:
+        config = json.load(f)
+existing = config.get("registry-mirrors", [])
+config["registry-mirrors"] = existing + [m for m in mirrors if m not in existing]
+os.makedirs(os.path.dirname(DOCKER_CONFIG), exist_ok=True)
+with open(DOCKER_CONFIG, "w") as f:
+    json.dump(config, f, indent=2)
+
+content = ""
+if os.path.exists(CONTAINERD_CONFIG):
+    with open(CONTAINERD_CONFIG) as f:
+        content = f.read()
+if not content.strip():
+    content = "version = 2\n"
+# The name of the plugin section depends on the version of the config. Configs
+# without a version are version 1.
+if re.search(r"^\s*version\s*=\s*3", content, re.M):
+    table = '[plugins."io.containerd.cri.v1.images".registry]'
+elif re.search(r"^\s*version\s*=\s*2", content, re.M):
+    table = '[plugins."io.containerd.grpc.v1.cri".registry]'
+else:
+    table = "[plugins.cri.registry]"
+# A config_path set in the image is kept.
+if re.search(r'^\s*config_path\s*=\s*"[^"]+"', content, re.M):
+    pass
+elif re.search(r'^\s*config_path\s*=\s*""', content, re.M):
+    content = re.sub(r'^(\s*)config_path\s*=\s*""', lambda m: m.group(1) + CONFIG_PATH, content, count=1, flags=re.M)
+elif table in content:
+    content = content.replace(table, table + "\n  " + CONFIG_PATH, 1)
+else:
+    content += "\n" + table + "\n  " + CONFIG_PATH + "\n"
+os.makedirs(os.path.dirname(CONTAINERD_CONFIG), exist_ok=True)
+with open(CONTAINERD_CONFIG, "w") as f:
+    f.write(content)
+`
+
+// cloudInitExtras holds top level cloud-init settings that are not part of the
+// cloudconfig.CloudInit struct from the common package.
+type cloudInitExtras struct {
+	Hostname string             `yaml:"hostname,omitempty"`
+	NTP      *cloudInitNTP      `yaml:"ntp,omitempty"`
+	Apt      *cloudInitApt      `yaml:"apt,omitempty"`
+	YumRepos *cloudInitYumRepos `yaml:"yum_repos,omitempty"`
+	BootCmd  []string           `yaml:"bootcmd,omitempty"`
+}
+
+type cloudInitNTP struct {
+	Enabled bool     `yaml:"enabled"`
+	Servers []string `yaml:"servers"`
+}
+
+// cloudInitApt configures the apt mirrors. cloud-init applies it before any packages
+// are installed.
+type cloudInitApt struct {
+	Primary  []cloudInitAptMirror `yaml:"primary"`
+	Security []cloudInitAptMirror `yaml:"security"`
+}
+
+type cloudInitAptMirror struct {
+	Arches []string `yaml:"arches"`
+	URI    string   `yaml:"uri"`
+}
+
+// cloudInitYumRepos holds the yum repositories, keyed by their ID. cloud-init writes
+// them before any packages are installed.
+type cloudInitYumRepos struct {
+	PackageMirror cloudInitRepo `yaml:"garm-package-mirror"`
+}
+
+type cloudInitRepo struct {
+	Name     string `yaml:"name"`
+	BaseURL  string `yaml:"baseurl"`
+	Enabled  bool   `yaml:"enabled"`
+	GPGCheck bool   `yaml:"gpgcheck"`
+}
+
+// netplanConfig is the netplan config of the ports with a static IP.
+type netplanConfig struct {
+	Network netplanNetwork `yaml:"network"`
+}
+
+type netplanNetwork struct {
+	Version   int                        `yaml:"version"`
+	Ethernets map[string]netplanEthernet `yaml:"ethernets"`
+}
+
+type netplanEthernet struct {
+	Match       netplanMatch        `yaml:"match"`
+	DHCP4       bool                `yaml:"dhcp4"`
+	DHCP6       bool                `yaml:"dhcp6"`
+	Addresses   []string            `yaml:"addresses"`
+	Routes      []netplanRoute      `yaml:"routes,omitempty"`
+	Nameservers *netplanNameservers `yaml:"nameservers,omitempty"`
+}
+
+type netplanMatch struct {
+	MACAddress string `yaml:"macaddress"`
+}
+
+type netplanRoute struct {
+	To  string `yaml:"to"`
+	Via string `yaml:"via"`
+}
+
+type netplanNameservers struct {
+	Addresses []string `yaml:"addresses"`
+}
+
+// staticNetworkConfig returns the netplan config of the ports with a static IP. The
+// interfaces are matched by the MAC address of their port.
+func staticNetworkConfig(staticNetworks []staticNetwork) ([]byte, error) {
+	cfg := netplanConfig{
+		Network: netplanNetwork{
+			Version:   2,
+			Ethernets: map[string]netplanEthernet{},
+		},
+	}
+	for idx, network := range staticNetworks {
+		ethernet := netplanEthernet{
+			Match:     netplanMatch{MACAddress: network.MACAddress},
+			Addresses: []string{network.Address},
+		}
+		if network.Gateway != "" {
+			ethernet.Routes = []netplanRoute{{To: "default", Via: network.Gateway}}
+		}
+		if len(network.DNSServers) > 0 {
+			ethernet.Nameservers = &netplanNameservers{Addresses: network.DNSServers}
+		}
+		cfg.Network.Ethernets[fmt.Sprintf("garm-static%d", idx)] = ethernet
+	}
+	asYaml, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal netplan config: %w", err)
+	}
+	return asYaml, nil
+}
+
+// staticNetworkCmd returns the command that replaces the network config of cloud-init
+// for the ports with a static IP, and applies it.
+func staticNetworkCmd(staticNetworks []staticNetwork, netplanCfg []byte) string {
+	args := []string{shellQuote(cloudInitNetplanPath)}
+	for _, network := range staticNetworks {
+		args = append(args, shellQuote(network.MACAddress))
+	}
+	return fmt.Sprintf(
+		"umask 077 && printf 'network: {config: disabled}\\n' > %s && python3 -c %s %s && printf '%%s' %s > %s && netplan apply",
+		cloudInitNetworkDisabledPath, shellQuote(removeStaticPortsScript), strings.Join(args, " "), shellQuote(string(netplanCfg)), staticNetworkConfigPath,
+	)
+}
+
+// shellQuote quotes s so it is passed to the shell as a single word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// completionCallbackCmd returns the command that notifies the completion callback URL
+// that the runner finished bootstrapping. A failed callback does not fail the boot.
+func completionCallbackCmd(callbackURL, name string) (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"name":   name,
+		"status": "ready",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal callback payload: %w", err)
+	}
+	return fmt.Sprintf("curl -fsS --retry 5 -X POST -H 'Content-Type: application/json' -d %s %s || true", shellQuote(string(payload)), shellQuote(callbackURL)), nil
+}
+
+// hostnameParams holds the values that can be used in the hostname template.
+type hostnameParams struct {
+	Name   string
+	PoolID string
+	OSType string
+	Suffix string
+}
+
+var (
+	hostnameInvalidChars = regexp.MustCompile(`[^a-z0-9-]+`)
+	rfc1123Label         = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+const hostnameSuffixChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+func randomHostnameSuffix(length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random suffix: %w", err)
+	}
+	for idx := range buf {
+		buf[idx] = hostnameSuffixChars[int(buf[idx])%len(hostnameSuffixChars)]
+	}
+	return string(buf), nil
+}
+
+// renderHostname renders the hostname template and turns the result into a valid
+// RFC 1123 hostname label.
+func renderHostname(hostnameTemplate string, bootstrapParams params.BootstrapInstance) (string, error) {
+	tpl, err := template.New("hostname").Option("missingkey=error").Parse(hostnameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse hostname template: %w", err)
+	}
+	suffix, err := randomHostnameSuffix(6)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, hostnameParams{
+		Name:   bootstrapParams.Name,
+		PoolID: bootstrapParams.PoolID,
+		OSType: string(bootstrapParams.OSType),
+		Suffix: suffix,
+	}); err != nil {
+		return "", fmt.Errorf("failed to render hostname template: %w", err)
+	}
+
+	hostname := hostnameInvalidChars.ReplaceAllString(strings.ToLower(buf.String()), "-")
+	if len(hostname) > 63 {
+		hostname = hostname[:63]
+	}
+	hostname = strings.Trim(hostname, "-")
+	if !rfc1123Label.MatchString(hostname) {
+		return "", fmt.Errorf("rendered hostname %q is not a valid RFC 1123 hostname", hostname)
+	}
+	return hostname, nil
+}
+
+func (m *machineSpec) getCloudInitExtras() (cloudInitExtras, error) {
+	var extras cloudInitExtras
+	hostnameTemplate := m.HostnameTemplate
+	if m.Hostname != "" {
+		hostnameTemplate = m.Hostname
+	}
+	if hostnameTemplate != "" {
+		hostname, err := renderHostname(hostnameTemplate, m.BootstrapParams)
+		if err != nil {
+			return cloudInitExtras{}, err
+		}
+		extras.Hostname = hostname
+	}
+	if len(m.NTPServers) > 0 {
+		extras.NTP = &cloudInitNTP{
+			Enabled: true,
+			Servers: m.NTPServers,
+		}
+	}
+	if m.PackageMirror != "" {
+		// Only the section that matches the package manager of the image is used.
+		mirror := []cloudInitAptMirror{{Arches: []string{"default"}, URI: m.PackageMirror}}
+		extras.Apt = &cloudInitApt{
+			Primary:  mirror,
+			Security: mirror,
+		}
+		extras.YumRepos = &cloudInitYumRepos{
+			PackageMirror: cloudInitRepo{
+				Name:     "garm package mirror",
+				BaseURL:  m.PackageMirror,
+				Enabled:  true,
+				GPGCheck: true,
+			},
+		}
+	}
+	if len(m.StaticNetworks) > 0 {
+		// bootcmd runs before anything else that needs the network, like package
+		// installs and the runner install script.
+		netplanCfg, err := staticNetworkConfig(m.StaticNetworks)
+		if err != nil {
+			return cloudInitExtras{}, err
+		}
+		extras.BootCmd = []string{
+			staticNetworkCmd(m.StaticNetworks, netplanCfg),
+		}
+	}
+	return extras, nil
+}
+
+// addCloudInitExtras inserts the extra settings right after the #cloud-config header
+// of the serialized cloud-init config.
+func addCloudInitExtras(cloudCfg string, extras cloudInitExtras) (string, error) {
+	if reflect.DeepEqual(extras, cloudInitExtras{}) {
+		return cloudCfg, nil
+	}
+	asYaml, err := yaml.Marshal(extras)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal cloud config: %w", err)
+	}
+	header, body, found := strings.Cut(cloudCfg, "\n")
+	if !found || header != "#cloud-config" {
+		return "", fmt.Errorf("unexpected cloud config header")
+	}
+	return header + "\n" + string(asYaml) + body, nil
+}
+
+// containerdHostsConfig returns the containerd hosts.toml that sets the registry mirrors
+// for docker.io.
+func containerdHostsConfig(mirrors []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("server = \"https://registry-1.docker.io\"\n")
+	for _, mirror := range mirrors {
+		fmt.Fprintf(&buf, "\n[host.%q]\n  capabilities = [\"pull\", \"resolve\"]\n", mirror)
+	}
+	return buf.Bytes()
+}
+
+// addRegistryConfig configures the registry mirrors and CA certificates for the
+// container runtimes on the runner.
+func (m *machineSpec) addRegistryConfig(cloudCfg *cloudconfig.CloudInit) error {
+	for _, ca := range m.RegistryCA {
+		if err := cloudCfg.AddCACert([]byte(ca)); err != nil {
+			return fmt.Errorf("failed to add registry CA: %w", err)
+		}
+	}
+
+	if len(m.RegistryMirrors) > 0 {
+		mirrors, err := json.Marshal(m.RegistryMirrors)
+		if err != nil {
+			return fmt.Errorf("failed to marshal registry mirrors: %w", err)
+		}
+		// The docker and containerd configs may already exist in the image, so we
+		// merge our settings into them instead of writing them out.
+		cloudCfg.AddFile(mirrors, registryMirrorsPath, "root:root", "644")
+		cloudCfg.AddFile([]byte(mergeRegistryConfigScript), mergeRegistryConfigPath, "root:root", "755")
+		cloudCfg.AddFile(containerdHostsConfig(m.RegistryMirrors), containerdHostsPath, "root:root", "644")
+		cloudCfg.AddRunCmd("python3 " + mergeRegistryConfigPath)
+	}
+	cloudCfg.AddRunCmd(containerRuntimeRestartCmd)
+	return nil
+}
+
+// validateSystemdUnit does a minimal sanity check of systemd unit file syntax. Every
+// line that is not empty or a comment must either be a section header or a key=value
+// pair, and the first such line must be a section header.
+func validateSystemdUnit(content []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	inSection := false
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") && len(line) > 2 {
+			inSection = true
+			continue
+		}
+		if !inSection {
+			return fmt.Errorf("line %d: expected a section header, got %q", lineNo, line)
+		}
+		if key, _, found := strings.Cut(line, "="); !found || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("line %d: expected key=value, got %q", lineNo, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read unit: %w", err)
+	}
+	if !inSection {
+		return fmt.Errorf("unit has no sections")
+	}
+	return nil
+}
+
+// composeCloudInit builds the cloud-init config for Linux runners. This mirrors what
+// cloudconfig.GetCloudInitConfig() does, while allowing us to add provider specific
+// settings to the config.
+func (m *machineSpec) composeCloudInit(bootstrapParams params.BootstrapInstance) (string, error) {
+	installScript, err := cloudconfig.GetRunnerInstallScript(bootstrapParams, m.Tools, bootstrapParams.Name)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate runner install script: %w", err)
+	}
+
+	specs, err := cloudconfig.GetSpecs(bootstrapParams)
+	if err != nil {
+		return "", fmt.Errorf("failed to get cloud config specs: %w", err)
+	}
+
+	cloudCfg := cloudconfig.NewDefaultCloudInitConfig()
+
+	if bootstrapParams.UserDataOptions.DisableUpdatesOnBoot {
+		cloudCfg.PackageUpgrade = false
+		cloudCfg.Packages = []string{}
+	}
+	for _, pkg := range bootstrapParams.UserDataOptions.ExtraPackages {
+		cloudCfg.AddPackage(pkg)
+	}
+
+	injectPaths := make([]string, 0, len(m.InjectFiles))
+	for filePath := range m.InjectFiles {
+		injectPaths = append(injectPaths, filePath)
+	}
+	sort.Strings(injectPaths)
+	for _, filePath := range injectPaths {
+		cloudCfg.AddFile(m.InjectFiles[filePath], filePath, "root:root", "644")
+	}
+
+	if len(m.RegistryMirrors) > 0 || len(m.RegistryCA) > 0 {
+		if err := m.addRegistryConfig(cloudCfg); err != nil {
+			return "", fmt.Errorf("failed to add registry config: %w", err)
+		}
+	}
+
+	if len(specs.PreInstallScripts) > 0 {
+		names := make([]string, 0, len(specs.PreInstallScripts))
+		for name := range specs.PreInstallScripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cloudCfg.AddFile(specs.PreInstallScripts[name], fmt.Sprintf("/garm-pre-install/%s", name), "root:root", "755")
+			cloudCfg.AddRunCmd(fmt.Sprintf("/garm-pre-install/%s", name))
+		}
+	}
+	cloudCfg.AddRunCmd("rm -rf /garm-pre-install")
+
+	cloudCfg.AddSSHKey(bootstrapParams.SSHKeys...)
+	cloudCfg.AddFile(installScript, "/install_runner.sh", "root:root", "755")
+	cloudCfg.AddRunCmd(fmt.Sprintf("su -l -c /install_runner.sh %s", defaults.DefaultUser))
+	cloudCfg.AddRunCmd("rm -f /install_runner.sh")
+
+	if len(m.RunnerServiceOverride) > 0 {
+		cloudCfg.AddFile(m.RunnerServiceOverride, runnerServiceOverridePath, "root:root", "644")
+		cloudCfg.AddRunCmd(runnerServiceOverrideCmd)
+	}
+
+	if len(bootstrapParams.CACertBundle) > 0 {
+		if err := cloudCfg.AddCACert(bootstrapParams.CACertBundle); err != nil {
+			return "", fmt.Errorf("failed to add CA cert bundle: %w", err)
+		}
+	}
+
+	// This must be the last command, so it signals that the bootstrap is done.
+	if m.CompletionCallbackURL != "" {
+		callbackCmd, err := completionCallbackCmd(m.CompletionCallbackURL, bootstrapParams.Name)
+		if err != nil {
+			return "", err
+		}
+		cloudCfg.AddRunCmd(callbackCmd)
+	}
+
+	asStr, err := cloudCfg.Serialize()
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize cloud config: %w", err)
+	}
+	extras, err := m.getCloudInitExtras()
+	if err != nil {
+		return "", fmt.Errorf("failed to get cloud config extras: %w", err)
+	}
+	asStr, err = addCloudInitExtras(asStr, extras)
+	if err != nil {
+		return "", fmt.Errorf("failed to add cloud config extras: %w", err)
+	}
+	return asStr, nil
+}
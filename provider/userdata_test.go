@@ -0,0 +1,445 @@
+// Copyright 2023 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package provider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cloudbase/garm-provider-common/cloudconfig"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+const testRegistryCA = `-----BEGIN CERTIFICATE-----
+MIIBgzCCASmgAwIBAgIUSi78/fltMLXs56xM8Rvf1EJrXg4wCgYIKoZIzj0EAwIw
+FjEUMBIGA1UEAwwLcmVnaXN0cnktY2EwIBcNMjYxMDE3MDQwNTQwWhgPMjEyNjA5
+MjMwNDA1NDBaMBYxFDASBgNVBAMMC3JlZ2lzdHJ5LWNhMFkwEwYHKoZIzj0CAQYI
+KoZIzj0DAQcDQgAEMjkFR41Y0bOLUCIB/IjwhxDUJvSQ7/iXqeFvdIkHf/sJ42g3
+F8fo/Apip81BEgp4s250cowyTJYpNf0sFM8zYaNTMFEwHQYDVR0OBBYEFOO864D/
+0yB3m8wn8xu8NItzWsEDMB8GA1UdIwQYMBaAFOO864D/0yB3m8wn8xu8NItzWsED
+MA8GA1UdEwEB/wQFMAMBAf8wCgYIKoZIzj0EAwIDSAAwRQIgIEIEIub97zGefkj7
+c+31gdUumNPNgO/UjAbt6rRqMnACIQCBXhjaP5cZWaaqqPyRi0KUGybij7GHydBs
+FJrd5gMvHQ==
+-----END CERTIFICATE-----
+`
+
+func newTestUserDataSpec() *machineSpec {
+	tools := params.RunnerApplicationDownload{
+		OS:                Ptr("linux"),
+		Architecture:      Ptr("x64"),
+		DownloadURL:       Ptr("http://test.com"),
+		Filename:          Ptr("runner.tar.gz"),
+		SHA256Checksum:    Ptr("sha256:1123"),
+		TempDownloadToken: Ptr("test-token"),
+	}
+	return &machineSpec{
+		Tools: tools,
+		BootstrapParams: params.BootstrapInstance{
+			Name:          "test-instance",
+			InstanceToken: "test-token",
+			OSArch:        params.Amd64,
+			OSType:        params.Linux,
+			Tools:         []params.RunnerApplicationDownload{tools},
+			PoolID:        "test-pool",
+		},
+	}
+}
+
+func TestComposeUserDataMatchesCommon(t *testing.T) {
+	spec := newTestUserDataSpec()
+
+	expected, err := cloudconfig.GetCloudConfig(spec.BootstrapParams, spec.Tools, spec.BootstrapParams.Name)
+	assert.NoError(t, err)
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(udata))
+}
+
+func TestComposeUserDataRunnerServiceOverride(t *testing.T) {
+	override := []byte("[Service]\nRestart=always\nLimitNOFILE=65536\n")
+	spec := newTestUserDataSpec()
+	spec.RunnerServiceOverride = override
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+	assert.Contains(t, string(udata), runnerServiceOverridePath)
+	assert.Contains(t, string(udata), base64.StdEncoding.EncodeToString(override))
+	assert.Contains(t, string(udata), "systemctl try-restart 'actions.runner.*'")
+}
+
+func TestComposeUserDataRegistryConfig(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.RegistryMirrors = []string{"https://mirror.example.com"}
+	spec.RegistryCA = []string{testRegistryCA}
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+
+	var cfg struct {
+		WriteFiles []cloudconfig.File `yaml:"write_files"`
+		RunCmd     []string           `yaml:"runcmd"`
+		CACerts    struct {
+			Trusted []string `yaml:"trusted"`
+		} `yaml:"ca-certs"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	assert.Equal(t, []string{testRegistryCA}, cfg.CACerts.Trusted)
+	// The registry config is merged before the container runtimes are restarted.
+	mergeIdx := slices.Index(cfg.RunCmd, "python3 "+mergeRegistryConfigPath)
+	restartIdx := slices.Index(cfg.RunCmd, containerRuntimeRestartCmd)
+	assert.NotEqual(t, -1, mergeIdx)
+	assert.Greater(t, restartIdx, mergeIdx)
+
+	files := map[string]string{}
+	for _, file := range cfg.WriteFiles {
+		content, err := base64.StdEncoding.DecodeString(file.Content)
+		assert.NoError(t, err)
+		files[file.Path] = string(content)
+	}
+	assert.JSONEq(t, `["https://mirror.example.com"]`, files[registryMirrorsPath])
+	assert.Equal(t, mergeRegistryConfigScript, files[mergeRegistryConfigPath])
+	assert.NotContains(t, files, "/etc/docker/daemon.json")
+	assert.Contains(t, files[containerdHostsPath], `[host."https://mirror.example.com"]`)
+}
+
+func TestComposeUserDataInjectFiles(t *testing.T) {
+	extra, err := extraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"inject_files": {
+			"/etc/apt/apt.conf.d/90proxy": "QWNxdWlyZTo6aHR0cDo6UHJveHkgImh0dHA6Ly9wcm94eS5leGFtcGxlLmNvbTozMTI4Ijs=",
+			"/usr/local/share/ca-certificates/internal.crt": "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0t"
+		}}`),
+	})
+	assert.NoError(t, err)
+
+	spec := newTestUserDataSpec()
+	spec.MergeExtraSpecs(extra)
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+
+	var cfg struct {
+		WriteFiles []cloudconfig.File `yaml:"write_files"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	files := map[string]string{}
+	for _, file := range cfg.WriteFiles {
+		content, err := base64.StdEncoding.DecodeString(file.Content)
+		assert.NoError(t, err)
+		files[file.Path] = string(content)
+		if strings.HasPrefix(file.Path, "/etc/apt") || strings.HasPrefix(file.Path, "/usr/local") {
+			assert.Equal(t, "root:root", file.Owner)
+			assert.Equal(t, "644", file.Permissions)
+		}
+	}
+	assert.Equal(t, `Acquire::http::Proxy "http://proxy.example.com:3128";`, files["/etc/apt/apt.conf.d/90proxy"])
+	assert.Equal(t, "-----BEGIN CERTIFICATE-----", files["/usr/local/share/ca-certificates/internal.crt"])
+}
+
+func TestComposeUserDataRunnerLabels(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.BootstrapParams.Labels = []string{"self-hosted", "linux"}
+	spec.RunnerLabels = []string{"gpu", "linux"}
+	spec.RunnerGroup = "ml-team"
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+
+	var cfg struct {
+		WriteFiles []cloudconfig.File `yaml:"write_files"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	var installScript string
+	for _, file := range cfg.WriteFiles {
+		if file.Path == "/install_runner.sh" {
+			content, err := base64.StdEncoding.DecodeString(file.Content)
+			assert.NoError(t, err)
+			installScript = string(content)
+		}
+	}
+	assert.Contains(t, installScript, `--runnergroup ml-team`)
+	assert.Contains(t, installScript, `--labels "self-hosted,linux,gpu"`)
+	// The labels of the bootstrap params are not changed.
+	assert.Equal(t, []string{"self-hosted", "linux"}, spec.BootstrapParams.Labels)
+}
+
+func TestComposeUserDataNTPServers(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.NTPServers = []string{"ntp1.example.com", "ntp2.example.com"}
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(udata), "#cloud-config\n"))
+
+	var cfg struct {
+		NTP struct {
+			Enabled bool     `yaml:"enabled"`
+			Servers []string `yaml:"servers"`
+		} `yaml:"ntp"`
+		RunCmd []string `yaml:"runcmd"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	assert.True(t, cfg.NTP.Enabled)
+	assert.Equal(t, []string{"ntp1.example.com", "ntp2.example.com"}, cfg.NTP.Servers)
+	assert.NotEmpty(t, cfg.RunCmd)
+}
+
+func TestComposeUserDataPackageMirror(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.PackageMirror = "http://mirror.example.com/ubuntu"
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+
+	var cfg struct {
+		Apt struct {
+			Primary []struct {
+				Arches []string `yaml:"arches"`
+				URI    string   `yaml:"uri"`
+			} `yaml:"primary"`
+		} `yaml:"apt"`
+		YumRepos map[string]struct {
+			BaseURL string `yaml:"baseurl"`
+		} `yaml:"yum_repos"`
+		Packages []string `yaml:"packages"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	assert.Len(t, cfg.Apt.Primary, 1)
+	assert.Equal(t, "http://mirror.example.com/ubuntu", cfg.Apt.Primary[0].URI)
+	assert.Equal(t, []string{"default"}, cfg.Apt.Primary[0].Arches)
+	assert.Equal(t, "http://mirror.example.com/ubuntu", cfg.YumRepos["garm-package-mirror"].BaseURL)
+	assert.NotEmpty(t, cfg.Packages)
+
+	// The mirror must be configured before the packages are installed.
+	aptIdx := strings.Index(string(udata), "\napt:")
+	packagesIdx := strings.Index(string(udata), "\npackages:")
+	assert.NotEqual(t, -1, aptIdx)
+	assert.NotEqual(t, -1, packagesIdx)
+	assert.Less(t, aptIdx, packagesIdx)
+}
+
+func TestComposeUserDataStaticNetworks(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.StaticNetworks = []staticNetwork{
+		{
+			MACAddress: "fa:16:3e:00:00:01",
+			Address:    "10.0.0.5/24",
+			Gateway:    "10.0.0.1",
+			DNSServers: []string{"10.0.0.2", "10.0.0.3"},
+		},
+		{
+			MACAddress: "fa:16:3e:00:00:02",
+			Address:    "192.168.0.5/24",
+		},
+	}
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+
+	var cfg struct {
+		BootCmd []string `yaml:"bootcmd"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	netplanCfg, err := staticNetworkConfig(spec.StaticNetworks)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"umask 077 && printf 'network: {config: disabled}\\n' > /etc/cloud/cloud.cfg.d/99-garm-disable-network-config.cfg" +
+			" && python3 -c " + shellQuote(removeStaticPortsScript) + " '/etc/netplan/50-cloud-init.yaml' 'fa:16:3e:00:00:01' 'fa:16:3e:00:00:02'" +
+			" && printf '%s' " + shellQuote(string(netplanCfg)) + " > /etc/netplan/90-garm-static.yaml && netplan apply",
+	}, cfg.BootCmd)
+
+	var netplan netplanConfig
+	assert.NoError(t, yaml.Unmarshal(netplanCfg, &netplan))
+	assert.Equal(t, netplanConfig{
+		Network: netplanNetwork{
+			Version: 2,
+			Ethernets: map[string]netplanEthernet{
+				"garm-static0": {
+					Match:       netplanMatch{MACAddress: "fa:16:3e:00:00:01"},
+					Addresses:   []string{"10.0.0.5/24"},
+					Routes:      []netplanRoute{{To: "default", Via: "10.0.0.1"}},
+					Nameservers: &netplanNameservers{Addresses: []string{"10.0.0.2", "10.0.0.3"}},
+				},
+				"garm-static1": {
+					Match:     netplanMatch{MACAddress: "fa:16:3e:00:00:02"},
+					Addresses: []string{"192.168.0.5/24"},
+				},
+			},
+		},
+	}, netplan)
+}
+
+func TestRemoveStaticPortsScript(t *testing.T) {
+	if err := exec.Command("python3", "-c", "import yaml").Run(); err != nil {
+		t.Skip("python3 with PyYAML is not available")
+	}
+	path := filepath.Join(t.TempDir(), "50-cloud-init.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`network:
+  version: 2
+  ethernets:
+    ens3:
+      match:
+        macaddress: FA:16:3E:00:00:01
+      set-name: ens3
+      dhcp4: true
+    ens4:
+      match:
+        macaddress: fa:16:3e:00:00:03
+      set-name: ens4
+      dhcp4: true
+`), 0o600))
+
+	out, err := exec.Command("python3", "-c", removeStaticPortsScript, path, "fa:16:3e:00:00:01").CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var cfg netplanConfig
+	assert.NoError(t, yaml.Unmarshal(data, &cfg))
+	assert.Equal(t, map[string]netplanEthernet{
+		"ens4": {Match: netplanMatch{MACAddress: "fa:16:3e:00:00:03"}, DHCP4: true},
+	}, cfg.Network.Ethernets)
+
+	// A missing config is not an error.
+	out, err = exec.Command("python3", "-c", removeStaticPortsScript, filepath.Join(t.TempDir(), "missing.yaml")).CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
+
+func TestComposeUserDataCompletionCallback(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.CompletionCallbackURL = "https://garm.example.com/callback?runner=it's"
+	spec.RunnerServiceOverride = []byte("[Service]\nRestart=always\n")
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+
+	var cfg struct {
+		RunCmd []string `yaml:"runcmd"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	assert.NotEmpty(t, cfg.RunCmd)
+	expected := `curl -fsS --retry 5 -X POST -H 'Content-Type: application/json' -d '{"name":"` + spec.BootstrapParams.Name + `","status":"ready"}' 'https://garm.example.com/callback?runner=it'\''s' || true`
+	assert.Equal(t, expected, cfg.RunCmd[len(cfg.RunCmd)-1])
+}
+
+func TestComposeUserDataHostnameTemplate(t *testing.T) {
+	spec := newTestUserDataSpec()
+	spec.BootstrapParams.PoolID = "Test_Pool.01"
+	spec.HostnameTemplate = "runner-{{.PoolID}}-{{.Suffix}}"
+
+	udata, err := spec.ComposeUserData()
+	assert.NoError(t, err)
+
+	var cfg struct {
+		Hostname string `yaml:"hostname"`
+	}
+	assert.NoError(t, yaml.Unmarshal(udata, &cfg))
+	assert.Regexp(t, `^runner-test-pool-01-[a-z0-9]{6}$`, cfg.Hostname)
+}
+
+func TestRenderHostname(t *testing.T) {
+	bootstrapParams := params.BootstrapInstance{
+		Name:   "garm-abc",
+		PoolID: "pool",
+		OSType: params.Linux,
+	}
+	tests := []struct {
+		name      string
+		template  string
+		want      string
+		errString string
+	}{
+		{
+			name:     "name and os type",
+			template: "{{.Name}}-{{.OSType}}",
+			want:     "garm-abc-linux",
+		},
+		{
+			name:     "truncated to 63 characters",
+			template: strings.Repeat("a", 62) + "-{{.Name}}",
+			want:     strings.Repeat("a", 62),
+		},
+		{
+			name:      "empty",
+			template:  "---",
+			errString: "is not a valid RFC 1123 hostname",
+		},
+		{
+			name:      "unknown field",
+			template:  "{{.Flavor}}",
+			errString: "failed to render hostname template",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostname, err := renderHostname(tt.template, bootstrapParams)
+			if tt.errString != "" {
+				assert.ErrorContains(t, err, tt.errString)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, hostname)
+		})
+	}
+}
+
+func TestValidateSystemdUnit(t *testing.T) {
+	tests := []struct {
+		name      string
+		unit      string
+		errString string
+	}{
+		{
+			name:      "valid",
+			unit:      "# tune the runner\n[Service]\nRestart=always\n\n[Unit]\nStartLimitIntervalSec=0\n",
+			errString: "",
+		},
+		{
+			name:      "missing section",
+			unit:      "Restart=always\n",
+			errString: "line 1: expected a section header",
+		},
+		{
+			name:      "not a key value pair",
+			unit:      "[Service]\nRestart\n",
+			errString: "line 2: expected key=value",
+		},
+		{
+			name:      "empty",
+			unit:      "# nothing here\n",
+			errString: "unit has no sections",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSystemdUnit([]byte(tt.unit))
+			if tt.errString == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.errString)
+			}
+		})
+	}
+}